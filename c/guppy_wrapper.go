@@ -4,21 +4,62 @@ package main
 import "C"
 import (
 	read_guppy "github.com/phil-mansfield/guppy/go"
-	"reflect"
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"errors"
+	"os"
+	"sync"
 	"unsafe"
 	"fmt"
 )
 
-const maxArraySize = 1<<14
+const (
+	// maxBufferBytes is the largest buffer that can be passed to
+	// Guppy_Read.
+	maxBufferBytes = 1<<40
+)
+
+// openFile is a file opened by Guppy_Open. C code refers to it by its handle.
+// Only the file's name and header are kept: the file itself is closed after
+// its header is read and reopened by name by every ReadFileVar call.
+type openFile struct {
+	fileName string
+	hd *read_guppy.Header
+}
+
+// These variables keep track of the files opened by Guppy_Open. C can't hold
+// Go pointers, so files are referred to by integer handles instead.
+var (
+	filesMutex = &sync.Mutex{ }
+	files = map[C.int64_t]*openFile{ }
+	nextHandle C.int64_t = 1
+)
+
+// typeSizes gives the size in bytes of a single element of each type string.
+var typeSizes = map[string]int64{
+	"u32": 4, "u64": 8, "f32": 4, "f64": 8, "v32": 12, "v64": 24,
+	"{RockstarParticle}": int64(unsafe.Sizeof(read_guppy.RockstarParticle{ })),
+}
+
+// cTypes gives the Guppy_Type corresponding to each type string.
+var cTypes = map[string]C.int{
+	"u32": C.Guppy_TypeU32, "u64": C.Guppy_TypeU64,
+	"f32": C.Guppy_TypeF32, "f64": C.Guppy_TypeF64,
+	"v32": C.Guppy_TypeV32, "v64": C.Guppy_TypeV64,
+	"{RockstarParticle}": C.Guppy_TypeRockstar,
+}
 
 //export ReadHeader
 func ReadHeader(fileName *C.char) *C.Guppy_Header {
+	goFileName := C.GoString(fileName)
+	return newCHeader(read_guppy.ReadHeader(goFileName))
+}
+
+// newCHeader copies a Go header into C memory. It needs to be freed with
+// Guppy_FreeHeader.
+func newCHeader(goHd *read_guppy.Header) *C.Guppy_Header {
 	// Turns out that allocating nested arrays in C memory from Go is a
 	// little complicated, ha ha...
 
-	goFileName := C.GoString(fileName)
-	goHd := read_guppy.ReadHeader(goFileName)
-
 	var pointer *C.char
 	pointerSize := (C.ulong)(unsafe.Sizeof((*C.char)(pointer)))
 
@@ -30,19 +71,59 @@ func ReadHeader(fileName *C.char) *C.Guppy_Header {
 	cHd.NVars = (C.int64_t)(nVars)
 	cHd.Names = (**C.char)(C.malloc(nVars*pointerSize))
 	cHd.Types = (**C.char)(C.malloc(nVars*pointerSize))
-	cHd.Szies = (*C.int64_t)(C.malloc(nVars*pointerSize))
+	cHd.Sizes = (*C.int64_t)(C.malloc(nVars*8))
+	cHd.Methods = (**C.char)(C.malloc(nVars*pointerSize))
+	cHd.Units = (**C.char)(C.malloc(nVars*pointerSize))
+	cHd.Deltas = (*C.double)(C.malloc(nVars*8))
+	cHd.Periods = (*C.double)(C.malloc(nVars*8))
 
 	n := len(goHd.Names)
-	// Need to convert the C pointer to a Go slice. The idea here
-	// is to convert to a fixed-size Go /array/, then convert that
-	// to a slice.
-	cNames := (*[maxArraySize]*C.char)(unsafe.Pointer(cHd.Names))[:n:n]
-	cTypes := (*[maxArraySize]*C.char)(unsafe.Pointer(cHd.Types))[:n:n]
+	// Need to convert the C pointers to Go slices so they can be indexed.
+	cNames := unsafe.Slice(cHd.Names, n)
+	cTypes := unsafe.Slice(cHd.Types, n)
+	cSizes := unsafe.Slice(cHd.Sizes, n)
+	cMethods := unsafe.Slice(cHd.Methods, n)
+	cUnits := unsafe.Slice(cHd.Units, n)
+	cDeltas := unsafe.Slice(cHd.Deltas, n)
+	cPeriods := unsafe.Slice(cHd.Periods, n)
 
 	for i := range goHd.Names {
 		cNames[i] = C.CString(goHd.Names[i])
 		cTypes[i] = C.CString(goHd.Types[i])
-		cHd.Sizes[i] = (C.int64_t)(goHd.Sizes[i])
+		cSizes[i] = (C.int64_t)(goHd.Sizes[i])
+		cMethods[i] = C.CString(goHd.Methods[i])
+		cUnits[i] = C.CString(goHd.Units[i])
+		cDeltas[i] = (C.double)(goHd.Deltas[i])
+		cPeriods[i] = (C.double)(goHd.Periods[i])
+	}
+
+	// Handle the metadata. Each entry gets a slot in all three value
+	// arrays, but only the one matching its type is filled in.
+	nMeta := (C.ulong)(len(goHd.Metadata))
+	cHd.NMetadata = (C.int64_t)(nMeta)
+	cHd.MetadataKeys = (**C.char)(C.malloc(nMeta*pointerSize))
+	cHd.MetadataTypes = (**C.char)(C.malloc(nMeta*pointerSize))
+	cHd.MetadataStrings = (**C.char)(C.malloc(nMeta*pointerSize))
+	cHd.MetadataInts = (*C.int64_t)(C.malloc(nMeta*8))
+	cHd.MetadataFloats = (*C.double)(C.malloc(nMeta*8))
+
+	m := len(goHd.Metadata)
+	cKeys := unsafe.Slice(cHd.MetadataKeys, m)
+	cMetaTypes := unsafe.Slice(cHd.MetadataTypes, m)
+	cStrings := unsafe.Slice(cHd.MetadataStrings, m)
+	cInts := unsafe.Slice(cHd.MetadataInts, m)
+	cFloats := unsafe.Slice(cHd.MetadataFloats, m)
+
+	for i, e := range goHd.Metadata {
+		cKeys[i] = C.CString(e.Key)
+		cMetaTypes[i] = C.CString(e.Type)
+		cStrings[i], cInts[i], cFloats[i] = nil, 0, 0
+
+		switch x := e.Value.(type) {
+		case int64: cInts[i] = (C.int64_t)(x)
+		case float64: cFloats[i] = (C.double)(x)
+		case string: cStrings[i] = C.CString(x)
+		}
 	}
 
 	//Handle all the (much simpler!) header properties
@@ -69,79 +150,240 @@ func ReadVar(fileName, varName *C.char, workerID C.int, out unsafe.Pointer) {
 	goFileName, goVarName := C.GoString(fileName), C.GoString(varName)
 	hd := read_guppy.ReadHeader(goFileName)
 
-	typeString := getTypeString(hd, goVarName)
-	buf := createBuffer(out, int(hd.N), typeString)
+	typeString, err := getTypeString(hd, goVarName)
+	if err != nil { panic(err.Error()) }
+	buf, err := createBuffer(out, int(hd.N), typeString)
+	if err != nil { panic(err.Error()) }
 
 	read_guppy.ReadVar(goFileName, goVarName, int(workerID), buf)
 }
 
-func getTypeString(hd *read_guppy.Header, varName string) string {
-	if varName == "[RockstarParticle]" { return "rockstar" }
+// ReadVarError is identical to ReadVar, except that errors are returned
+// instead of aborting the process. On success NULL is returned. Otherwise a
+// C string containing the error message is returned, which must be freed by
+// the caller. This is intended for languages like Python, where panicking
+// would kill the interpreter.
+//
+//export ReadVarError
+func ReadVarError(
+	fileName, varName *C.char, workerID C.int, out unsafe.Pointer,
+) (msg *C.char) {
+	defer func() {
+		if panicData := recover(); panicData != nil {
+			msg = C.CString(fmt.Sprintf("%v", panicData))
+		}
+	}()
+
+	ReadVar(fileName, varName, workerID, out)
+	return nil
+}
+
+// DerivedVarType returns the type string of the derived variable with the
+// given name, e.g. "v32" for "{Displacement}", as a C string which must be
+// freed by the caller. NULL is returned if there is no derived variable with
+// that name or if its arguments are invalid. This lets other languages
+// allocate buffers for derived variables without keeping their own list.
+//
+//export DerivedVarType
+func DerivedVarType(varName *C.char) *C.char {
+	v, _, err := read_guppy.LookupDerivedVar(C.GoString(varName))
+	if v == nil || err != nil { return nil }
+	return C.CString(v.Type)
+}
+
+// OpenFile opens a .gup file and reads its header. The handle of the file is
+// written to handle and a copy of its header to hd. Like all the functions
+// which return a status, an error message is written to msg if the status
+// isn't Guppy_OK, and it needs to be freed by the caller.
+//
+//export OpenFile
+func OpenFile(
+	fileName *C.char, handle *C.int64_t, hd **C.Guppy_Header, msg **C.char,
+) (status C.int) {
+	goFileName := C.GoString(fileName)
 
-	for i := range hd.Names {
-		if hd.Names[i] == varName {
-			return hd.Types[i]
+	buf := compress.NewBuffer(0)
+	rd, err := compress.NewReader(goFileName, buf, []byte{ })
+	if err != nil {
+		pathErr := &os.PathError{ }
+		if errors.As(err, &pathErr) {
+			return cError(msg, C.Guppy_ErrorOpen, "Could not open %s: %s",
+				goFileName, err.Error())
 		}
-		if varName + "[0]" == hd.Names[i] {
-			switch hd.Types[i] {
-			case "f32": return "v32"
-			case "f64": return "v64"
-			default:
-				panic(fmt.Sprintf("Impossible file configuration: the " + 
-					"variable '%s' has type '%s'.", hd.Names[i], hd.Types[i]))
-			}
+		return cError(msg, C.Guppy_ErrorFormat, "%s is not a valid .gup " +
+			"file: %s", goFileName, err.Error())
+	}
+	rd.Close()
+
+	// ReadHeader panics instead of returning errors, but the file was just
+	// successfully opened, so this would only happen if it changed in the
+	// meantime.
+	defer func() {
+		if panicData := recover(); panicData != nil {
+			status = cError(msg, C.Guppy_ErrorRead, "%v", panicData)
 		}
+	}()
+	goHd := read_guppy.ReadHeader(goFileName)
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	*handle = nextHandle
+	files[nextHandle] = &openFile{ goFileName, goHd }
+	nextHandle++
+
+	*hd = newCHeader(goHd)
+	return C.Guppy_OK
+}
+
+// CloseFile closes the file with the given handle.
+//
+//export CloseFile
+func CloseFile(handle C.int64_t, msg **C.char) C.int {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	if _, ok := files[handle]; !ok {
+		return cError(msg, C.Guppy_ErrorArgument, "There is no open file " +
+			"with the handle %d. It may have already been closed.", handle)
 	}
-	panic(fmt.Sprintf("The file does not have a variable named " + 
-		"'%s'. It only has the variables %s", varName, hd.Names))
+	delete(files, handle)
+	return C.Guppy_OK
+}
+
+// FileVarInfo writes the Guppy_Type of a variable to typ, the number of
+// elements in it to n and the size of the buffer needed to read it to bytes.
+//
+//export FileVarInfo
+func FileVarInfo(
+	handle C.int64_t, varName *C.char, typ *C.int, n, bytes *C.int64_t,
+	msg **C.char,
+) C.int {
+	f, status := getFile(handle, msg)
+	if status != C.Guppy_OK { return status }
+
+	typeString, err := getTypeString(f.hd, C.GoString(varName))
+	if err != nil { return cError(msg, C.Guppy_ErrorVar, "%s", err.Error()) }
+
+	*typ = cTypes[typeString]
+	*n = C.int64_t(f.hd.N)
+	*bytes = C.int64_t(f.hd.N*typeSizes[typeString])
+	return C.Guppy_OK
 }
 
-func createBuffer(ptr unsafe.Pointer, n int, typeString string) interface{} {
-	var buf interface{}
+// ReadFileVar reads a variable from the file with the given handle into out,
+// which has a size of outBytes bytes. See ReadVar for a description of the
+// other arguments.
+//
+//export ReadFileVar
+func ReadFileVar(
+	handle C.int64_t, varName *C.char, workerID C.int,
+	out unsafe.Pointer, outBytes C.int64_t, msg **C.char,
+) (status C.int) {
+	f, status := getFile(handle, msg)
+	if status != C.Guppy_OK { return status }
 
+	goVarName := C.GoString(varName)
+	typeString, err := getTypeString(f.hd, goVarName)
+	if err != nil { return cError(msg, C.Guppy_ErrorVar, "%s", err.Error()) }
+
+	nBytes := f.hd.N*typeSizes[typeString]
+	if int64(outBytes) < nBytes {
+		return cError(msg, C.Guppy_ErrorBuffer, "Reading '%s' from %s " +
+			"requires a buffer of %d bytes, but the buffer only has %d bytes.",
+			goVarName, f.fileName, nBytes, outBytes)
+	} else if out == nil && nBytes > 0 {
+		return cError(msg, C.Guppy_ErrorArgument, "The buffer passed " +
+			"while reading '%s' from %s is NULL.", goVarName, f.fileName)
+	}
+
+	nWorkers, w := read_guppy.Workers(), int(workerID)
+	if w < -2 || w >= nWorkers || (w == -2 && nWorkers == 0) {
+		return cError(msg, C.Guppy_ErrorArgument, "Cannot use worker %d " +
+			"when %d workers have been allocated by Guppy_InitWorkers.",
+			w, nWorkers)
+	}
+
+	buf, err := createBuffer(out, int(f.hd.N), typeString)
+	if err != nil {
+		return cError(msg, C.Guppy_ErrorBuffer, "%s", err.Error())
+	}
+
+	defer func() {
+		if panicData := recover(); panicData != nil {
+			status = cError(msg, C.Guppy_ErrorRead, "Could not read '%s' " +
+				"from %s: %v", goVarName, f.fileName, panicData)
+		}
+	}()
+	read_guppy.ReadVar(f.fileName, goVarName, w, buf)
+
+	return C.Guppy_OK
+}
+
+// getFile returns the open file with the given handle.
+func getFile(handle C.int64_t, msg **C.char) (*openFile, C.int) {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	f, ok := files[handle]
+	if !ok {
+		return nil, cError(msg, C.Guppy_ErrorArgument, "There is no open " +
+			"file with the handle %d. It may have already been closed.",
+			handle)
+	}
+	return f, C.Guppy_OK
+}
+
+// cError writes an error message to msg and returns status.
+func cError(
+	msg **C.char, status C.int, format string, args ...interface{},
+) C.int {
+	*msg = C.CString(fmt.Sprintf(format, args...))
+	return status
+}
+
+// getTypeString returns the type string of the buffer that a variable needs
+// to be read into.
+func getTypeString(hd *read_guppy.Header, varName string) (string, error) {
+	return read_guppy.VarType(hd, varName)
+}
+
+// createBuffer converts the n-element C array at ptr into a Go slice with the
+// type given by typeString.
+func createBuffer(
+	ptr unsafe.Pointer, n int, typeString string,
+) (interface{}, error) {
+	if int64(n)*typeSizes[typeString] > maxBufferBytes {
+		return nil, fmt.Errorf("Cannot read %d elements of type '%s' into " +
+			"a single buffer. The maximum buffer size is %d bytes.",
+			n, typeString, maxBufferBytes)
+	}
+
+	// Empty buffers may be NULL, so they're given empty Go slices instead.
 	switch typeString {
-	case "f32": 
-		// Here we get an empty slice and reassign its header fields to 
-		// point to the data behind ptr.
-		slice := []float32{ } 
-		hd := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-		hd.Data, hd.Len, hd.Cap = uintptr(ptr), n, n
-		buf = slice
+	case "f32":
+		if n == 0 { return []float32{ }, nil }
+		return unsafe.Slice((*float32)(ptr), n), nil
 	case "f64":
-		slice := []float64{ } 
-		hd := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-		hd.Data, hd.Len, hd.Cap = uintptr(ptr), n, n
-		buf = slice
+		if n == 0 { return []float64{ }, nil }
+		return unsafe.Slice((*float64)(ptr), n), nil
 	case "u32":
-		slice := []uint32{ } 
-		hd := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-		hd.Data, hd.Len, hd.Cap = uintptr(ptr), n, n
-		buf = slice
+		if n == 0 { return []uint32{ }, nil }
+		return unsafe.Slice((*uint32)(ptr), n), nil
 	case "u64":
-		slice := []uint64{ } 
-		hd := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-		hd.Data, hd.Len, hd.Cap = uintptr(ptr), n, n
-		buf = slice
+		if n == 0 { return []uint64{ }, nil }
+		return unsafe.Slice((*uint64)(ptr), n), nil
 	case "v32":
-		slice := [][3]float32{ } 
-		hd := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-		hd.Data, hd.Len, hd.Cap = uintptr(ptr), n, n
-		buf = slice
+		if n == 0 { return [][3]float32{ }, nil }
+		return unsafe.Slice((*[3]float32)(ptr), n), nil
 	case "v64":
-		slice := [][3]float64{ } 
-		hd := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-		hd.Data, hd.Len, hd.Cap = uintptr(ptr), n, n
-		buf = slice
-	case "rockstar":
-		slice := []read_guppy.RockstarParticle{ } 
-		hd := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-		hd.Data, hd.Len, hd.Cap = uintptr(ptr), n, n
-		buf = slice
-	default:
-		panic(fmt.Sprintf("Unrecognized type string: '%s'", typeString))
-	} 
-
-	return buf
+		if n == 0 { return [][3]float64{ }, nil }
+		return unsafe.Slice((*[3]float64)(ptr), n), nil
+	case "{RockstarParticle}":
+		if n == 0 { return []read_guppy.RockstarParticle{ }, nil }
+		return unsafe.Slice((*read_guppy.RockstarParticle)(ptr), n), nil
+	}
+
+	return nil, fmt.Errorf("Unrecognized type string: '%s'", typeString)
 }
 
 //export InitWorkers
@@ -5,13 +5,15 @@
 
 #line 1 "cgo-builtin-export-prolog"
 
-#include <stddef.h> /* for ptrdiff_t below */
+#include <stddef.h>
 
 #ifndef GO_CGO_EXPORT_PROLOGUE_H
 #define GO_CGO_EXPORT_PROLOGUE_H
 
 #ifndef GO_CGO_GOSTRING_TYPEDEF
 typedef struct { const char *p; ptrdiff_t n; } _GoString_;
+extern size_t _GoStringLen(_GoString_ s);
+extern const char *_GoStringPtr(_GoString_ s);
 #endif
 
 #endif
@@ -44,11 +46,23 @@ typedef long long GoInt64;
 typedef unsigned long long GoUint64;
 typedef GoInt64 GoInt;
 typedef GoUint64 GoUint;
-typedef __SIZE_TYPE__ GoUintptr;
+typedef size_t GoUintptr;
 typedef float GoFloat32;
 typedef double GoFloat64;
+#ifdef _MSC_VER
+#if !defined(__cplusplus) || _MSVC_LANG <= 201402L
+#include <complex.h>
+typedef _Fcomplex GoComplex64;
+typedef _Dcomplex GoComplex128;
+#else
+#include <complex>
+typedef std::complex<float> GoComplex64;
+typedef std::complex<double> GoComplex128;
+#endif
+#else
 typedef float _Complex GoComplex64;
 typedef double _Complex GoComplex128;
+#endif
 
 /*
   static assertion to make sure the file is being used on architecture
@@ -72,12 +86,15 @@ typedef struct { void *data; GoInt len; GoInt cap; } GoSlice;
 extern "C" {
 #endif
 
-
-extern Guppy_Header* ReadHeader(char* p0);
-
-extern void ReadVar(char* p0, char* p1, int p2, void* p3);
-
-extern void InitWorkers(GoInt p0);
+extern Guppy_Header* ReadHeader(char* fileName);
+extern void ReadVar(char* fileName, char* varName, int workerID, void* out);
+extern char* ReadVarError(char* fileName, char* varName, int workerID, void* out);
+extern char* DerivedVarType(char* varName);
+extern int OpenFile(char* fileName, int64_t* handle, Guppy_Header** hd, char** msg);
+extern int CloseFile(int64_t handle, char** msg);
+extern int FileVarInfo(int64_t handle, char* varName, int* typ, int64_t* n, int64_t* bytes, char** msg);
+extern int ReadFileVar(int64_t handle, char* varName, int workerID, void* out, int64_t outBytes, char** msg);
+extern void InitWorkers(GoInt n);
 
 #ifdef __cplusplus
 }
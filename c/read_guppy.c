@@ -1,9 +1,131 @@
 #include <stdlib.h>
 #include <stdio.h>
 #include <inttypes.h>
+#include <string.h>
 #include "read_guppy.h"
 #include "guppy_wrapper.h"
 
+// Guppy_File wraps the handle that the Go library uses to refer to an open
+// file. The handle only refers to the file's name and header: the Go library
+// reopens the file by name whenever a variable is read.
+struct Guppy_File {
+	int64_t handle;
+	Guppy_Header *hd;
+};
+
+// errorMessage is the most recent error message returned to each thread.
+static _Thread_local char *errorMessage = NULL;
+
+// setError records msg as the calling thread's error message if status isn't
+// Guppy_OK and returns status. msg must have been allocated with malloc.
+static Guppy_Status setError(int status, char *msg) {
+	if (status != Guppy_OK) {
+		free(errorMessage);
+		errorMessage = msg;
+	}
+	return (Guppy_Status) status;
+}
+
+// copyError records a copy of msg as the calling thread's error message and
+// returns status.
+static Guppy_Status copyError(int status, const char *msg) {
+	char *copy = malloc(strlen(msg) + 1);
+	if (copy != NULL) strcpy(copy, msg);
+	return setError(status, copy);
+}
+
+// argumentError records an error caused by an invalid argument.
+static Guppy_Status argumentError(const char *msg) {
+	return copyError(Guppy_ErrorArgument, msg);
+}
+
+const char *Guppy_ErrorMessage(void) {
+	return errorMessage == NULL ? "" : errorMessage;
+}
+
+Guppy_Status Guppy_Open(const char *fileName, Guppy_File **f) {
+	if (f == NULL) return argumentError("Guppy_Open was passed a NULL file.");
+	*f = NULL;
+	if (fileName == NULL) {
+		return argumentError("Guppy_Open was passed a NULL file name.");
+	}
+
+	int64_t handle;
+	Guppy_Header *hd;
+	char *msg = NULL;
+	int status = OpenFile((char*) fileName, &handle, &hd, &msg);
+	if (status != Guppy_OK) return setError(status, msg);
+
+	*f = malloc(sizeof(**f));
+	if (*f == NULL) {
+		CloseFile(handle, &msg);
+		free(msg);
+		Guppy_FreeHeader(hd);
+		return copyError(Guppy_ErrorMemory,
+			"Guppy_Open could not allocate memory for the file.");
+	}
+	(*f)->handle = handle;
+	(*f)->hd = hd;
+	return Guppy_OK;
+}
+
+Guppy_Status Guppy_Close(Guppy_File *f) {
+	if (f == NULL) return Guppy_OK;
+
+	char *msg = NULL;
+	int status = CloseFile(f->handle, &msg);
+	if (status != Guppy_OK) return setError(status, msg);
+
+	Guppy_FreeHeader(f->hd);
+	free(f);
+	return Guppy_OK;
+}
+
+Guppy_Status Guppy_GetHeader(Guppy_File *f, Guppy_Header **hd) {
+	if (f == NULL || hd == NULL) {
+		return argumentError("Guppy_GetHeader was passed a NULL argument.");
+	}
+	*hd = f->hd;
+	return Guppy_OK;
+}
+
+Guppy_Status Guppy_VarInfo(
+	Guppy_File *f, const char *varName,
+	Guppy_Type *type, int64_t *n, int64_t *bytes
+) {
+	if (f == NULL || varName == NULL) {
+		return argumentError("Guppy_VarInfo was passed a NULL file or " 
+			"variable name.");
+	}
+
+	int goType;
+	int64_t goN, goBytes;
+	char *msg = NULL;
+	int status = FileVarInfo(f->handle, (char*) varName,
+		&goType, &goN, &goBytes, &msg);
+	if (status != Guppy_OK) return setError(status, msg);
+
+	if (type != NULL) *type = (Guppy_Type) goType;
+	if (n != NULL) *n = goN;
+	if (bytes != NULL) *bytes = goBytes;
+	return Guppy_OK;
+}
+
+Guppy_Status Guppy_Read(
+	Guppy_File *f, const char *varName, int workerID,
+	void *out, int64_t outBytes
+) {
+	if (f == NULL || varName == NULL) {
+		return argumentError("Guppy_Read was passed a NULL file or variable "
+			"name.");
+	}
+
+	char *msg = NULL;
+	int status = ReadFileVar(f->handle, (char*) varName, workerID,
+		out, outBytes, &msg);
+	return setError(status, msg);
+}
+
 Guppy_Header *Guppy_ReadHeader(char *fileName) {
 	return ReadHeader(fileName);
 }
@@ -13,10 +135,60 @@ void Guppy_FreeHeader(Guppy_Header *hd) {
 	for (int i = 0; i < hd->NVars; i++) {
 		free(hd->Names[i]);
 		free(hd->Types[i]);
+		free(hd->Methods[i]);
+		free(hd->Units[i]);
 	}
 	free(hd->Names);
 	free(hd->Types);
 	free(hd->Sizes);
+	free(hd->Methods);
+	free(hd->Units);
+	free(hd->Deltas);
+	free(hd->Periods);
+
+	for (int64_t i = 0; i < hd->NMetadata; i++) {
+		free(hd->MetadataKeys[i]);
+		free(hd->MetadataTypes[i]);
+		free(hd->MetadataStrings[i]);
+	}
+	free(hd->MetadataKeys);
+	free(hd->MetadataTypes);
+	free(hd->MetadataStrings);
+	free(hd->MetadataInts);
+	free(hd->MetadataFloats);
+	free(hd);
+}
+
+// findMetadata returns the index of the metadata entry with the given key and
+// type, or -1 if there is no such entry.
+static int64_t findMetadata(Guppy_Header *hd, char *key, char *type) {
+	for (int64_t i = 0; i < hd->NMetadata; i++) {
+		if (strcmp(hd->MetadataKeys[i], key) == 0) {
+			return strcmp(hd->MetadataTypes[i], type) == 0 ? i : -1;
+		}
+	}
+	return -1;
+}
+
+int Guppy_MetadataInt(Guppy_Header *hd, char *key, int64_t *out) {
+	int64_t i = findMetadata(hd, key, "i64");
+	if (i == -1) return 0;
+	*out = hd->MetadataInts[i];
+	return 1;
+}
+
+int Guppy_MetadataFloat(Guppy_Header *hd, char *key, double *out) {
+	int64_t i = findMetadata(hd, key, "f64");
+	if (i == -1) return 0;
+	*out = hd->MetadataFloats[i];
+	return 1;
+}
+
+int Guppy_MetadataString(Guppy_Header *hd, char *key, char **out) {
+	int64_t i = findMetadata(hd, key, "str");
+	if (i == -1) return 0;
+	*out = hd->MetadataStrings[i];
+	return 1;
 }
 
 
@@ -40,6 +212,12 @@ void Guppy_PrintHeader(Guppy_Header *hd) {
 		printf("'%"PRId64"', ", hd->Sizes[i]);
 	}
 	printf("'%s']\n", hd->Types[hd->NVars - 1]);
+	printf("Fields:\n");
+	for (int64_t i = 0; i < hd->NVars; i++) {
+		printf("    %s: method = %s, delta = %g, period = %g, units = '%s'\n",
+			hd->Names[i], hd->Methods[i], hd->Deltas[i], hd->Periods[i],
+			hd->Units[i]);
+	}
 	printf("Span:\n    [%"PRId64", %"PRId64", %"PRId64"]\n",
 		hd->Span[0], hd->Span[1], hd->Span[2]);
 	printf("Z:\n    %.6f\n", hd->Z);
@@ -47,6 +225,19 @@ void Guppy_PrintHeader(Guppy_Header *hd) {
 	printf("L:\n    %.6f\n", hd->L);
 	printf("H100:\n    %.6f\n", hd->H100);
 	printf("Mass:\n    %.6g\n", hd->Mass);
+	printf("Metadata:\n");
+	for (int64_t i = 0; i < hd->NMetadata; i++) {
+		printf("    %s (%s): ", hd->MetadataKeys[i], hd->MetadataTypes[i]);
+		if (strcmp(hd->MetadataTypes[i], "i64") == 0) {
+			printf("%"PRId64"\n", hd->MetadataInts[i]);
+		} else if (strcmp(hd->MetadataTypes[i], "f64") == 0) {
+			printf("%.6g\n", hd->MetadataFloats[i]);
+		} else if (strcmp(hd->MetadataTypes[i], "str") == 0) {
+			printf("'%s'\n", hd->MetadataStrings[i]);
+		} else {
+			printf("<unknown type>\n");
+		}
+	}
 }	
 
 void Guppy_ReadVar(char *fileName, char *varName, int workerID, void *out) {
@@ -19,6 +19,15 @@ typedef struct Guppy_Header {
 	char **Names, **Types;
     int64_t *Sizes;
 	int64_t NVars;
+	// Methods gives the compression method used for each variable. Deltas
+	// gives the accuracy each variable is stored to: floating point values
+	// are within Deltas[i] of their original values. Periods gives the
+	// periodicity of each variable (non-positive if it isn't periodic) and
+	// Units gives the units of each variable. Integers, including "id", are
+	// stored exactly and have a Delta of 0. All these arrays have length
+	// NVars.
+	char **Methods, **Units;
+	double *Deltas, *Periods;
 	// N and NTot give the number of particles in the file and in the
 	// total simulation, respectively.
 	int64_t N, NTot;
@@ -29,6 +38,17 @@ typedef struct Guppy_Header {
 	// H0 / (100 km/s/Mpc), box width in comoving Mpc/h, and particle
 	// mass in Msun/h, respectively.
 	double Z, OmegaM, OmegaL, H100, L, Mass;
+	// NMetadata is the number of typed key/value metadata entries in the
+	// file. MetadataKeys and MetadataTypes give the key and type ("i64",
+	// "f64", or "str") of each entry. The value of the i-th entry is stored
+	// in MetadataInts[i], MetadataFloats[i], or MetadataStrings[i],
+	// depending on its type, and the other two arrays hold 0 or NULL at
+	// that index. Guppy_MetadataInt, Guppy_MetadataFloat, and
+	// Guppy_MetadataString are simpler ways to look values up.
+	char **MetadataKeys, **MetadataTypes, **MetadataStrings;
+	int64_t *MetadataInts;
+	double *MetadataFloats;
+	int64_t NMetadata;
 } Guppy_Header;
 
 // Guppy_RockstarParitcle has the same structure as the particles used 
@@ -39,7 +59,91 @@ typedef struct Guppy_RockstarParticle {
 	float X[3], V[3];
 } Guppy_RockstarParticle;
 
-// Guppy_ReadHeader returns the header of a given file.
+// Guppy_Status is the status code returned by the functions which report
+// errors instead of aborting. If a function returns anything other than
+// Guppy_OK, Guppy_ErrorMessage will return a description of the error.
+typedef enum Guppy_Status {
+	// Guppy_OK means that the call succeeded.
+	Guppy_OK = 0,
+	// Guppy_ErrorOpen means that a file doesn't exist or couldn't be opened.
+	Guppy_ErrorOpen = 1,
+	// Guppy_ErrorFormat means that a file isn't a valid .gup file.
+	Guppy_ErrorFormat = 2,
+	// Guppy_ErrorRead means that a file's data couldn't be read or
+	// decompressed. This usually means the file is corrupted.
+	Guppy_ErrorRead = 3,
+	// Guppy_ErrorVar means that a file doesn't contain the requested
+	// variable.
+	Guppy_ErrorVar = 4,
+	// Guppy_ErrorBuffer means that the supplied buffer is too small.
+	Guppy_ErrorBuffer = 5,
+	// Guppy_ErrorArgument means that an argument was invalid, e.g. a NULL
+	// pointer, a closed file, or a worker ID that hasn't been allocated.
+	Guppy_ErrorArgument = 6,
+	// Guppy_ErrorMemory means that memory couldn't be allocated.
+	Guppy_ErrorMemory = 7
+} Guppy_Status;
+
+// Guppy_Type is the type of buffer that a variable needs to be read into.
+// Guppy_TypeU32 and Guppy_TypeU64 are uint32_t and uint64_t arrays,
+// Guppy_TypeF32 and Guppy_TypeF64 are float and double arrays, Guppy_TypeV32
+// and Guppy_TypeV64 are float[3] and double[3] arrays, and
+// Guppy_TypeRockstar is a Guppy_RockstarParticle array.
+typedef enum Guppy_Type {
+	Guppy_TypeU32 = 0,
+	Guppy_TypeU64 = 1,
+	Guppy_TypeF32 = 2,
+	Guppy_TypeF64 = 3,
+	Guppy_TypeV32 = 4,
+	Guppy_TypeV64 = 5,
+	Guppy_TypeRockstar = 6
+} Guppy_Type;
+
+// Guppy_File is a .gup file opened by Guppy_Open.
+typedef struct Guppy_File Guppy_File;
+
+// Guppy_Open opens a .gup file and reads its header. On success, *f points to
+// the opened file, which needs to be closed with Guppy_Close. Otherwise, *f is
+// set to NULL. Only the header is kept in memory: the file is closed again
+// once its header is read, and every call to Guppy_Read reopens it by name.
+// This means that open files don't use up file descriptors, but a file
+// shouldn't be moved or replaced before it's closed.
+Guppy_Status Guppy_Open(const char *fileName, Guppy_File **f);
+
+// Guppy_Close closes a file opened by Guppy_Open and frees its header.
+// Closing a NULL file does nothing.
+Guppy_Status Guppy_Close(Guppy_File *f);
+
+// Guppy_GetHeader points *hd at the header of an open file. The header belongs
+// to the file and will be freed by Guppy_Close.
+Guppy_Status Guppy_GetHeader(Guppy_File *f, Guppy_Header **hd);
+
+// Guppy_VarInfo looks up a variable in an open file. It writes the type of
+// buffer the variable needs to be read into to *type, the number of elements
+// in the buffer to *n, and the size of the buffer in bytes to *bytes. Any of
+// these pointers may be NULL. See Guppy_ReadVar for the variable names that
+// are accepted.
+Guppy_Status Guppy_VarInfo(
+	Guppy_File *f, const char *varName,
+	Guppy_Type *type, int64_t *n, int64_t *bytes
+);
+
+// Guppy_Read reads a variable from an open file into out, which has a size of
+// outBytes bytes. Use Guppy_VarInfo to find the size and type of buffer that
+// is needed. See Guppy_ReadVar for a description of the variable names and
+// worker IDs that are accepted.
+Guppy_Status Guppy_Read(
+	Guppy_File *f, const char *varName, int workerID,
+	void *out, int64_t outBytes
+);
+
+// Guppy_ErrorMessage returns a description of the most recent error returned
+// to the calling thread. The string belongs to guppy and is only valid until
+// the next failed call on the same thread.
+const char *Guppy_ErrorMessage(void);
+
+// Guppy_ReadHeader returns the header of a given file. It aborts the process
+// if there is an error, so Guppy_Open should be preferred.
 Guppy_Header *Guppy_ReadHeader(char *fileName);
 
 // Guppy_FreeHeader frees the a Guppy_Header.
@@ -48,6 +152,22 @@ void Guppy_FreeHeader(Guppy_Header *hd);
 // Guppy_PrintHeader prints a Guppy_Header.
 void Guppy_PrintHeader(Guppy_Header *hd);
 
+// Guppy_MetadataInt looks up the integer metadata entry with the given key
+// and writes its value to out. It returns 1 if the entry exists and is an
+// integer and 0 otherwise.
+int Guppy_MetadataInt(Guppy_Header *hd, char *key, int64_t *out);
+
+// Guppy_MetadataFloat looks up the floating point metadata entry with the
+// given key and writes its value to out. It returns 1 if the entry exists
+// and is a float and 0 otherwise.
+int Guppy_MetadataFloat(Guppy_Header *hd, char *key, double *out);
+
+// Guppy_MetadataString looks up the string metadata entry with the given key
+// and points out at its value. The string belongs to the header and will be
+// freed by Guppy_FreeHeader. It returns 1 if the entry exists and is a string
+// and 0 otherwise.
+int Guppy_MetadataString(Guppy_Header *hd, char *key, char **out);
+
 // Guppy_ReadVar reads a variable with a given name from a given file. If
 // you and to use one of the pre-allocated workers, you should give the
 // integer ID of that workers (i.e. in the range [0, n). ReadVar uses
@@ -59,17 +179,22 @@ void Guppy_PrintHeader(Guppy_Header *hd);
 // written to.
 //
 // For vector quantities, you can either load each component one by one
-// (e.g. "x[0]", "x[1]", etc.) and supply a []float32 or []float64 buffer,
+// (e.g. "x{0}", "x{1}", etc.) and supply a []float32 or []float64 buffer,
 // or you can get the full vector (e.g. "x") and supply a [][3]float32 or
 // [][3]float64.
 //
 // The variable "id" is implicitly contained in every .gup file and can be
 // read into a []uint64 array.
 //
-// If the buffer has the name "[RockstarParticle]" and type
-// []Guppy_RockstarParticle, the fields "x[0]", "x[1]", "x[2]" will be read
-// into the X field, "v[0]", "v[1]", and "v[2]" into the V field and "id"
-// into the ID field.
+// If the buffer has the name "{RockstarParticle}" and type
+// []Guppy_RockstarParticle, the fields "x{0}", "x{1}", "x{2}" will be read
+// into the X field, "v{0}", "v{1}", and "v{2}" into the V field and "id"
+// into the ID field. Other derived variables, like "{Displacement}" and
+// "{Speed}", are computed from the stored variables in the same way. Use
+// Guppy_VarInfo to find the type of buffer each one needs.
+//
+// Guppy_ReadVar aborts the process if there is an error, so Guppy_Read should
+// be preferred.
 void Guppy_ReadVar(char *fileName, char *varName, int workerID, void *out);
 
 // Guppy_InitWorkers allocates memory-managed space for n workers which can
@@ -27,7 +27,7 @@ void PrintGuppyArrays(
 		printf("%"PRIu64" ", id[i]);
 	printf("]\n\n");
 
-	printf("[RockstarParticle]:\n[\n");
+	printf("{RockstarParticle}:\n[\n");
 	for(int i = 0; i < 5; i++)
 		printf("    [%"PRIu64" (%7.4f %7.4f %7.4f) (%9.4f %9.4f %9.4f)]\n",
 			rs[i].ID, rs[i].X[0], rs[i].X[1], rs[i].X[2],
@@ -35,32 +35,74 @@ void PrintGuppyArrays(
 	printf("]\n");
 }
 
-int main() {
+// readVar allocates a buffer for a variable, reads it, and returns it. It
+// exits if there is an error.
+void *readVar(Guppy_File *f, char *varName, int workerID) {
+	int64_t bytes;
+	Guppy_Status status = Guppy_VarInfo(f, varName, NULL, NULL, &bytes);
+	if (status != Guppy_OK) {
+		fprintf(stderr, "Guppy error %d: %s\n", status, Guppy_ErrorMessage());
+		exit(1);
+	}
+
+	void *out = malloc(bytes);
+	status = Guppy_Read(f, varName, workerID, out, bytes);
+	if (status != Guppy_OK) {
+		fprintf(stderr, "Guppy error %d: %s\n", status, Guppy_ErrorMessage());
+		exit(1);
+	}
+
+	return out;
+}
+
+int main(int argc, char **argv) {
 	char *fileName = "../large_test_data/large_test.gup";
-	Guppy_Header *hd = Guppy_ReadHeader(fileName);
+	if (argc > 1) fileName = argv[1];
+
+	// Errors are reported through status codes instead of crashing.
+	Guppy_File *missing;
+	Guppy_Status status = Guppy_Open("this_file_does_not_exist.gup", &missing);
+	if (status != Guppy_ErrorOpen || missing != NULL) {
+		fprintf(stderr, "Expected Guppy_ErrorOpen when opening a missing "
+			"file, got %d.\n", status);
+		return 1;
+	}
+	printf("Opening a missing file: %s\n\n", Guppy_ErrorMessage());
+
+	Guppy_File *f;
+	status = Guppy_Open(fileName, &f);
+	if (status != Guppy_OK) {
+		fprintf(stderr, "Guppy error %d: %s\n", status, Guppy_ErrorMessage());
+		return 1;
+	}
+
+	Guppy_Header *hd;
+	Guppy_GetHeader(f, &hd);
 	Guppy_PrintHeader(hd);
 
 	Guppy_InitWorkers(2);
 
-	float (*x)[3] = calloc(hd->N, sizeof(*x));
-	float (*v)[3] = calloc(hd->N, sizeof(*v));
-	float *x0 = calloc(hd->N, sizeof(*x0));
-	uint64_t *id = calloc(hd->N, sizeof(*id)); 
-	Guppy_RockstarParticle *rs = calloc(hd->N, sizeof(*rs));
-
-	Guppy_ReadVar(fileName, "x", 0, x);
-	Guppy_ReadVar(fileName, "v", 1, v);
-	Guppy_ReadVar(fileName, "x[0]", 0, x0);
-	Guppy_ReadVar(fileName, "id", 1, id);
-	Guppy_ReadVar(fileName, "[RockstarParticle]", 0, rs);
+	float (*x)[3] = readVar(f, "x", 0);
+	float (*v)[3] = readVar(f, "v", 1);
+	float *x0 = readVar(f, "x{0}", 0);
+	uint64_t *id = readVar(f, "id", 1);
+	Guppy_RockstarParticle *rs = readVar(f, "{RockstarParticle}", -2);
 
 	PrintGuppyArrays(x, v, x0, id, rs);
 
+	status = Guppy_Read(f, "x", 0, x, 1);
+	if (status != Guppy_ErrorBuffer) {
+		fprintf(stderr, "Expected Guppy_ErrorBuffer when reading into a "
+			"buffer that's too small, got %d.\n", status);
+		return 1;
+	}
+	printf("\nReading into a small buffer: %s\n", Guppy_ErrorMessage());
+
 	free(x);
 	free(v);
 	free(x0);
 	free(id);
 	free(rs);
 
-	Guppy_FreeHeader(hd);
+	Guppy_Close(f);
 }
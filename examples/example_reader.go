@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
 	"os"
 	"os/exec"
@@ -30,14 +29,11 @@ func main() {
 	err = cmd.Start()
 	if err != nil { panic(err.Error()) }
 	
-	// Guppy writes in system order so our C-based friends don't have to
-	// do more work.
-	sysOrder := lib.SystemByteOrder()
-	
-	// Read the header first
-	hd := &lib.PipeHeader{ }
-
-	err = binary.Read(pipe, sysOrder, hd)
+	// Read the header first. Guppy writes in system order so our C-based
+	// friends don't have to do more work, but ReadPipeHeader figures out
+	// which order that was in case the data was saved and moved to a
+	// different machine.
+	hd, order, err := lib.ReadPipeHeader(pipe)
 	if err != nil { panic(err.Error()) }
 	
 	part := make([]lib.RockstarParticle, hd.N)
@@ -48,13 +44,13 @@ func main() {
 	// Read the data next. You could do this with calls to binary.Read(), but
 	// Go uses reflection to read composite type and arrays of arrays. So you
 	// should really use the function I wrote that takes care of this for you.
-	err = lib.ReadAsBytes(pipe, part)
+	err = lib.ReadAsBytesOrder(pipe, order, part)
 	if err != nil { panic(err.Error) }
-	err = lib.ReadAsBytes(pipe, x0)
+	err = lib.ReadAsBytesOrder(pipe, order, x0)
 	if err != nil { panic(err.Error) }
-	err = lib.ReadAsBytes(pipe, v)
+	err = lib.ReadAsBytesOrder(pipe, order, v)
 	if err != nil { panic(err.Error) }
-	err = lib.ReadAsBytes(pipe, id)
+	err = lib.ReadAsBytesOrder(pipe, order, id)
 	if err != nil { panic(err.Error) }
 
 	for i := 0; i < 8; i++ {
@@ -0,0 +1,10 @@
+# Build the C library that the Fortran module wraps
+(cd ../c && ./build_script.sh) &&
+	# Compile the Fortran module into an object file and a .mod file
+	gfortran -c -std=f2008 -Wall -O2 read_guppy.f90 &&
+	# Compile the test file into an executable binary
+	gfortran -std=f2008 read_guppy_test.f90 read_guppy.o -L../c -lread_guppy -lguppy_wrapper -lpthread -o read_guppy_test &&
+	# Exit normally
+	exit 0
+# Uh oh, there's a problem
+exit 1
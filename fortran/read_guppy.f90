@@ -0,0 +1,608 @@
+! read_guppy is a Fortran module for reading .gup files. It is a thin wrapper
+! around the C library in c/, which needs to be built first. See docs/fortran.md
+! for instructions.
+!
+! Errors are handled like Fortran's allocate statement: every routine which
+! can fail takes optional stat and errmsg arguments. If stat is present it is
+! set to GUPPY_OK on success and to one of the GUPPY_ERROR_* codes otherwise.
+! If stat is not present, errors print a message and stop the program.
+module read_guppy
+  use, intrinsic :: iso_c_binding
+  use, intrinsic :: iso_fortran_env, only: error_unit
+  implicit none
+  private
+
+  public :: guppy_header, guppy_rockstar_particle
+  public :: guppy_read_header, guppy_free_header, guppy_read_var
+  public :: guppy_init_workers
+
+  ! Status codes. These have the same values as Guppy_Status in read_guppy.h.
+  integer, parameter, public :: GUPPY_OK = 0
+  integer, parameter, public :: GUPPY_ERROR_OPEN = 1
+  integer, parameter, public :: GUPPY_ERROR_FORMAT = 2
+  integer, parameter, public :: GUPPY_ERROR_READ = 3
+  integer, parameter, public :: GUPPY_ERROR_VAR = 4
+  integer, parameter, public :: GUPPY_ERROR_BUFFER = 5
+  integer, parameter, public :: GUPPY_ERROR_ARGUMENT = 6
+  integer, parameter, public :: GUPPY_ERROR_MEMORY = 7
+
+  ! Buffer types. These have the same values as Guppy_Type in read_guppy.h.
+  integer(c_int), parameter :: GUPPY_TYPE_U32 = 0
+  integer(c_int), parameter :: GUPPY_TYPE_U64 = 1
+  integer(c_int), parameter :: GUPPY_TYPE_F32 = 2
+  integer(c_int), parameter :: GUPPY_TYPE_F64 = 3
+  integer(c_int), parameter :: GUPPY_TYPE_V32 = 4
+  integer(c_int), parameter :: GUPPY_TYPE_V64 = 5
+  integer(c_int), parameter :: GUPPY_TYPE_ROCKSTAR = 6
+
+  ! guppy_header contains header information about a .gup file. It has the
+  ! same fields as Guppy_Header in read_guppy.h, but arrays are allocatable
+  ! and strings are Fortran strings. String arrays are padded with spaces to
+  ! the length of their longest element, so use trim() on their elements.
+  type :: guppy_header
+     ! original_header is the original header of one of the original
+     ! simulation files.
+     integer(c_int8_t), allocatable :: original_header(:)
+     ! names gives the names of all the variables stored in the file and
+     ! types gives their types: "u32", "u64", "f32", or "f64". sizes gives
+     ! the size of each variable in bytes. methods, units, deltas, and
+     ! periods give the compression method, units, accuracy, and periodicity
+     ! of each variable. n_vars is the number of variables.
+     character(len=:), allocatable :: names(:), types(:)
+     character(len=:), allocatable :: methods(:), units(:)
+     integer(c_int64_t), allocatable :: sizes(:)
+     real(c_double), allocatable :: deltas(:), periods(:)
+     integer(c_int64_t) :: n_vars = 0
+     ! n and n_tot give the number of particles in the file and in the
+     ! total simulation, and span gives the dimensions of the slab of
+     ! particles in the file.
+     integer(c_int64_t) :: n = 0, n_tot = 0, span(3) = 0
+     ! z, omega_m, omega_l, h100, l, and mass give the redshift, Omega_m,
+     ! Omega_Lambda, H0 / (100 km/s/Mpc), box width in comoving Mpc/h, and
+     ! particle mass in Msun/h.
+     real(c_double) :: z = 0, omega_m = 0, omega_l = 0, h100 = 0
+     real(c_double) :: l = 0, mass = 0
+     ! metadata_keys and metadata_types give the key and type ("i64",
+     ! "f64", or "str") of each metadata entry. The value of the i-th entry
+     ! is in metadata_ints(i), metadata_floats(i), or metadata_strings(i),
+     ! depending on its type. n_metadata is the number of entries.
+     character(len=:), allocatable :: metadata_keys(:), metadata_types(:)
+     character(len=:), allocatable :: metadata_strings(:)
+     integer(c_int64_t), allocatable :: metadata_ints(:)
+     real(c_double), allocatable :: metadata_floats(:)
+     integer(c_int64_t) :: n_metadata = 0
+  end type guppy_header
+
+  ! guppy_rockstar_particle has the same layout as Guppy_RockstarParticle.
+  type, bind(c) :: guppy_rockstar_particle
+     integer(c_int64_t) :: id
+     real(c_float) :: x(3), v(3)
+  end type guppy_rockstar_particle
+
+  ! guppy_header_c has the same layout as Guppy_Header.
+  type, bind(c) :: guppy_header_c
+     type(c_ptr) :: original_header
+     integer(c_int64_t) :: original_header_length
+     type(c_ptr) :: names, types, sizes
+     integer(c_int64_t) :: n_vars
+     type(c_ptr) :: methods, units, deltas, periods
+     integer(c_int64_t) :: n, n_tot, span(3)
+     real(c_double) :: z, omega_m, omega_l, h100, l, mass
+     type(c_ptr) :: metadata_keys, metadata_types, metadata_strings
+     type(c_ptr) :: metadata_ints, metadata_floats
+     integer(c_int64_t) :: n_metadata
+  end type guppy_header_c
+
+  ! guppy_read_var reads a variable from a .gup file into an allocatable
+  ! array, which is allocated to the right size:
+  !
+  !   call guppy_read_var(file_name, var_name, out [, worker_id, stat, errmsg])
+  !
+  ! The kind and rank of out depend on the variable's type:
+  !
+  !   u32: integer(c_int32_t) :: out(:)
+  !   u64: integer(c_int64_t) :: out(:)
+  !   f32: real(c_float) :: out(:)
+  !   f64: real(c_double) :: out(:)
+  !   v32: real(c_float) :: out(:,:), with shape (3, n)
+  !   v64: real(c_double) :: out(:,:), with shape (3, n)
+  !
+  ! Fortran doesn't have unsigned integers, so u32 values larger than 2^31 - 1
+  ! will be negative. Vectors can be read whole (e.g. "x") or one component at
+  ! a time (e.g. "x{0}"). "id" is in every file and has type u64.
+  ! "{RockstarParticle}" can be read into a guppy_rockstar_particle array.
+  !
+  ! worker_id works the same way as in Guppy_ReadVar. It defaults to -1, which
+  ! allocates new buffers for each read. Call guppy_init_workers(n) and use
+  ! IDs in [0, n) to reuse buffers, or use -2 to let guppy choose a worker.
+  interface guppy_read_var
+     module procedure guppy_read_u32, guppy_read_u64
+     module procedure guppy_read_f32, guppy_read_f64
+     module procedure guppy_read_v32, guppy_read_v64
+     module procedure guppy_read_rockstar
+  end interface guppy_read_var
+
+  interface
+     ! guppy_init_workers allocates memory-managed space for n workers which
+     ! can be used simultaneously by different threads.
+     subroutine guppy_init_workers(n) bind(c, name="Guppy_InitWorkers")
+       import :: c_int
+       integer(c_int), value :: n
+     end subroutine guppy_init_workers
+
+     function c_guppy_open(file_name, f) bind(c, name="Guppy_Open")
+       import :: c_char, c_ptr, c_int
+       character(kind=c_char), intent(in) :: file_name(*)
+       type(c_ptr), intent(out) :: f
+       integer(c_int) :: c_guppy_open
+     end function c_guppy_open
+
+     function c_guppy_close(f) bind(c, name="Guppy_Close")
+       import :: c_ptr, c_int
+       type(c_ptr), value :: f
+       integer(c_int) :: c_guppy_close
+     end function c_guppy_close
+
+     function c_guppy_get_header(f, hd) bind(c, name="Guppy_GetHeader")
+       import :: c_ptr, c_int
+       type(c_ptr), value :: f
+       type(c_ptr), intent(out) :: hd
+       integer(c_int) :: c_guppy_get_header
+     end function c_guppy_get_header
+
+     function c_guppy_var_info(f, var_name, typ, n, bytes) &
+          bind(c, name="Guppy_VarInfo")
+       import :: c_ptr, c_char, c_int, c_int64_t
+       type(c_ptr), value :: f
+       character(kind=c_char), intent(in) :: var_name(*)
+       integer(c_int), intent(out) :: typ
+       integer(c_int64_t), intent(out) :: n, bytes
+       integer(c_int) :: c_guppy_var_info
+     end function c_guppy_var_info
+
+     function c_guppy_read(f, var_name, worker_id, out, out_bytes) &
+          bind(c, name="Guppy_Read")
+       import :: c_ptr, c_char, c_int, c_int64_t
+       type(c_ptr), value :: f
+       character(kind=c_char), intent(in) :: var_name(*)
+       integer(c_int), value :: worker_id
+       type(c_ptr), value :: out
+       integer(c_int64_t), value :: out_bytes
+       integer(c_int) :: c_guppy_read
+     end function c_guppy_read
+
+     function c_guppy_error_message() bind(c, name="Guppy_ErrorMessage")
+       import :: c_ptr
+       type(c_ptr) :: c_guppy_error_message
+     end function c_guppy_error_message
+
+     function c_strlen(s) bind(c, name="strlen")
+       import :: c_ptr, c_size_t
+       type(c_ptr), value :: s
+       integer(c_size_t) :: c_strlen
+     end function c_strlen
+  end interface
+
+contains
+
+  ! guppy_read_header reads the header of a .gup file into hd.
+  subroutine guppy_read_header(file_name, hd, stat, errmsg)
+    character(len=*), intent(in) :: file_name
+    type(guppy_header), intent(out) :: hd
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f, hd_ptr
+    type(guppy_header_c), pointer :: chd
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    f = c_null_ptr
+    msg = ""
+    status = c_guppy_open(to_c_string(file_name), f)
+    if (status == GUPPY_OK) status = c_guppy_get_header(f, hd_ptr)
+
+    if (status == GUPPY_OK) then
+       call c_f_pointer(hd_ptr, chd)
+       call copy_header(chd, hd)
+    else
+       msg = error_message()
+    end if
+
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_header
+
+  ! guppy_free_header deallocates the arrays in a guppy_header. They are also
+  ! deallocated automatically when hd goes out of scope.
+  subroutine guppy_free_header(hd)
+    type(guppy_header), intent(inout) :: hd
+    type(guppy_header) :: empty
+
+    hd = empty
+  end subroutine guppy_free_header
+
+  subroutine guppy_read_u32(file_name, var_name, out, worker_id, stat, errmsg)
+    character(len=*), intent(in) :: file_name, var_name
+    integer(c_int32_t), allocatable, target, intent(out) :: out(:)
+    integer, intent(in), optional :: worker_id
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f
+    integer(c_int64_t) :: n, bytes
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    call open_var(file_name, var_name, GUPPY_TYPE_U32, f, n, bytes, &
+         status, msg)
+    if (status == GUPPY_OK) then
+       allocate(out(n))
+       if (n > 0) call read_var(f, var_name, worker_id, c_loc(out), bytes, &
+            status, msg)
+    end if
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_u32
+
+  subroutine guppy_read_u64(file_name, var_name, out, worker_id, stat, errmsg)
+    character(len=*), intent(in) :: file_name, var_name
+    integer(c_int64_t), allocatable, target, intent(out) :: out(:)
+    integer, intent(in), optional :: worker_id
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f
+    integer(c_int64_t) :: n, bytes
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    call open_var(file_name, var_name, GUPPY_TYPE_U64, f, n, bytes, &
+         status, msg)
+    if (status == GUPPY_OK) then
+       allocate(out(n))
+       if (n > 0) call read_var(f, var_name, worker_id, c_loc(out), bytes, &
+            status, msg)
+    end if
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_u64
+
+  subroutine guppy_read_f32(file_name, var_name, out, worker_id, stat, errmsg)
+    character(len=*), intent(in) :: file_name, var_name
+    real(c_float), allocatable, target, intent(out) :: out(:)
+    integer, intent(in), optional :: worker_id
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f
+    integer(c_int64_t) :: n, bytes
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    call open_var(file_name, var_name, GUPPY_TYPE_F32, f, n, bytes, &
+         status, msg)
+    if (status == GUPPY_OK) then
+       allocate(out(n))
+       if (n > 0) call read_var(f, var_name, worker_id, c_loc(out), bytes, &
+            status, msg)
+    end if
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_f32
+
+  subroutine guppy_read_f64(file_name, var_name, out, worker_id, stat, errmsg)
+    character(len=*), intent(in) :: file_name, var_name
+    real(c_double), allocatable, target, intent(out) :: out(:)
+    integer, intent(in), optional :: worker_id
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f
+    integer(c_int64_t) :: n, bytes
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    call open_var(file_name, var_name, GUPPY_TYPE_F64, f, n, bytes, &
+         status, msg)
+    if (status == GUPPY_OK) then
+       allocate(out(n))
+       if (n > 0) call read_var(f, var_name, worker_id, c_loc(out), bytes, &
+            status, msg)
+    end if
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_f64
+
+  subroutine guppy_read_v32(file_name, var_name, out, worker_id, stat, errmsg)
+    character(len=*), intent(in) :: file_name, var_name
+    real(c_float), allocatable, target, intent(out) :: out(:,:)
+    integer, intent(in), optional :: worker_id
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f
+    integer(c_int64_t) :: n, bytes
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    call open_var(file_name, var_name, GUPPY_TYPE_V32, f, n, bytes, &
+         status, msg)
+    if (status == GUPPY_OK) then
+       allocate(out(3, n))
+       if (n > 0) call read_var(f, var_name, worker_id, c_loc(out), bytes, &
+            status, msg)
+    end if
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_v32
+
+  subroutine guppy_read_v64(file_name, var_name, out, worker_id, stat, errmsg)
+    character(len=*), intent(in) :: file_name, var_name
+    real(c_double), allocatable, target, intent(out) :: out(:,:)
+    integer, intent(in), optional :: worker_id
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f
+    integer(c_int64_t) :: n, bytes
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    call open_var(file_name, var_name, GUPPY_TYPE_V64, f, n, bytes, &
+         status, msg)
+    if (status == GUPPY_OK) then
+       allocate(out(3, n))
+       if (n > 0) call read_var(f, var_name, worker_id, c_loc(out), bytes, &
+            status, msg)
+    end if
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_v64
+
+  subroutine guppy_read_rockstar(file_name, var_name, out, worker_id, &
+       stat, errmsg)
+    character(len=*), intent(in) :: file_name, var_name
+    type(guppy_rockstar_particle), allocatable, target, intent(out) :: out(:)
+    integer, intent(in), optional :: worker_id
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    type(c_ptr) :: f
+    integer(c_int64_t) :: n, bytes
+    integer(c_int) :: status
+    character(len=:), allocatable :: msg
+
+    call open_var(file_name, var_name, GUPPY_TYPE_ROCKSTAR, f, n, bytes, &
+         status, msg)
+    if (status == GUPPY_OK) then
+       allocate(out(n))
+       if (n > 0) call read_var(f, var_name, worker_id, c_loc(out), bytes, &
+            status, msg)
+    end if
+    call finish(f, status, msg, stat, errmsg)
+  end subroutine guppy_read_rockstar
+
+  ! open_var opens a file and checks that var_name needs to be read into a
+  ! buffer with the type typ. The number of elements in the buffer and its
+  ! size in bytes are written to n and bytes. If there's an error, status
+  ! and msg describe it.
+  subroutine open_var(file_name, var_name, typ, f, n, bytes, status, msg)
+    character(len=*), intent(in) :: file_name, var_name
+    integer(c_int), intent(in) :: typ
+    type(c_ptr), intent(out) :: f
+    integer(c_int64_t), intent(out) :: n, bytes
+    integer(c_int), intent(out) :: status
+    character(len=:), allocatable, intent(out) :: msg
+
+    integer(c_int) :: var_type
+
+    f = c_null_ptr
+    n = 0
+    bytes = 0
+    msg = ""
+
+    status = c_guppy_open(to_c_string(file_name), f)
+    if (status == GUPPY_OK) then
+       status = c_guppy_var_info(f, to_c_string(var_name), var_type, &
+            n, bytes)
+    end if
+    if (status /= GUPPY_OK) then
+       msg = error_message()
+       return
+    end if
+
+    if (var_type /= typ) then
+       status = GUPPY_ERROR_BUFFER
+       msg = "'" // trim(var_name) // "' in " // trim(file_name) // &
+            " must be read into " // type_description(var_type) // &
+            ", not " // type_description(typ) // "."
+    end if
+  end subroutine open_var
+
+  ! read_var reads var_name from the open file f into the buffer at out, which
+  ! has a size of bytes bytes.
+  subroutine read_var(f, var_name, worker_id, out, bytes, status, msg)
+    type(c_ptr), intent(in) :: f, out
+    character(len=*), intent(in) :: var_name
+    integer, intent(in), optional :: worker_id
+    integer(c_int64_t), intent(in) :: bytes
+    integer(c_int), intent(out) :: status
+    character(len=:), allocatable, intent(inout) :: msg
+
+    integer(c_int) :: id
+
+    id = -1
+    if (present(worker_id)) id = int(worker_id, c_int)
+
+    status = c_guppy_read(f, to_c_string(var_name), id, out, bytes)
+    if (status /= GUPPY_OK) msg = error_message()
+  end subroutine read_var
+
+  ! finish closes f, if it was opened, and reports the error described by
+  ! status and msg to the caller. If the caller didn't pass stat, the error
+  ! stops the program.
+  subroutine finish(f, status, msg, stat, errmsg)
+    type(c_ptr), intent(in) :: f
+    integer(c_int), intent(in) :: status
+    character(len=*), intent(in) :: msg
+    integer, intent(out), optional :: stat
+    character(len=*), intent(inout), optional :: errmsg
+
+    integer(c_int) :: close_status
+
+    if (c_associated(f)) close_status = c_guppy_close(f)
+
+    if (present(stat)) stat = int(status)
+    if (status == GUPPY_OK) return
+
+    if (present(errmsg)) errmsg = msg
+    if (.not. present(stat)) then
+       write(error_unit, '(a)') "guppy error: " // msg
+       error stop 1
+    end if
+  end subroutine finish
+
+  ! copy_header copies a C header into a Fortran header.
+  subroutine copy_header(chd, hd)
+    type(guppy_header_c), intent(in) :: chd
+    type(guppy_header), intent(out) :: hd
+
+    integer(c_int8_t), pointer :: original_header(:)
+    integer(c_int64_t), pointer :: int64s(:)
+    real(c_double), pointer :: doubles(:)
+
+    hd%n_vars = chd%n_vars
+    hd%n = chd%n
+    hd%n_tot = chd%n_tot
+    hd%span = chd%span
+    hd%z = chd%z
+    hd%omega_m = chd%omega_m
+    hd%omega_l = chd%omega_l
+    hd%h100 = chd%h100
+    hd%l = chd%l
+    hd%mass = chd%mass
+    hd%n_metadata = chd%n_metadata
+
+    allocate(hd%original_header(chd%original_header_length))
+    if (chd%original_header_length > 0) then
+       call c_f_pointer(chd%original_header, original_header, &
+            [chd%original_header_length])
+       hd%original_header = original_header
+    end if
+
+    call copy_strings(chd%names, chd%n_vars, hd%names)
+    call copy_strings(chd%types, chd%n_vars, hd%types)
+    call copy_strings(chd%methods, chd%n_vars, hd%methods)
+    call copy_strings(chd%units, chd%n_vars, hd%units)
+
+    allocate(hd%sizes(chd%n_vars), hd%deltas(chd%n_vars))
+    allocate(hd%periods(chd%n_vars))
+    if (chd%n_vars > 0) then
+       call c_f_pointer(chd%sizes, int64s, [chd%n_vars])
+       hd%sizes = int64s
+       call c_f_pointer(chd%deltas, doubles, [chd%n_vars])
+       hd%deltas = doubles
+       call c_f_pointer(chd%periods, doubles, [chd%n_vars])
+       hd%periods = doubles
+    end if
+
+    call copy_strings(chd%metadata_keys, chd%n_metadata, hd%metadata_keys)
+    call copy_strings(chd%metadata_types, chd%n_metadata, hd%metadata_types)
+    call copy_strings(chd%metadata_strings, chd%n_metadata, &
+         hd%metadata_strings)
+
+    allocate(hd%metadata_ints(chd%n_metadata))
+    allocate(hd%metadata_floats(chd%n_metadata))
+    if (chd%n_metadata > 0) then
+       call c_f_pointer(chd%metadata_ints, int64s, [chd%n_metadata])
+       hd%metadata_ints = int64s
+       call c_f_pointer(chd%metadata_floats, doubles, [chd%n_metadata])
+       hd%metadata_floats = doubles
+    end if
+  end subroutine copy_header
+
+  ! copy_strings copies an array of n C strings into a Fortran string array.
+  ! NULL strings become blank.
+  subroutine copy_strings(ptr, n, out)
+    type(c_ptr), intent(in) :: ptr
+    integer(c_int64_t), intent(in) :: n
+    character(len=:), allocatable, intent(out) :: out(:)
+
+    type(c_ptr), pointer :: ptrs(:)
+    integer(c_int64_t) :: i
+    integer :: width
+
+    if (n == 0) then
+       allocate(character(len=0) :: out(0))
+       return
+    end if
+
+    call c_f_pointer(ptr, ptrs, [n])
+    width = 0
+    do i = 1, n
+       width = max(width, len(c_to_f_string(ptrs(i))))
+    end do
+
+    allocate(character(len=width) :: out(n))
+    do i = 1, n
+       out(i) = c_to_f_string(ptrs(i))
+    end do
+  end subroutine copy_strings
+
+  ! c_to_f_string converts a C string to a Fortran string. NULL becomes "".
+  function c_to_f_string(ptr) result(s)
+    type(c_ptr), intent(in) :: ptr
+    character(len=:), allocatable :: s
+
+    character(kind=c_char), pointer :: chars(:)
+    integer :: i, n
+
+    if (.not. c_associated(ptr)) then
+       s = ""
+       return
+    end if
+
+    n = int(c_strlen(ptr))
+    call c_f_pointer(ptr, chars, [n])
+    allocate(character(len=n) :: s)
+    do i = 1, n
+       s(i:i) = chars(i)
+    end do
+  end function c_to_f_string
+
+  ! to_c_string converts a Fortran string to a null-terminated C string.
+  function to_c_string(s) result(out)
+    character(len=*), intent(in) :: s
+    character(kind=c_char, len=len_trim(s) + 1) :: out
+
+    out = trim(s) // c_null_char
+  end function to_c_string
+
+  ! error_message returns the most recent error message from the C library.
+  function error_message() result(msg)
+    character(len=:), allocatable :: msg
+
+    msg = c_to_f_string(c_guppy_error_message())
+  end function error_message
+
+  ! type_description describes the Fortran array that a Guppy_Type is read
+  ! into.
+  function type_description(typ) result(s)
+    integer(c_int), intent(in) :: typ
+    character(len=:), allocatable :: s
+
+    select case (typ)
+    case (GUPPY_TYPE_U32)
+       s = "an integer(c_int32_t) :: out(:) array"
+    case (GUPPY_TYPE_U64)
+       s = "an integer(c_int64_t) :: out(:) array"
+    case (GUPPY_TYPE_F32)
+       s = "a real(c_float) :: out(:) array"
+    case (GUPPY_TYPE_F64)
+       s = "a real(c_double) :: out(:) array"
+    case (GUPPY_TYPE_V32)
+       s = "a real(c_float) :: out(:,:) array"
+    case (GUPPY_TYPE_V64)
+       s = "a real(c_double) :: out(:,:) array"
+    case (GUPPY_TYPE_ROCKSTAR)
+       s = "a type(guppy_rockstar_particle) :: out(:) array"
+    case default
+       s = "an unknown type of array"
+    end select
+  end function type_description
+
+end module read_guppy
@@ -0,0 +1,110 @@
+! read_guppy_test reads a .gup file with the read_guppy module and prints the
+! first few values of each variable. It mirrors c/read_guppy_test.c. Pass the
+! name of a .gup file as the first argument to read a file other than the
+! default one.
+program read_guppy_test
+  use, intrinsic :: iso_c_binding
+  use read_guppy
+  implicit none
+
+  character(len=1024) :: file_name
+  character(len=1024) :: errmsg
+  type(guppy_header) :: hd
+  real(c_float), allocatable :: x(:,:), v(:,:), x0(:)
+  integer(c_int64_t), allocatable :: id(:)
+  integer(c_int32_t), allocatable :: id32(:)
+  type(guppy_rockstar_particle), allocatable :: rs(:)
+  integer :: i, stat
+
+  file_name = "../large_test_data/large_test.gup"
+  if (command_argument_count() > 0) call get_command_argument(1, file_name)
+
+  ! Errors are reported through stat instead of stopping the program.
+  call guppy_read_header("this_file_does_not_exist.gup", hd, stat, errmsg)
+  if (stat /= GUPPY_ERROR_OPEN) then
+     write(*, '(a,i0,a)') "Expected GUPPY_ERROR_OPEN when opening a " // &
+          "missing file, got ", stat, "."
+     error stop 1
+  end if
+  write(*, '(a)') "Opening a missing file: " // trim(errmsg)
+  write(*, *)
+
+  call guppy_read_header(file_name, hd)
+  call print_header(hd)
+
+  call guppy_init_workers(2)
+
+  call guppy_read_var(file_name, "x", x, 0)
+  call guppy_read_var(file_name, "v", v, 1)
+  call guppy_read_var(file_name, "x{0}", x0, 0)
+  call guppy_read_var(file_name, "id", id, 1)
+  call guppy_read_var(file_name, "{RockstarParticle}", rs, -2)
+
+  write(*, '(a)') "x:"
+  do i = 1, 5
+     write(*, '(4x,3f9.4)') x(:, i)
+  end do
+  write(*, '(a)') "v:"
+  do i = 1, 5
+     write(*, '(4x,3f11.4)') v(:, i)
+  end do
+  write(*, '(a)') "x0:"
+  write(*, '(4x,5f9.4)') x0(1:5)
+  write(*, '(a)') "id:"
+  write(*, '(4x,5(i0,1x))') id(1:5)
+  write(*, '(a)') "{RockstarParticle}:"
+  do i = 1, 5
+     write(*, '(4x,i0,3f9.4,3f11.4)') rs(i)%id, rs(i)%x, rs(i)%v
+  end do
+
+  ! IDs are 64-bit, so they can't be read into a 32-bit array.
+  call guppy_read_var(file_name, "id", id32, stat=stat, errmsg=errmsg)
+  if (stat /= GUPPY_ERROR_BUFFER) then
+     write(*, '(a,i0,a)') "Expected GUPPY_ERROR_BUFFER when reading into " // &
+          "the wrong kind of array, got ", stat, "."
+     error stop 1
+  end if
+  write(*, *)
+  write(*, '(a)') "Reading into the wrong kind of array: " // trim(errmsg)
+
+  call guppy_free_header(hd)
+
+contains
+
+  ! print_header prints some of the fields in a guppy_header.
+  subroutine print_header(hd)
+    type(guppy_header), intent(in) :: hd
+    integer :: i
+
+    write(*, '(a)') "Fields:"
+    do i = 1, int(hd%n_vars)
+       write(*, '(4x,a,": type = ",a,", method = ",a,", delta = ",g0,' // &
+            '", period = ",g0,", units = ''",a,"''")') trim(hd%names(i)), &
+            trim(hd%types(i)), trim(hd%methods(i)), hd%deltas(i), &
+            hd%periods(i), trim(hd%units(i))
+    end do
+    write(*, '(a,i0)') "N: ", hd%n
+    write(*, '(a,3(i0,1x))') "Span: ", hd%span
+    write(*, '(a,g0)') "Z: ", hd%z
+    write(*, '(a,g0)') "OmegaM: ", hd%omega_m
+    write(*, '(a,g0)') "L: ", hd%l
+    write(*, '(a,g0)') "H100: ", hd%h100
+    write(*, '(a,g0)') "Mass: ", hd%mass
+    write(*, '(a)') "Metadata:"
+    do i = 1, int(hd%n_metadata)
+       select case (trim(hd%metadata_types(i)))
+       case ("i64")
+          write(*, '(4x,a,": ",i0)') trim(hd%metadata_keys(i)), &
+               hd%metadata_ints(i)
+       case ("f64")
+          write(*, '(4x,a,": ",g0)') trim(hd%metadata_keys(i)), &
+               hd%metadata_floats(i)
+       case default
+          write(*, '(4x,a,": ''",a,"''")') trim(hd%metadata_keys(i)), &
+               trim(hd%metadata_strings(i))
+       end select
+    end do
+    write(*, *)
+  end subroutine print_header
+
+end program read_guppy_test
@@ -1,12 +1,15 @@
 module github.com/phil-mansfield/guppy
 
-go 1.16
+go 1.17
 
 require (
 	github.com/DataDog/zstd v1.4.8
 	github.com/phil-mansfield/gotetra v0.0.0-20200929220940-e55459c21bdf
 	github.com/phil-mansfield/gravitree v1.0.1
 	gonum.org/v1/gonum v0.9.3
+)
+
+require (
 	gopkg.in/gcfg.v1 v1.2.3 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
 )
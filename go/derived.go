@@ -0,0 +1,353 @@
+package read_guppy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+)
+
+// DerivedVar is a variable which isn't stored in .gup files but can be
+// computed from variables that are. Derived variables are read with ReadVar
+// like any other variable, and their names are surrounded by braces to
+// distinguish them from stored variables.
+type DerivedVar struct {
+	// Name is the name of the variable, e.g. "{Displacement}". Variables
+	// which take arguments are read with the arguments after a colon, e.g.
+	// "{RadialVelocity:50,50,50}".
+	Name string
+	// Description is a short description of the variable.
+	Description string
+	// NArgs is the number of floating point arguments the variable takes.
+	NArgs int
+	// Requires and RequiredTypes give the names and types of the stored
+	// variables needed to compute the variable.
+	Requires, RequiredTypes []string
+	// Type is the type of the buffer the variable is read into: "u32",
+	// "u64", "f32", "f64", "v32", "v64", or "{RockstarParticle}".
+	Type string
+	// Read computes the variable from the file opened by rd and writes it to
+	// buf. Its prerequisites and the type of buf have already been checked.
+	Read func(rd *compress.Reader, args []float64, buf interface{})
+}
+
+var (
+	derivedMutex = &sync.Mutex{ }
+	derivedVars = map[string]*DerivedVar{ }
+)
+
+var (
+	vecNames = []string{ "x{0}", "x{1}", "x{2}" }
+	velNames = []string{ "v{0}", "v{1}", "v{2}" }
+	f32Types = []string{ "f32", "f32", "f32" }
+)
+
+func init() {
+	RegisterDerivedVar(&DerivedVar{
+		"{RockstarParticle}",
+		"x, v, and id, packed into the particle struct used by Rockstar.",
+		0, append(append([]string{ "id" }, vecNames...), velNames...),
+		append([]string{ "u64" }, append(f32Types, f32Types...)...),
+		"{RockstarParticle}",
+		func(rd *compress.Reader, args []float64, buf interface{}) {
+			readRockstarParticle(rd, buf.([]RockstarParticle))
+		},
+	})
+
+	RegisterDerivedVar(&DerivedVar{
+		"{Displacement}",
+		"x minus the particle's Lagrangian position, wrapped into " +
+			"[-L/2, L/2).",
+		0, vecNames, f32Types, "v32", readDisplacement,
+	})
+
+	RegisterDerivedVar(&DerivedVar{
+		"{PeculiarVelocity}",
+		"The peculiar velocity in physical km/s, v*sqrt(a). This assumes v " +
+			"uses Gadget-2's velocity convention.",
+		0, velNames, f32Types, "v32", readPeculiarVelocity,
+	})
+
+	RegisterDerivedVar(&DerivedVar{
+		"{RadialVelocity}",
+		"The component of v pointing away from the point given by the " +
+			"three arguments, accounting for periodic boundaries.",
+		3, append(append([]string{ }, vecNames...), velNames...),
+		append(append([]string{ }, f32Types...), f32Types...),
+		"f32", readRadialVelocity,
+	})
+
+	RegisterDerivedVar(&DerivedVar{
+		"{Speed}", "The magnitude of v, |v|.",
+		0, velNames, f32Types, "f32", readSpeed,
+	})
+}
+
+// RegisterDerivedVar adds a derived variable to the registry used by ReadVar
+// and VarType. It panics if a variable with the same name already exists.
+func RegisterDerivedVar(v *DerivedVar) {
+	derivedMutex.Lock()
+	defer derivedMutex.Unlock()
+
+	if len(v.Name) < 2 || v.Name[0] != '{' || v.Name[len(v.Name)-1] != '}' {
+		panic(fmt.Sprintf("The derived variable '%s' must have a name " +
+			"surrounded by braces.", v.Name))
+	} else if _, ok := derivedVars[v.Name]; ok {
+		panic(fmt.Sprintf("The derived variable '%s' has already been " +
+			"registered.", v.Name))
+	} else if len(v.Requires) != len(v.RequiredTypes) {
+		panic(fmt.Sprintf("The derived variable '%s' has %d prerequisites, " +
+			"but %d prerequisite types.", v.Name, len(v.Requires),
+			len(v.RequiredTypes)))
+	}
+
+	derivedVars[v.Name] = v
+}
+
+// DerivedVars returns every registered derived variable, sorted by name.
+func DerivedVars() []*DerivedVar {
+	derivedMutex.Lock()
+	defer derivedMutex.Unlock()
+
+	out := []*DerivedVar{ }
+	for _, v := range derivedVars { out = append(out, v) }
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// LookupDerivedVar parses the name of a derived variable and returns the
+// variable and its arguments. v is nil if no derived variable has the name.
+// An error is returned if the arguments are invalid.
+func LookupDerivedVar(name string) (v *DerivedVar, args []float64, err error) {
+	if len(name) == 0 || name[0] != '{' || name[len(name)-1] != '}' {
+		return nil, nil, nil
+	}
+
+	base, argString := name, ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		base, argString = name[:i] + "}", name[i+1: len(name)-1]
+	}
+
+	derivedMutex.Lock()
+	v, ok := derivedVars[base]
+	derivedMutex.Unlock()
+	if !ok { return nil, nil, nil }
+
+	if argString != "" {
+		for _, tok := range strings.Split(argString, ",") {
+			x, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("The argument '%s' of '%s' isn't " +
+					"a number.", tok, name)
+			}
+			args = append(args, x)
+		}
+	}
+
+	if len(args) != v.NArgs {
+		return nil, nil, fmt.Errorf("'%s' takes %d arguments, but %d were " +
+			"given. Arguments are written after a colon, e.g. '%s'.",
+			name, v.NArgs, len(args), exampleName(v))
+	}
+
+	return v, args, nil
+}
+
+// exampleName returns an example of how to write the name of v with its
+// arguments.
+func exampleName(v *DerivedVar) string {
+	if v.NArgs == 0 { return v.Name }
+	args := make([]string, v.NArgs)
+	for i := range args { args[i] = "0" }
+	return v.Name[:len(v.Name)-1] + ":" + strings.Join(args, ",") + "}"
+}
+
+// missingPrerequisites returns the prerequisites of v which are missing from
+// a file, or which have the wrong type.
+func missingPrerequisites(v *DerivedVar, names, types []string) []string {
+	missing := []string{ }
+	for i := range v.Requires {
+		found := false
+		for j := range names {
+			if names[j] == v.Requires[i] && types[j] == v.RequiredTypes[i] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%s (%s)",
+				v.Requires[i], v.RequiredTypes[i]))
+		}
+	}
+	return missing
+}
+
+// VarType returns the type of the buffer that the variable name needs to be
+// read into: "u32", "u64", "f32", "f64", "v32", "v64", or
+// "{RockstarParticle}". This covers stored variables, vectors made from
+// "{0}", "{1}", and "{2}" components, and derived variables. An error is
+// returned if the variable can't be read from a file with the header hd.
+func VarType(hd *Header, name string) (string, error) {
+	v, _, err := LookupDerivedVar(name)
+	if err != nil {
+		return "", err
+	} else if v != nil {
+		missing := missingPrerequisites(v, hd.Names, hd.Types)
+		if len(missing) > 0 {
+			return "", fmt.Errorf("'%s' can't be read because the file " +
+				"doesn't contain the variables %s.", name,
+				strings.Join(missing, ", "))
+		}
+		return v.Type, nil
+	}
+
+	for i := range hd.Names {
+		if hd.Names[i] == name {
+			return hd.Types[i], nil
+		}
+		if name + "{0}" == hd.Names[i] {
+			switch hd.Types[i] {
+			case "f32": return "v32", nil
+			case "f64": return "v64", nil
+			default:
+				return "", fmt.Errorf("Impossible file configuration: the " +
+					"variable '%s' has type '%s'.", hd.Names[i], hd.Types[i])
+			}
+		}
+	}
+
+	derived := []string{ }
+	for _, v := range DerivedVars() { derived = append(derived, v.Name) }
+	return "", fmt.Errorf("The file does not have a variable named " +
+		"'%s'. It only has the variables %s, along with vectors made from " +
+		"'{0}', '{1}', and '{2}' components and the derived variables %s.",
+		name, hd.Names, derived)
+}
+
+// bufferType returns the type string of a buffer, or "" if it isn't a
+// supported buffer type.
+func bufferType(buf interface{}) string {
+	switch buf.(type) {
+	case []uint32: return "u32"
+	case []uint64: return "u64"
+	case []float32: return "f32"
+	case []float64: return "f64"
+	case [][3]float32: return "v32"
+	case [][3]float64: return "v64"
+	case []RockstarParticle: return "{RockstarParticle}"
+	}
+	return ""
+}
+
+// readDerivedVar checks the prerequisites of a derived variable and the type
+// of the buffer it's being read into, and then reads it.
+func readDerivedVar(
+	rd *compress.Reader, name string, v *DerivedVar, args []float64,
+	buf interface{},
+) {
+	missing := missingPrerequisites(v, rd.Names, rd.Types)
+	if len(missing) > 0 {
+		panic(fmt.Sprintf("'%s' can't be read because the file doesn't " +
+			"contain the variables %s.", name, strings.Join(missing, ", ")))
+	}
+	if typ := bufferType(buf); typ != v.Type {
+		panic(fmt.Sprintf("'%s' must be read into a buffer with type '%s', " +
+			"but the supplied buffer has type '%s'.", name, v.Type, typ))
+	}
+
+	v.Read(rd, args, buf)
+}
+
+// readDisplacement reads x - q, where q is each particle's Lagrangian
+// position.
+func readDisplacement(
+	rd *compress.Reader, args []float64, buf interface{},
+) {
+	x := buf.([][3]float32)
+	readVec32(rd, "x", x)
+
+	L := float32(rd.L)
+	dq := [3]float64{ }
+	for dim := 0; dim < 3; dim++ {
+		dq[dim] = rd.L / float64(rd.TotalSpan[dim])
+	}
+
+	for i := range x {
+		i64 := int64(i)
+		idx := [3]int64{
+			i64 % rd.Span[0],
+			(i64 / rd.Span[0]) % rd.Span[1],
+			i64 / (rd.Span[0]*rd.Span[1]),
+		}
+
+		for dim := 0; dim < 3; dim++ {
+			q := float32(float64(idx[dim] + rd.Offset[dim])*dq[dim])
+			x[i][dim] = periodicDelta(x[i][dim] - q, L)
+		}
+	}
+}
+
+// readPeculiarVelocity reads v*sqrt(a).
+func readPeculiarVelocity(
+	rd *compress.Reader, args []float64, buf interface{},
+) {
+	v := buf.([][3]float32)
+	readVec32(rd, "v", v)
+
+	scale := float32(math.Sqrt(1 / (1 + rd.Z)))
+	for i := range v {
+		for dim := 0; dim < 3; dim++ { v[i][dim] *= scale }
+	}
+}
+
+// readRadialVelocity reads the component of v pointing away from the point
+// given by args.
+func readRadialVelocity(
+	rd *compress.Reader, args []float64, buf interface{},
+) {
+	vr := buf.([]float32)
+	x, v := make([][3]float32, len(vr)), make([][3]float32, len(vr))
+	readVec32(rd, "x", x)
+	readVec32(rd, "v", v)
+
+	L := float32(rd.L)
+	for i := range vr {
+		r2, vDotR := float32(0), float32(0)
+		for dim := 0; dim < 3; dim++ {
+			dx := periodicDelta(x[i][dim] - float32(args[dim]), L)
+			r2 += dx*dx
+			vDotR += dx*v[i][dim]
+		}
+
+		if r2 == 0 {
+			vr[i] = 0
+		} else {
+			vr[i] = vDotR / float32(math.Sqrt(float64(r2)))
+		}
+	}
+}
+
+// readSpeed reads |v|.
+func readSpeed(rd *compress.Reader, args []float64, buf interface{}) {
+	speed := buf.([]float32)
+	v := make([][3]float32, len(speed))
+	readVec32(rd, "v", v)
+
+	for i := range speed {
+		v2 := v[i][0]*v[i][0] + v[i][1]*v[i][1] + v[i][2]*v[i][2]
+		speed[i] = float32(math.Sqrt(float64(v2)))
+	}
+}
+
+// periodicDelta wraps the difference between two positions into
+// [-L/2, L/2). If L isn't positive, dx is returned unchanged.
+func periodicDelta(dx, L float32) float32 {
+	if L <= 0 { return dx }
+	for dx >= L/2 { dx -= L }
+	for dx < -L/2 { dx += L }
+	return dx
+}
@@ -0,0 +1,172 @@
+package read_guppy
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+)
+
+func TestLookupDerivedVar(t *testing.T) {
+	tests := []struct{
+		name string
+		found, valid bool
+		args []float64
+	} {
+		{ "x", false, true, nil },
+		{ "{Foo}", false, true, nil },
+		{ "{Speed}", true, true, nil },
+		{ "{RadialVelocity:1, 2.5,-3}", true, true, []float64{ 1, 2.5, -3 } },
+		{ "{RadialVelocity}", true, false, nil },
+		{ "{RadialVelocity:1,2}", true, false, nil },
+		{ "{RadialVelocity:1,2,a}", true, false, nil },
+		{ "{Speed:1}", true, false, nil },
+	}
+
+	for i := range tests {
+		v, args, err := LookupDerivedVar(tests[i].name)
+		if (err == nil) != tests[i].valid {
+			t.Errorf("%d) Expected valid = %v for '%s', got error %v.",
+				i, tests[i].valid, tests[i].name, err)
+		} else if err == nil && (v != nil) != tests[i].found {
+			t.Errorf("%d) Expected found = %v for '%s'.",
+				i, tests[i].found, tests[i].name)
+		} else if err == nil && len(args) != len(tests[i].args) {
+			t.Errorf("%d) Expected args %g, got %g.", i, tests[i].args, args)
+		} else if err == nil {
+			for j := range args {
+				if args[j] != tests[i].args[j] {
+					t.Errorf("%d) Expected args %g, got %g.",
+						i, tests[i].args, args)
+				}
+			}
+		}
+	}
+}
+
+func TestDerivedVars(t *testing.T) {
+	n := 4*4*4
+	L := 100.0
+	x, v := make([][3]float32, n), make([][3]float32, n)
+	for i := range x {
+		for dim := 0; dim < 3; dim++ {
+			x[i][dim] = float32(L*rand.Float64())
+			v[i][dim] = 200*rand.Float32() - 100
+		}
+	}
+
+	fname := filepath.Join(t.TempDir(), "derived_test.gup")
+	writeTestFile(t, fname, binary.LittleEndian, x, v)
+	hd := ReadHeader(fname)
+
+	// Fresh workers dequantize floats identically, so derived variables can
+	// be compared against x and v directly.
+	xr, vr := make([][3]float32, n), make([][3]float32, n)
+	ReadVar(fname, "x", -1, xr)
+	ReadVar(fname, "v", -1, vr)
+
+	types := map[string]string{
+		"{Displacement}": "v32", "{PeculiarVelocity}": "v32",
+		"{RadialVelocity:10,20,30}": "f32", "{Speed}": "f32",
+		"{RockstarParticle}": "{RockstarParticle}", "x": "v32", "x{1}": "f32",
+		"id": "u64",
+	}
+	for name, exp := range types {
+		if typ, err := VarType(hd, name); err != nil {
+			t.Errorf("Couldn't get type of '%s': %s", name, err.Error())
+		} else if typ != exp {
+			t.Errorf("Expected '%s' to have type '%s', got '%s'.",
+				name, exp, typ)
+		}
+	}
+	if _, err := VarType(hd, "{Foo}"); err == nil {
+		t.Errorf("Expected error for unknown variable.")
+	}
+
+	disp := make([][3]float32, n)
+	pv := make([][3]float32, n)
+	radial := make([]float32, n)
+	speed := make([]float32, n)
+	ReadVar(fname, "{Displacement}", -1, disp)
+	ReadVar(fname, "{PeculiarVelocity}", -1, pv)
+	ReadVar(fname, "{RadialVelocity:10,20,30}", -1, radial)
+	ReadVar(fname, "{Speed}", -1, speed)
+
+	a := 1 / (1 + hd.Z)
+	center := [3]float64{ 10, 20, 30 }
+	for i := 0; i < n; i++ {
+		// writeTestFile uses Span = (4, 4, 4), Offset = (4, 0, 4), and
+		// TotalSpan = (8, 8, 8).
+		idx := [3]int{ i % 4 + 4, (i / 4) % 4, i / 16 + 4 }
+
+		r, r2, vDotR, v2 := [3]float64{ }, 0.0, 0.0, 0.0
+		for dim := 0; dim < 3; dim++ {
+			q := float64(idx[dim])*L/8
+			dq := math.Mod(float64(xr[i][dim]) - q + 1.5*L, L) - L/2
+			if math.Abs(dq - float64(disp[i][dim])) > 1e-3 {
+				t.Fatalf("Expected {Displacement}[%d] = %g, got %g.",
+					i, dq, disp[i][dim])
+			}
+
+			vPec := float64(vr[i][dim])*math.Sqrt(a)
+			if math.Abs(vPec - float64(pv[i][dim])) > 1e-3 {
+				t.Fatalf("Expected {PeculiarVelocity}[%d] = %g, got %g.",
+					i, vPec, pv[i])
+			}
+
+			r[dim] = math.Mod(float64(xr[i][dim]) - center[dim] + 1.5*L,
+				L) - L/2
+			r2 += r[dim]*r[dim]
+			vDotR += r[dim]*float64(vr[i][dim])
+			v2 += float64(vr[i][dim]*vr[i][dim])
+		}
+
+		// Derived variables are computed in single precision.
+		if exp := vDotR/math.Sqrt(r2); math.Abs(exp - float64(radial[i])) >
+			1e-2 {
+			t.Fatalf("Expected {RadialVelocity}[%d] = %g, got %g.",
+				i, exp, radial[i])
+		}
+		if exp := math.Sqrt(v2); math.Abs(exp - float64(speed[i])) > 1e-2 {
+			t.Fatalf("Expected {Speed}[%d] = %g, got %g.", i, exp, speed[i])
+		}
+	}
+}
+
+func TestRegisterDerivedVar(t *testing.T) {
+	RegisterDerivedVar(&DerivedVar{
+		"{TestVx}", "x{0}, read through the registry.", 0,
+		[]string{ "x{0}" }, []string{ "f32" }, "f32",
+		func(rd *compress.Reader, args []float64, buf interface{}) {
+			readFloat32(rd, "x{0}", buf.([]float32))
+		},
+	})
+
+	x := make([][3]float32, 64)
+	fname := filepath.Join(t.TempDir(), "register_test.gup")
+	writeTestFile(t, fname, binary.LittleEndian, x, x)
+
+	vx := make([]float32, 64)
+	ReadVar(fname, "{TestVx}", -1, vx)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected panic for a buffer with the wrong type.")
+			}
+		}()
+		ReadVar(fname, "{TestVx}", -1, make([]float64, 64))
+	}()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected panic for a duplicate registration.")
+			}
+		}()
+		RegisterDerivedVar(&DerivedVar{ Name: "{TestVx}" })
+	}()
+}
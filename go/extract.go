@@ -0,0 +1,234 @@
+package read_guppy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/phil-mansfield/guppy/lib"
+)
+
+// Locator maps particle IDs to the .gup files that contain them, so that
+// particles can be read by ID or by Lagrangian region without reading every
+// file in a snapshot. IDs follow the same convention as the "id" variable:
+// the particle at Lagrangian index (ix, iy, iz) has the ID
+// 1 + iz + iy*TotalSpan[2] + ix*TotalSpan[2]*TotalSpan[1].
+type Locator struct {
+	// FileNames and Headers give the names and headers of each file.
+	FileNames []string
+	Headers []*Header
+	// TotalSpan is the width of the simulation's Lagrangian grid in each
+	// dimension.
+	TotalSpan [3]int64
+
+	// edges[dim] are the sorted, unique file offsets in each dimension,
+	// and files maps a file's offset to its index.
+	edges [3][]int64
+	files map[[3]int64]int
+}
+
+// NewLocator reads the headers of a set of .gup files and returns a Locator
+// for them. The files must be from the same snapshot and must not overlap,
+// but they don't need to cover the whole simulation.
+func NewLocator(fileNames []string) *Locator {
+	if len(fileNames) == 0 {
+		panic("NewLocator was not given any files.")
+	}
+
+	loc := &Locator{
+		FileNames: fileNames, Headers: make([]*Header, len(fileNames)),
+		files: map[[3]int64]int{ },
+	}
+
+	for i := range fileNames {
+		hd := ReadHeader(fileNames[i])
+		loc.Headers[i] = hd
+
+		if i == 0 {
+			loc.TotalSpan = hd.TotalSpan
+		} else if hd.TotalSpan != loc.TotalSpan {
+			panic(fmt.Sprintf("%s has TotalSpan = %d, but %s has " +
+				"TotalSpan = %d. Files from different simulations can't be " +
+				"read together.", fileNames[i], hd.TotalSpan, fileNames[0],
+				loc.TotalSpan))
+		}
+
+		if j, ok := loc.files[hd.Offset]; ok {
+			panic(fmt.Sprintf("%s and %s both start at the Lagrangian " +
+				"index %d.", fileNames[j], fileNames[i], hd.Offset))
+		}
+		loc.files[hd.Offset] = i
+
+		for dim := 0; dim < 3; dim++ {
+			loc.edges[dim] = append(loc.edges[dim], hd.Offset[dim])
+		}
+	}
+
+	for dim := 0; dim < 3; dim++ {
+		loc.edges[dim] = uniqueInt64s(loc.edges[dim])
+	}
+
+	return loc
+}
+
+// uniqueInt64s sorts x and removes duplicate elements.
+func uniqueInt64s(x []int64) []int64 {
+	sort.Slice(x, func(i, j int) bool { return x[i] < x[j] })
+	out := x[:0]
+	for i := range x {
+		if i == 0 || x[i] != x[i-1] { out = append(out, x[i]) }
+	}
+	return out
+}
+
+// Locate returns the index of the file containing the particle with the
+// given ID and the index of the particle within that file. If none of the
+// files contain the particle, file is -1.
+func (loc *Locator) Locate(id uint64) (file int, index int64) {
+	nTot := loc.TotalSpan[0]*loc.TotalSpan[1]*loc.TotalSpan[2]
+	if id == 0 || int64(id) > nTot { return -1, -1 }
+
+	i := int64(id - 1)
+	idx := [3]int64{
+		i / (loc.TotalSpan[2]*loc.TotalSpan[1]),
+		(i / loc.TotalSpan[2]) % loc.TotalSpan[1],
+		i % loc.TotalSpan[2],
+	}
+
+	// Find the last file edge at or below the index in each dimension.
+	offset := [3]int64{ }
+	for dim := 0; dim < 3; dim++ {
+		edges := loc.edges[dim]
+		j := sort.Search(len(edges), func(j int) bool {
+			return edges[j] > idx[dim]
+		}) - 1
+		if j < 0 { return -1, -1 }
+		offset[dim] = edges[j]
+	}
+
+	file, ok := loc.files[offset]
+	if !ok { return -1, -1 }
+
+	span := loc.Headers[file].Span
+	local := [3]int64{ }
+	for dim := 0; dim < 3; dim++ {
+		local[dim] = idx[dim] - offset[dim]
+		if local[dim] >= span[dim] { return -1, -1 }
+	}
+
+	return file, local[0] + local[1]*span[0] + local[2]*span[0]*span[1]
+}
+
+// BoxIDs returns the IDs of the particles in the Lagrangian box
+// [lo[0], hi[0]) x [lo[1], hi[1]) x [lo[2], hi[2]). The box is periodic, so
+// lo may be negative and hi may be larger than TotalSpan, but hi - lo can't
+// be larger than TotalSpan. IDs are ordered with x changing fastest and z
+// changing slowest, the same order as particles within a .gup file.
+func (loc *Locator) BoxIDs(lo, hi [3]int64) []uint64 {
+	for dim := 0; dim < 3; dim++ {
+		if hi[dim] < lo[dim] || hi[dim] - lo[dim] > loc.TotalSpan[dim] {
+			panic(fmt.Sprintf("The Lagrangian box [%d, %d) is invalid for " +
+				"TotalSpan = %d.", lo, hi, loc.TotalSpan))
+		}
+	}
+
+	ts := loc.TotalSpan
+	ids := make([]uint64, 0, (hi[0] - lo[0])*(hi[1] - lo[1])*(hi[2] - lo[2]))
+	for iz := lo[2]; iz < hi[2]; iz++ {
+		for iy := lo[1]; iy < hi[1]; iy++ {
+			for ix := lo[0]; ix < hi[0]; ix++ {
+				jx := ((ix % ts[0]) + ts[0]) % ts[0]
+				jy := ((iy % ts[1]) + ts[1]) % ts[1]
+				jz := ((iz % ts[2]) + ts[2]) % ts[2]
+				ids = append(ids, uint64(1 + jz + jy*ts[2] + jx*ts[2]*ts[1]))
+			}
+		}
+	}
+
+	return ids
+}
+
+// ReadIDs reads the variable with the given name for the particles with the
+// given IDs and writes it to buf, which must have the same length as ids.
+// buf has the same types as in ReadVar, and workerID is used in the same
+// way. Only the files containing at least one of the IDs are read, and buf
+// is written in the same order as ids. ReadIDs panics if one of the IDs isn't
+// in any of the files.
+func (loc *Locator) ReadIDs(
+	name string, ids []uint64, workerID int, buf interface{},
+) {
+	if reflect.TypeOf(buf).Kind() != reflect.Slice {
+		panic(fmt.Sprintf("The buffer passed to ReadIDs has the type %T, " +
+			"which isn't a slice.", buf))
+	} else if n := reflect.ValueOf(buf).Len(); n != len(ids) {
+		panic(fmt.Sprintf("%d IDs were requested, but the buffer has " +
+			"length %d.", len(ids), n))
+	}
+
+	// Group the requested particles by file.
+	dst := make([][]int, len(loc.FileNames))
+	src := make([][]int64, len(loc.FileNames))
+	for i, id := range ids {
+		file, index := loc.Locate(id)
+		if file == -1 {
+			panic(fmt.Sprintf("The ID %d isn't in any of the %d files " +
+				"being read.", id, len(loc.FileNames)))
+		}
+		dst[file] = append(dst[file], i)
+		src[file] = append(src[file], index)
+	}
+
+	var fileBuf interface{}
+	for file := range loc.FileNames {
+		if len(dst[file]) == 0 { continue }
+
+		n := int(loc.Headers[file].N)
+		if fileBuf == nil || reflect.ValueOf(fileBuf).Len() != n {
+			fileBuf = reflect.MakeSlice(reflect.TypeOf(buf), n, n).Interface()
+		}
+
+		ReadVar(loc.FileNames[file], name, workerID, fileBuf)
+		gather(buf, fileBuf, dst[file], src[file])
+	}
+}
+
+// ReadBox reads the variable with the given name for the particles in the
+// Lagrangian box [lo, hi) and writes it to buf. The box and the order of
+// the particles are the same as in BoxIDs, and buf must have the same length
+// as the slice returned by BoxIDs.
+func (loc *Locator) ReadBox(
+	name string, lo, hi [3]int64, workerID int, buf interface{},
+) {
+	loc.ReadIDs(name, loc.BoxIDs(lo, hi), workerID, buf)
+}
+
+// gather sets buf[dst[i]] = fileBuf[src[i]] for each i.
+func gather(buf, fileBuf interface{}, dst []int, src []int64) {
+	switch x := buf.(type) {
+	case []uint32:
+		y := fileBuf.([]uint32)
+		for i := range dst { x[dst[i]] = y[src[i]] }
+	case []uint64:
+		y := fileBuf.([]uint64)
+		for i := range dst { x[dst[i]] = y[src[i]] }
+	case []float32:
+		y := fileBuf.([]float32)
+		for i := range dst { x[dst[i]] = y[src[i]] }
+	case []float64:
+		y := fileBuf.([]float64)
+		for i := range dst { x[dst[i]] = y[src[i]] }
+	case [][3]float32:
+		y := fileBuf.([][3]float32)
+		for i := range dst { x[dst[i]] = y[src[i]] }
+	case [][3]float64:
+		y := fileBuf.([][3]float64)
+		for i := range dst { x[dst[i]] = y[src[i]] }
+	case []lib.RockstarParticle:
+		y := fileBuf.([]lib.RockstarParticle)
+		for i := range dst { x[dst[i]] = y[src[i]] }
+	default:
+		panic("The buffer passed to ReadIDs is not [][3]float32, " +
+			"[][3]float64, []float32, []float64, []uint32, []uint64, or " +
+			"[]lib.RockstarParticle.")
+	}
+}
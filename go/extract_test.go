@@ -0,0 +1,135 @@
+package read_guppy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/particles"
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+// writeGridFiles splits a grid with the given total span into files with the
+// given span and writes them to dir. Each particle's "q" variable is its
+// Lagrangian index.
+func writeGridFiles(
+	t *testing.T, dir string, span, totalSpan [3]int64,
+) []string {
+	nTot := int(totalSpan[0]*totalSpan[1]*totalSpan[2])
+	n := int(span[0]*span[1]*span[2])
+	fakeFile, _ := snapio.NewFakeFile(
+		[]string{ "q" }, []interface{}{ []float32{ } }, nTot,
+		binary.LittleEndian,
+	)
+	fakeHd, _ := fakeFile.ReadHeader()
+
+	fileNames := []string{ }
+	for ox := int64(0); ox < totalSpan[0]; ox += span[0] {
+		for oy := int64(0); oy < totalSpan[1]; oy += span[1] {
+			for oz := int64(0); oz < totalSpan[2]; oz += span[2] {
+				fname := filepath.Join(dir,
+					fmt.Sprintf("grid.%d.gup", len(fileNames)))
+				wr := compress.NewWriter(fname, fakeHd, span,
+					[3]int64{ ox, oy, oz }, totalSpan, compress.NewBuffer(0),
+					[]byte{ }, binary.LittleEndian)
+
+				q := make([][]float32, 3)
+				for dim := range q { q[dim] = make([]float32, n) }
+				for i := 0; i < n; i++ {
+					q[0][i] = float32(ox + int64(i) % span[0])
+					q[1][i] = float32(oy + (int64(i) / span[0]) % span[1])
+					q[2][i] = float32(oz + int64(i) / (span[0]*span[1]))
+				}
+
+				for dim := 0; dim < 3; dim++ {
+					field := particles.NewFloat32(
+						fmt.Sprintf("q{%d}", dim), q[dim])
+					err := wr.AddField(field, compress.NewLagrangianDelta(
+						[3]int{ int(span[0]), int(span[1]), int(span[2]) },
+						1e-3, 0))
+					if err != nil { t.Fatalf(err.Error()) }
+				}
+				if _, err := wr.Flush(); err != nil { t.Fatalf(err.Error()) }
+
+				fileNames = append(fileNames, fname)
+			}
+		}
+	}
+
+	return fileNames
+}
+
+func TestLocator(t *testing.T) {
+	span, totalSpan := [3]int64{ 2, 3, 4 }, [3]int64{ 4, 6, 8 }
+	fileNames := writeGridFiles(t, t.TempDir(), span, totalSpan)
+	InitWorkers(1)
+
+	// Skip the first file so some IDs aren't contained.
+	loc := NewLocator(fileNames[1:])
+
+	// Check Locate against the IDs stored in each file.
+	for file := range loc.FileNames {
+		hd := loc.Headers[file]
+		id := make([]uint64, hd.N)
+		ReadVar(loc.FileNames[file], "id", 0, id)
+		for i := range id {
+			f, idx := loc.Locate(id[i])
+			if f != file || idx != int64(i) {
+				t.Fatalf("Expected ID %d to be at (%d, %d), got (%d, %d).",
+					id[i], file, i, f, idx)
+			}
+		}
+	}
+
+	// The first file has the box [0, 2) x [0, 3) x [0, 4).
+	if f, _ := loc.Locate(1); f != -1 {
+		t.Errorf("Expected ID 1 to be missing, but it was in file %d.", f)
+	}
+	if f, _ := loc.Locate(0); f != -1 {
+		t.Errorf("Expected ID 0 to be invalid, but it was in file %d.", f)
+	}
+
+	// This box wraps around the periodic boundaries in x and z.
+	lo, hi := [3]int64{ 3, 3, -1 }, [3]int64{ 5, 5, 2 }
+	ids := loc.BoxIDs(lo, hi)
+	if len(ids) != 2*2*3 {
+		t.Fatalf("Expected %d IDs, got %d.", 2*2*3, len(ids))
+	}
+
+	q := make([][3]float32, len(ids))
+	id := make([]uint64, len(ids))
+	loc.ReadBox("q", lo, hi, 0, q)
+	loc.ReadIDs("id", ids, 0, id)
+
+	i := 0
+	for iz := lo[2]; iz < hi[2]; iz++ {
+		for iy := lo[1]; iy < hi[1]; iy++ {
+			for ix := lo[0]; ix < hi[0]; ix++ {
+				exp := [3]float32{
+					float32((ix + 4) % 4), float32(iy), float32((iz + 8) % 8),
+				}
+				for dim := 0; dim < 3; dim++ {
+					if d := q[i][dim] - exp[dim]; d > 1e-3 || d < -1e-3 {
+						t.Fatalf("Expected particle %d to have q = %g, " +
+							"got %g.", i, exp, q[i])
+					}
+				}
+				if id[i] != ids[i] {
+					t.Fatalf("Expected particle %d to have ID %d, got %d.",
+						i, ids[i], id[i])
+				}
+				i++
+			}
+		}
+	}
+
+	// IDs can be requested in any order and repeated.
+	order := []uint64{ ids[5], ids[0], ids[5] }
+	q = make([][3]float32, len(order))
+	loc.ReadIDs("q", order, 0, q)
+	if d := q[1][2] - 7; q[0] != q[2] || d > 1e-3 || d < -1e-3 {
+		t.Errorf("Got q = %g for IDs %d.", q, order)
+	}
+}
@@ -36,6 +36,14 @@ type Header struct {
 	Names, Types []string
 	// Sizes gives the size of each variable in bytes.
 	Sizes []int64
+	// Methods gives the compression method used for each variable. Deltas
+	// gives the accuracy each variable is stored to: floating point values
+	// are within Deltas[i] of their original values. Periods gives the
+	// periodicity of each variable (non-positive if it isn't periodic) and
+	// Units gives the units of each variable. Integers, including "id", are
+	// stored exactly and have a Delta of 0.
+	Methods, Units []string
+	Deltas, Periods []float64
 	// N and NTot give the number of particles in the file and in the
 	// total simulation, respectively.
 	N, NTot int64
@@ -51,9 +59,18 @@ type Header struct {
 	// H0 / (100 km/s/Mpc), box width in comoving Mpc/h, and particle
 	// mass in Msun/h, respectively.
 	Z, OmegaM, OmegaL, H100, L, Mass float64
-
+	// Metadata contains typed key/value pairs describing the file (e.g.
+	// units, softening lengths, and the config used to create it). Use
+	// Metadata.Int(), Metadata.Float(), and Metadata.String() to look up
+	// values. It is empty for files written by older versions of guppy.
+	Metadata compress.Metadata
 }
 
+// RockstarParticle is a particle with the same layout as the particles used
+// internally by the Rockstar halo finder. It is identical to
+// lib.RockstarParticle.
+type RockstarParticle = lib.RockstarParticle
+
 // worker contains various buffers which prevent excess heap allocations
 // when reading the file.
 type worker struct {
@@ -92,6 +109,7 @@ func getWorker(workerID int) (*worker, int) {
 func finishWorker(workerIdx int) {
 	if workerIdx != -1 {
 		mutexes[workerIdx].Unlock()
+	}
 }
 
 // ReadHeader returns the header of a given file.
@@ -108,8 +126,10 @@ func ReadHeader(fileName string) *Header {
 	return &Header{
 		rhd.OriginalHeader,
 		rhd.Names, rhd.Types, rhd.Sizes,
+		rhd.Methods, rhd.Units, rhd.Deltas, rhd.Periods,
 		rhd.N, rhd.NTot, rhd.Span, rhd.Offset, rhd.TotalSpan,
 		rhd.Z, rhd.OmegaM, rhd.OmegaL, rhd.H100, rhd.L, rhd.Mass,
+		rhd.Metadata,
 	}
 }
 
@@ -135,17 +155,36 @@ func ReadHeader(fileName string) *Header {
 // []lib.RockstarParticle, the fields "x[0]", "x[1]", "x[2]" will be
 // read into the X field, "v[0]", "v[1]", and "v[2]" into the V field and "id"
 // into the ID field.
+//
+// Derived variables, like "{RockstarParticle}", are computed from the
+// variables stored in the file. See DerivedVars for the full list and
+// VarType for the type of buffer each one needs.
 func ReadVar(fileName, name string, workerID int, buf interface{}) {
 	//flag := string([]byte{fileName[len(fileName) - 5]})
 	// Allocated underlying buffers.
 	worker, workerIdx := getWorker(workerID)
+	// The worker is released even if reading panics so that callers which
+	// recover from the panic can keep using it.
+	defer finishWorker(workerIdx)
 	rd, err := compress.NewReader(fileName, worker.buf, worker.midBuf)
 	if err != nil {
 		panic(fmt.Sprintf("Guppy encountered an error while opening and " + 
 			"initializing the file: %s", err.Error()))
 	}
 
-	defer rd.Close()
+	defer func() {
+		rd.Close()
+		worker.midBuf = rd.ReuseMidBuf()
+	}()
+
+	// Handle derived variables.
+	v, args, err := LookupDerivedVar(name)
+	if err != nil {
+		panic(err.Error())
+	} else if v != nil {
+		readDerivedVar(rd, name, v, args, buf)
+		return
+	}
 
 	// Handle generic variables.
 	switch x := buf.(type) {
@@ -161,9 +200,6 @@ func ReadVar(fileName, name string, workerID int, buf interface{}) {
 			"[][3]float64, []float32, []float64, []uint32, []uint64, or " +
 			"[]lib.RockstarParticle.")
 	}
-
-	worker.midBuf = rd.ReuseMidBuf()
-	finishWorker(workerIdx)
 }
 
 func readRockstarParticle(
@@ -504,3 +540,10 @@ func InitWorkers(nWorkers int) {
 		mutexes[i] = &sync.Mutex{ }
 	}
 }
+
+// Workers returns the number of workers allocated by InitWorkers.
+func Workers() int {
+	setupMutex.Lock()
+	defer setupMutex.Unlock()
+	return len(workers)
+}
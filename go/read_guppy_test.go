@@ -1,8 +1,16 @@
 package read_guppy
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
 	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/particles"
+	"github.com/phil-mansfield/guppy/lib/snapio"
 )
 
 func TestEverything(t *testing.T) {
@@ -37,4 +45,108 @@ func TestEverything(t *testing.T) {
 		default: panic("Impossible")
 		}
 	}
-}
\ No newline at end of file
+}
+
+// writeTestFile writes a small .gup file with the given byte order containing
+// the vectors x and v.
+func writeTestFile(
+	t *testing.T, fname string, order binary.ByteOrder, x, v [][3]float32,
+) {
+	span := [3]int{ 4, 4, 4 }
+	span64 := [3]int64{ 4, 4, 4 }
+
+	fakeFile, _ := snapio.NewFakeFile(
+		[]string{"x", "v"}, []interface{}{[]float32{}, []float32{}},
+		1000, order,
+	)
+	fakeHd, _ := fakeFile.ReadHeader()
+
+	wr := compress.NewWriter(fname, fakeHd, span64, [3]int64{4, 0, 4},
+		[3]int64{8, 8, 8}, compress.NewBuffer(0), []byte{ }, order)
+	wr.Metadata.SetString("Simulation", "order_test")
+
+	vecs := map[string][][3]float32{ "x": x, "v": v }
+	for _, name := range []string{ "x", "v" } {
+		period := 0.0
+		if name == "x" { period = fakeHd.L() }
+
+		for dim := 0; dim < 3; dim++ {
+			comp := make([]float32, len(x))
+			for i := range comp { comp[i] = vecs[name][i][dim] }
+			field := particles.NewFloat32(fmt.Sprintf("%s{%d}", name, dim), comp)
+			err := wr.AddField(field,
+				compress.NewLagrangianDelta(span, 1e-3, period))
+			if err != nil { t.Fatalf("Error in AddField(): %s", err.Error()) }
+		}
+	}
+
+	if _, err := wr.Flush(); err != nil {
+		t.Fatalf("Error in Flush(): %s", err.Error())
+	}
+}
+
+func TestByteOrders(t *testing.T) {
+	n := 4*4*4
+	x, v := make([][3]float32, n), make([][3]float32, n)
+	for i := range x {
+		for dim := 0; dim < 3; dim++ {
+			x[i][dim] = 100*rand.Float32()
+			v[i][dim] = 200*rand.Float32() - 100
+		}
+	}
+
+	dir := t.TempDir()
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	xOut := make([][][3]float32, len(orders))
+	rsOut := make([][]RockstarParticle, len(orders))
+
+	InitWorkers(1)
+	for j, order := range orders {
+		fname := filepath.Join(dir, fmt.Sprintf("order_test.%d.gup", j))
+		writeTestFile(t, fname, order, x, v)
+
+		hd := ReadHeader(fname)
+		if hd.N != int64(n) {
+			t.Fatalf("%s) Expected N = %d, got %d.", order, n, hd.N)
+		} else if sim, _ := hd.Metadata.String("Simulation");
+			sim != "order_test" {
+			t.Errorf("%s) Read Simulation = '%s'.", order, sim)
+		}
+
+		xOut[j] = make([][3]float32, n)
+		v1 := make([]float32, n)
+		id := make([]uint64, n)
+		rsOut[j] = make([]RockstarParticle, n)
+
+		// Floats are dequantized with random noise from a fixed seed, so
+		// reads which need to give identical results, including the reads
+		// of both files compared below, need fresh workers.
+		ReadVar(fname, "x", -1, xOut[j])
+		ReadVar(fname, "v{1}", 0, v1)
+		ReadVar(fname, "id", -2, id)
+		ReadVar(fname, "{RockstarParticle}", -1, rsOut[j])
+
+		for i := 0; i < n; i++ {
+			for dim := 0; dim < 3; dim++ {
+				if math.Abs(float64(xOut[j][i][dim] - x[i][dim])) > 1e-3 {
+					t.Fatalf("%s) x[%d] = %g, but read %g.",
+						order, i, x[i], xOut[j][i])
+				}
+			}
+			if math.Abs(float64(v1[i] - v[i][1])) > 1e-3 {
+				t.Fatalf("%s) v{1}[%d] = %g, but read %g.",
+					order, i, v[i][1], v1[i])
+			} else if rsOut[j][i].ID != id[i] || rsOut[j][i].X != xOut[j][i] {
+				t.Fatalf("%s) {RockstarParticle} %d = %v, but x = %g and " +
+					"id = %d.", order, i, rsOut[j][i], xOut[j][i], id[i])
+			}
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if xOut[0][i] != xOut[1][i] || rsOut[0][i] != rsOut[1][i] {
+			t.Fatalf("Particle %d differs between byte orders: %v vs. %v.",
+				i, rsOut[0][i], rsOut[1][i])
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package read_guppy
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/phil-mansfield/guppy/lib"
+	"github.com/phil-mansfield/guppy/lib/thread"
+)
+
+// Simulation is a compressed simulation described by the index file that
+// guppy's write mode creates next to its outputs. It lets you find the files
+// in a snapshot without knowing how they were named.
+type Simulation struct {
+	// Index is the contents of the index file.
+	Index *lib.SimulationIndex
+	// Dir is the directory containing the index file. File names in the
+	// index are relative to it.
+	Dir string
+}
+
+// OpenSimulation reads the index file with the given name. If index is a
+// directory, the index file inside it is read. A directory which contains
+// the indices of several write jobs is ambiguous, so the name of the index
+// must be given instead.
+func OpenSimulation(index string) *Simulation {
+	if filepath.Ext(index) != ".json" { index = findIndex(index) }
+
+	idx, err := lib.ReadSimulationIndex(index)
+	if err != nil {
+		panic(fmt.Sprintf("Could not open the simulation index %s: %s",
+			index, err.Error()))
+	}
+
+	return &Simulation{ idx, filepath.Dir(index) }
+}
+
+// findIndex returns the name of the index file in dir. Indices written by
+// BuildSimulationIndex use lib.SimulationIndexName, and those written by
+// guppy's write mode use lib.SimulationIndexPattern.
+func findIndex(dir string) string {
+	index := filepath.Join(dir, lib.SimulationIndexName)
+	if _, err := os.Stat(index); err == nil { return index }
+
+	pattern := fmt.Sprintf(lib.SimulationIndexPattern, "*")
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil { panic(err.Error()) }
+
+	switch len(matches) {
+	case 0: return index
+	case 1: return matches[0]
+	}
+	panic(fmt.Sprintf("%s contains the simulation indices %s of several " +
+		"write jobs. Pass the name of one of them to OpenSimulation.",
+		dir, matches))
+}
+
+// Snapshots returns the snapshots in the simulation in increasing order.
+func (sim *Simulation) Snapshots() []int {
+	snaps := make([]int, len(sim.Index.Snapshots))
+	for i := range snaps {
+		snaps[i] = int(sim.Index.Snapshots[i].Snapshot)
+	}
+	return snaps
+}
+
+// Snapshot returns the index entry for a snapshot. It panics if the
+// snapshot isn't in the simulation.
+func (sim *Simulation) Snapshot(snap int) *lib.SnapshotIndex {
+	for i := range sim.Index.Snapshots {
+		if sim.Index.Snapshots[i].Snapshot == int64(snap) {
+			return &sim.Index.Snapshots[i]
+		}
+	}
+	panic(fmt.Sprintf("The simulation doesn't contain snapshot %d. It " +
+		"only contains the snapshots %v.", snap, sim.Snapshots()))
+}
+
+// ClosestSnapshot returns the snapshot whose redshift is closest to z.
+func (sim *Simulation) ClosestSnapshot(z float64) int {
+	if len(sim.Index.Snapshots) == 0 {
+		panic("The simulation doesn't contain any snapshots.")
+	}
+
+	best := sim.Index.Snapshots[0]
+	for _, snap := range sim.Index.Snapshots {
+		if math.Abs(snap.Z - z) < math.Abs(best.Z - z) { best = snap }
+	}
+	return int(best.Snapshot)
+}
+
+// FileNames returns the paths to the files in a snapshot.
+func (sim *Simulation) FileNames(snap int) []string {
+	files := sim.Snapshot(snap).Files
+	names := make([]string, len(files))
+	for i := range files {
+		names[i] = filepath.Join(sim.Dir, files[i].Name)
+	}
+	return names
+}
+
+// Locator returns a Locator for the files in a snapshot, which can be used
+// to read particles by ID or by Lagrangian region.
+func (sim *Simulation) Locator(snap int) *Locator {
+	return NewLocator(sim.FileNames(snap))
+}
+
+// FilesInBox returns the indices of the files in a snapshot whose particles
+// could be inside the box [lo, hi). The box is periodic, so lo may be
+// negative and hi may be larger than L. Files without bounds in the index
+// are always returned.
+func (sim *Simulation) FilesInBox(snap int, lo, hi [3]float32) []int {
+	L := float32(sim.Index.L)
+	out := []int{ }
+	for i, file := range sim.Snapshot(snap).Files {
+		if len(file.Bounds) != 6 {
+			out = append(out, i)
+			continue
+		}
+
+		overlaps := true
+		for dim := 0; dim < 3; dim++ {
+			if !periodicOverlap(file.Bounds[dim], file.Bounds[dim+3],
+				lo[dim], hi[dim], L) {
+				overlaps = false
+				break
+			}
+		}
+		if overlaps { out = append(out, i) }
+	}
+	return out
+}
+
+// periodicOverlap returns true if the particle bounds [lo1, hi1] and the
+// range [lo2, hi2) overlap in a periodic box of width L. lo1 must be in
+// [0, L).
+func periodicOverlap(lo1, hi1, lo2, hi2, L float32) bool {
+	if L <= 0 { return lo1 < hi2 && lo2 <= hi1 }
+	if hi2 - lo2 >= L || hi1 - lo1 >= L { return true }
+
+	shift := L*float32(math.Floor(float64(lo2 / L)))
+	lo2, hi2 = lo2 - shift, hi2 - shift
+
+	for k := float32(-1); k <= 1; k++ {
+		if lo1 + k*L < hi2 && lo2 <= hi1 + k*L { return true }
+	}
+	return false
+}
+
+// BuildSimulationIndex creates an index for a set of .gup files. snaps are
+// the snapshots, files[i] are the files in snaps[i], and dir is the
+// directory that the index will be written to. Every file is read to find
+// its periodic bounds and checksum, using the workers allocated by
+// InitWorkers if there are any.
+func BuildSimulationIndex(
+	snaps []int, files [][]string, dir string,
+) *lib.SimulationIndex {
+	idx := &lib.SimulationIndex{ Version: lib.IndexVersion }
+	idx.Snapshots = make([]lib.SnapshotIndex, len(snaps))
+
+	type job struct{ snap, file int }
+	jobs := []job{ }
+	for i := range snaps {
+		idx.Snapshots[i].Snapshot = int64(snaps[i])
+		idx.Snapshots[i].Files = make([]lib.FileIndex, len(files[i]))
+		for j := range files[i] { jobs = append(jobs, job{ i, j }) }
+	}
+
+	nWorkers, nThreads := Workers(), Workers()
+	if nThreads == 0 { nThreads = 1 }
+	errs := make([]interface{}, len(jobs))
+	thread.WorkerQueue(len(jobs), nThreads, func(worker, j int) {
+		defer func() { errs[j] = recover() }()
+
+		workerID := worker
+		if nWorkers == 0 { workerID = -1 }
+		snap, file := jobs[j].snap, jobs[j].file
+		idx.Snapshots[snap].Files[file] = indexFile(
+			files[snap][file], dir, workerID)
+	})
+
+	for _, err := range errs {
+		if err != nil { panic(err) }
+	}
+
+	for i := range snaps {
+		if len(files[i]) == 0 { continue }
+		hd := ReadHeader(files[i][0])
+		idx.Snapshots[i].Z = hd.Z
+
+		if i == 0 {
+			idx.NTot, idx.TotalSpan, idx.L = hd.NTot, hd.TotalSpan, hd.L
+			idx.OmegaM, idx.OmegaL = hd.OmegaM, hd.OmegaL
+			idx.H100, idx.Mass = hd.H100, hd.Mass
+		}
+	}
+
+	sort.SliceStable(idx.Snapshots, func(i, j int) bool {
+		return idx.Snapshots[i].Snapshot < idx.Snapshots[j].Snapshot
+	})
+
+	return idx
+}
+
+// indexFile creates the index entry for a single file.
+func indexFile(fname, dir string, workerID int) lib.FileIndex {
+	hd := ReadHeader(fname)
+
+	name, err := filepath.Rel(dir, fname)
+	if err != nil {
+		panic(fmt.Sprintf("%s can't be written relative to the index " +
+			"directory %s: %s", fname, dir, err.Error()))
+	}
+
+	file := lib.FileIndex{
+		Name: name, N: hd.N, Span: hd.Span, Offset: hd.Offset,
+	}
+
+	if typ, err := VarType(hd, "x"); err == nil && typ == "v32" {
+		x := make([][3]float32, hd.N)
+		ReadVar(fname, "x", workerID, x)
+		file.Bounds = PeriodicBounds(x, float32(hd.L))
+	}
+
+	file.Size, file.CRC32C, err = lib.FileChecksum(fname)
+	if err != nil {
+		panic(fmt.Sprintf("Could not compute the checksum of %s: %s",
+			fname, err.Error()))
+	}
+
+	return file
+}
@@ -0,0 +1,141 @@
+package read_guppy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib"
+)
+
+func TestSimulation(t *testing.T) {
+	dir := t.TempDir()
+	span, totalSpan := [3]int64{ 2, 2, 2 }, [3]int64{ 4, 2, 2 }
+	files := make([][]string, 2)
+	for i, sub := range []string{ "snap_5", "snap_2" } {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		files[i] = writeGridFiles(t, filepath.Join(dir, sub), span, totalSpan)
+	}
+
+	InitWorkers(2)
+	idx := BuildSimulationIndex([]int{ 5, 2 }, files, dir)
+	err := lib.WriteSimulationIndex(
+		filepath.Join(dir, lib.SimulationIndexName), idx)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	sim := OpenSimulation(dir)
+	if snaps := sim.Snapshots(); !reflect.DeepEqual(snaps, []int{ 2, 5 }) {
+		t.Fatalf("Expected Snapshots() = [2 5], got %d.", snaps)
+	}
+	if sim.Index.NTot != 16 || sim.Index.TotalSpan != totalSpan {
+		t.Errorf("Expected NTot = 16 and TotalSpan = %d, got %d and %d.",
+			totalSpan, sim.Index.NTot, sim.Index.TotalSpan)
+	}
+
+	if names := sim.FileNames(5); !reflect.DeepEqual(names, files[0]) {
+		t.Errorf("Expected FileNames(5) = %s, got %s.", files[0], names)
+	}
+	for i, file := range sim.Snapshot(2).Files {
+		if file.Name != filepath.Join("snap_2", filepath.Base(files[1][i])) {
+			t.Errorf("File %d has name %s in the index.", i, file.Name)
+		}
+		size, checksum, err := lib.FileChecksum(files[1][i])
+		if err != nil { t.Fatalf(err.Error()) }
+		if file.N != 8 || file.Span != span || file.Size != size ||
+			file.CRC32C != checksum {
+			t.Errorf("File %d has the wrong index entry: %v.", i, file)
+		}
+		if file.Offset != [3]int64{ 2*int64(i), 0, 0 } {
+			t.Errorf("Expected file %d to have Offset = [%d 0 0], got %d.",
+				i, 2*i, file.Offset)
+		}
+		if len(file.Bounds) != 0 {
+			t.Errorf("File %d has bounds %.3g without an x variable.",
+				i, file.Bounds)
+		}
+	}
+
+	loc := sim.Locator(2)
+	if f, _ := loc.Locate(3); f != 0 {
+		t.Errorf("Expected ID 3 to be in file 0, got %d.", f)
+	}
+
+	sim.Index.Snapshots[0].Z, sim.Index.Snapshots[1].Z = 2, 0.5
+	if snap := sim.ClosestSnapshot(1.5); snap != 2 {
+		t.Errorf("Expected ClosestSnapshot(1.5) = 2, got %d.", snap)
+	}
+	if snap := sim.ClosestSnapshot(0); snap != 5 {
+		t.Errorf("Expected ClosestSnapshot(0) = 5, got %d.", snap)
+	}
+}
+
+func TestOpenSimulationIndexNames(t *testing.T) {
+	dir := t.TempDir()
+	idx := &lib.SimulationIndex{ Version: lib.IndexVersion, L: 100 }
+	names := []string{
+		fmt.Sprintf(lib.SimulationIndexPattern, "0000abcd"),
+		fmt.Sprintf(lib.SimulationIndexPattern, "1234abcd"),
+	}
+
+	// A directory with one index written by guppy's write mode.
+	err := lib.WriteSimulationIndex(filepath.Join(dir, names[0]), idx)
+	if err != nil { t.Fatalf(err.Error()) }
+	if sim := OpenSimulation(dir); sim.Index.L != 100 {
+		t.Errorf("Expected OpenSimulation(%s) to read %s.", dir, names[0])
+	}
+
+	// Two write jobs in the same directory need the file to be named.
+	err = lib.WriteSimulationIndex(filepath.Join(dir, names[1]), idx)
+	if err != nil { t.Fatalf(err.Error()) }
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected OpenSimulation(%s) to panic when it " +
+					"contains several indices.", dir)
+			}
+		}()
+		OpenSimulation(dir)
+	}()
+	if sim := OpenSimulation(filepath.Join(dir, names[1])); sim.Dir != dir {
+		t.Errorf("Expected Dir = %s, got %s.", dir, sim.Dir)
+	}
+}
+
+func TestFilesInBox(t *testing.T) {
+	sim := &Simulation{ Index: &lib.SimulationIndex{ L: 100 } }
+	files := []lib.FileIndex{
+		{ Bounds: []float32{ 10, 10, 10, 20, 20, 20 } },
+		{ Bounds: []float32{ 90, 10, 10, 105, 20, 20 } },
+		{ Bounds: []float32{ 50, 50, 50, 60, 60, 60 } },
+		{ },
+	}
+	sim.Index.Snapshots = []lib.SnapshotIndex{ { Snapshot: 0, Files: files } }
+
+	tests := []struct{
+		lo, hi [3]float32
+		exp []int
+	} {
+		{ [3]float32{ 0, 0, 0 }, [3]float32{ 100, 100, 100 },
+			[]int{ 0, 1, 2, 3 } },
+		{ [3]float32{ 15, 15, 15 }, [3]float32{ 16, 16, 16 }, []int{ 0, 3 } },
+		{ [3]float32{ 0, 15, 15 }, [3]float32{ 3, 16, 16 }, []int{ 1, 3 } },
+		{ [3]float32{ -15, 15, 15 }, [3]float32{ 12, 16, 16 },
+			[]int{ 0, 1, 3 } },
+		{ [3]float32{ 115, 15, 15 }, [3]float32{ 116, 16, 16 },
+			[]int{ 0, 3 } },
+		{ [3]float32{ 30, 30, 30 }, [3]float32{ 40, 40, 40 }, []int{ 3 } },
+		{ [3]float32{ 55, 15, 55 }, [3]float32{ 56, 16, 56 }, []int{ 3 } },
+	}
+
+	for i := range tests {
+		out := sim.FilesInBox(0, tests[i].lo, tests[i].hi)
+		if !reflect.DeepEqual(out, tests[i].exp) {
+			t.Errorf("%d) Expected FilesInBox(%.3g, %.3g) = %d, got %d.",
+				i, tests[i].lo, tests[i].hi, tests[i].exp, out)
+		}
+	}
+}
@@ -3,12 +3,22 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
-	"encoding/binary"
+	"time"
 	
 	read_guppy "github.com/phil-mansfield/guppy/go"
 	"github.com/phil-mansfield/guppy/lib"
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/export"
+	"github.com/phil-mansfield/guppy/lib/format"
+	"github.com/phil-mansfield/guppy/lib/logging"
 	"github.com/phil-mansfield/guppy/lib/particles"
 	"github.com/phil-mansfield/guppy/lib/snapio"
 	"github.com/phil-mansfield/guppy/lib/thread"
@@ -23,6 +33,10 @@ func main() {
 	switch mode {
 	case "read": Read(flags)
 	case "write": Write(flags)
+	case "verify": Verify(flags)
+	case "confirm": Confirm(flags)
+	case "estimate": Estimate(flags)
+	case "convert": Convert(flags)
 	default:
 		ModeError()
 	}
@@ -35,6 +49,14 @@ Valid modes are:
             read - reads particles from a file and writes them to stdout.
            write - convert files that are on disk into .gup files according to
                    some config file.
+          verify - checks .gup files (or whole directories of them) for
+                   corrupted or incomplete data.
+         confirm - checks that the .gup files created by a config file match
+                   the original snapshots to within the requested accuracies.
+        estimate - predicts the size of the .gup files a config file will
+                   create and the time and memory needed to write them.
+         convert - converts .gup files back into Gadget-2 or LGadget-2
+                   snapshots according to some config file.
 Run "./guppy <mode_name> --help to print help information about what flags a
 particular mode takes.%s`, "\n")
 	os.Exit(1)
@@ -44,10 +66,42 @@ func Read(flags []string) {
 	set := flag.NewFlagSet("read", flag.ContinueOnError)
 	filePtr := set.String("file", "",
 		"The name of the guppy file to read.")
+	filesPtr := set.String("files", "",
+		"A pattern giving the names of several guppy files to read, e.g. " +
+		"'snap_{%03d,snapshot}.{%d,0..63}.gup'. The particles in all the " +
+		"files are concatenated. Can't be used with 'file'.")
+	snapPtr := set.Int("snapshot", 0,
+		"The value of the 'snapshot' variable in the 'files' pattern.")
 	varStringPtr := set.String("vars", "",
 		"The name of the variables that will be read. Should be a comma-separated list.")
+	formatPtr := set.String("format", "pipe",
+		"The output format. 'pipe' writes a binary stream to stdout, and " +
+		"'hdf5', 'npy', 'npz', and 'csv' write files that can be read " +
+		"without guppy.")
+	outPtr := set.String("out", "",
+		"The output file. For 'npy', this is a directory containing one " +
+		".npy file per variable. 'csv' writes to stdout if this isn't set.")
+	workersPtr := set.Int("workers", 1,
+		"The number of files which are decoded in parallel.")
+	everyPtr := set.Int64("every", 1,
+		"Only read every N-th particle in each file.")
+	fractionPtr := set.Float64("fraction", 1,
+		"Only read a random fraction of the particles in each file. The " +
+		"same particles are selected for every variable.")
+	seedPtr := set.Int64("seed", 0,
+		"The random seed used by 'fraction'. Reads with the same seed " +
+		"select the same particles.")
+	logPtr := set.String("log", "", "If set, the time and size of each " +
+		"file read is logged to stderr in this format, 'text' or 'json'.")
+	progressPtr := set.Duration("progress", 0, "If set, a progress line " +
+		"with the fraction of files read and an ETA is logged this often, " +
+		"e.g. --progress 10s. Needs 'log' to be set.")
 	err := set.Parse(flags)
-	file, varString := *filePtr, *varStringPtr
+	file, files, snap, varString := *filePtr, *filesPtr, *snapPtr, *varStringPtr
+	format, out, workers := *formatPtr, *outPtr, *workersPtr
+	sub := &lib.Subsample{
+		Every: *everyPtr, Fraction: *fractionPtr, Seed: *seedPtr,
+	}
 	vars := SplitCommaList(varString)
 	
 	if err != nil {
@@ -55,20 +109,150 @@ func Read(flags []string) {
 		os.Exit(1)
 	}
 
-	hd, err := ReadHeader(file, vars)
+	if err = CheckExportFlags(format, out, vars); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	} else if err = sub.Check(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	} else if workers < 1 {
+		fmt.Fprintf(os.Stderr, "'workers' is set to %d, but it must be at " +
+			"least 1.\n", workers)
+		os.Exit(1)
+	}
+
+	log, err := NewLogger(*logPtr, "read")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		os.Exit(1)
 	}
-	
-	err = PipeDataToStdout(file, hd, vars)
+
+	fileNames, err := ReadFileNames(file, files, snap)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	hds := make([]*read_guppy.Header, len(fileNames))
+	for i := range fileNames {
+		hds[i], err = ReadHeader(fileNames[i], vars)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err = CheckHeaders(fileNames, hds, vars); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// Each variable in each file is one job.
+	prog := logging.NewProgress(log, len(vars)*len(fileNames))
+	rd := &MultiFileReader{ fileNames, hds, sub, workers, prog }
+	prog.Start(*progressPtr)
+	if format == "pipe" {
+		err = PipeDataToStdout(rd, vars)
+	} else {
+		err = ExportData(rd, vars, format, out)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	prog.Stop()
+}
+
+// CheckExportFlags checks that the --format and --out flags passed to read
+// mode are consistent with one another and with the requested variables.
+func CheckExportFlags(format, out string, vars []string) error {
+	switch format {
+	case "pipe", "csv":
+	case "hdf5", "npy", "npz":
+		if out == "" {
+			return fmt.Errorf("Must set the 'out' flag to read variables " +
+				"with --format=%s. Call 'guppy read --help' for flag " +
+				"descriptions.", format)
+		}
+	default:
+		return fmt.Errorf("The 'format' flag was set to '%s', but the only " +
+			"supported formats are 'pipe', 'hdf5', 'npy', 'npz', and 'csv'.",
+			format)
+	}
+
+	if format == "pipe" { return nil }
+	for _, v := range vars {
+		dv, _, _ := read_guppy.LookupDerivedVar(v)
+		if dv != nil && dv.Type == "{RockstarParticle}" {
+			return fmt.Errorf("'%s' can only be read with --format=pipe. " +
+				"Read 'x' and 'v' instead.", v)
+		}
 	}
+
+	return nil
 }
 
+// ReadFileNames returns the names of the files read by read mode. Exactly one
+// of file and files must be set, and files is expanded as a format pattern
+// with the given snapshot.
+func ReadFileNames(file, files string, snap int) ([]string, error) {
+	if file != "" && files != "" {
+		return nil, fmt.Errorf("Only one of the 'file' and 'files' flags " +
+			"can be set.")
+	} else if file != "" {
+		return []string{ file }, nil
+	} else if files == "" {
+		return nil, fmt.Errorf("Must set the 'file' or 'files' flag to run " +
+			"guppy in read mode. Call 'guppy read --help' for flag " +
+			"descriptions.")
+	}
+
+	fileNames, err := format.ExpandFormatString(
+		files, map[string]int{ "snapshot": snap })
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the 'files' flag, '%s': %s",
+			files, err.Error())
+	}
+	return fileNames, nil
+}
+
+// CheckHeaders returns an error if the requested variables don't have the
+// same types in every file.
+func CheckHeaders(
+	fileNames []string, hds []*read_guppy.Header, vars []string,
+) error {
+	for i := 1; i < len(hds); i++ {
+		for _, v := range vars {
+			t0 := fmt.Sprintf("%T", AllocateBuffer(v, hds[0], 0))
+			ti := fmt.Sprintf("%T", AllocateBuffer(v, hds[i], 0))
+			if t0 != ti {
+				return fmt.Errorf("The variable '%s' has the type %s in %s " +
+					"but has the type %s in %s.", v, t0, fileNames[0],
+					ti, fileNames[i])
+			}
+		}
+	}
+	return nil
+}
+
+// SplitCommaList splits a comma-separated list of variables. Commas inside
+// braces, like the arguments of "{RadialVelocity:50,50,50}", don't split the
+// list.
 func SplitCommaList(vars string) []string {
-	tokens := strings.Split(vars, ",")
+	tokens, depth, start := []string{ }, 0, 0
+	for i, c := range vars {
+		switch c {
+		case '{': depth++
+		case '}': depth--
+		case ',':
+			if depth == 0 {
+				tokens = append(tokens, vars[start:i])
+				start = i + 1
+			}
+		}
+	}
+	tokens = append(tokens, vars[start:])
+
 	for i := range tokens {
 		tokens[i] = strings.Trim(tokens[i], " ")
 	}
@@ -83,10 +267,7 @@ func SplitCommaList(vars string) []string {
 
 func ReadHeader(file string, vars []string) (
 	hd *read_guppy.Header, err error) {
-	if file == "" {
-		return nil, fmt.Errorf("Must set the 'file' flag to run guppy in " +
-			"read mode. Call 'guppy read --help' for flag descriptions.")
-	} else if len(vars) == 0 {
+	if len(vars) == 0 {
 		return nil, fmt.Errorf("Must set the 'vars' flag to run guppy in " +
 			"read mode. Call 'guppy read --help' for flag descriptions.")
 	}
@@ -117,13 +298,10 @@ func ReadHeader(file string, vars []string) (
 	hd = read_guppy.ReadHeader(file)
 
 	for i, v := range vars {
-		if !IsValidVar(v, hd) {
-			return nil, fmt.Errorf("The %s requested variable, '%s', is not " +
-				"in the guppy file %s. This file can only read the " +
-				"variables %s, as well as derived variables, like " +
-				"'{RockstarParticle}', if the prerequisite variables exist " +
-				"in the file.", OrderString(i+1), v,
-				file, ArrayToCommaList(hd.Names))
+		if _, err := read_guppy.VarType(hd, v); err != nil {
+			return nil, fmt.Errorf("The %s requested variable, '%s', can't " +
+				"be read from the guppy file %s: %s", OrderString(i+1), v,
+				file, err.Error())
 		}
 	}
 
@@ -131,25 +309,8 @@ func ReadHeader(file string, vars []string) (
 }
 
 func IsValidVar(v string, hd *read_guppy.Header) bool {
-	hasV, hasX := false, false
-	for i := range hd.Names {
-		if hd.Names[i] == "x{0}" { hasX = true }
-		if hd.Names[i] == "v{0}" { hasV = true }
-	}
-
-	if hasV && hasX && v == "{RockstarParticle}" { return true }
-
-	for i := range hd.Names {
-		if v == hd.Names[i] {
-			return true
-		}
-		j := strings.Index(hd.Names[i], "{0}")
-		if j >= 0 && hd.Names[i][:j] == v {
-			return true
-		}
-	}
-
-	return false
+	_, err := read_guppy.VarType(hd, v)
+	return err == nil
 }
 
 func OrderString(n int) string {
@@ -165,10 +326,101 @@ func ArrayToCommaList(x []string) string {
 	return strings.Join(x, ", ")
 }
 
-func PipeDataToStdout(
-	file string, hd *read_guppy.Header, vars []string,
+// MultiFileReader reads variables from a sequence of .gup files and
+// concatenates them. Workers files are decoded in parallel, and only the
+// particles selected by Subsample are kept. Each variable read from each
+// file is logged to Progress as one job.
+type MultiFileReader struct {
+	FileNames []string
+	Headers []*read_guppy.Header
+	Subsample *lib.Subsample
+	Workers int
+	Progress *logging.Progress
+}
+
+// Header returns a header describing the concatenated files. N is the number
+// of particles after subsampling, and Span and Offset give the smallest
+// region of ID space which contains all the files. Everything else is taken
+// from the first file.
+func (rd *MultiFileReader) Header() *read_guppy.Header {
+	hd := *rd.Headers[0]
+	hd.N = 0
+	end := [3]int64{ }
+	for i, hdi := range rd.Headers {
+		hd.N += rd.Subsample.Len(i, hdi.N)
+		for dim := 0; dim < 3; dim++ {
+			if hdi.Offset[dim] < hd.Offset[dim] {
+				hd.Offset[dim] = hdi.Offset[dim]
+			}
+			if e := hdi.Offset[dim] + hdi.Span[dim]; e > end[dim] {
+				end[dim] = e
+			}
+		}
+	}
+	for dim := 0; dim < 3; dim++ { hd.Span[dim] = end[dim] - hd.Offset[dim] }
+
+	return &hd
+}
+
+// ReadVar reads the variable v from each file in order and passes the
+// selected particles to the function write.
+func (rd *MultiFileReader) ReadVar(
+	v string, write func(buf interface{}) error,
+) error {
+	read_guppy.InitWorkers(rd.Workers)
+	bufs := make([]interface{}, rd.Workers)
+	errs := make([]error, rd.Workers)
+	stats := make([]logging.FileStats, rd.Workers)
+
+	for start := 0; start < len(rd.FileNames); start += rd.Workers {
+		end := start + rd.Workers
+		if end > len(rd.FileNames) { end = len(rd.FileNames) }
+
+		// Every file in the batch is decoded at once, so each job can use
+		// its own buffers and read_guppy worker.
+		read := func(_, worker int) {
+			i := start + worker
+			n := rd.Headers[i].N
+			if bufs[worker] == nil || BufferLen(bufs[worker]) < n {
+				bufs[worker] = AllocateBuffer(v, rd.Headers[i], n)
+			}
+			buf := SliceBuffer(bufs[worker], n)
+
+			t0 := time.Now()
+			errs[worker] = ReadVarError(rd.FileNames[i], v, worker, buf)
+			stats[worker] = logging.FileStats{
+				File: rd.FileNames[i], ReadTime: time.Since(t0),
+				BytesIn: VarBytes(rd.Headers[i], v),
+				BytesOut: BufferBytes(buf), Decompressed: true,
+			}
+
+			idx := rd.Subsample.Indices(i, n)
+			bufs[worker] = lib.SubsampleBuffer(buf, idx)
+		}
+		jobs := end - start
+		thread.CountedWorkerQueue(rd.Progress.Counter, jobs, jobs, read)
+
+		for worker := 0; worker < end - start; worker++ {
+			if errs[worker] != nil { return errs[worker] }
+			t0 := time.Now()
+			if err := write(bufs[worker]); err != nil { return err }
+			stats[worker].WriteTime = time.Since(t0)
+			rd.Progress.File(&stats[worker], "var", v)
+
+			// Subsampling shrinks the buffer, so restore its full length.
+			bufs[worker] = SliceBuffer(bufs[worker],
+				rd.Headers[start + worker].N)
+		}
+	}
+
+	return nil
+}
+
+// ReadVarError calls read_guppy.ReadVar and converts its panics into errors.
+func ReadVarError(
+	file, v string, worker int, buf interface{},
 ) (err error) {
-	// As state above: read_guppy.go panics instead of returning errors to
+	// As stated above: read_guppy.go panics instead of returning errors to
 	// make C-users' lives easier. We need to convert those back into
 	// errors with this defer + recover().
 	defer func() {
@@ -178,21 +430,25 @@ func PipeDataToStdout(
 				panic(fmt.Sprintf("Internal error: read_guppy panicked " +
 					"with something other than a string: %v", panicData))
 			}
-			err = fmt.Errorf(panicMsg)
+			err = fmt.Errorf("Could not read '%s' from %s: %s",
+				v, file, panicMsg)
 		}
 	}()
 
+	read_guppy.ReadVar(file, v, worker, buf)
+	return nil
+}
 
-	read_guppy.InitWorkers(1)
-	err = WriteHeader(hd, os.Stdout)
+func PipeDataToStdout(rd *MultiFileReader, vars []string) error {
+	err := WriteHeader(rd.Header(), os.Stdout)
 	if err != nil {
 		return fmt.Errorf("Could not write header: %s", err.Error())
 	}
 
 	for i := range vars {
-		buf := AllocateBuffer(vars[i], hd)
-		read_guppy.ReadVar(file, vars[i], 0, buf)
-		err = lib.WriteAsBytes(os.Stdout, buf)
+		err = rd.ReadVar(vars[i], func(buf interface{}) error {
+			return lib.WriteAsBytes(os.Stdout, buf)
+		})
 		if err != nil {
 			return fmt.Errorf("Could not write %s: %s", vars[i], err.Error())
 		}
@@ -201,51 +457,189 @@ func PipeDataToStdout(
 	return nil
 }
 
-func AllocateBuffer(v string, hd *read_guppy.Header) interface{} {
-	typeString := ""	
+// ExportData reads vars from a set of .gup files and writes them, along with
+// the combined header, to out in the given export format.
+func ExportData(
+	rd *MultiFileReader, vars []string, format, out string,
+) (err error) {
+	hd := rd.Header()
+	f := ExportHeader(hd)
+	if len(rd.FileNames) > 1 {
+		f.Attributes = append(f.Attributes, export.Attribute{
+			Name: "Files", Value: int64(len(rd.FileNames)),
+		})
+	}
+
+	for i := range vars {
+		data := AllocateBuffer(vars[i], hd, hd.N)
+		n := int64(0)
+		err = rd.ReadVar(vars[i], func(buf interface{}) error {
+			m := BufferLen(buf)
+			dst := reflect.ValueOf(data).Slice(int(n), int(n + m))
+			reflect.Copy(dst, reflect.ValueOf(buf))
+			n += m
+			return nil
+		})
+		if err != nil { return err }
+
+		f.Variables = append(f.Variables, export.Variable{
+			Name: vars[i], Data: data,
+			Attributes: ExportVarAttributes(vars[i], hd),
+		})
+	}
+
+	switch format {
+	case "hdf5": err = export.WriteHDF5(out, f)
+	case "npy": err = export.WriteNpyDir(out, f)
+	case "npz": err = export.WriteNpz(out, f)
+	case "csv":
+		if out == "" {
+			err = export.WriteCSV(os.Stdout, f)
+		} else {
+			var fp *os.File
+			if fp, err = os.Create(out); err != nil { return err }
+			err = export.WriteCSV(fp, f)
+			if closeErr := fp.Close(); err == nil { err = closeErr }
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("Could not write %s output: %s", format, err.Error())
+	}
+	return nil
+}
+
+// ExportHeader converts a .gup header into the attributes and metadata of an
+// exported file.
+func ExportHeader(hd *read_guppy.Header) *export.File {
+	names := []string{
+		"N", "NTot", "Span", "Offset", "TotalSpan", "Z", "OmegaM", "OmegaL",
+		"H100", "L", "Mass", "OriginalHeader",
+	}
+	values := []interface{}{
+		hd.N, hd.NTot, hd.Span[:], hd.Offset[:], hd.TotalSpan[:], hd.Z,
+		hd.OmegaM, hd.OmegaL, hd.H100, hd.L, hd.Mass, hd.OriginalHeader,
+	}
+	attrs := make([]export.Attribute, len(names))
+	for i := range names {
+		attrs[i] = export.Attribute{ Name: names[i], Value: values[i] }
+	}
+
+	metadata := make([]export.Attribute, len(hd.Metadata))
+	for i, e := range hd.Metadata {
+		metadata[i] = export.Attribute{ Name: e.Key, Value: e.Value }
+	}
+
+	return &export.File{ Attributes: attrs, Metadata: metadata }
+}
+
+// ExportVarAttributes returns the attributes describing the variable v. For
+// vectors, these are taken from the vector's first component.
+func ExportVarAttributes(
+	v string, hd *read_guppy.Header,
+) []export.Attribute {
 	for i := range hd.Names {
-		if v == hd.Names[i] {
-			typeString = hd.Types[i]
-			break
+		typ := hd.Types[i]
+		if hd.Names[i] == v + "{0}" {
+			typ = "v" + typ[1:]
+		} else if hd.Names[i] != v {
+			continue
 		}
-		j := strings.Index(hd.Names[i], "{0}")
-		if j >= 0 && v == hd.Names[i][:j] {
-			typeString = "v" + hd.Types[i][1:]
-			break
+
+		return []export.Attribute{
+			{ Name: "Type", Value: typ },
+			{ Name: "Method", Value: hd.Methods[i] },
+			{ Name: "Units", Value: hd.Units[i] },
+			{ Name: "Accuracy", Value: hd.Deltas[i] },
+			{ Name: "Period", Value: hd.Periods[i] },
 		}
 	}
-	if v == "{RockstarParticle}" {
-		typeString = "{RockstarParticle}"
+
+	// Derived variables
+	v0, _, _ := read_guppy.LookupDerivedVar(v)
+	if v0 == nil { return nil }
+	return []export.Attribute{
+		{ Name: "Type", Value: v0.Type },
+		{ Name: "Description", Value: v0.Description },
+	}
+}
+
+// AllocateBuffer allocates a buffer with length n which can hold the variable
+// v.
+func AllocateBuffer(v string, hd *read_guppy.Header, n int64) interface{} {
+	typeString, err := read_guppy.VarType(hd, v)
+	if err != nil {
+		panic(fmt.Sprintf("Internal error: the variable '%s' passed " +
+			"correctness checks, but doesn't have a type: %s", v, err.Error()))
 	}
 
 	switch typeString {
-	case "u32": return make([]uint32, hd.N)
-	case "u64": return make([]uint64, hd.N)
-	case "f32": return make([]float32, hd.N)
-	case "f64": return make([]float64, hd.N)
-	case "v32": return make([][3]float32, hd.N)
-	case "v64": return make([][3]float64, hd.N)
-	case "{RockstarParticle}": return make([]lib.RockstarParticle, hd.N)
+	case "u32": return make([]uint32, n)
+	case "u64": return make([]uint64, n)
+	case "f32": return make([]float32, n)
+	case "f64": return make([]float64, n)
+	case "v32": return make([][3]float32, n)
+	case "v64": return make([][3]float64, n)
+	case "{RockstarParticle}": return make([]lib.RockstarParticle, n)
 	}
 
 	panic(fmt.Sprintf("Internal error: the variable '%s' passed correctness " +
 		"checks, but wasn't assigned a type string.", v))
 }
 
-type OutputHeader struct {
-    Version, Format uint64
-    N, NTot int64
-    Span, Origin, TotalSpan [3]int64
-    Z, OmegaM, OmegaL, H100, L, Mass float64
+// VarBytes returns the compressed size of a variable in a .gup file, or zero
+// if it isn't stored in the file directly, like "id" and derived variables.
+func VarBytes(hd *read_guppy.Header, v string) int64 {
+	n := int64(0)
+	for i := range hd.Names {
+		if hd.Names[i] == v || strings.HasPrefix(hd.Names[i], v + "{") {
+			n += hd.Sizes[i]
+		}
+	}
+	return n
+}
+
+// BufferBytes returns the size of a buffer in bytes.
+func BufferBytes(buf interface{}) int64 {
+	t := reflect.TypeOf(buf)
+	return BufferLen(buf) * int64(t.Elem().Size())
 }
 
-func WriteHeader(hd *read_guppy.Header, f *os.File) error {
-    ohd := &lib.PipeHeader{
-        lib.Version, lib.RockstarFormatCode, hd.N, hd.NTot,
-		hd.Span, hd.Offset, hd.TotalSpan,
-        hd.Z, hd.OmegaM, hd.OmegaL, hd.H100, hd.L, hd.Mass,
-    }
-	return binary.Write(f, lib.SystemByteOrder(), ohd)
+// BufferLen returns the length of a buffer allocated by AllocateBuffer.
+func BufferLen(buf interface{}) int64 {
+	return int64(reflect.ValueOf(buf).Len())
+}
+
+// SliceBuffer returns the first n elements of a buffer allocated by
+// AllocateBuffer. n may be larger than the buffer's length, but not its
+// capacity.
+func SliceBuffer(buf interface{}, n int64) interface{} {
+	return reflect.ValueOf(buf).Slice(0, int(n)).Interface()
+}
+
+// WriteHeader writes the PipeHeader that starts the output of guppy read's
+// pipe format. The variables that follow it are written as contiguous
+// arrays, so it uses ArraysFormatCode.
+func WriteHeader(hd *read_guppy.Header, f io.Writer) error {
+	ohd := &lib.PipeHeader{
+		Version: lib.Version, Format: lib.ArraysFormatCode,
+		N: hd.N, NTot: hd.NTot,
+		Span: hd.Span, Origin: hd.Offset, TotalSpan: hd.TotalSpan,
+		Z: hd.Z, OmegaM: hd.OmegaM, OmegaL: hd.OmegaL, H100: hd.H100,
+		L: hd.L, Mass: hd.Mass,
+	}
+	return lib.WritePipeHeader(f, lib.SystemByteOrder(), ohd)
+}
+
+// OverrideFlags is a flag that can be passed multiple times, which collects
+// Var=Value strings that override the values in a config file.
+type OverrideFlags []string
+
+func (o *OverrideFlags) String() string { return strings.Join(*o, " ") }
+
+func (o *OverrideFlags) Set(s string) error {
+	*o = append(*o, s)
+	return nil
 }
 
 func Write(flags []string) {
@@ -253,18 +647,35 @@ func Write(flags []string) {
 	configPtr := set.String("config", "", "Configuration file specifying " +
 		"what files to compress and how. 'guppy write --config example' " +
 		"will print an example config file with comments to stdout.")
+	overrides := OverrideFlags{ }
+	set.Var(&overrides, "set", "Overrides a variable in the config file, " +
+		"e.g. --set Snaps=0..10. Can be passed multiple times.")
 	checkPtr := set.Bool("check", false, "If true, guppy will check the " +
 		"configuration file without running. Useful to run before " +
 		"submitting long jobs.")
+	resumePtr := set.Bool("resume", false, "If true, guppy will skip the " +
+		"output files that a previous, interrupted run with the same " +
+		"config file finished and verified.")
+	logPtr := set.String("log", "text", "The format of the log written " +
+		"to stderr, 'text' or 'json'. An empty string turns logging off.")
+	progressPtr := set.Duration("progress", 0, "If set, a progress line " +
+		"with the fraction of files finished and an ETA is logged this " +
+		"often, e.g. --progress 1m.")
 	err := set.Parse(flags)
 
-	config, check := *configPtr, *checkPtr
+	config, check, resume := *configPtr, *checkPtr, *resumePtr
 	if config == "example" {
 		fmt.Println(lib.ExampleWriteConfig())
 		return
 	}
 
-	cfg, err := lib.ParseWriteConfig(config)
+	log, err := NewLogger(*logPtr, "write")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	cfg, err := lib.ParseWriteConfig(config, overrides...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not parse config file: %s", err.Error())
 		os.Exit(1)
@@ -274,19 +685,89 @@ func Write(flags []string) {
 		os.Exit(1)
 	}
 
-	if check { return }
+	snaps, inputs, _, err := lib.ExpandFileNames(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid values in the config file %s: %s\n",
+			config, err.Error())
+		os.Exit(1)
+	}
+	hds, err := lib.SnapshotHeaders(cfg, inputs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := PrintAccuracyWarnings(cfg, snaps, hds); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if check {
+		summary, err := lib.AccuracySummary(cfg, snaps, hds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(lib.InputCountSummary(snaps, inputs))
+		fmt.Println(summary)
+		return
+	}
 
-	err = SingleNodeWrite(cfg)
+	err = SingleNodeWrite(cfg, resume, log, *progressPtr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }
 
-func SingleNodeWrite(cfg *lib.WriteConfig) error {
+// NewLogger creates the logger used by a mode from the format passed to its
+// --log flag. Logs are written to stderr, and an empty format returns a nil
+// logger, which doesn't log anything.
+func NewLogger(format, mode string) (*logging.Logger, error) {
+	if format == "" { return nil, nil }
+	f, err := logging.ParseFormat(format)
+	if err != nil { return nil, err }
+	return logging.New(os.Stderr, f, mode), nil
+}
+
+// SingleNodeWrite runs guppy write on a single node. Each input file read
+// and output file written is logged to log, and a progress line is logged
+// every interval if it's positive.
+func SingleNodeWrite(
+	cfg *lib.WriteConfig, resume bool, log *logging.Logger,
+	interval time.Duration,
+) error {
 	workers := thread.Set(int(cfg.Threads))
 
-	snaps, inputs, outputs := lib.ExpandFileNames(cfg)
+	snaps, inputs, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { return err }
+
+	progressName := lib.ProgressFileName(cfg)
+	if cfg.CreateMissingDirectories {
+		err := os.MkdirAll(filepath.Dir(progressName), 0755)
+		if err != nil { return err }
+	}
+	progress, err := lib.OpenWriteProgress(progressName, resume)
+	if err != nil { return err }
+	defer progress.Close()
+
+	pending := make([][]int, len(snaps))
+	nPending, nOutputs := 0, 0
+	for iSnap := range snaps {
+		pending[iSnap], err = PendingOutputs(
+			progress, snaps[iSnap], outputs[iSnap])
+		if err != nil { return err }
+		nPending += len(pending[iSnap])
+		nOutputs += len(outputs[iSnap])
+	}
+	log.Log("start", "snapshots", len(snaps), "outputs", nOutputs,
+		"finished", nOutputs - nPending, "resume", resume,
+		"manifest", progressName, "threads", workers)
+
+	// Each output file is one job, so the ETA only counts the files which
+	// still need to be written.
+	prog := logging.NewProgress(log, nPending)
+	prog.Start(interval)
+
 	// We choose a random file here so all the workers aren't fighting the
 	// file system over the same data.
 	hd0, err := lib.GetSnapioHeader(cfg, lib.RandomFileName(inputs))
@@ -296,45 +777,892 @@ func SingleNodeWrite(cfg *lib.WriteConfig) error {
 	outputBuffers := lib.OutputBuffers(cfg, workers)
 	read_guppy.InitWorkers(workers)
 
-	part := CreateParticles(cfg, hd0)
-	
 	for iSnap := range snaps {
-		readJobs, writeJobs := len(inputs[iSnap]), len(outputs[iSnap])
-
-		// Note: this wastes memory a little bit: instead we could read one
-		// field, transfer it, write it to memory for each file, then repeat
-		// and finally write at the end. I'll revisit this if the memory
-		// constraints are intense.
-		
-		thread.WorkerQueue(readJobs, workers, func(worker, job int) {
-			ReadToParticles(cfg, inputs[iSnap][job], inputBuffers[worker],part)
-		})
+		// Snapshots whose outputs are all finished don't need to be read.
+		if len(pending[iSnap]) == 0 { continue }
+		readJobs := len(inputs[iSnap])
 
-		thread.WorkerQueue(writeJobs, workers, func(worker, job int) {
-			WriteFromParticles(cfg, outputs[iSnap][job], outputBuffers[worker],
-				job, worker, part)
-		})
+		// Accuracies can depend on redshift, so they're found separately
+		// for each snapshot and stored in the method headers of its files.
+		hd, err := lib.GetSnapioHeader(cfg, inputs[iSnap][0])
+		if err != nil { return err }
+		acc, err := lib.SnapshotAccuracies(cfg, hd)
+		if err != nil { return err }
+
+		// Holding every particle in the snapshot at once can take more
+		// memory than a node has, so the snapshot is split into passes
+		// that fit in MaxMemory.
+		nFile, err := lib.MaxInputParticles(cfg, inputs[iSnap])
+		if err != nil { return err }
+		passes, err := lib.PlanWrite(cfg, pending[iSnap], hd.NTot(), nFile,
+			0, workers)
+		if err != nil { return err }
+
+		gw := cfg.OutputGridWidth
+		outputBytes := hd.NTot() / (gw*gw*gw) * lib.ParticleBytes(cfg)
+		// Outputs can be compressed over several passes, so their times
+		// are added up until they're finished.
+		compressTimes := make([]time.Duration, len(outputs[iSnap]))
+
+		for iPass, pass := range passes {
+			part := CreateParticles(cfg, hd, pass)
+
+			readErrs := make([]error, readJobs)
+			thread.WorkerQueue(readJobs, workers, func(worker, job int) {
+				input := inputs[iSnap][job]
+				start := time.Now()
+				readErrs[job] = ReadToParticles(cfg, input,
+					inputBuffers[worker], pass, part)
+				if readErrs[job] != nil { return }
+
+				stats := &logging.FileStats{ File: input,
+					ReadTime: time.Since(start), BytesIn: FileSize(input) }
+				log.Log("read", append(stats.Fields(),
+					"snapshot", snaps[iSnap], "pass", iPass)...)
+			})
+			for _, err := range readErrs {
+				if err != nil { return err }
+			}
+
+			errs := make([]error, len(pass.Outputs))
+			write := func(worker, job int) {
+				out := pass.Outputs[job]
+				start := time.Now()
+				errs[job] = WriteFromParticles(cfg, hd, outputs[iSnap][out],
+					outputBuffers[worker], acc, pass, job, part)
+				compressTimes[out] += time.Since(start)
+				if errs[job] != nil || !pass.Flush { return }
+
+				stats := &logging.FileStats{ File: outputs[iSnap][out],
+					CompressTime: compressTimes[out], BytesIn: outputBytes }
+				errs[job] = FinishOutput(progress, snaps[iSnap], out,
+					outputBuffers[worker], stats)
+				if errs[job] == nil {
+					prog.File(stats, "snapshot", snaps[iSnap])
+				}
+			}
+
+			if len(pass.Outputs) == 1 {
+				// Passes that only write some of a file's variables only
+				// have one output. It's always written with the first
+				// buffer so the partially compressed file is still there
+				// when the next pass adds the rest of the variables.
+				write(0, 0)
+				if pass.Flush && errs[0] == nil { prog.Counter.Finish() }
+			} else {
+				thread.CountedWorkerQueue(prog.Counter, len(pass.Outputs),
+					workers, write)
+			}
+
+			for _, err := range errs {
+				if err != nil { return err }
+			}
+		}
+	}
+
+	prog.Stop()
+	return WriteIndex(cfg, progress, snaps, outputs)
+}
+
+// WriteIndex writes the simulation index describing every output file of a
+// write job. The index is built from the records in the progress manifest,
+// so the output files don't need to be read again.
+func WriteIndex(
+	cfg *lib.WriteConfig, progress *lib.WriteProgress, snaps []int,
+	outputs [][]string,
+) error {
+	indexName := lib.IndexFileName(cfg)
+
+	records := make([][]lib.OutputRecord, len(snaps))
+	for i := range snaps {
+		records[i] = make([]lib.OutputRecord, len(outputs[i]))
+		for j := range outputs[i] {
+			rec, ok := progress.Get(snaps[i], j)
+			if !ok || rec.File != outputs[i][j] {
+				return fmt.Errorf("Could not create the simulation index " +
+					"%s: %s isn't in the progress manifest %s.", indexName,
+					outputs[i][j], progress.FileName)
+			}
+			records[i][j] = rec
+		}
+	}
+
+	idx, err := lib.NewSimulationIndex(snaps, records,
+		filepath.Dir(indexName))
+	if err != nil {
+		return fmt.Errorf("Could not create the simulation index %s: %s",
+			indexName, err.Error())
+	}
+	return lib.WriteSimulationIndex(indexName, idx)
+}
+
+// PrintAccuracyWarnings prints warnings about the accuracies that cfg will
+// use to stderr. hds are the headers of each snapshot. A warning that applies
+// to several snapshots is only printed once.
+func PrintAccuracyWarnings(
+	cfg *lib.WriteConfig, snaps []int, hds []snapio.Header,
+) error {
+	warnings, warnSnaps := []string{ }, map[string][]int{ }
+	for i := range hds {
+		snapWarnings, err := lib.AccuracyWarnings(cfg, hds[i])
+		if err != nil {
+			return fmt.Errorf("Snapshot %d: %s", snaps[i], err.Error())
+		}
+
+		for _, warning := range snapWarnings {
+			if _, ok := warnSnaps[warning]; !ok {
+				warnings = append(warnings, warning)
+			}
+			warnSnaps[warning] = append(warnSnaps[warning], snaps[i])
+		}
 	}
 
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s (Snapshots: %v)\n", warning,
+			warnSnaps[warning])
+	}
 	return nil
 }
 
+// PendingOutputs returns the indices of the output files of a snapshot that
+// haven't been finished yet. Temporary files left behind by an interrupted
+// run are removed so the outputs can be written again.
+func PendingOutputs(
+	progress *lib.WriteProgress, snap int, outputs []string,
+) ([]int, error) {
+	pending := []int{ }
+	for i := range outputs {
+		if progress.Done(snap, i, outputs[i]) { continue }
+
+		_, err := compress.RemoveTempFiles(outputs[i])
+		if err != nil {
+			return nil, fmt.Errorf("Could not remove the partial files " +
+				"left behind while writing %s: %s", outputs[i], err.Error())
+		}
+		pending = append(pending, i)
+	}
+	return pending, nil
+}
+
+// FinishOutput writes the output file compressed into buf.Writer to disk,
+// verifies it, and records it in the progress manifest along with the
+// information that the simulation index needs. The time taken to write the
+// file and its size are stored in stats.
+func FinishOutput(
+	progress *lib.WriteProgress, snap, output int, buf *lib.OutputBuffer,
+	stats *logging.FileStats,
+) error {
+	file := stats.File
+	wr, bounds := buf.Writer, buf.Bounds
+	start := time.Now()
+	// The Writer can't be reused after Flush, even if it failed, so the
+	// next output on this buffer starts a new one.
+	b, err := wr.Flush()
+	buf.Writer, buf.Bounds = nil, nil
+	if err != nil {
+		return fmt.Errorf("Could not write %s: %s", file, err.Error())
+	}
+	buf.B = b
+	stats.WriteTime, stats.BytesOut = time.Since(start), wr.Size
+
+	res := VerifyFile(file)
+	if res.Err != nil {
+		return fmt.Errorf("Could not verify %s after writing it: %s",
+			file, res.Err.Error())
+	} else if len(res.BadBlocks) > 0 {
+		return fmt.Errorf("%s failed verification after it was written: %s",
+			file, res.BadBlocks[0].Error())
+	}
+
+	return progress.Record(lib.OutputRecord{
+		Snapshot: snap, Output: output, File: file, Size: wr.Size,
+		CRC32C: wr.CRC32C, Bounds: bounds, Header: wr.FixedWidthHeader,
+	})
+}
+
+// FileSize returns the size of a file in bytes, or zero if it can't be
+// found.
+func FileSize(file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil { return 0 }
+	return info.Size()
+}
+
+// CreateParticles allocates the particles for each output file written
+// during a pass. Only the variables read during the pass are allocated.
 func CreateParticles(
-	cfg *lib.WriteConfig, hd snapio.Header,
-) particles.Particles {
-	for i := range cfg
+	cfg *lib.WriteConfig, hd snapio.Header, pass lib.WritePass,
+) []particles.Particles {
+	gw := cfg.OutputGridWidth
+	nSub := int(hd.NTot() / (gw*gw*gw))
+
+	p := make([]particles.Particles, len(pass.Outputs))
+	for i := range p {
+		p[i] = particles.Particles{ }
+		for _, v := range pass.Vars {
+			typ := cfg.Types[IndexOfString(cfg.Vars, v)]
+			EmptyField(v, typ).CreateDestination(p[i], nSub)
+		}
+	}
+	return p
 }
 
+// EmptyField returns a zero-length Field with the given name and type
+// string. It's used to create the Fields in output Particles.
+func EmptyField(name, typ string) particles.Field {
+	switch typ {
+	case "u32": return particles.NewUint32(name, []uint32{ })
+	case "u64": return particles.NewUint64(name, []uint64{ })
+	case "f32": return particles.NewFloat32(name, []float32{ })
+	case "f64": return particles.NewFloat64(name, []float64{ })
+	case "v32": return particles.NewVec32(name, [][3]float32{ })
+	case "v64": return particles.NewVec64(name, [][3]float64{ })
+	}
+	panic(fmt.Sprintf("Internal error: unrecognized type string '%s'", typ))
+}
+
+// IndexOfString returns the index of x in list, or -1 if it isn't there.
+func IndexOfString(list []string, x string) int {
+	for i := range list {
+		if list[i] == x { return i }
+	}
+	return -1
+}
+
+// ReadToParticles reads the variables in a pass from an input file and
+// moves the particles that belong to the pass's outputs into p, which has
+// one Particles map for each output. (See CreateParticles.)
 func ReadToParticles(
-	cfg *lib.WriteConfig, input string,
-	buf *snapio.Buffer, p particles.Particles,
-) {
-	panic("NYI")
+	cfg *lib.WriteConfig, input string, buf *snapio.Buffer,
+	pass lib.WritePass, p []particles.Particles,
+) error {
+	f, err := lib.OpenSnapioFile(cfg, input)
+	if err != nil { return err }
+	hd, err := f.ReadHeader()
+	if err != nil {
+		return fmt.Errorf("Cannot read %s: %s", input, err.Error())
+	}
+
+	buf.Reset()
+	vars := append([]string{ "id" }, pass.Vars...)
+	for _, v := range vars {
+		if err := f.Read(v, buf); err != nil {
+			return fmt.Errorf("Cannot read %s: %s", input, err.Error())
+		}
+	}
+
+	idGeneric, err := buf.Get("id")
+	if err != nil { return err }
+	var id []uint64
+	switch x := idGeneric.(type) {
+	case []uint32:
+		id = make([]uint64, len(x))
+		for i := range x { id[i] = uint64(x[i]) }
+	case []uint64:
+		id = x
+	default:
+		return fmt.Errorf("'id' in %s doesn't have type u32 or u64.", input)
+	}
+
+	// Find the output file and Lagrangian index of each particle.
+	order, err := lib.NewIDOrder(cfg.IDOrder, hd.NTot())
+	if err != nil { return err }
+	gw := int(cfg.OutputGridWidth)
+	scheme, err := particles.NewEqualSplitUnigrid(hd, order, gw,
+		[]string{ })
+	if err != nil {
+		return fmt.Errorf("Cannot split %s: %s", input, err.Error())
+	}
+	from, to := make([][]int, gw*gw*gw), make([][]int, gw*gw*gw)
+	from, to, err = scheme.Indices(id, from, to)
+	if err != nil {
+		return fmt.Errorf("Cannot split %s: %s", input, err.Error())
+	}
+
+	for _, v := range pass.Vars {
+		x, err := buf.Get(v)
+		if err != nil { return err }
+		field, err := particles.NewGenericField(v, x)
+		if err != nil { return err }
+
+		for j, out := range pass.Outputs {
+			err := field.Transfer(p[j], from[out], to[out])
+			if err != nil {
+				return fmt.Errorf("Cannot copy '%s' from %s: %s",
+					v, input, err.Error())
+			}
+		}
+	}
+
+	return nil
 }
 
+// WriteFromParticles compresses the variables in a pass for the job-th
+// output of the pass into buf.Writer, storing them to the accuracies in acc.
+// hd is the header of one of the snapshot's input files. buf.Writer is
+// created by the output's first pass and written to disk by FinishOutput
+// after its last pass.
 func WriteFromParticles(
-	cfg *lib.WriteConfig, output string, buf *lib.OutputBuffer,
-	job, worker int, p particles.Particles,
+	cfg *lib.WriteConfig, hd snapio.Header, output string,
+	buf *lib.OutputBuffer, acc []float64, pass lib.WritePass, job int,
+	p []particles.Particles,
+) error {
+	out := int64(pass.Outputs[job])
+	gw := cfg.OutputGridWidth
+	nAll := int64(math.Round(math.Cbrt(float64(hd.NTot()))))
+	sub := nAll / gw
+
+	if buf.Writer == nil {
+		if cfg.CreateMissingDirectories {
+			err := os.MkdirAll(filepath.Dir(output), 0755)
+			if err != nil { return err }
+		}
+
+		span := [3]int64{ sub, sub, sub }
+		offset := [3]int64{ sub*(out % gw), sub*((out / gw) % gw),
+			sub*(out / (gw*gw)) }
+		totalSpan := [3]int64{ nAll, nAll, nAll }
+		buf.Writer = compress.NewWriter(output, hd, span, offset, totalSpan,
+			buf.Buffer, buf.B, lib.SystemByteOrder())
+		buf.Writer.Metadata = lib.OutputMetadata(cfg, hd)
+	}
+
+	span := [3]int{ int(sub), int(sub), int(sub) }
+	for _, v := range pass.Vars {
+		i := IndexOfString(cfg.Vars, v)
+		period := 0.0
+		if v == "x" { period = hd.L() }
+
+		names := []string{ v }
+		switch cfg.Types[i] {
+		case "v32", "v64":
+			names = []string{ v + "{0}", v + "{1}", v + "{2}" }
+		}
+
+		for _, name := range names {
+			method := compress.NewLagrangianDelta(span, acc[i], period)
+			err := buf.Writer.AddField(p[job][name], method)
+			if err != nil {
+				return fmt.Errorf("Could not compress '%s' for %s: %s",
+					name, output, err.Error())
+			}
+		}
+
+		if v == "x" && cfg.Types[i] == "v32" {
+			buf.Bounds = OutputBounds(p[job], acc[i], hd.L())
+		}
+	}
+
+	return nil
+}
+
+// OutputBounds returns the periodic bounds of the positions in p, in the
+// format used by read_guppy.PeriodicBounds. Positions are stored to accuracy
+// acc, so the bounds are widened by acc to enclose the stored positions.
+func OutputBounds(p particles.Particles, acc, L float64) []float32 {
+	x0 := p["x{0}"].Data().([]float32)
+	x1, x2 := p["x{1}"].Data().([]float32), p["x{2}"].Data().([]float32)
+	x := make([][3]float32, len(x0))
+	for i := range x { x[i] = [3]float32{ x0[i], x1[i], x2[i] } }
+
+	bounds := read_guppy.PeriodicBounds(x, float32(L))
+	for dim := 0; dim < 3; dim++ {
+		bounds[dim] -= float32(acc)
+		bounds[dim+3] += float32(acc)
+		if bounds[dim] < 0 {
+			bounds[dim] += float32(L)
+			bounds[dim+3] += float32(L)
+		}
+	}
+	return bounds
+}
+
+func Verify(flags []string) {
+	set := flag.NewFlagSet("verify", flag.ContinueOnError)
+	filePtr := set.String("file", "", "The .gup file to verify. If this is " +
+		"a directory, every .gup file in it and its subdirectories will be " +
+		"verified.")
+	threadsPtr := set.Int("threads", -1, "The number of threads used to " +
+		"verify files. -1 uses one thread per core.")
+	err := set.Parse(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	file, threads := *filePtr, *threadsPtr
+	if file == "" {
+		fmt.Fprintf(os.Stderr, "Must set the 'file' flag to run guppy in " +
+			"verify mode. Call 'guppy verify --help' for flag descriptions.\n")
+		os.Exit(1)
+	} else if threads == 0 || threads < -1 {
+		fmt.Fprintf(os.Stderr, "The 'threads' flag was set to %d, but the " +
+			"only valid values are -1 or a positive integer.\n", threads)
+		os.Exit(1)
+	}
+
+	files, err := VerifyFileNames(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	workers := thread.Set(threads)
+	results := make([]*VerifyResult, len(files))
+	thread.WorkerQueue(len(files), workers, func(worker, job int) {
+		results[job] = VerifyFile(files[job])
+	})
+
+	nBadFiles, nBadBlocks, nUnchecked := 0, 0, 0
+	for _, res := range results {
+		switch {
+		case res.Err != nil:
+			nBadFiles++
+			fmt.Printf("BAD  %s: %s\n", res.File, res.Err.Error())
+		case len(res.BadBlocks) > 0:
+			nBadFiles++
+			nBadBlocks += len(res.BadBlocks)
+			for _, block := range res.BadBlocks {
+				fmt.Printf("BAD  %s: %s block of '%s' has checksum %08x, " +
+					"expected %08x\n", res.File, block.Block, block.Field,
+					block.Found, block.Expected)
+			}
+		case !res.HasChecksums:
+			nUnchecked++
+			fmt.Printf("OK?  %s: written before checksums were added, only " +
+				"the header was checked\n", res.File)
+		}
+	}
+
+	fmt.Printf("Verified %d files: %d bad files, %d bad blocks, %d files " +
+		"without checksums.\n", len(files), nBadFiles, nBadBlocks, nUnchecked)
+
+	if nBadFiles > 0 { os.Exit(1) }
+}
+
+// VerifyResult contains the results of running VerifyFile on a single file.
+type VerifyResult struct {
+	File string
+	// Err is non-nil if the file could not be opened or read at all.
+	Err error
+	// BadBlocks lists all the blocks whose checksums don't match.
+	BadBlocks []*compress.ChecksumError
+	// HasChecksums is false if the file is too old to contain checksums.
+	HasChecksums bool
+}
+
+// VerifyFile checks that a file can be opened and that every block matches
+// its checksum.
+func VerifyFile(file string) *VerifyResult {
+	res := &VerifyResult{ File: file }
+
+	rd, err := compress.NewReader(file, compress.NewBuffer(0), []byte{ })
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer rd.Close()
+
+	res.HasChecksums = rd.HasChecksums()
+	res.BadBlocks, res.Err = rd.Verify()
+	return res
+}
+
+// VerifyFileNames returns the files that should be checked by verify mode. If
+// file is a directory, all the .gup files inside it are returned in sorted
+// order. Otherwise file itself is returned.
+func VerifyFileNames(file string) ([]string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("Guppy could not open %s: %s",
+			file, err.Error())
+	} else if !info.IsDir() {
+		return []string{ file }, nil
+	}
+
+	files := []string{ }
+	err = filepath.Walk(file, func(
+		path string, info os.FileInfo, err error,
+	) error {
+		if err != nil { return err }
+		if !info.IsDir() && filepath.Ext(path) == ".gup" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Guppy could not search the directory %s: %s",
+			file, err.Error())
+	} else if len(files) == 0 {
+		return nil, fmt.Errorf("The directory %s does not contain any .gup " +
+			"files.", file)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+func Confirm(flags []string) {
+	set := flag.NewFlagSet("confirm", flag.ContinueOnError)
+	configPtr := set.String("config", "", "The configuration file that " +
+		"was used to create the .gup files.")
+	samplePtr := set.Int("sample", -1, "The number of randomly chosen " +
+		"input files to check in each snapshot. -1 checks every file.")
+	overrides := OverrideFlags{ }
+	set.Var(&overrides, "set", "Overrides a variable in the config file, " +
+		"e.g. --set Snaps=0..10. Use the same overrides that were passed " +
+		"to guppy write.")
+	err := set.Parse(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	config, sample := *configPtr, *samplePtr
+	if config == "" {
+		fmt.Fprintf(os.Stderr, "Must set the 'config' flag to run guppy in " +
+			"confirm mode. Call 'guppy confirm --help' for flag " +
+			"descriptions.\n")
+		os.Exit(1)
+	} else if sample == 0 || sample < -1 {
+		fmt.Fprintf(os.Stderr, "The 'sample' flag was set to %d, but the " +
+			"only valid values are -1 or a positive integer.\n", sample)
+		os.Exit(1)
+	}
+
+	cfg, err := lib.ParseWriteConfig(config, overrides...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse config file: %s\n",
+			err.Error())
+		os.Exit(1)
+	} else if err := lib.CheckWriteConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid values in the config file %s: %s\n",
+			config, err.Error())
+		os.Exit(1)
+	}
+
+	ok, err := SingleNodeConfirm(cfg, sample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	} else if !ok {
+		os.Exit(1)
+	}
+}
+
+// SingleNodeConfirm compares the .gup files generated by cfg against the
+// original snapshot files and prints the errors in each field. sample input
+// files are checked in each snapshot, or all of them if sample is -1. false
+// is returned if any value was less accurate than it should have been.
+//
+// The sampled input files in a snapshot are all read into memory first, so
+// that each .gup file only needs to be decompressed once.
+func SingleNodeConfirm(cfg *lib.WriteConfig, sample int) (bool, error) {
+	workers := thread.Set(int(cfg.Threads))
+
+	snaps, inputs, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { return false, err }
+	hd0, err := lib.GetSnapioHeader(cfg, lib.RandomFileName(inputs))
+	if err != nil { return false, err }
+
+	bufs := make([]*lib.ConfirmBuffer, workers)
+	for i := range bufs {
+		bufs[i], err = lib.NewConfirmBuffer(hd0)
+		if err != nil { return false, err }
+	}
+
+	allOK := true
+	for iSnap := range snaps {
+		files := SampleFileNames(inputs[iSnap], sample)
+
+		hd, err := lib.GetSnapioHeader(cfg, inputs[iSnap][0])
+		if err != nil { return false, err }
+		acc, err := lib.SnapshotAccuracies(cfg, hd)
+		if err != nil { return false, err }
+
+		in := make([]*lib.ConfirmInput, len(files))
+		for i := range in {
+			in[i], err = lib.NewConfirmInput(hd)
+			if err != nil { return false, err }
+		}
+		fileErrs := make([]error, len(files))
+		thread.WorkerQueue(len(files), workers, func(worker, job int) {
+			fileErrs[job] = in[job].Read(cfg, files[job],
+				len(outputs[iSnap]))
+		})
+		for _, err := range fileErrs {
+			if err != nil { return false, err }
+		}
+
+		errs := make([][]*lib.FieldError, workers)
+		for i := range errs { errs[i] = lib.NewFieldErrors(cfg, acc) }
+		outErrs := make([]error, len(outputs[iSnap]))
+		thread.WorkerQueue(len(outputs[iSnap]), workers,
+			func(worker, job int) {
+				outErrs[job] = lib.ConfirmOutput(cfg, outputs[iSnap][job],
+					job, in, bufs[worker], errs[worker])
+			})
+		for _, err := range outErrs {
+			if err != nil { return false, err }
+		}
+
+		total := errs[0]
+		for i := 1; i < len(errs); i++ {
+			for j := range total { total[j].Merge(errs[i][j]) }
+		}
+
+		fmt.Printf("Snapshot %d: checked %d of %d input files.\n",
+			snaps[iSnap], len(files), len(inputs[iSnap]))
+		if !PrintFieldErrors(total) { allOK = false }
+	}
+
+	if allOK {
+		fmt.Println("All fields are within their accuracy limits.")
+	} else {
+		fmt.Println("Some fields are NOT within their accuracy limits.")
+	}
+
+	return allOK, nil
+}
+
+// SampleFileNames returns n randomly chosen files without replacement. If n
+// is -1 or larger than the number of files, all of them are returned.
+func SampleFileNames(files []string, n int) []string {
+	if n == -1 || n >= len(files) { return files }
+	out := make([]string, n)
+	for i, j := range rand.Perm(len(files))[:n] { out[i] = files[j] }
+	return out
+}
+
+// PrintFieldErrors prints a table of errors to stdout and returns false if
+// any of the fields had values that were less accurate than they should have
+// been.
+func PrintFieldErrors(errs []*lib.FieldError) bool {
+	ok := true
+	fmt.Printf("    %-12s %12s %12s %12s %12s  %s\n", "Field", "Accuracy",
+		"Period", "Max Error", "RMS Error", "Status")
+	for _, e := range errs {
+		status := "OK"
+		if e.NBad > 0 {
+			status = fmt.Sprintf("FAILED (%d of %d values)", e.NBad, e.N)
+			ok = false
+		}
+		fmt.Printf("    %-12s %12.4g %12.4g %12.4g %12.4g  %s\n", e.Name,
+			e.Accuracy, e.Period, e.Max, e.RMS(), status)
+	}
+	return ok
+}
+
+func Estimate(flags []string) {
+	set := flag.NewFlagSet("estimate", flag.ContinueOnError)
+	configPtr := set.String("config", "", "The configuration file that " +
+		"will be used to create the .gup files.")
+	samplePtr := set.Int("sample", 4, "The number of randomly chosen " +
+		"input files to read in each snapshot. -1 reads every file.")
+	overrides := OverrideFlags{ }
+	set.Var(&overrides, "set", "Overrides a variable in the config file, " +
+		"e.g. --set Accuracies=0.001,1,0. Can be used more than once.")
+	err := set.Parse(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	config, sample := *configPtr, *samplePtr
+	if config == "" {
+		fmt.Fprintf(os.Stderr, "Must set the 'config' flag to run guppy in " +
+			"estimate mode. Call 'guppy estimate --help' for flag " +
+			"descriptions.\n")
+		os.Exit(1)
+	} else if sample == 0 || sample < -1 {
+		fmt.Fprintf(os.Stderr, "The 'sample' flag was set to %d, but the " +
+			"only valid values are -1 or a positive integer.\n", sample)
+		os.Exit(1)
+	}
+
+	cfg, err := lib.ParseWriteConfig(config, overrides...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse config file: %s\n",
+			err.Error())
+		os.Exit(1)
+	} else if err := lib.CheckWriteConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid values in the config file %s: %s\n",
+			config, err.Error())
+		os.Exit(1)
+	}
+
+	if err := SingleNodeEstimate(cfg, sample); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// SingleNodeEstimate compresses sub-cubes from sample input files in each
+// snapshot of cfg, or all of them if sample is -1, and prints the projected
+// size of the .gup files along with the time and memory needed to write
+// them.
+func SingleNodeEstimate(cfg *lib.WriteConfig, sample int) error {
+	workers := thread.Set(int(cfg.Threads))
+
+	snaps, inputs, _, err := lib.ExpandFileNames(cfg)
+	if err != nil { return err }
+
+	totalBytes, totalTime, peakMemory := 0.0, time.Duration(0), int64(0)
+	for iSnap := range snaps {
+		files := SampleFileNames(inputs[iSnap], sample)
+
+		hd, err := lib.GetSnapioHeader(cfg, inputs[iSnap][0])
+		if err != nil { return err }
+		acc, err := lib.SnapshotAccuracies(cfg, hd)
+		if err != nil { return err }
+
+		est, err := lib.EstimateSnapshot(cfg, files, acc, workers)
+		if err != nil {
+			return fmt.Errorf("Snapshot %d: %s", snaps[iSnap], err.Error())
+		}
+
+		if est.CompressedParticles < lib.EstimateMinParticles {
+			fmt.Fprintf(os.Stderr, "Warning: only %d sampled particles " +
+				"in snapshot %d were in complete Lagrangian sub-cubes, so " +
+				"its sizes and times will be overestimated. Try sampling " +
+				"more files with --sample.\n", est.CompressedParticles,
+				snaps[iSnap])
+		}
+
+		passes, memory, err := est.Plan(cfg, workers)
+		if err != nil {
+			return fmt.Errorf("Snapshot %d: %s", snaps[iSnap], err.Error())
+		}
+		t := est.Time(cfg, passes, workers)
+		totalBytes += est.Bytes()
+		totalTime += t
+		if memory > peakMemory { peakMemory = memory }
+
+		fmt.Printf("Snapshot %d (z = %.3g): compressed %d sub-cubes of " +
+			"%d^3 particles from %d of %d input files.\n", snaps[iSnap],
+			hd.Z(), est.Cubes, est.CubeWidth, len(files),
+			len(inputs[iSnap]))
+		PrintSnapshotEstimate(est, workers, len(passes), t, memory)
+	}
+
+	fmt.Printf("Total: %s in %d snapshots, taking %s with %d threads " +
+		"and at most %s of memory.\n", FormatBytes(totalBytes),
+		len(snaps), FormatDuration(totalTime), workers,
+		FormatBytes(float64(peakMemory)))
+
+	return nil
+}
+
+// PrintSnapshotEstimate prints the projected size of each field in a
+// snapshot, followed by its throughput, time, and memory use. passes is the
+// number of passes that the snapshot's input files are read in.
+func PrintSnapshotEstimate(
+	est *lib.SnapshotEstimate, workers, passes int, t time.Duration,
+	memory int64,
 ) {
-	panic("NYI")
+	fmt.Printf("    %-12s %12s %12s %12s\n", "Field", "Accuracy",
+		"Bytes/Part.", "Size")
+	for i := range est.Names {
+		fmt.Printf("    %-12s %12.4g %12.4g %12s\n", est.Names[i],
+			est.Accuracies[i], est.BytesPerParticle[i],
+			FormatBytes(est.BytesPerParticle[i]*float64(est.NTot)))
+	}
+	fmt.Printf("    %-12s %12s %12.4g %12s\n", "Total", "",
+		est.Bytes() / float64(est.NTot), FormatBytes(est.Bytes()))
+	fmt.Printf("    Throughput per thread: reading %s/s, compressing " +
+		"%.3g particles/s\n", FormatBytes(est.ReadRate()),
+		est.CompressRate())
+	fmt.Printf("    With %d threads and %d pass(es): %s, %s of memory\n",
+		workers, passes, FormatDuration(t), FormatBytes(float64(memory)))
+}
+
+// FormatBytes writes a number of bytes with a binary unit prefix.
+func FormatBytes(b float64) string {
+	units := []string{ "B", "KiB", "MiB", "GiB", "TiB", "PiB" }
+	i := 0
+	for ; i < len(units) - 1 && b >= 1024; i++ { b /= 1024 }
+	return fmt.Sprintf("%.3g %s", b, units[i])
+}
+
+// FormatDuration rounds a duration so it's easy to read.
+func FormatDuration(t time.Duration) string {
+	switch {
+	case t > time.Hour: return t.Round(time.Minute).String()
+	case t > time.Second: return t.Round(time.Second).String()
+	default: return t.Round(time.Millisecond).String()
+	}
+}
+
+func Convert(flags []string) {
+	set := flag.NewFlagSet("convert", flag.ContinueOnError)
+	configPtr := set.String("config", "", "Configuration file specifying " +
+		"what files to convert and how. 'guppy convert --config example' " +
+		"will print an example config file with comments to stdout.")
+	checkPtr := set.Bool("check", false, "If true, guppy will check the " +
+		"configuration file without running.")
+	err := set.Parse(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	config, check := *configPtr, *checkPtr
+	if config == "example" {
+		fmt.Println(lib.ExampleConvertConfig())
+		return
+	} else if config == "" {
+		fmt.Fprintf(os.Stderr, "Must set the 'config' flag to run guppy in " +
+			"convert mode. Call 'guppy convert --help' for flag " +
+			"descriptions.\n")
+		os.Exit(1)
+	}
+
+	cfg, err := lib.ParseConvertConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse config file: %s\n",
+			err.Error())
+		os.Exit(1)
+	} else if err := lib.CheckConvertConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid values in the config file %s: %s\n",
+			config, err.Error())
+		os.Exit(1)
+	}
+
+	if check { return }
+
+	err = SingleNodeConvert(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// SingleNodeConvert converts every snapshot described by cfg, splitting the
+// output files between threads.
+func SingleNodeConvert(cfg *lib.ConvertConfig) error {
+	workers := thread.Set(int(cfg.Threads))
+
+	snaps, inputs, outputs, err := lib.ExpandConvertFileNames(cfg)
+	if err != nil { return err }
+
+	bufs := make([]*lib.ConvertBuffer, workers)
+	for i := range bufs { bufs[i] = lib.NewConvertBuffer() }
+
+	for iSnap := range snaps {
+		hds, err := lib.ReadConvertHeaders(inputs[iSnap])
+		if err != nil { return err }
+
+		fileErrs := make([]error, len(outputs[iSnap]))
+		thread.WorkerQueue(len(outputs[iSnap]), workers,
+			func(worker, job int) {
+				fileErrs[job] = lib.ConvertFile(cfg, inputs[iSnap], hds,
+					outputs[iSnap], job, bufs[worker])
+			})
+
+		for _, err := range fileErrs {
+			if err != nil { return err }
+		}
+	}
+
+	return nil
 }
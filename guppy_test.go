@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	read_guppy "github.com/phil-mansfield/guppy/go"
+	"github.com/phil-mansfield/guppy/lib"
+	"github.com/phil-mansfield/guppy/lib/logging"
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+// testSimulation is a small simulation written to LGadget-2 files. Every
+// snapshot contains the same particles.
+type testSimulation struct {
+	Width int
+	L float64
+	X, V [][3]float32
+	ID []uint32
+}
+
+// newTestSimulation creates a simulation with width^3 particles at random
+// positions and with randomly ordered IDs.
+func newTestSimulation(width int, L float64) *testSimulation {
+	n := width*width*width
+	sim := &testSimulation{ width, L, make([][3]float32, n),
+		make([][3]float32, n), make([]uint32, n) }
+	for i, j := range rand.Perm(n) {
+		sim.ID[i] = uint32(j + 1)
+		for dim := 0; dim < 3; dim++ {
+			sim.X[i][dim] = float32(L*rand.Float64())
+			sim.V[i][dim] = float32(200*rand.Float64() - 100)
+		}
+	}
+	return sim
+}
+
+// writeSnapshot writes a snapshot at redshift z to two LGadget-2 files,
+// dir/snap_{snap}.0 and dir/snap_{snap}.1.
+func (sim *testSimulation) writeSnapshot(
+	dir string, snap int, z float64,
+) error {
+	n := len(sim.ID)
+	for i := 0; i < 2; i++ {
+		start, end := i*n/2, (i + 1)*n/2
+		fname := filepath.Join(dir, fmt.Sprintf("snap_%03d.%d", snap, i))
+		err := snapio.WriteLGadget2(fname, n, 2, sim.L, z,
+			sim.X[start: end], sim.V[start: end], sim.ID[start: end])
+		if err != nil { return err }
+	}
+	return nil
+}
+
+// writeTestConfig writes a config file to dir which compresses the
+// snapshots in zs (see testSimulation.writeSnapshot) into gw^3 files each.
+// extra lines are appended to the end of the config.
+func writeTestConfig(
+	dir string, zs []float64, gw int, extra ...string,
+) (*lib.WriteConfig, error) {
+	lines := []string{
+		"[write]",
+		"CompressionMethod = LagrangianDelta",
+		"Vars = x, v, id",
+		"Types = v32, v32, u32",
+		"Accuracies = 0.01, 0.1, 0",
+		"Input = " + filepath.Join(dir, "snap_{%03d,snapshot}.{%d,0..1}"),
+		"Output = " + filepath.Join(dir, "out",
+			"snap_{%03d,snapshot}.{%d,output}.gup"),
+		fmt.Sprintf("Snaps = 0..%d", len(zs) - 1),
+		fmt.Sprintf("OutputGridWidth = %d", gw),
+		"CreateMissingDirectories = true",
+		"FileType = LGadget-2",
+		"ByteOrder = LittleEndian",
+		"Threads = 1",
+	}
+	lines = append(lines, extra...)
+
+	fname := filepath.Join(dir, "write.config")
+	text := strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(fname, []byte(text), 0644); err != nil {
+		return nil, err
+	}
+
+	cfg, err := lib.ParseWriteConfig(fname)
+	if err != nil { return nil, err }
+	if err := lib.CheckWriteConfig(cfg); err != nil { return nil, err }
+	return cfg, nil
+}
+
+// setupTestWrite writes a simulation with width^3 particles and a config
+// file for it to a temporary directory.
+func setupTestWrite(
+	t *testing.T, width, gw int, zs []float64, extra ...string,
+) (*testSimulation, *lib.WriteConfig) {
+	dir := t.TempDir()
+	sim := newTestSimulation(width, 100)
+	for snap := range zs {
+		if err := sim.writeSnapshot(dir, snap, zs[snap]); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	cfg, err := writeTestConfig(dir, zs, gw, extra...)
+	if err != nil { t.Fatalf(err.Error()) }
+	return sim, cfg
+}
+
+// confirmTestWrite checks that every particle in every snapshot written by
+// cfg was stored to the right accuracy.
+func confirmTestWrite(cfg *lib.WriteConfig) error {
+	snaps, inputs, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { return err }
+
+	for iSnap := range snaps {
+		hd, err := lib.GetSnapioHeader(cfg, inputs[iSnap][0])
+		if err != nil { return err }
+		acc, err := lib.SnapshotAccuracies(cfg, hd)
+		if err != nil { return err }
+		buf, err := lib.NewConfirmBuffer(hd)
+		if err != nil { return err }
+
+		errs := lib.NewFieldErrors(cfg, acc)
+		for _, input := range inputs[iSnap] {
+			err := lib.ConfirmFile(cfg, input, outputs[iSnap], buf, errs)
+			if err != nil { return err }
+		}
+
+		for _, e := range errs {
+			if e.N != hd.NTot() || e.NBad > 0 {
+				return fmt.Errorf("Snapshot %d: %d of %d values of '%s' " +
+					"are less accurate than %g, and %d were expected.",
+					snaps[iSnap], e.NBad, e.N, e.Name, e.Accuracy, hd.NTot())
+			}
+		}
+	}
+
+	return nil
+}
+
+// testPasses returns the passes that SingleNodeWrite splits the first
+// snapshot written by cfg into.
+func testPasses(cfg *lib.WriteConfig) ([]lib.WritePass, error) {
+	_, inputs, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { return nil, err }
+	hd, err := lib.GetSnapioHeader(cfg, inputs[0][0])
+	if err != nil { return nil, err }
+	nFile, err := lib.MaxInputParticles(cfg, inputs[0])
+	if err != nil { return nil, err }
+
+	pending := make([]int, len(outputs[0]))
+	for i := range pending { pending[i] = i }
+	return lib.PlanWrite(cfg, pending, hd.NTot(), nFile, 0, 1)
+}
+
+func TestSingleNodeWrite(t *testing.T) {
+	tests := []struct{
+		maxMemory string
+		passes int
+		splitVars bool
+	} {
+		{ "", 1, false },
+		// Two output files per pass.
+		{ "15000", 4, false },
+		// x and v are written to each output file in separate passes.
+		{ "10000", 16, true },
+	}
+
+	for i := range tests {
+		_, cfg := setupTestWrite(t, 8, 2, []float64{ 0 },
+			"MaxMemory = " + tests[i].maxMemory)
+
+		passes, err := testPasses(cfg)
+		if err != nil { t.Fatalf(err.Error()) }
+		if len(passes) != tests[i].passes {
+			t.Fatalf("%d) Expected %d passes, got %d.", i,
+				tests[i].passes, len(passes))
+		} else if splitVars := len(passes[0].Vars) == 1;
+			splitVars != tests[i].splitVars {
+			t.Fatalf("%d) Expected split variables = %v, got %v.", i,
+				tests[i].splitVars, splitVars)
+		}
+
+		if err := SingleNodeWrite(cfg, false, nil, 0); err != nil {
+			t.Fatalf("%d) %s", i, err.Error())
+		}
+		if err := confirmTestWrite(cfg); err != nil {
+			t.Errorf("%d) %s", i, err.Error())
+		}
+		if ok, err := SingleNodeConfirm(cfg, -1); err != nil {
+			t.Errorf("%d) %s", i, err.Error())
+		} else if !ok {
+			t.Errorf("%d) Expected guppy confirm to accept the files.", i)
+		}
+	}
+}
+
+func TestSingleNodeWriteResume(t *testing.T) {
+	_, cfg := setupTestWrite(t, 8, 2, []float64{ 1, 0 })
+	snaps, _, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	// A directory with the same name as an output makes the write fail
+	// partway through the first snapshot, like a killed job would. A
+	// partially written temporary file is also left next to it.
+	blocked := outputs[0][3]
+	if err := os.MkdirAll(blocked, 0755); err != nil { t.Fatalf(err.Error()) }
+	dir, base := filepath.Split(blocked)
+	tmp := filepath.Join(dir, "." + base + ".tmp123")
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err := SingleNodeWrite(cfg, false, nil, 0); err == nil {
+		t.Fatalf("Expected the first write to fail.")
+	}
+
+	before := map[string]os.FileInfo{ }
+	for iSnap := range snaps {
+		for _, out := range outputs[iSnap] {
+			if info, err := os.Stat(out); err == nil && !info.IsDir() {
+				before[out] = info
+			}
+		}
+	}
+	if len(before) == 0 || len(before) >= len(outputs[0]) {
+		t.Fatalf("Expected the first write to finish some of snapshot " +
+			"%d's %d outputs, but it finished %d.", snaps[0],
+			len(outputs[0]), len(before))
+	}
+
+	if err := os.Remove(blocked); err != nil { t.Fatalf(err.Error()) }
+	if err := SingleNodeWrite(cfg, true, nil, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Finished outputs are replaced by renaming a new file over them, so
+	// they're only the same file if they weren't rewritten.
+	rewritten := 0
+	for iSnap := range snaps {
+		for _, out := range outputs[iSnap] {
+			info, err := os.Stat(out)
+			if err != nil { t.Fatalf(err.Error()) }
+
+			if old, ok := before[out]; !ok {
+				rewritten++
+			} else if !os.SameFile(old, info) {
+				t.Errorf("%s was finished before resuming, but it was " +
+					"rewritten.", out)
+			}
+		}
+	}
+	if exp := len(outputs[0]) + len(outputs[1]) - len(before);
+		rewritten != exp {
+		t.Errorf("Expected %d outputs to be written after resuming, got %d.",
+			exp, rewritten)
+	}
+
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file %s to be removed.", tmp)
+	}
+	if err := confirmTestWrite(cfg); err != nil { t.Errorf(err.Error()) }
+}
+
+func TestSingleNodeWriteIndex(t *testing.T) {
+	zs := []float64{ 1, 0 }
+	sim, cfg := setupTestWrite(t, 8, 2, zs)
+	if err := SingleNodeWrite(cfg, false, nil, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	gup := read_guppy.OpenSimulation(filepath.Dir(lib.IndexFileName(cfg)))
+	snaps := gup.Snapshots()
+	if len(snaps) != 2 || snaps[0] != 0 || snaps[1] != 1 {
+		t.Fatalf("Expected snapshots [0 1], got %v.", snaps)
+	}
+
+	for snap := range zs {
+		if z := gup.Snapshot(snap).Z; math.Abs(z - zs[snap]) > 1e-6 {
+			t.Errorf("Expected snapshot %d to have z = %g, got %g.",
+				snap, zs[snap], z)
+		}
+		if n := len(gup.FileNames(snap)); n != 8 {
+			t.Errorf("Expected snapshot %d to have 8 files, got %d.",
+				snap, n)
+		}
+
+		// Every particle can be found from its ID and has the position it
+		// was written with.
+		ids := make([]uint64, len(sim.ID))
+		for i := range ids { ids[i] = uint64(sim.ID[i]) }
+		x := make([][3]float32, len(ids))
+		gup.Locator(snap).ReadIDs("x", ids, 0, x)
+
+		for i := range x {
+			for dim := 0; dim < 3; dim++ {
+				dx := math.Abs(float64(x[i][dim] - sim.X[i][dim]))
+				dx = math.Min(dx, sim.L - dx)
+				if dx > 0.01 + 1e-4 {
+					t.Fatalf("Snapshot %d: expected particle %d to have " +
+						"x = %v, got %v.", snap, ids[i], sim.X[i], x[i])
+				}
+			}
+		}
+	}
+
+	if snap := gup.ClosestSnapshot(0.9); snap != 0 {
+		t.Errorf("Expected snapshot 0 to be closest to z = 0.9, got %d.",
+			snap)
+	}
+
+	// The index is built from records made as each file was written, so it
+	// should agree with one built by reading the files back.
+	snapList, _, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+	idx, err := lib.ReadSimulationIndex(lib.IndexFileName(cfg))
+	if err != nil { t.Fatalf(err.Error()) }
+	read := read_guppy.BuildSimulationIndex(snapList, outputs,
+		filepath.Dir(lib.IndexFileName(cfg)))
+
+	for i := range idx.Snapshots {
+		for j := range idx.Snapshots[i].Files {
+			file := &idx.Snapshots[i].Files[j]
+			x := make([][3]float32, file.N)
+			read_guppy.ReadVar(outputs[i][j], "x", 0, x)
+			if !boundsContain(file.Bounds, x, float32(sim.L)) {
+				t.Errorf("Bounds %v of %s don't contain its particles.",
+					file.Bounds, file.Name)
+			}
+			// Bounds may be slightly wider than the ones computed from the
+			// decompressed positions, so only compare everything else.
+			file.Bounds = read.Snapshots[i].Files[j].Bounds
+		}
+	}
+	if !reflect.DeepEqual(idx, read) {
+		t.Errorf("Expected the written index to be %v, got %v.", read, idx)
+	}
+}
+
+// boundsContain returns true if every position in x is inside the periodic
+// bounding box given by bounds.
+func boundsContain(bounds []float32, x [][3]float32, L float32) bool {
+	if len(bounds) != 6 { return false }
+	for i := range x {
+		for dim := 0; dim < 3; dim++ {
+			dx := x[i][dim] - bounds[dim]
+			if dx < 0 { dx += L }
+			if dx > bounds[dim+3] - bounds[dim] { return false }
+		}
+	}
+	return true
+}
+
+func TestSingleNodeWriteScaledAccuracy(t *testing.T) {
+	// Positions are stored to a fixed physical accuracy, so their comoving
+	// accuracy at z = 1 is twice as large as at z = 0.
+	zs := []float64{ 1, 0 }
+	_, cfg := setupTestWrite(t, 8, 2, zs, "AccuracyScaling = a^-1, 1, 1")
+	if err := SingleNodeWrite(cfg, false, nil, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, _, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	exp := []map[string]float64{
+		{ "x{0}": 0.02, "v{0}": 0.1 },
+		{ "x{0}": 0.01, "v{0}": 0.1 },
+	}
+	for snap := range zs {
+		for _, out := range outputs[snap] {
+			hd := read_guppy.ReadHeader(out)
+			found := 0
+			for i, name := range hd.Names {
+				delta, ok := exp[snap][name]
+				if !ok { continue }
+				found++
+				if math.Abs(hd.Deltas[i] - delta) > 1e-9 {
+					t.Errorf("Expected '%s' in %s to have a delta of %g, " +
+						"got %g.", name, out, delta, hd.Deltas[i])
+				}
+			}
+			if found != len(exp[snap]) {
+				t.Errorf("Expected %s to contain x{0} and v{0}, but it " +
+					"contains %v.", out, hd.Names)
+			}
+		}
+	}
+}
+
+func TestSingleNodeWriteMetadata(t *testing.T) {
+	tests := []struct{
+		extra []string
+		softening float64
+	} {
+		// The default softening is 1/40 of the mean spacing, 100/8.
+		{ []string{ "SimulationName = TestSim" }, 0.3125 },
+		{ []string{ "SimulationName = TestSim", "ForceSoftening = 0.05" },
+			0.05 },
+	}
+
+	for i := range tests {
+		_, cfg := setupTestWrite(t, 8, 2, []float64{ 0 }, tests[i].extra...)
+		if err := SingleNodeWrite(cfg, false, nil, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, _, outputs, err := lib.ExpandFileNames(cfg)
+		if err != nil { t.Fatalf(err.Error()) }
+
+		for _, out := range outputs[0] {
+			md := read_guppy.ReadHeader(out).Metadata
+			name, _ := md.String("Simulation")
+			config, _ := md.String("Config")
+			version, _ := md.Int("GuppyVersion")
+			softening, ok := md.Float("Softening")
+
+			if name != "TestSim" {
+				t.Errorf("%d) Expected %s to have the simulation name " +
+					"TestSim, got '%s'.", i, out, name)
+			}
+			if config != cfg.ConfigText ||
+				!strings.Contains(config, "SimulationName = TestSim") {
+				t.Errorf("%d) Expected %s to store the config file, got " +
+					"'%s'.", i, out, config)
+			}
+			if version != int64(lib.Version) {
+				t.Errorf("%d) Expected %s to have GuppyVersion %d, got %d.",
+					i, out, lib.Version, version)
+			}
+			if !ok || math.Abs(softening - tests[i].softening) > 1e-9 {
+				t.Errorf("%d) Expected %s to have a softening of %g, got %g.",
+					i, out, tests[i].softening, softening)
+			}
+		}
+	}
+}
+
+func TestSingleNodeWriteLogging(t *testing.T) {
+	_, cfg := setupTestWrite(t, 8, 2, []float64{ 0 })
+	_, inputs, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	buf := &bytes.Buffer{ }
+	log := logging.New(buf, logging.JSON, "write")
+	if err := SingleNodeWrite(cfg, false, log, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	recs, err := logging.ParseJSON(buf.String())
+	if err != nil { t.Fatalf(err.Error()) }
+	if n := 1 + len(inputs[0]) + len(outputs[0]) + 1; len(recs) != n {
+		t.Fatalf("Expected %d records, got:\n%s", n, buf.String())
+	}
+	for _, rec := range recs {
+		if rec["mode"] != "write" {
+			t.Errorf("Expected mode = write, got %v.", rec["mode"])
+		}
+	}
+
+	start := recs[0]
+	if start["event"] != "start" || start["outputs"] != 8.0 ||
+		start["finished"] != 0.0 || start["resume"] != false {
+		t.Errorf("Expected a start record for 8 unfinished outputs, got %v.",
+			start)
+	}
+
+	for i, input := range inputs[0] {
+		rec := recs[1 + i]
+		if rec["event"] != "read" || rec["file"] != input ||
+			rec["bytes_in"] != float64(FileSize(input)) ||
+			rec["pass"] != 0.0 || rec["snapshot"] != 0.0 {
+			t.Errorf("Expected a read record for %s, got %v.", input, rec)
+		}
+	}
+
+	// Each output holds 64 particles with 28 bytes each before compression.
+	written := map[string]bool{ }
+	for _, rec := range recs[1 + len(inputs[0]): len(recs) - 1] {
+		file, _ := rec["file"].(string)
+		written[file] = true
+		if rec["event"] != "file" || rec["bytes_in"] != 64*28.0 ||
+			rec["bytes_out"] != float64(FileSize(file)) {
+			t.Errorf("Expected a file record for an output, got %v.", rec)
+		} else if _, ok := rec["ratio"]; !ok {
+			t.Errorf("Expected the file record for %s to have a ratio.", file)
+		}
+	}
+	for _, out := range outputs[0] {
+		if !written[out] { t.Errorf("%s wasn't logged.", out) }
+	}
+
+	finish := recs[len(recs) - 1]
+	if finish["event"] != "finish" || finish["done"] != 8.0 ||
+		finish["jobs"] != 8.0 || finish["files"] != 8.0 {
+		t.Errorf("Expected a finish record for 8 files, got %v.", finish)
+	}
+}
+
+func TestReadLogging(t *testing.T) {
+	_, cfg := setupTestWrite(t, 8, 2, []float64{ 0 })
+	if err := SingleNodeWrite(cfg, false, nil, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, _, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	vars := []string{ "x", "id" }
+	files := outputs[0]
+	hds := make([]*read_guppy.Header, len(files))
+	for i := range files {
+		hds[i], err = ReadHeader(files[i], vars)
+		if err != nil { t.Fatalf(err.Error()) }
+	}
+
+	buf := &bytes.Buffer{ }
+	log := logging.New(buf, logging.Text, "read")
+	prog := logging.NewProgress(log, len(vars)*len(files))
+	rd := &MultiFileReader{ files, hds,
+		&lib.Subsample{ Every: 1, Fraction: 1 }, 2, prog }
+	for _, v := range vars {
+		err := rd.ReadVar(v, func(buf interface{}) error { return nil })
+		if err != nil { t.Fatalf(err.Error()) }
+	}
+	prog.Stop()
+
+	recs, err := logging.ParseText(buf.String())
+	if err != nil { t.Fatalf(err.Error()) }
+	if n := len(vars)*len(files) + 1; len(recs) != n {
+		t.Fatalf("Expected %d records, got:\n%s", n, buf.String())
+	}
+
+	// x is decompressed to 64 12-byte vectors and id to 64 8-byte integers.
+	// IDs aren't stored in the files, so they don't have an input size.
+	outBytes := map[string]string{ "x": "768", "id": "512" }
+	for i, rec := range recs[:len(recs) - 1] {
+		v, file := vars[i / len(files)], files[i % len(files)]
+		if rec["mode"] != "read" || rec["event"] != "file" ||
+			rec["file"] != file || rec["var"] != v ||
+			rec["bytes_out"] != outBytes[v] {
+			t.Errorf("Expected a file record for '%s' in %s, got %v.",
+				v, file, rec)
+		}
+
+		_, hasIn := rec["bytes_in"]
+		if v == "x" {
+			exp := strconv.FormatInt(VarBytes(hds[i % len(files)], v), 10)
+			if rec["bytes_in"] != exp || rec["ratio"] == "" {
+				t.Errorf("Expected the record for '%s' in %s to have " +
+					"bytes_in = %s and a ratio, got %v.", v, file, exp, rec)
+			}
+		} else if hasIn {
+			t.Errorf("Expected the record for '%s' in %s to not have " +
+				"bytes_in, got %v.", v, file, rec)
+		}
+	}
+
+	finish := recs[len(recs) - 1]
+	if finish["event"] != "finish" || finish["done"] != "16" ||
+		finish["jobs"] != "16" || finish["percent"] != "100" ||
+		finish["files"] != "16" {
+		t.Errorf("Expected a finish record for 16 files, got %v.", finish)
+	}
+}
+
+func TestReadSubsampleSeed(t *testing.T) {
+	_, cfg := setupTestWrite(t, 8, 2, []float64{ 0 })
+	if err := SingleNodeWrite(cfg, false, nil, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, _, outputs, err := lib.ExpandFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	files := outputs[0]
+	hds := make([]*read_guppy.Header, len(files))
+	for i := range files {
+		hds[i], err = ReadHeader(files[i], []string{ "id" })
+		if err != nil { t.Fatalf(err.Error()) }
+	}
+
+	// readIDs returns the IDs selected with the given seed.
+	readIDs := func(seed int64) []uint64 {
+		log := logging.New(&bytes.Buffer{ }, logging.Text, "read")
+		sub := &lib.Subsample{ Every: 1, Fraction: 0.5, Seed: seed }
+		rd := &MultiFileReader{ files, hds, sub, 2,
+			logging.NewProgress(log, len(files)) }
+
+		ids := []uint64{ }
+		err := rd.ReadVar("id", func(buf interface{}) error {
+			ids = append(ids, buf.([]uint64)...)
+			return nil
+		})
+		if err != nil { t.Fatalf(err.Error()) }
+		if int64(len(ids)) != rd.Header().N {
+			t.Errorf("Read %d IDs, but the header has N = %d.",
+				len(ids), rd.Header().N)
+		}
+		return ids
+	}
+
+	ids1, ids2, ids3 := readIDs(42), readIDs(42), readIDs(43)
+	if len(ids1) == 0 || len(ids1) == 512 {
+		t.Errorf("Expected about half of the 512 particles to be read, " +
+			"got %d.", len(ids1))
+	}
+	if !reflect.DeepEqual(ids1, ids2) {
+		t.Errorf("Reading with the same seed selected different particles.")
+	} else if reflect.DeepEqual(ids1, ids3) {
+		t.Errorf("Reading with different seeds selected the same particles.")
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	hd := &read_guppy.Header{ }
+	hd.N, hd.NTot, hd.L, hd.Z = 8, 64, 100, 0.5
+	hd.Span, hd.Offset = [3]int64{ 2, 2, 2 }, [3]int64{ 2, 0, 0 }
+	hd.TotalSpan = [3]int64{ 4, 4, 4 }
+
+	b := &bytes.Buffer{ }
+	if err := WriteHeader(hd, b); err != nil { t.Fatalf(err.Error()) }
+	phd, _, err := lib.ReadPipeHeader(b)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	// guppy read writes each variable as a contiguous array.
+	if phd.Format != lib.ArraysFormatCode {
+		t.Errorf("Expected Format = %x, got %x.",
+			lib.ArraysFormatCode, phd.Format)
+	}
+	if phd.N != hd.N || phd.NTot != hd.NTot || phd.L != hd.L ||
+		phd.Z != hd.Z || phd.Origin != hd.Offset ||
+		phd.TotalSpan != hd.TotalSpan {
+		t.Errorf("Header %v was written as %v.", hd, phd)
+	}
+}
@@ -0,0 +1,453 @@
+package lib
+
+/* This file contains guppy's accuracy presets, which choose Accuracies from
+the parameters of a simulation, the scaling laws and tables that let
+accuracies change with redshift, and checks that warn users about accuracies
+that are probably too coarse. */
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+const (
+	// RhoCrit0 is the critical density of the universe today, in h^2
+	// Msun/Mpc^3.
+	RhoCrit0 = 2.77536627e11
+	// GravitationalConstant is G in Mpc (km/s)^2 / Msun.
+	GravitationalConstant = 4.30091e-9
+
+	// DefaultSofteningFraction is the ratio between the force softening and
+	// the mean interparticle spacing that presets assume if ForceSoftening
+	// isn't set.
+	DefaultSofteningFraction = 1.0/40
+	// PresetHaloParticles is the number of particles in the smallest halo
+	// whose velocity structure the presets try to preserve.
+	PresetHaloParticles = 100
+	// PresetHaloOverdensity is the overdensity, relative to the mean matter
+	// density, used to define the radius of that halo.
+	PresetHaloOverdensity = 200
+
+	// WarnSpacingFraction is the fraction of the mean interparticle spacing
+	// above which explicit position accuracies cause a warning. This is
+	// close to the force softening of most simulations, so particles
+	// stored less accurately than this will have their orbits inside small
+	// halos visibly scrambled.
+	WarnSpacingFraction = 1.0/30
+)
+
+// AccuracyPreset describes how a preset chooses accuracies. Position
+// accuracies are a fraction of the force softening, and velocity accuracies
+// are a fraction of the circular velocity of a halo with
+// PresetHaloParticles particles.
+type AccuracyPreset struct {
+	SofteningFraction, VelocityFraction float64
+}
+
+// AccuracyPresets are the presets that can be used with the AccuracyPreset
+// config variable.
+var AccuracyPresets = map[string]AccuracyPreset{
+	"conservative": { 0.1, 0.01 },
+	"fiducial": { 0.5, 0.05 },
+	"aggressive": { 1.0, 0.2 },
+}
+
+// AccuracyPresetNames returns the names of the presets in AccuracyPresets in
+// alphabetical order.
+func AccuracyPresetNames() []string {
+	names := []string{ }
+	for name := range AccuracyPresets { names = append(names, name) }
+	sort.Strings(names)
+	return names
+}
+
+// MeanSpacing returns the mean interparticle spacing of a simulation in
+// comoving Mpc/h.
+func MeanSpacing(hd snapio.Header) float64 {
+	return hd.L() / math.Cbrt(float64(hd.NTot()))
+}
+
+// ParticleMass returns the mass of a particle in Msun/h. If the header
+// doesn't have a mass, it's computed from Omega_m and the size of the box.
+func ParticleMass(hd snapio.Header) float64 {
+	if hd.Mass() > 0 { return hd.Mass() }
+	L := hd.L()
+	return RhoCrit0 * hd.OmegaM() * L*L*L / float64(hd.NTot())
+}
+
+// HaloVelocity returns the circular velocity, in km/s, at the radius of a
+// halo with n particles whose mean physical density is overdensity times the
+// mean matter density at the snapshot's redshift.
+func HaloVelocity(hd snapio.Header, n, overdensity float64) float64 {
+	m := n * ParticleMass(hd)
+	a := 1 / (1 + hd.Z())
+	rhoM := RhoCrit0 * hd.OmegaM() / (a*a*a)
+	r := math.Cbrt(3*m / (4*math.Pi*overdensity*rhoM))
+	return math.Sqrt(GravitationalConstant * m / r)
+}
+
+// PresetAccuracies returns the position and velocity accuracies chosen by a
+// preset for a snapshot. softening is the force softening in comoving Mpc/h.
+// If it isn't positive, DefaultSofteningFraction of the mean interparticle
+// spacing is used instead.
+func PresetAccuracies(
+	name string, softening float64, hd snapio.Header,
+) (dx, dv float64, err error) {
+	preset, ok := AccuracyPresets[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("There's no accuracy preset named '%s'. " +
+			"The valid presets are %s.", name, AccuracyPresetNames())
+	}
+
+	if softening <= 0 {
+		softening = DefaultSofteningFraction * MeanSpacing(hd)
+	}
+	v := HaloVelocity(hd, PresetHaloParticles, PresetHaloOverdensity)
+
+	return preset.SofteningFraction*softening, preset.VelocityFraction*v, nil
+}
+
+// AccuracyScaling is a power law that multiplies an accuracy. It's either
+// a^Power or (1 + z)^Power, where a is the scale factor.
+type AccuracyScaling struct {
+	// Redshift is true if the law is written in terms of 1 + z instead of a.
+	Redshift bool
+	Power float64
+}
+
+// ParseAccuracyScaling parses a scaling law. The valid forms are "1", "a",
+// "a^p", "1+z", "(1+z)", and "(1+z)^p", where p is any number. Whitespace is
+// ignored.
+func ParseAccuracyScaling(s string) (AccuracyScaling, error) {
+	law := strings.Join(strings.Fields(s), "")
+
+	base, power := law, "1"
+	if i := strings.Index(law, "^"); i >= 0 {
+		base, power = law[:i], law[i+1:]
+	}
+
+	p, err := strconv.ParseFloat(power, 64)
+	if err != nil {
+		return AccuracyScaling{ }, fmt.Errorf("'%s' has the exponent " +
+			"'%s', which isn't a number.", s, power)
+	}
+
+	switch base {
+	case "1":
+		if power != "1" { break }
+		return AccuracyScaling{ false, 0 }, nil
+	case "a":
+		return AccuracyScaling{ false, p }, nil
+	case "(1+z)":
+		return AccuracyScaling{ true, p }, nil
+	case "1+z":
+		if power != "1" { break }
+		return AccuracyScaling{ true, p }, nil
+	}
+
+	return AccuracyScaling{ }, fmt.Errorf("'%s' isn't a valid scaling law. " +
+		"Scaling laws must look like 1, a^p, or (1+z)^p.", s)
+}
+
+// Factor returns the factor that the law multiplies accuracies by at
+// redshift z.
+func (law AccuracyScaling) Factor(z float64) float64 {
+	if law.Redshift { return math.Pow(1 + z, law.Power) }
+	return math.Pow(1 / (1 + z), law.Power)
+}
+
+// AccuracyTable is a table of accuracies as a function of scale factor.
+type AccuracyTable struct {
+	// A is the scale factor of each row, in increasing order.
+	A []float64
+	// Accuracies[i] are the accuracies of every variable at A[i].
+	Accuracies [][]float64
+}
+
+// ReadAccuracyTable reads an accuracy table from a text file. Each line
+// contains a scale factor followed by the accuracy of each of the nVars
+// variables. Empty lines and text after '#' are ignored.
+func ReadAccuracyTable(fname string, nVars int) (*AccuracyTable, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil { return nil, err }
+
+	table := &AccuracyTable{ }
+	for i, line := range strings.Split(string(b), "\n") {
+		if j := strings.Index(line, "#"); j >= 0 { line = line[:j] }
+		cols := strings.Fields(line)
+		if len(cols) == 0 { continue }
+
+		if len(cols) != nVars + 1 {
+			return nil, fmt.Errorf("Line %d of the accuracy table %s has " +
+				"%d columns, but it should have %d: the scale factor " +
+				"followed by an accuracy for each of the %d variables.",
+				i + 1, fname, len(cols), nVars + 1, nVars)
+		}
+
+		row := make([]float64, len(cols))
+		for j := range cols {
+			row[j], err = strconv.ParseFloat(cols[j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d of the accuracy table %s " +
+					"contains '%s', which isn't a number.", i + 1, fname,
+					cols[j])
+			}
+		}
+
+		n := len(table.A)
+		if row[0] <= 0 {
+			return nil, fmt.Errorf("Line %d of the accuracy table %s has " +
+				"the scale factor %g, but scale factors must be positive.",
+				i + 1, fname, row[0])
+		} else if n > 0 && row[0] <= table.A[n-1] {
+			return nil, fmt.Errorf("The scale factors in the accuracy " +
+				"table %s must be in increasing order, but line %d has " +
+				"a = %g after a = %g.", fname, i + 1, row[0], table.A[n-1])
+		}
+
+		table.A = append(table.A, row[0])
+		table.Accuracies = append(table.Accuracies, row[1:])
+	}
+
+	if len(table.A) == 0 {
+		return nil, fmt.Errorf("The accuracy table %s is empty.", fname)
+	}
+	return table, nil
+}
+
+// Interpolate returns the accuracies at redshift z, interpolating linearly
+// in scale factor between rows of the table. It returns an error if z is
+// outside the range of the table.
+func (table *AccuracyTable) Interpolate(z float64) ([]float64, error) {
+	a, n := 1 / (1 + z), len(table.A)
+	// Scale factors read from headers are rarely exactly equal to the ones
+	// that users type into tables.
+	eps := 1e-4*a
+
+	if a < table.A[0] - eps || a > table.A[n-1] + eps {
+		return nil, fmt.Errorf("A snapshot has a = %.5g (z = %.5g), which " +
+			"is outside the range of the accuracy table, a = %g to %g.",
+			a, z, table.A[0], table.A[n-1])
+	}
+
+	i := sort.SearchFloat64s(table.A, a)
+	switch {
+	case i == 0:
+		return table.Accuracies[0], nil
+	case i == n:
+		return table.Accuracies[n-1], nil
+	}
+
+	f := (a - table.A[i-1]) / (table.A[i] - table.A[i-1])
+	acc := make([]float64, len(table.Accuracies[i]))
+	for j := range acc {
+		lo, hi := table.Accuracies[i-1][j], table.Accuracies[i][j]
+		acc[j] = lo + f*(hi - lo)
+	}
+	return acc, nil
+}
+
+// SnapshotAccuracies returns the accuracy of every variable in cfg.Vars for
+// the snapshot with the given header. If cfg uses an AccuracyPreset, "x" and
+// "v" are set by PresetAccuracies and integer variables have an accuracy of
+// zero. If it uses an AccuracyTable, the table is interpolated to the
+// snapshot's redshift. Otherwise, cfg.Accuracies is multiplied by
+// cfg.AccuracyScaling, if it's set.
+func SnapshotAccuracies(
+	cfg *WriteConfig, hd snapio.Header,
+) ([]float64, error) {
+	switch {
+	case cfg.AccuracyTable != "":
+		table, err := ReadAccuracyTable(cfg.AccuracyTable, len(cfg.Vars))
+		if err != nil { return nil, err }
+		return table.Interpolate(hd.Z())
+	case cfg.AccuracyPreset == "":
+		return scaledAccuracies(cfg, hd.Z())
+	}
+
+	dx, dv, err := PresetAccuracies(cfg.AccuracyPreset,
+		cfg.ForceSoftening, hd)
+	if err != nil { return nil, err }
+
+	acc := make([]float64, len(cfg.Vars))
+	for i := range cfg.Vars {
+		switch {
+		case cfg.Types[i] == "u32" || cfg.Types[i] == "u64":
+			acc[i] = 0
+		case cfg.Vars[i] == "x":
+			acc[i] = dx
+		case cfg.Vars[i] == "v":
+			acc[i] = dv
+		default:
+			return nil, fmt.Errorf("The variable %s can't use an accuracy " +
+				"preset, since presets only know how to choose accuracies " +
+				"for x and v.", cfg.Vars[i])
+		}
+	}
+
+	return acc, nil
+}
+
+// scaledAccuracies applies cfg.AccuracyScaling to cfg.Accuracies.
+func scaledAccuracies(cfg *WriteConfig, z float64) ([]float64, error) {
+	if len(cfg.AccuracyScaling) == 0 { return cfg.Accuracies, nil }
+
+	acc := make([]float64, len(cfg.Accuracies))
+	for i := range acc {
+		law, err := ParseAccuracyScaling(cfg.AccuracyScaling[i])
+		if err != nil { return nil, err }
+		acc[i] = cfg.Accuracies[i] * law.Factor(z)
+	}
+	return acc, nil
+}
+
+// checkAccuracyScaling checks the AccuracyScaling and AccuracyTable
+// variables of cfg.
+func checkAccuracyScaling(cfg *WriteConfig) error {
+	if cfg.AccuracyTable != "" {
+		if len(cfg.Accuracies) > 0 || cfg.AccuracyPreset != "" ||
+			len(cfg.AccuracyScaling) > 0 {
+			return fmt.Errorf("The AccuracyTable variable was set, so " +
+				"Accuracies, AccuracyPreset, and AccuracyScaling can't be.")
+		}
+
+		table, err := ReadAccuracyTable(cfg.AccuracyTable, len(cfg.Vars))
+		if err != nil {
+			return fmt.Errorf("The AccuracyTable variable was set to %s, " +
+				"but the table couldn't be read: %s", cfg.AccuracyTable,
+				err.Error())
+		}
+
+		for i := range table.A {
+			err := checkAccuracies(cfg.Vars, cfg.Types, table.Accuracies[i])
+			if err != nil {
+				return fmt.Errorf("The row of the accuracy table %s with " +
+					"a = %g is invalid. %s", cfg.AccuracyTable, table.A[i],
+					err.Error())
+			}
+		}
+		return nil
+	}
+
+	if len(cfg.AccuracyScaling) == 0 { return nil }
+
+	if cfg.AccuracyPreset != "" {
+		return fmt.Errorf("AccuracyScaling can't be used with " +
+			"AccuracyPreset, since presets already depend on redshift.")
+	} else if len(cfg.AccuracyScaling) != len(cfg.Vars) {
+		return fmt.Errorf("Vars and AccuracyScaling should have the same " +
+			"length, but they have lengths %d and %d.", len(cfg.Vars),
+			len(cfg.AccuracyScaling))
+	}
+
+	for i := range cfg.AccuracyScaling {
+		if _, err := ParseAccuracyScaling(cfg.AccuracyScaling[i]); err != nil {
+			return fmt.Errorf("The AccuracyScaling variable has an invalid " +
+				"law for %s. %s", cfg.Vars[i], err.Error())
+		}
+	}
+
+	return nil
+}
+
+// checkAccuracyPreset checks the AccuracyPreset and ForceSoftening variables
+// of cfg. It doesn't need a snapshot header.
+func checkAccuracyPreset(cfg *WriteConfig) error {
+	if cfg.AccuracyPreset == "" { return nil }
+
+	if _, ok := AccuracyPresets[cfg.AccuracyPreset]; !ok {
+		return fmt.Errorf("The AccuracyPreset variable was set to '%s', " +
+			"but the only valid presets are %s.", cfg.AccuracyPreset,
+			AccuracyPresetNames())
+	} else if len(cfg.Accuracies) > 0 {
+		return fmt.Errorf("Both the AccuracyPreset and Accuracies variables " +
+			"were set. Only one of them can be used.")
+	}
+
+	for i := range cfg.Vars {
+		switch {
+		case cfg.Types[i] == "u32" || cfg.Types[i] == "u64":
+		case cfg.Vars[i] == "x" || cfg.Vars[i] == "v":
+		default:
+			return fmt.Errorf("The variable %s has type %s, but accuracy " +
+				"presets can only choose accuracies for x and v. Set " +
+				"Accuracies instead of AccuracyPreset.", cfg.Vars[i],
+				cfg.Types[i])
+		}
+	}
+
+	return nil
+}
+
+// AccuracyWarnings returns warnings about the accuracies that cfg will use
+// for the snapshot with the given header. Currently, this warns about
+// position accuracies coarser than WarnSpacingFraction of the mean
+// interparticle spacing.
+func AccuracyWarnings(
+	cfg *WriteConfig, hd snapio.Header,
+) ([]string, error) {
+	acc, err := SnapshotAccuracies(cfg, hd)
+	if err != nil { return nil, err }
+
+	warnings := []string{ }
+	spacing := MeanSpacing(hd)
+	for i := range cfg.Vars {
+		if cfg.Vars[i] != "x" { continue }
+
+		if acc[i] > WarnSpacingFraction*spacing {
+			warnings = append(warnings, fmt.Sprintf("The accuracy of %s, " +
+				"%g comoving Mpc/h, is %.3g times the mean interparticle " +
+				"spacing of %g comoving Mpc/h. Positions this coarse will " +
+				"disrupt the structure of small halos. Accuracies smaller " +
+				"than %.3g comoving Mpc/h are recommended.", cfg.Vars[i],
+				acc[i], acc[i] / spacing, spacing,
+				WarnSpacingFraction*spacing))
+		}
+	}
+
+	return warnings, nil
+}
+
+// AccuracySummary describes the accuracies used for each snapshot, given
+// the header of each snapshot. Consecutive snapshots with the same
+// accuracies are grouped together.
+func AccuracySummary(
+	cfg *WriteConfig, snaps []int, hds []snapio.Header,
+) (string, error) {
+	accs := make([]string, len(snaps))
+	for i := range snaps {
+		acc, err := SnapshotAccuracies(cfg, hds[i])
+		if err != nil {
+			return "", fmt.Errorf("Snapshot %d: %s", snaps[i], err.Error())
+		}
+
+		vars := make([]string, len(acc))
+		for j := range acc {
+			vars[j] = fmt.Sprintf("%s = %.4g", cfg.Vars[j], acc[j])
+		}
+		accs[i] = strings.Join(vars, ", ")
+	}
+
+	lines := []string{ }
+	for start := 0; start < len(snaps); {
+		end := start + 1
+		for end < len(snaps) && accs[end] == accs[start] { end++ }
+
+		if end - start == 1 {
+			lines = append(lines, fmt.Sprintf("Snapshot %d (z = %.3g): " +
+				"%s", snaps[start], hds[start].Z(), accs[start]))
+		} else {
+			lines = append(lines, fmt.Sprintf("Snapshots %d to %d (%d " +
+				"snapshots): %s", snaps[start], snaps[end-1], end - start,
+				accs[start]))
+		}
+		start = end
+	}
+	return strings.Join(lines, "\n"), nil
+}
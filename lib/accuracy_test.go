@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+// testHeader is a snapio.Header with adjustable simulation parameters.
+type testHeader struct {
+	snapio.Header
+	l, z, omegaM, mass float64
+	nTot int64
+}
+
+func (hd *testHeader) L() float64 { return hd.l }
+func (hd *testHeader) Z() float64 { return hd.z }
+func (hd *testHeader) OmegaM() float64 { return hd.omegaM }
+func (hd *testHeader) Mass() float64 { return hd.mass }
+func (hd *testHeader) NTot() int64 { return hd.nTot }
+
+func TestHaloVelocity(t *testing.T) {
+	hd := &testHeader{ l: 100, omegaM: 0.3, mass: 1e10, nTot: 512*512*512 }
+
+	// A 10^12 Msun/h halo has R_200m = 0.243 Mpc/h and V = 133 km/s.
+	v0 := HaloVelocity(hd, 100, 200)
+	if math.Abs(v0 - 133.4) > 1 {
+		t.Errorf("Expected HaloVelocity() = 133.4 km/s, got %.4g.", v0)
+	}
+
+	hd.z = 3
+	if v := HaloVelocity(hd, 100, 200); math.Abs(v/v0 - 2) > 1e-6 {
+		t.Errorf("Expected V(z=3)/V(z=0) = 2, got %.6g.", v/v0)
+	}
+
+	// Without a mass, it's computed from the cosmology.
+	hd.z, hd.mass = 0, 0
+	m := RhoCrit0 * 0.3 * 100*100*100 / float64(512*512*512)
+	if pm := ParticleMass(hd); math.Abs(pm/m - 1) > 1e-6 {
+		t.Errorf("Expected ParticleMass() = %.4g, got %.4g.", m, pm)
+	}
+}
+
+func TestPresetAccuracies(t *testing.T) {
+	hd := &testHeader{ l: 100, omegaM: 0.3, mass: 1e10, nTot: 500*500*500 }
+	v := HaloVelocity(hd, PresetHaloParticles, PresetHaloOverdensity)
+
+	tests := []struct {
+		preset string
+		softening, dx, dv float64
+	} {
+		{ "fiducial", -1, 0.5 * 0.2/40, 0.05*v },
+		{ "fiducial", 0.001, 0.0005, 0.05*v },
+		{ "conservative", 0.001, 0.0001, 0.01*v },
+		{ "aggressive", 0.001, 0.001, 0.2*v },
+	}
+
+	for i := range tests {
+		dx, dv, err := PresetAccuracies(tests[i].preset,
+			tests[i].softening, hd)
+		if err != nil { t.Fatalf(err.Error()) }
+		if math.Abs(dx/tests[i].dx - 1) > 1e-6 ||
+			math.Abs(dv/tests[i].dv - 1) > 1e-6 {
+			t.Errorf("%d) Expected PresetAccuracies() = (%g, %g), got " +
+				"(%g, %g).", i, tests[i].dx, tests[i].dv, dx, dv)
+		}
+	}
+
+	if _, _, err := PresetAccuracies("meow", 0.001, hd); err == nil {
+		t.Errorf("Expected error for an unknown preset.")
+	}
+}
+
+func TestSnapshotAccuracies(t *testing.T) {
+	hd := &testHeader{ l: 100, omegaM: 0.3, mass: 1e10, nTot: 500*500*500 }
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "v", "id" },
+		Types: []string{ "v32", "v32", "u64" },
+		AccuracyPreset: "fiducial", ForceSoftening: 0.001,
+	}
+	if err := checkAccuracyPreset(cfg); err != nil { t.Fatalf(err.Error()) }
+
+	acc, err := SnapshotAccuracies(cfg, hd)
+	if err != nil { t.Fatalf(err.Error()) }
+	dx, dv, _ := PresetAccuracies("fiducial", 0.001, hd)
+	if len(acc) != 3 || acc[0] != dx || acc[1] != dv || acc[2] != 0 {
+		t.Errorf("Expected accuracies [%g %g 0], got %g.", dx, dv, acc)
+	}
+
+	cfg.Accuracies = []float64{ 0.001, 1, 0 }
+	if err := checkAccuracyPreset(cfg); err == nil {
+		t.Errorf("Expected error when Accuracies and AccuracyPreset are " +
+			"both set.")
+	}
+
+	cfg.AccuracyPreset = ""
+	acc, err = SnapshotAccuracies(cfg, hd)
+	if err != nil { t.Fatalf(err.Error()) }
+	if acc[0] != 0.001 || acc[1] != 1 || acc[2] != 0 {
+		t.Errorf("Expected Accuracies to be used without a preset, got %g.",
+			acc)
+	}
+
+	cfg = &WriteConfig{
+		Vars: []string{ "x", "phi" }, Types: []string{ "v32", "f32" },
+		AccuracyPreset: "fiducial",
+	}
+	if err := checkAccuracyPreset(cfg); err == nil {
+		t.Errorf("Expected error for a preset with a variable besides x " +
+			"and v.")
+	}
+	cfg.AccuracyPreset = "meow"
+	cfg.Vars, cfg.Types = cfg.Vars[:1], cfg.Types[:1]
+	if err := checkAccuracyPreset(cfg); err == nil {
+		t.Errorf("Expected error for an unknown preset.")
+	}
+}
+
+func TestAccuracyWarnings(t *testing.T) {
+	// The mean interparticle spacing is 0.2 Mpc/h.
+	hd := &testHeader{ l: 100, omegaM: 0.3, mass: 1e10, nTot: 500*500*500 }
+	tests := []struct {
+		acc []float64
+		preset string
+		warn bool
+	} {
+		{ []float64{ 0.001, 1, 0 }, "", false },
+		{ []float64{ 0.006, 1, 0 }, "", false },
+		{ []float64{ 0.007, 1, 0 }, "", true },
+		{ nil, "aggressive", false },
+	}
+
+	for i := range tests {
+		cfg := &WriteConfig{
+			Vars: []string{ "x", "v", "id" },
+			Types: []string{ "v32", "v32", "u64" },
+			Accuracies: tests[i].acc, AccuracyPreset: tests[i].preset,
+		}
+		warnings, err := AccuracyWarnings(cfg, hd)
+		if err != nil { t.Fatalf(err.Error()) }
+		if warn := len(warnings) > 0; warn != tests[i].warn {
+			t.Errorf("%d) Expected warning = %v, got warnings %q.",
+				i, tests[i].warn, warnings)
+		}
+	}
+}
+
+func TestParseAccuracyScaling(t *testing.T) {
+	tests := []struct {
+		law string
+		valid bool
+		z, factor float64
+	} {
+		{ "1", true, 3, 1 },
+		{ "a", true, 3, 0.25 },
+		{ "a^2", true, 3, 1.0/16 },
+		{ " a ^ -1 ", true, 3, 4 },
+		{ "1+z", true, 3, 4 },
+		{ "(1+z)", true, 3, 4 },
+		{ "(1 + z)^-0.5", true, 3, 0.5 },
+		{ "1+z^2", false, 0, 0 },
+		{ "1^2", false, 0, 0 },
+		{ "a^b", false, 0, 0 },
+		{ "z", false, 0, 0 },
+		{ "", false, 0, 0 },
+	}
+
+	for i := range tests {
+		law, err := ParseAccuracyScaling(tests[i].law)
+		if !tests[i].valid {
+			if err == nil {
+				t.Errorf("%d) Expected '%s' to be invalid.", i, tests[i].law)
+			}
+			continue
+		}
+
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		if f := law.Factor(tests[i].z); math.Abs(f - tests[i].factor) > 1e-12 {
+			t.Errorf("%d) Expected '%s' to give %g at z = %g, got %g.",
+				i, tests[i].law, tests[i].factor, tests[i].z, f)
+		}
+	}
+}
+
+func TestAccuracyTable(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "accuracies.txt")
+	text := `# a   x      v     id
+0.25  0.004  4     0
+0.5   0.002  2     0 # Comment
+1.0   0.001  1     0
+`
+	err := os.WriteFile(fname, []byte(text), 0644)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	table, err := ReadAccuracyTable(fname, 3)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	tests := []struct {
+		z float64
+		acc []float64
+	} {
+		{ 3, []float64{ 0.004, 4, 0 } },
+		{ 1, []float64{ 0.002, 2, 0 } },
+		{ 0, []float64{ 0.001, 1, 0 } },
+		{ 1/0.75 - 1, []float64{ 0.0015, 1.5, 0 } },
+		{ 1/0.375 - 1, []float64{ 0.003, 3, 0 } },
+		{ 1/0.2500001 - 1, []float64{ 0.004, 4, 0 } },
+	}
+
+	for i := range tests {
+		acc, err := table.Interpolate(tests[i].z)
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		for j := range acc {
+			if math.Abs(acc[j] - tests[i].acc[j]) > 1e-6*tests[i].acc[j] {
+				t.Errorf("%d) Expected accuracies %g at z = %g, got %g.",
+					i, tests[i].acc, tests[i].z, acc)
+				break
+			}
+		}
+	}
+
+	if _, err := table.Interpolate(4); err == nil {
+		t.Errorf("Expected error for a redshift outside the table.")
+	}
+
+	badTables := []string{
+		"",
+		"0.5 0.002 2\n",
+		"0.5 0.002 2 0\n0.25 0.004 4 0\n",
+		"0 0.002 2 0\n",
+		"0.5 0.002 meow 0\n",
+	}
+	for i := range badTables {
+		err := os.WriteFile(fname, []byte(badTables[i]), 0644)
+		if err != nil { t.Fatalf(err.Error()) }
+		if _, err := ReadAccuracyTable(fname, 3); err == nil {
+			t.Errorf("%d) Expected error when reading %q.", i, badTables[i])
+		}
+	}
+}
+
+func TestRedshiftAccuracies(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "accuracies.txt")
+	err := os.WriteFile(fname, []byte("0.5 0.002 2 0\n1 0.001 1 0\n"), 0644)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	hd := &testHeader{ l: 100, omegaM: 0.3, mass: 1e10, nTot: 500*500*500 }
+	vars, types := []string{ "x", "v", "id" }, []string{ "v32", "v32", "u64" }
+	tests := []struct {
+		cfg *WriteConfig
+		z float64
+		acc []float64
+	} {
+		{ &WriteConfig{ Accuracies: []float64{ 0.001, 1, 0 },
+			AccuracyScaling: []string{ "a^-1", "(1+z)^-0.5", "1" } },
+			3, []float64{ 0.004, 0.5, 0 } },
+		{ &WriteConfig{ Accuracies: []float64{ 0.001, 1, 0 } },
+			3, []float64{ 0.001, 1, 0 } },
+		{ &WriteConfig{ AccuracyTable: fname },
+			1, []float64{ 0.002, 2, 0 } },
+	}
+
+	for i := range tests {
+		tests[i].cfg.Vars, tests[i].cfg.Types = vars, types
+		if err := checkAccuracyScaling(tests[i].cfg); err != nil {
+			t.Fatalf("%d) %s", i, err.Error())
+		}
+
+		hd.z = tests[i].z
+		acc, err := SnapshotAccuracies(tests[i].cfg, hd)
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		for j := range acc {
+			if math.Abs(acc[j] - tests[i].acc[j]) > 1e-9*tests[i].acc[j] {
+				t.Errorf("%d) Expected accuracies %g, got %g.",
+					i, tests[i].acc, acc)
+				break
+			}
+		}
+	}
+
+	badCfgs := []*WriteConfig{
+		{ Accuracies: []float64{ 0.001, 1, 0 },
+			AccuracyScaling: []string{ "a", "a" } },
+		{ Accuracies: []float64{ 0.001, 1, 0 },
+			AccuracyScaling: []string{ "a", "a", "b" } },
+		{ AccuracyPreset: "fiducial",
+			AccuracyScaling: []string{ "a", "a", "1" } },
+		{ AccuracyTable: fname, Accuracies: []float64{ 0.001, 1, 0 } },
+		{ AccuracyTable: filepath.Join(filepath.Dir(fname), "missing.txt") },
+	}
+	for i := range badCfgs {
+		badCfgs[i].Vars, badCfgs[i].Types = vars, types
+		if err := checkAccuracyScaling(badCfgs[i]); err == nil {
+			t.Errorf("%d) Expected checkAccuracyScaling() to fail.", i)
+		}
+	}
+
+	// Integer variables in tables must have an accuracy of zero.
+	err = os.WriteFile(fname, []byte("1 0.001 1 1\n"), 0644)
+	if err != nil { t.Fatalf(err.Error()) }
+	cfg := &WriteConfig{ Vars: vars, Types: types, AccuracyTable: fname }
+	if err := checkAccuracyScaling(cfg); err == nil {
+		t.Errorf("Expected error for a table with a non-zero id accuracy.")
+	}
+}
+
+func TestAccuracySummary(t *testing.T) {
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "id" }, Types: []string{ "v32", "u64" },
+		Accuracies: []float64{ 0.001, 0 },
+		AccuracyScaling: []string{ "a^-1", "1" },
+	}
+	zs := []float64{ 3, 1, 1, 1, 0 }
+	snaps, hds := []int{ 10, 20, 21, 22, 30 }, []snapio.Header{ }
+	for _, z := range zs {
+		hds = append(hds, &testHeader{ l: 100, omegaM: 0.3, z: z,
+			mass: 1e10, nTot: 500*500*500 })
+	}
+
+	summary, err := AccuracySummary(cfg, snaps, hds)
+	if err != nil { t.Fatalf(err.Error()) }
+	expected := []string{
+		"Snapshot 10 (z = 3): x = 0.004, id = 0",
+		"Snapshots 20 to 22 (3 snapshots): x = 0.002, id = 0",
+		"Snapshot 30 (z = 0): x = 0.001, id = 0",
+	}
+	lines := strings.Split(summary, "\n")
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected summary:\n%s\ngot:\n%s",
+			strings.Join(expected, "\n"), summary)
+	}
+}
@@ -29,6 +29,14 @@ const (
 	LagrangianDeltaFlag MethodFlag = iota
 )
 
+// String returns the name of the method represented by the flag.
+func (flag MethodFlag) String() string {
+	switch flag {
+	case LagrangianDeltaFlag: return "LagrangianDelta"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint32(flag))
+}
+
 // GetTypeFlag returns the type flag associated with an array. Only []uint32,
 // []uint64, []float32, and []float64 are supported.
 func GetTypeFlag(x interface{}) TypeFlag {
@@ -213,6 +221,17 @@ type Method interface {
 	SetOrder(order binary.ByteOrder)
 	// Span returns the span of the data compressed by the method.
 	Span() [3]int
+	// Delta returns the accuracy that floating point data is stored to.
+	// This may be smaller than the accuracy the method was created with if
+	// it needed to be adjusted to evenly divide the period.
+	Delta() float64
+	// Period returns the periodicity of the data, or a non-positive number
+	// if the data isn't periodic.
+	Period() float64
+	// SetPeriod sets the periodicity of the data. The period isn't stored in
+	// the method's header, so this must be called before decompressing
+	// periodic data.
+	SetPeriod(period float64)
 
 	// WriteInfo writes initialization information to a Writer.
 	WriteInfo(wr io.Writer) error
@@ -265,6 +284,15 @@ func (m *LagrangianDelta) MethodFlag() MethodFlag {
 // (see documentaion for the Method interface)
 func (m *LagrangianDelta) Span() [3]int { return m.span }
 
+// (see documentaion for the Method interface)
+func (m *LagrangianDelta) Delta() float64 { return m.delta }
+
+// (see documentaion for the Method interface)
+func (m *LagrangianDelta) Period() float64 { return m.period }
+
+// (see documentaion for the Method interface)
+func (m *LagrangianDelta) SetPeriod(period float64) { m.period = period }
+
 // (see documentaion for the Method interface)
 func (m *LagrangianDelta) WriteInfo(wr io.Writer) error {
 	span64 := [3]uint64{uint64(m.span[0]), uint64(m.span[1]), uint64(m.span[2])}
@@ -305,6 +333,37 @@ func (m *LagrangianDelta) ReadInfo(order binary.ByteOrder, rd io.Reader) error {
 func (m *LagrangianDelta) Compress(
 	f particles.Field, buf *Buffer, wr io.Writer,
 ) error {
+	hd := m.encode(f, buf)
+	err := binary.Write(wr, m.order, hd)
+	if err != nil { return err }
+
+	// Write to disk.
+	buf.bZStd, err = WriteCompressedIntsZStd(buf.i64, buf.b, buf.bZStd, wr)
+	if err != nil {
+		return fmt.Errorf("zlib error while writing block '%s': %s",
+			f.Name(), err.Error())
+	}
+
+	return err
+}
+
+// AppendEncoded quantizes and delta-encodes f exactly like Compress does, but
+// appends the resulting integers to out instead of entropy coding them. The
+// integers from several blocks can then be entropy coded together to estimate
+// how well a field will compress without paying for the per-block overhead of
+// many small blocks.
+func (m *LagrangianDelta) AppendEncoded(
+	f particles.Field, buf *Buffer, out []int64,
+) []int64 {
+	m.encode(f, buf)
+	return append(out, buf.i64...)
+}
+
+// encode quantizes and delta-encodes f into buf.i64 and returns the header
+// that needs to be written before the block.
+func (m *LagrangianDelta) encode(
+	f particles.Field, buf *Buffer,
+) *lagrangianDeltaHeader {
 	buf.Resize(f.Len())
 
 	typeFlag := GetTypeFlag(f.Data())
@@ -332,18 +391,7 @@ func (m *LagrangianDelta) Compress(
 	
 	RotateEncode(buf.i64, rot)
 
-	hd := &lagrangianDeltaHeader{ typeFlag, buf.q[0], rot }
-	err := binary.Write(wr, m.order, hd)
-	if err != nil { return err }
-
-	// Write to disk.
-	buf.bZStd, err = WriteCompressedIntsZStd(buf.i64, buf.b, buf.bZStd, wr)
-	if err != nil {
-		return fmt.Errorf("zlib error while writing block '%s': %s",
-			f.Name(), err.Error())
-	}
-
-	return err
+	return &lagrangianDeltaHeader{ typeFlag, buf.q[0], rot }
 }
 
 // CooseFirstDim chooses the first encoded dimension for a variable with a
@@ -310,6 +310,40 @@ func TestLagrangianDelta(t *testing.T) {
 	}
 }
 
+func TestAppendEncoded(t *testing.T) {
+	span := [3]int{ 8, 4, 2 }
+	data := make([]float64, 8*4*2)
+	for i := range data { data[i] = rand.Float64() }
+	f := particles.NewFloat64("x[0]", data)
+
+	// Entropy coding the appended integers should give the same bytes that
+	// Compress writes after its block header.
+	buf := NewBuffer(0)
+	m := NewLagrangianDelta(span, 1e-3, 1.0)
+	wr := bytes.NewBuffer([]byte{ })
+	if err := m.Compress(f, buf, wr); err != nil { t.Fatalf(err.Error()) }
+
+	prefix := []int64{ 1, 2, 3 }
+	ints := m.AppendEncoded(f, buf, prefix)
+	if len(ints) != len(prefix) + len(data) {
+		t.Fatalf("Expected %d integers, got %d.",
+			len(prefix) + len(data), len(ints))
+	} else if ints[0] != 1 || ints[1] != 2 || ints[2] != 3 {
+		t.Errorf("AppendEncoded() overwrote the start of its output array.")
+	}
+
+	encoded := bytes.NewBuffer([]byte{ })
+	_, err := WriteCompressedIntsZStd(ints[len(prefix):],
+		make([]byte, len(data)), nil, encoded)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	block := wr.Bytes()[binary.Size(lagrangianDeltaHeader{ }):]
+	if !bytes.Equal(block, encoded.Bytes()) {
+		t.Errorf("Entropy coded output of AppendEncoded() doesn't match " +
+			"Compress().")
+	}
+}
+
 func TestSplitArray(t *testing.T) {
 	tests := []struct{
 		x []int64
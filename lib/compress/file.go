@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"io"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/phil-mansfield/guppy/lib/particles"
 	"github.com/phil-mansfield/guppy/lib/snapio"
@@ -20,10 +25,27 @@ const (
 	MagicNumber = 0xbadf00d0
 	// ReverseMagicNumber is the magic number if read on a machine with 
 	// flipped endianness.
-	ReverseMagicNumber = 0xd000fdba
-	Version = 1
+	ReverseMagicNumber = 0xd000dfba
+	// EndMagicNumber is written at the very end of every guppy file, followed
+	// by the total size of the file. Files which are missing it were not
+	// completely written.
+	EndMagicNumber = 0xf00dd0d0
+	// Version is the current version of the .gup format. Version 1 files do
+	// not have an end-of-file marker, files before version 3 do not have
+	// block checksums, files before version 4 do not have a metadata
+	// section, and files before version 5 do not store the period and units
+	// of each field.
+	Version = 5
+
+	// footerSize is the number of bytes used by the end-of-file marker.
+	footerSize = 12
 )
 
+// crcTable is the table used to compute block checksums. The Castagnoli
+// polynomial (CRC32C) is used because it's hardware-accelerated on most
+// machines.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // Writer is a class which handles writing to disk. The pattern is that you
 // create a single writer wiht NewWriter, add fields to it with AddField, and
 // to finally call Flush() when you want to flush all the buffers and write to
@@ -35,7 +57,13 @@ type Writer struct {
 	order binary.ByteOrder
 	methodFlags []uint32
 	headerEdges, dataEdges []int64
+	headerChecksums, dataChecksums []uint32
 	header, data *bytes.Buffer
+
+	// Size and CRC32C are the size of the file in bytes and the CRC32C
+	// checksum of its contents. They're set by Flush().
+	Size int64
+	CRC32C uint32
 }
 
 // NewWriter creates a Writer targeting a given file and using a given byte
@@ -55,8 +83,8 @@ func NewWriter(
 
 	return &Writer{
 		*hd, fname, buf, order, []uint32{},
-		[]int64{0}, []int64{0},
-		header, data,
+		[]int64{0}, []int64{0}, []uint32{}, []uint32{},
+		header, data, 0, 0,
 	}
 }
 
@@ -77,16 +105,35 @@ func (wr *Writer) AddField(field particles.Field, method Method) error {
 	err = method.Compress(field, wr.buf, wr.data)
 	if err != nil { return err }
 
+	bHeader := wr.header.Bytes()[wr.headerEdges[len(wr.headerEdges) - 1]:]
+	bData := wr.data.Bytes()[wr.dataEdges[len(wr.dataEdges) - 1]:]
+	wr.headerChecksums = append(wr.headerChecksums,
+		crc32.Checksum(bHeader, crcTable))
+	wr.dataChecksums = append(wr.dataChecksums,
+		crc32.Checksum(bData, crcTable))
+
 	wr.headerEdges = append(wr.headerEdges, int64(wr.header.Len()))
 	wr.dataEdges = append(wr.dataEdges, int64(wr.data.Len()))
 	wr.methodFlags = append(wr.methodFlags, uint32(method.MethodFlag()))
 
 	wr.Names = append(wr.Names, field.Name())
+	wr.Methods = append(wr.Methods, method.MethodFlag().String())
+	wr.Units = append(wr.Units, DefaultUnits(field.Name()))
+	wr.Periods = append(wr.Periods, method.Period())
 	switch field.Data().(type) {
-	case []uint32: wr.Types = append(wr.Types, "u32")
-	case []uint64: wr.Types = append(wr.Types, "u64")
-	case []float32: wr.Types = append(wr.Types, "f32")
-	case []float64: wr.Types = append(wr.Types, "f64")
+	// Integers are stored exactly, regardless of the method's delta.
+	case []uint32:
+		wr.Types = append(wr.Types, "u32")
+		wr.Deltas = append(wr.Deltas, 0)
+	case []uint64:
+		wr.Types = append(wr.Types, "u64")
+		wr.Deltas = append(wr.Deltas, 0)
+	case []float32:
+		wr.Types = append(wr.Types, "f32")
+		wr.Deltas = append(wr.Deltas, method.Delta())
+	case []float64:
+		wr.Types = append(wr.Types, "f64")
+		wr.Deltas = append(wr.Deltas, method.Delta())
 	default:
 		panic(fmt.Sprintf("Internal error: unknown-typed " + 
 			"paritcles.Field (name: '%s') given " + 
@@ -96,12 +143,149 @@ func (wr *Writer) AddField(field particles.Field, method Method) error {
 	return nil
 }
 
+// SetUnits sets the units of a field which has already been added to the
+// Writer. By default, fields are given the units returned by DefaultUnits().
+func (wr *Writer) SetUnits(name, units string) error {
+	i := findString(wr.Names, name)
+	if i == -1 {
+		return fmt.Errorf("Cannot set the units of '%s' because it hasn't " +
+			"been added to the file. The file only contains the fields %s.",
+			name, wr.Names)
+	}
+	wr.Units[i] = units
+	return nil
+}
+
+// DefaultUnits returns the units of a field with the given name in guppy's
+// code units: comoving Mpc/h for positions and Gadget's velocity units for
+// velocities. Gadget stores v_pec/sqrt(a), where v_pec is the peculiar
+// velocity in km/s, so velocities are labeled "km/s/sqrt(a)". An empty
+// string is returned for any other field.
+func DefaultUnits(name string) string {
+	switch name {
+	case "x", "x{0}", "x{1}", "x{2}": return "cMpc/h"
+	case "v", "v{0}", "v{1}", "v{2}": return "km/s/sqrt(a)"
+	}
+	return ""
+}
+
 // Flush flushes the internal buffers to disk. It returns a (potentially
 // cap-expanded) byte array that can be passed to later call to NewWriter().
+//
+// The file is written with AtomicWrite, so if the process is killed partway
+// through Flush(), there will never be a truncated file with the final name
+// on disk. The size and checksum of the file are computed as it's written
+// and stored in wr.Size and wr.CRC32C.
 func (wr *Writer) Flush() ([]byte, error) {
-	fp, err := os.Create(wr.fname)
-	if err != nil { return nil, err }
-	defer fp.Close()
+	var b []byte
+	h := crc32.New(crcTable)
+	err := AtomicWrite(wr.fname, func(f io.Writer) error {
+		var err error
+		cw := &countingWriter{ w: io.MultiWriter(f, h) }
+		b, err = wr.write(cw)
+		wr.Size = cw.n
+		return err
+	})
+	wr.CRC32C = h.Sum32()
+	return b, err
+}
+
+// countingWriter is an io.Writer which counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// AtomicWrite writes the file fname by passing a temporary file in the same
+// directory to write. The temporary file is synced and then renamed to
+// fname, and the directory is synced after the rename so the new name
+// survives a crash, too. This means that an interrupted write never leaves a
+// partial file with the final name on disk. Temporary files left behind by
+// killed processes can be cleaned up with RemoveTempFiles.
+//
+// New files get the usual permissions, 0666 minus the umask. If fname
+// already exists, its permissions are kept.
+func AtomicWrite(fname string, write func(f io.Writer) error) error {
+	dir, base := filepath.Split(fname)
+	if dir == "" { dir = "." }
+	fp, err := createTemp(dir, "." + base + ".tmp")
+	if err != nil { return err }
+	tmpName := fp.Name()
+
+	err = write(fp)
+	if info, statErr := os.Stat(fname); err == nil && statErr == nil {
+		err = fp.Chmod(info.Mode().Perm())
+	}
+	if err == nil { err = fp.Sync() }
+	if closeErr := fp.Close(); err == nil { err = closeErr }
+	if err == nil { err = os.Rename(tmpName, fname) }
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// createTemp creates a new file in dir whose name is prefix followed by a
+// random number. Unlike os.CreateTemp, which always uses the mode 0600, the
+// file is created with the mode 0666, which the OS restricts with the umask.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, prefix +
+			strconv.FormatUint(uint64(rand.Uint32()), 10))
+		fp, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) { continue }
+		return fp, err
+	}
+	return nil, fmt.Errorf("Could not find an unused temporary file name " +
+		"starting with %s in %s.", prefix, dir)
+}
+
+// syncDir syncs a directory to disk, which makes renames inside it durable.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil { return err }
+	err = fp.Sync()
+	if closeErr := fp.Close(); err == nil { err = closeErr }
+	return err
+}
+
+// RemoveTempFiles removes the temporary files left behind if a process was
+// killed while Flush() was writing the file fname. It returns the names of
+// the files that were removed.
+func RemoveTempFiles(fname string) ([]string, error) {
+	dir, base := filepath.Split(fname)
+	if dir == "" { dir = "." }
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) { return nil, nil }
+		return nil, err
+	}
+
+	removed := []string{ }
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "." + base + ".tmp") { continue }
+		name := filepath.Join(dir, entry.Name())
+		if err := os.Remove(name); err != nil { return removed, err }
+		removed = append(removed, name)
+	}
+
+	return removed, nil
+}
+
+// write writes the contents of the file to fp, including the end-of-file
+// marker. It returns the same byte array as Flush().
+func (wr *Writer) write(fp io.Writer) ([]byte, error) {
+	var err error
 
 	// Number of bytes used by the file's header (i.e. not the method headers)
 	nHd := 0
@@ -125,6 +309,8 @@ func (wr *Writer) Flush() ([]byte, error) {
 	nHd += 4*len(wr.methodFlags) // methodFalgs size
 	nHd += 8*len(wr.headerEdges) // headerEdges size
 	nHd += 8*len(wr.dataEdges) // dataEdges size
+	nHd += 4*len(wr.headerChecksums) // headerChecksums size
+	nHd += 4*len(wr.dataChecksums) // dataChecksums size
 
 	headerOffset := int64(nHd)
 	dataOffset := int64(nHd) + wr.headerEdges[len(wr.headerEdges) - 1]
@@ -139,6 +325,10 @@ func (wr *Writer) Flush() ([]byte, error) {
 	if err != nil { return nil, err}
 	err = binary.Write(fp, wr.order, wr.dataEdges)
 	if err != nil { return nil, err }
+	err = binary.Write(fp, wr.order, wr.headerChecksums)
+	if err != nil { return nil, err }
+	err = binary.Write(fp, wr.order, wr.dataChecksums)
+	if err != nil { return nil, err }
 
 	// Write the  header and data
 	bHeader := wr.header.Bytes()
@@ -150,6 +340,13 @@ func (wr *Writer) Flush() ([]byte, error) {
 	_, err = fp.Write(bData)
 	if err != nil { return bData[:0], err }
 
+	// Write the end-of-file marker.
+	fileSize := dataOffset + int64(len(bData)) + footerSize
+	err = binary.Write(fp, wr.order, uint32(EndMagicNumber))
+	if err != nil { return bData[:0], err }
+	err = binary.Write(fp, wr.order, fileSize)
+	if err != nil { return bData[:0], err }
+
 	return bData, nil
 }
 
@@ -180,6 +377,17 @@ type Header struct {
 	// and 64-bit floats, respectively.
 	Names, Types []string
 	Sizes []int64
+	// Methods gives the name of the compression method used for each
+	// variable and Deltas gives the accuracy each variable is stored to (after
+	// any adjustment needed to evenly divide its period). Periods gives the
+	// periodicity of each variable, which is non-positive for non-periodic
+	// variables, and Units gives their units. The implicit "id" variable is
+	// stored exactly and has the method "None".
+	Methods, Units []string
+	Deltas, Periods []float64
+	// Metadata contains typed key/value pairs describing the file. It is
+	// empty for files written before version 4.
+	Metadata Metadata
 }
 
 func convertSnapioHeader(
@@ -192,21 +400,27 @@ func convertSnapioHeader(
 			snapioHeader.OmegaL(), snapioHeader.H100(),
 			snapioHeader.L(), snapioHeader.Mass()},
 		snapioHeader.ToBytes(), []string{}, []string{}, []int64{},
+		[]string{}, []string{}, []float64{}, []float64{}, Metadata{},
 	}	
 }
 
-func (hd *Header) read(f io.Reader, order binary.ByteOrder) error {
+// read reads a header written with the given version of the format.
+func (hd *Header) read(
+	f *io.LimitedReader, order binary.ByteOrder, version uint32,
+) error {
 	err := binary.Read(f, order, &hd.FixedWidthHeader)
 	if err != nil { return err }
 
 	var nOHeader uint32
 	if err := binary.Read(f, order, &nOHeader); err != nil { return err }
+	if int64(nOHeader) > f.N { return headerLengthError(nOHeader, f.N) }
 	hd.OriginalHeader = make([]byte, nOHeader)
 
 	if _, err := f.Read(hd.OriginalHeader); err != nil { return err }
 
 	var nFields uint32
 	if err := binary.Read(f, order, &nFields); err != nil { return err }
+	if 4*int64(nFields) > f.N { return headerLengthError(nFields, f.N) }
 	hd.Names, hd.Types = make([]string, nFields+1), make([]string, nFields+1)
 	hd.Sizes = make([]int64, nFields+1)
 
@@ -214,6 +428,7 @@ func (hd *Header) read(f io.Reader, order binary.ByteOrder) error {
 	if err := binary.Read(f, order, nNames); err != nil { return err }
 
 	for i := 0; i < len(nNames); i++ {
+		if int64(nNames[i]) > f.N { return headerLengthError(nNames[i], f.N) }
 		b := make([]byte, nNames[i])
 		if _, err = f.Read(b); err != nil { return err }
 		hd.Names[i] = string(b)
@@ -226,9 +441,45 @@ func (hd *Header) read(f io.Reader, order binary.ByteOrder) error {
 	}
 
 	hd.Names[nFields], hd.Types[nFields] = "id", "u64"
+
+	hd.Metadata = Metadata{}
+	if version >= 4 {
+		hd.Metadata, err = readMetadata(f, order)
+		if err != nil { return err }
+	}
+
+	hd.Methods, hd.Units = make([]string, nFields+1), make([]string, nFields+1)
+	hd.Deltas = make([]float64, nFields+1)
+	hd.Periods = make([]float64, nFields+1)
+	hd.Methods[nFields] = "None"
+
+	if version >= 5 {
+		for i := 0; i < int(nFields); i++ {
+			err = binary.Read(f, order, &hd.Deltas[i])
+			if err != nil { return err }
+			err = binary.Read(f, order, &hd.Periods[i])
+			if err != nil { return err }
+			units, err := readLengthPrefixed(f, order)
+			if err != nil { return err }
+			hd.Units[i] = string(units)
+		}
+	} else {
+		// Older files didn't store this information. Positions were always
+		// periodic and everything was in code units. The deltas are stored
+		// in the method headers and need to be set by the caller.
+		for i := 0; i < int(nFields); i++ {
+			switch hd.Names[i] {
+			case "x", "x{0}", "x{1}", "x{2}": hd.Periods[i] = hd.L
+			}
+			hd.Units[i] = DefaultUnits(hd.Names[i])
+		}
+	}
+
 	return nil
 }
 
+// write writes the header using the current version of the format and returns
+// the number of bytes written.
 func (hd *Header) write(f io.Writer, order binary.ByteOrder) (int, error) {
 	n := 0
 	err := binary.Write(f, order, &hd.FixedWidthHeader)
@@ -263,6 +514,29 @@ func (hd *Header) write(f io.Writer, order binary.ByteOrder) (int, error) {
 		n += 3
 	}
 
+	nMetadata, err := hd.Metadata.write(f, order)
+	if err != nil { return 0, err }
+	n += nMetadata
+
+	if len(hd.Deltas) != len(hd.Names) || len(hd.Periods) != len(hd.Names) ||
+		len(hd.Units) != len(hd.Names) {
+		panic(fmt.Sprintf("Internal error: header has %d names, but %d " +
+			"deltas, %d periods, and %d units.", len(hd.Names),
+			len(hd.Deltas), len(hd.Periods), len(hd.Units)))
+	}
+
+	for i := range hd.Names {
+		units := []byte(hd.Units[i])
+		err = binary.Write(f, order, hd.Deltas[i])
+		if err != nil { return 0, err }
+		err = binary.Write(f, order, hd.Periods[i])
+		if err != nil { return 0, err }
+		err = binary.Write(f, order, uint32(len(units)))
+		if err != nil { return 0, err }
+		if _, err = f.Write(units); err != nil { return 0, err }
+		n += 8 + 8 + 4 + len(units)
+	}
+
 	return n, nil
 }
 
@@ -273,8 +547,13 @@ type Reader struct {
 	fname string
 	f *os.File
 	order binary.ByteOrder
+	version uint32
 	headerEdges, dataEdges []int64
 	methodFlags []MethodFlag
+	// headerChecksums and dataChecksums are the CRC32C checksums of each
+	// method header and data block. They are nil for files written before
+	// version 3.
+	headerChecksums, dataChecksums []uint32
 	buf *Buffer
 
 	// I don't udnerstand why, but Go's zlib library crashes if I read directly
@@ -291,34 +570,83 @@ func NewReader(
 	f, err := os.Open(fname)
 	if err != nil { return nil, err }
 
-	order, err := checkFile(fname, f)
-	if err != nil { return nil, err }
+	order, version, err := checkFile(fname, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if version >= 2 {
+		if err := checkFooter(fname, f, order); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	// Counts and lengths in the header are checked against the number of
+	// bytes left in the file before anything is allocated for them.
+	remaining, err := bytesRemaining(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	hd := &Header{ }
-	if err := hd.read(f, order); err != nil { return nil, err }
+	lr := &io.LimitedReader{ R: f, N: remaining }
+	if err := hd.read(lr, order, version); err != nil {
+		f.Close()
+		return nil, truncationError(fname, err)
+	}
 	nFields := len(hd.Names) - 1
 
 	rd := &Reader{
-		*hd, fname, f, order, make([]int64, nFields+1),
-		make([]int64, nFields+1), make([]MethodFlag, nFields), buf, midBuf,
+		*hd, fname, f, order, version, make([]int64, nFields+1),
+		make([]int64, nFields+1), make([]MethodFlag, nFields), nil, nil,
+		buf, midBuf,
 	}
 
 	// Read in navigation information
 	if err := binary.Read(f, order, rd.methodFlags); err != nil {
-		return nil, err
+		f.Close()
+		return nil, truncationError(fname, err)
 	}
 
 	if err := binary.Read(f, order, rd.headerEdges); err != nil {
-		return nil, err
+		f.Close()
+		return nil, truncationError(fname, err)
 	}
 
 	if err := binary.Read(f, order, rd.dataEdges); err != nil {
-		return nil, err
+		f.Close()
+		return nil, truncationError(fname, err)
+	}
+
+	if version >= 3 {
+		rd.headerChecksums = make([]uint32, nFields)
+		rd.dataChecksums = make([]uint32, nFields)
+
+		if err := binary.Read(f, order, rd.headerChecksums); err != nil {
+			f.Close()
+			return nil, truncationError(fname, err)
+		}
+
+		if err := binary.Read(f, order, rd.dataChecksums); err != nil {
+			f.Close()
+			return nil, truncationError(fname, err)
+		}
 	}
 	
 	for i := 0; i < len(rd.Header.Sizes) - 1; i++ {
 		rd.Header.Sizes[i] = (rd.dataEdges[i+1] - rd.dataEdges[i]) +
 			(rd.headerEdges[i+1] - rd.headerEdges[i])
+		rd.Header.Methods[i] = rd.methodFlags[i].String()
+	}
+
+	if version < 5 {
+		if err := rd.readLegacyDeltas(); err != nil {
+			f.Close()
+			return nil, truncationError(fname, err)
+		}
 	}
 
 	return rd, err
@@ -340,39 +668,124 @@ func (rd *Reader) ReadField(name string) (particles.Field, error) {
 			name, rd.fname, rd.Names)
 	}
 
-	headerOffset, dataOffset := rd.headerEdges[i], rd.dataEdges[i]
-
-	_, err := rd.f.Seek(headerOffset, 0)
+	bHeader, err := rd.readBlock(rd.headerEdges[i], rd.headerEdges[i+1], nil)
 	if err != nil { return nil, err }
+	if err := rd.checkBlock(i, "method header", bHeader); err != nil {
+		return nil, err
+	}
 
 	// Select the method used
 	method := selectMethod(rd.methodFlags[i])
-	switch t := method.(type) {
-	case *LagrangianDelta:
-		if name == "x" || name == "x{0}" || name == "x{1}" || name == "x{2}" {
-			t.period = rd.L
-		}
-	}
+	method.SetPeriod(rd.Periods[i])
 
-	err = method.ReadInfo(rd.order, rd.f)
+	err = method.ReadInfo(rd.order, bytes.NewReader(bHeader))
 	if err != nil { return nil, err}
 
-	_, err = rd.f.Seek(dataOffset, 0)
-	if err != nil { return nil, err }
-
 	// Some trickery due to the way Go's zlib library handles reading from
 	// disk. I still don't understand why direct disk reads fail...
 	// But this does have another benefit: it prevents the disk from being
 	// locked while zlib is doing slow calculations.
-	n := rd.dataEdges[i+1] - rd.dataEdges[i]
-	rd.midBuf = resizeBytes(rd.midBuf, int(n))
-	_, err = rd.f.Read(rd.midBuf)
+	rd.midBuf, err = rd.readBlock(rd.dataEdges[i], rd.dataEdges[i+1], rd.midBuf)
 	if err != nil { return nil, err }
+	if err := rd.checkBlock(i, "data", rd.midBuf); err != nil {
+		return nil, err
+	}
 
 	midBuf := bytes.NewBuffer(rd.midBuf)
 	return method.Decompress(rd.buf, midBuf, name)
 }
 
+// readLegacyDeltas sets Deltas for files written before version 5, which only
+// stored them in the method headers.
+func (rd *Reader) readLegacyDeltas() error {
+	for i := 0; i < len(rd.Names) - 1; i++ {
+		if rd.Types[i] != "f32" && rd.Types[i] != "f64" { continue }
+
+		b, err := rd.readBlock(rd.headerEdges[i], rd.headerEdges[i+1], nil)
+		if err != nil { return err }
+		method := selectMethod(rd.methodFlags[i])
+		err = method.ReadInfo(rd.order, bytes.NewReader(b))
+		if err != nil { return err }
+		rd.Deltas[i] = method.Delta()
+	}
+	return nil
+}
+
+// readBlock reads the bytes in the range [start, end) into b, which is
+// resized as needed and returned.
+func (rd *Reader) readBlock(start, end int64, b []byte) ([]byte, error) {
+	b = resizeBytes(b, int(end - start))
+	_, err := rd.f.ReadAt(b, start)
+	if err != nil { return b, truncationError(rd.fname, err) }
+	return b, nil
+}
+
+// checkBlock compares the checksum of a block against the checksum stored in
+// the navigation table. blockType is either "method header" or "data" and i
+// is the index of the field. Files without checksums always pass.
+func (rd *Reader) checkBlock(i int, blockType string, b []byte) error {
+	if rd.headerChecksums == nil { return nil }
+
+	expected := rd.dataChecksums[i]
+	if blockType == "method header" { expected = rd.headerChecksums[i] }
+
+	found := crc32.Checksum(b, crcTable)
+	if found == expected { return nil }
+
+	return &ChecksumError{
+		File: rd.fname, Field: rd.Names[i], Block: blockType,
+		Expected: expected, Found: found,
+	}
+}
+
+// ChecksumError is returned when the checksum of a block in a .gup file
+// doesn't match the checksum recorded when the file was written.
+type ChecksumError struct {
+	// File and Field are the names of the file and field containing the bad
+	// block. Block is either "method header" or "data".
+	File, Field, Block string
+	// Expected and Found are the recorded and computed CRC32C checksums.
+	Expected, Found uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("The %s block of the field '%s' in %s is corrupted: " +
+		"its CRC32C checksum is %08x, but it was %08x when the file was " +
+		"written. The file will need to be regenerated or re-copied.",
+		e.Block, e.Field, e.File, e.Found, e.Expected)
+}
+
+// HasChecksums returns true if the file contains block checksums. Files
+// written before version 3 of the format do not.
+func (rd *Reader) HasChecksums() bool { return rd.headerChecksums != nil }
+
+// Verify checks the checksum of every block in the file without decompressing
+// any of them. All the corrupted blocks are returned. A non-nil error is
+// only returned if an I/O error prevents the blocks from being read.
+func (rd *Reader) Verify() ([]*ChecksumError, error) {
+	bad := []*ChecksumError{ }
+	if !rd.HasChecksums() { return bad, nil }
+
+	var err error
+	for i := range rd.methodFlags {
+		rd.midBuf, err = rd.readBlock(rd.headerEdges[i], rd.headerEdges[i+1],
+			rd.midBuf)
+		if err != nil { return nil, err }
+		if err := rd.checkBlock(i, "method header", rd.midBuf); err != nil {
+			bad = append(bad, err.(*ChecksumError))
+		}
+
+		rd.midBuf, err = rd.readBlock(rd.dataEdges[i], rd.dataEdges[i+1],
+			rd.midBuf)
+		if err != nil { return nil, err }
+		if err := rd.checkBlock(i, "data", rd.midBuf); err != nil {
+			bad = append(bad, err.(*ChecksumError))
+		}
+	}
+
+	return bad, nil
+}
+
 func (rd *Reader) readID() (particles.Field, error) {
 	rd.buf.Resize(int(rd.N))
 	ids := rd.buf.u64
@@ -425,30 +838,31 @@ func findString(x []string, target string) int {
 }
 
 // checkFile reads in the file's magic number and version number and makes
-// sure that guppy can actually read it. If it can, the byte order is returned.
-// Otherwise an error is returned.
-func checkFile(fname string, f *os.File) (binary.ByteOrder, error) {
+// sure that guppy can actually read it. If it can, the byte order and version
+// are returned. Otherwise an error is returned.
+func checkFile(fname string, f *os.File) (binary.ByteOrder, uint32, error) {
 	var magicNumber, version uint32
 
 	// Read the magic number and check that this is actually a guppy file.
 	order := binary.ByteOrder(binary.LittleEndian)
 	err := binary.Read(f, order, &magicNumber)
-	if err != nil { return nil, err }
+	if err != nil { return nil, 0, truncationError(fname, err) }
 
 	switch magicNumber {
 	case MagicNumber:
 	case ReverseMagicNumber: order = binary.BigEndian
 	default:
-		return order, fmt.Errorf("%s is not a guppy files. All guppy files " +
-			"begin with either the 32-bit integer %x or %x. This file begins " +
+		return order, 0, fmt.Errorf("%s is not a guppy files. All guppy " +
+			"files begin with either the 32-bit integer %x or %x. This file begins " +
 			"with %x.", fname, MagicNumber, ReverseMagicNumber, magicNumber)
 	}
 
 	// Check the version.
 	err = binary.Read(f, order, &version)
+	if err != nil { return nil, 0, truncationError(fname, err) }
 	if version > Version {
-		return order, fmt.Errorf("The file %s was created with guppy version " + 
-			"%d, but are trying to read it with guppy version %d. This means " +
+		return order, version, fmt.Errorf("The file %s was created with " +
+			"guppy version %d, but are trying to read it with guppy version %d. This means " +
 			"that the file contains features which weren't implemented at " +
 			"the time your code was written. You can download the latest " + 
 			"version of guppy at github.com/phil-mansfield/guppy.", fname, 
@@ -456,5 +870,60 @@ func checkFile(fname string, f *os.File) (binary.ByteOrder, error) {
 		)
 	}
 
-	return order, nil
+	return order, version, nil
+}
+
+// checkFooter checks that the file ends with an end-of-file marker that
+// correctly records the size of the file. If it doesn't, the file was not
+// completely written and an error is returned. The file's offset is not
+// changed.
+func checkFooter(fname string, f *os.File, order binary.ByteOrder) error {
+	info, err := f.Stat()
+	if err != nil { return err }
+	size := info.Size()
+
+	if size >= footerSize {
+		b := make([]byte, footerSize)
+		if _, err := f.ReadAt(b, size - footerSize); err != nil { return err }
+
+		endMagicNumber := order.Uint32(b[:4])
+		recordedSize := int64(order.Uint64(b[4:]))
+		if endMagicNumber == EndMagicNumber && recordedSize == size {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("The file %s is incomplete: it does not end with " +
+		"guppy's end-of-file marker. This almost always means that the job " +
+		"which wrote it was killed or ran out of disk space before it " +
+		"finished, or that the file was only partially copied. The file " +
+		"will need to be regenerated or re-copied.", fname)
+}
+
+// headerLengthError returns the error for a count or length in the header
+// which is larger than the number of bytes left in the file.
+func headerLengthError(n uint32, remaining int64) error {
+	return fmt.Errorf("The header says that one of its sections is %d bytes long, but only %d bytes are left in the file, so the header is corrupted.", n, remaining)
+}
+
+// bytesRemaining returns the number of bytes between f's current offset and
+// the end of the file.
+func bytesRemaining(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil { return 0, err }
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil { return 0, err }
+	return info.Size() - pos, nil
+}
+
+// truncationError converts the errors returned by the binary package when a
+// file ends early into a more readable error. Other errors are returned
+// unchanged.
+func truncationError(fname string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("The file %s is incomplete: it ended before guppy " +
+			"finished reading its header. The file will need to be " +
+			"regenerated or re-copied.", fname)
+	}
+	return err
 }
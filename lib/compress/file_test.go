@@ -6,7 +6,12 @@ import (
 	"testing"
 	"fmt"
 	"bytes"
+	"hash/crc32"
+	"io"
 	"time"
+	"os"
+	"path/filepath"
+	"strings"
 	
 	"github.com/phil-mansfield/guppy/lib/eq"
 	"github.com/phil-mansfield/guppy/lib/particles"
@@ -22,16 +27,31 @@ func TestHeader(t *testing.T) {
 		[]byte{5, 4, 3, 2, 1, 0}, []string{"a", "bb", "ccc", "", "eeeee"},
 		[]string{"u32", "u32", "f32", "f64", "u64"},
 		[]int64{0, 0, 0, 0, 0},
+		[]string{"", "", "", "", ""}, []string{"", "km/s", "", "", "Msun/h"},
+		[]float64{0, 0, 1e-3, 1e-4, 0}, []float64{0, 0, 100, 0, 0},
+		Metadata{},
 	}
+	hd1.Metadata.SetString("Simulation", "Erebos_CBol_L125")
+	hd1.Metadata.SetInt("Seed", -12345)
+	hd1.Metadata.SetFloat("Softening", 0.0025)
+	hd1.Metadata.SetString("Config", "")
+	hd1.Metadata.SetInt("Seed", 54321)
+	hd1.Metadata = append(hd1.Metadata,
+		MetadataEntry{ "Future", "zzz", []byte{1, 2, 3} })
+
 	hd2 := *hd1
 
 	hd2.write(buf, binary.LittleEndian)
 
 	hd3 := &Header{ }
-	hd3.read(buf, binary.LittleEndian)
+	hd3.read(&io.LimitedReader{ R: buf, N: int64(buf.Len()) },
+		binary.LittleEndian, Version)
 
 	hd1.Names = append(hd1.Names, "id")
 	hd1.Types = append(hd1.Types, "u64")
+	hd1.Units = append(hd1.Units, "")
+	hd1.Deltas = append(hd1.Deltas, 0)
+	hd1.Periods = append(hd1.Periods, 0)
 
 	if hd3.FixedWidthHeader != hd1.FixedWidthHeader {
 		t.Errorf("Written fixed-width header = %v, but read header = %v.",
@@ -45,6 +65,140 @@ func TestHeader(t *testing.T) {
 	} else if !eq.Strings(hd1.Types, hd3.Types) {
 		t.Errorf("Written types = %s, bute read types = %s.",
 			hd1.Types, hd3.Types)
+	} else if !eq.Strings(hd1.Units, hd3.Units) {
+		t.Errorf("Written units = %s, but read units = %s.",
+			hd1.Units, hd3.Units)
+	} else if !eq.Float64s(hd1.Deltas, hd3.Deltas) {
+		t.Errorf("Written deltas = %g, but read deltas = %g.",
+			hd1.Deltas, hd3.Deltas)
+	} else if !eq.Float64s(hd1.Periods, hd3.Periods) {
+		t.Errorf("Written periods = %g, but read periods = %g.",
+			hd1.Periods, hd3.Periods)
+	} else if len(hd1.Metadata) != len(hd3.Metadata) {
+		t.Errorf("Written metadata = %v, but read metadata = %v.",
+			hd1.Metadata, hd3.Metadata)
+	} else if buf.Len() != 0 {
+		t.Errorf("%d bytes left unread after reading the header.", buf.Len())
+	}
+
+	for i := 0; i < len(hd1.Metadata) - 1; i++ {
+		if hd1.Metadata[i] != hd3.Metadata[i] {
+			t.Errorf("Written metadata entry %d = %v, but read entry = %v.",
+				i, hd1.Metadata[i], hd3.Metadata[i])
+		}
+	}
+	future, ok := hd3.Metadata.Get("Future")
+	if !ok || future.Type != "zzz" ||
+		!eq.Bytes(future.Value.([]byte), []byte{1, 2, 3}) {
+		t.Errorf("Unknown metadata type read as %v.", future)
+	}
+
+	if seed, ok := hd3.Metadata.Int("Seed"); !ok || seed != 54321 {
+		t.Errorf("Expected Seed = 54321, got %d, %v.", seed, ok)
+	} else if _, ok := hd3.Metadata.Float("Seed"); ok {
+		t.Errorf("Integer entry Seed was returned as a float.")
+	} else if _, ok := hd3.Metadata.String("Missing"); ok {
+		t.Errorf("Missing entry was found.")
+	}
+}
+
+func TestHeaderCorruptLengths(t *testing.T) {
+	hd := &Header{
+		FixedWidthHeader{1<<8, 1<<30, [3]int64{8, 8, 8}, [3]int64{1, 2, 3},
+			[3]int64{100, 100, 100},
+			0.5, 0.27, 0.73, 0.70, 100.0, 3e9},
+		[]byte{5, 4, 3}, []string{"a", "bb"}, []string{"u32", "f32"},
+		[]int64{0, 0}, []string{"", ""}, []string{"", ""},
+		[]float64{0, 0}, []float64{0, 0}, Metadata{},
+	}
+	hd.Metadata.SetString("Simulation", "Erebos_CBol_L125")
+
+	buf := bytes.NewBuffer([]byte{})
+	hd.write(buf, binary.LittleEndian)
+	b := buf.Bytes()
+
+	// Offsets of the original header length, the number of fields, the
+	// number of metadata entries, the first metadata key length, and the
+	// first field's units length.
+	oHeader := binary.Size(hd.FixedWidthHeader)
+	fields := oHeader + 4 + 3
+	entries := fields + 4 + 2*4 + 3 + 2*3
+	key := entries + 4
+	units := key + 4 + len("Simulation") + 3 + 4 +
+		len("Erebos_CBol_L125") + 8 + 8
+
+	tests := []struct{
+		offset int
+		n uint32
+	} {
+		{ oHeader, 1<<31 }, { fields, 1<<30 }, { entries, 1<<31 },
+		{ entries, uint32(len(b)) }, { key, 1<<31 }, { units, 1<<31 },
+	}
+
+	for i := range tests {
+		corrupt := append([]byte{ }, b...)
+		binary.LittleEndian.PutUint32(corrupt[tests[i].offset:], tests[i].n)
+
+		rd := &io.LimitedReader{ R: bytes.NewReader(corrupt),
+			N: int64(len(corrupt)) }
+		err := (&Header{ }).read(rd, binary.LittleEndian, Version)
+		if err == nil {
+			t.Errorf("%d) Expected an error when the length at offset %d " +
+				"was set to %d, but got none.", i, tests[i].offset,
+				tests[i].n)
+		} else if !strings.Contains(err.Error(), "corrupted") {
+			t.Errorf("%d) Expected an error about a corrupted header, got " +
+				"'%s'.", i, err.Error())
+		}
+	}
+
+	// Check that the offsets above are right by reading the uncorrupted
+	// header.
+	rd := &io.LimitedReader{ R: bytes.NewReader(b), N: int64(len(b)) }
+	if err := (&Header{ }).read(rd, binary.LittleEndian, Version); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if binary.LittleEndian.Uint32(b[units:]) != 0 {
+		t.Errorf("Expected the first field's units length at offset %d.",
+			units)
+	}
+}
+
+func TestHeaderVersion1(t *testing.T) {
+	// Version 1 headers are identical to current headers, except that they
+	// end before the metadata and per-field sections. Here, those are four
+	// bytes for the empty metadata and 20 bytes per field.
+	hd1 := &Header{
+		FixedWidthHeader{1<<8, 1<<30, [3]int64{8, 8, 8}, [3]int64{1, 2, 3},
+			[3]int64{100, 100, 100},
+			0.5, 0.27, 0.73, 0.70, 100.0, 3e9},
+		[]byte{5, 4, 3}, []string{"x{0}", "bb"}, []string{"f32", "f32"},
+		[]int64{0, 0}, []string{"", ""}, []string{"", ""},
+		[]float64{0, 0}, []float64{0, 0}, Metadata{},
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	hd1.write(buf, binary.LittleEndian)
+	b := buf.Bytes()[:buf.Len() - 4 - 2*20]
+
+	hd2 := &Header{ }
+	err := hd2.read(&io.LimitedReader{ R: bytes.NewReader(b),
+		N: int64(len(b)) }, binary.LittleEndian, 1)
+	if err != nil {
+		t.Fatalf("Could not read version 1 header: %s", err.Error())
+	}
+
+	if hd2.FixedWidthHeader != hd1.FixedWidthHeader {
+		t.Errorf("Written fixed-width header = %v, but read header = %v.",
+			hd1, hd2)
+	} else if !eq.Strings(hd2.Names, []string{"x{0}", "bb", "id"}) {
+		t.Errorf("Read names = %s.", hd2.Names)
+	} else if hd2.Metadata == nil || len(hd2.Metadata) != 0 {
+		t.Errorf("Version 1 header read with metadata %v.", hd2.Metadata)
+	} else if !eq.Float64s(hd2.Periods, []float64{100, 0, 0}) {
+		t.Errorf("Version 1 header read with periods %g.", hd2.Periods)
+	} else if !eq.Strings(hd2.Units, []string{"cMpc/h", "", ""}) {
+		t.Errorf("Version 1 header read with units %s.", hd2.Units)
 	}
 }
 
@@ -103,8 +257,10 @@ func TestFileSmall(t *testing.T) {
 	)
 	fakeHd, _ := fakeFile.ReadHeader()
 
+	fname := filepath.Join(t.TempDir(), "small_test.gup")
+
 	var err error
-	wr := NewWriter("test_files/small_test.gup", fakeHd,
+	wr := NewWriter(fname, fakeHd,
 		span64, idOffset, totSpan, buf, b, order)
 	for i := range fields {
 		err = wr.AddField(fields[i], methods[i])
@@ -117,7 +273,7 @@ func TestFileSmall(t *testing.T) {
 		t.Fatalf("Error in Flush(): %s", err.Error())
 	}
 
-	rd, err := NewReader("test_files/small_test.gup", buf, []byte{ })
+	rd, err := NewReader(fname, buf, []byte{ })
 	if err != nil { t.Fatalf("Error in NewReader(): %s", err.Error()) }
 
 	names, types := rd.Names, rd.Types
@@ -129,6 +285,28 @@ func TestFileSmall(t *testing.T) {
  	if !eq.Strings(types, expTypes) {
  		t.Errorf("Expected Reader.Names to give %s, got %s.", expNames, names)
  	}
+	expMethods := []string{"LagrangianDelta", "LagrangianDelta",
+		"LagrangianDelta", "LagrangianDelta", "None"}
+	if !eq.Strings(rd.Methods, expMethods) {
+		t.Errorf("Expected Reader.Methods to give %s, got %s.",
+			expMethods, rd.Methods)
+	}
+	// 1e-3 evenly divides the period of x{0}, so it doesn't get adjusted.
+	expDeltas := []float64{ 1e-3, 1e-3, 0, 0, 0 }
+	if !eq.Float64sEps(rd.Deltas, expDeltas, 1e-12) {
+		t.Errorf("Expected Reader.Deltas to give %g, got %g.",
+			expDeltas, rd.Deltas)
+	}
+	expPeriods := []float64{ 1.0, 0, 0, 0, 0 }
+	if !eq.Float64s(rd.Periods, expPeriods) {
+		t.Errorf("Expected Reader.Periods to give %g, got %g.",
+			expPeriods, rd.Periods)
+	}
+	expUnits := []string{"cMpc/h", "cMpc/h", "cMpc/h", "", ""}
+	if !eq.Strings(rd.Units, expUnits) {
+		t.Errorf("Expected Reader.Units to give %s, got %s.",
+			expUnits, rd.Units)
+	}
 
 	for i := range names {
 		f, err := rd.ReadField(names[i])
@@ -177,6 +355,398 @@ func TestFileSmall(t *testing.T) {
 	rd.Close()
 }
 
+func TestIncompleteFile(t *testing.T) {
+	span := [3]int{ 4, 4, 4 }
+	span64 := [3]int64{ 4, 4, 4 }
+	n := span[0]*span[1]*span[2]
+	x := make([]float32, n)
+	for i := range x { x[i] = float32(rand.Float64()) }
+
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	for _, order := range orders {
+		dir := t.TempDir()
+		fname := filepath.Join(dir, "incomplete_test.gup")
+
+		fakeFile, _ := snapio.NewFakeFile(
+			[]string{"x"}, []interface{}{[]float32{}}, 1000, order,
+		)
+		fakeHd, _ := fakeFile.ReadHeader()
+
+		buf := NewBuffer(0)
+		wr := NewWriter(fname, fakeHd, span64, [3]int64{},
+			[3]int64{100, 100, 100}, buf, []byte{ }, order)
+		err := wr.AddField(particles.NewFloat32("x{0}", x),
+			NewLagrangianDelta(span, 1e-3, 0))
+		if err != nil { t.Fatalf("Error in AddField(): %s", err.Error()) }
+		if _, err = wr.Flush(); err != nil {
+			t.Fatalf("Error in Flush(): %s", err.Error())
+		}
+
+		// Flush() shouldn't leave any temporary files behind.
+		entries, err := os.ReadDir(dir)
+		if err != nil { t.Fatalf(err.Error()) }
+		if len(entries) != 1 || entries[0].Name() != "incomplete_test.gup" {
+			names := []string{ }
+			for i := range entries { names = append(names, entries[i].Name()) }
+			t.Errorf("Expected only incomplete_test.gup after Flush(), " +
+				"but found %s.", names)
+		}
+
+		rd, err := NewReader(fname, buf, []byte{ })
+		if err != nil {
+			t.Fatalf("Error in NewReader() on complete file: %s", err.Error())
+		}
+		rd.Close()
+
+		complete, err := os.ReadFile(fname)
+		if err != nil { t.Fatalf(err.Error()) }
+		size := int64(len(complete))
+
+		// Truncate a fresh copy of the file at a few different locations,
+		// including inside the header.
+		for _, cut := range []int64{ 1, footerSize, size/2, size - 10 } {
+			err := os.WriteFile(fname, complete[:size - cut], 0644)
+			if err != nil { t.Fatalf(err.Error()) }
+
+			_, err = NewReader(fname, buf, []byte{ })
+			if err == nil {
+				t.Errorf("Expected NewReader() to fail on a file with %d " +
+					"bytes removed.", cut)
+			} else if !strings.Contains(err.Error(), "incomplete") {
+				t.Errorf("Expected NewReader() to report an incomplete " +
+					"file with %d bytes removed, got: %s", cut, err.Error())
+			}
+		}
+	}
+}
+
+func TestAtomicWrite(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "atomic_test.txt")
+
+	err := AtomicWrite(fname, func(f io.Writer) error {
+		_, err := f.Write([]byte("first"))
+		return err
+	})
+	if err != nil { t.Fatalf(err.Error()) }
+
+	// A failed write should leave the old file and no temporary files.
+	err = AtomicWrite(fname, func(f io.Writer) error {
+		f.Write([]byte("second"))
+		return fmt.Errorf("write failed")
+	})
+	if err == nil || err.Error() != "write failed" {
+		t.Errorf("Expected AtomicWrite() to return the write error, got %v.",
+			err)
+	}
+
+	b, err := os.ReadFile(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	if string(b) != "first" {
+		t.Errorf("Expected the file to contain 'first', got '%s'.", b)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil { t.Fatalf(err.Error()) }
+	if len(entries) != 1 {
+		t.Errorf("Expected only %s in %s, found %d files.",
+			fname, dir, len(entries))
+	}
+}
+
+func TestFlushPermissions(t *testing.T) {
+	span := [3]int{ 4, 4, 4 }
+	x := make([]float32, span[0]*span[1]*span[2])
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "permissions_test.gup")
+
+	fakeFile, _ := snapio.NewFakeFile(
+		[]string{"x"}, []interface{}{[]float32{}}, 1000, binary.LittleEndian,
+	)
+	fakeHd, _ := fakeFile.ReadHeader()
+	flush := func() {
+		wr := NewWriter(fname, fakeHd, [3]int64{ 4, 4, 4 }, [3]int64{ },
+			[3]int64{ 100, 100, 100 }, NewBuffer(0), []byte{ },
+			binary.LittleEndian)
+		err := wr.AddField(particles.NewFloat32("x{0}", x),
+			NewLagrangianDelta(span, 1e-3, 0))
+		if err != nil { t.Fatalf(err.Error()) }
+		if _, err = wr.Flush(); err != nil { t.Fatalf(err.Error()) }
+
+		// Flush should record the size and checksum of what it wrote.
+		b, err := os.ReadFile(fname)
+		if err != nil { t.Fatalf(err.Error()) }
+		crc := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+		if wr.Size != int64(len(b)) || wr.CRC32C != crc {
+			t.Errorf("Expected Flush() to record a size of %d and a " +
+				"checksum of %x, got %d and %x.", len(b), crc,
+				wr.Size, wr.CRC32C)
+		}
+	}
+
+	// New files should have the same permissions as any other file created
+	// by the process.
+	probe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(probe, []byte{ }, 0666); err != nil {
+		t.Fatalf(err.Error())
+	}
+	probeInfo, err := os.Stat(probe)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	flush()
+	info, err := os.Stat(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	if info.Mode().Perm() != probeInfo.Mode().Perm() {
+		t.Errorf("Expected a new file to have permissions %s, got %s.",
+			probeInfo.Mode().Perm(), info.Mode().Perm())
+	}
+
+	// Overwritten files keep their permissions.
+	if err := os.Chmod(fname, 0640); err != nil { t.Fatalf(err.Error()) }
+	flush()
+	info, err = os.Stat(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected an overwritten file to keep the permissions " +
+			"%s, got %s.", os.FileMode(0640), info.Mode().Perm())
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "temp_test.gup")
+
+	// Temporary files for fname, and files that should be left alone.
+	temps := []string{ ".temp_test.gup.tmp123", ".temp_test.gup.tmp" }
+	others := []string{
+		"temp_test.gup", ".other.gup.tmp1", "temp_test.gup.tmp",
+	}
+	for _, name := range append(append([]string{ }, temps...), others...) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte{ 1 }, 0644)
+		if err != nil { t.Fatalf(err.Error()) }
+	}
+
+	removed, err := RemoveTempFiles(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	if len(removed) != len(temps) {
+		t.Errorf("Expected %d files to be removed, got %s.",
+			len(temps), removed)
+	}
+
+	for _, name := range temps {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s wasn't removed.", name)
+		}
+	}
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was removed.", name)
+		}
+	}
+
+	removed, err = RemoveTempFiles(filepath.Join(dir, "missing", "x.gup"))
+	if err != nil || len(removed) != 0 {
+		t.Errorf("Expected a missing directory to be ignored, got %s, %v.",
+			removed, err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	span := [3]int{ 4, 4, 4 }
+	span64 := [3]int64{ 4, 4, 4 }
+	n := span[0]*span[1]*span[2]
+	x0, x1 := make([]float32, n), make([]float32, n)
+	for i := range x0 { x0[i] = float32(rand.Float64()) }
+	for i := range x1 { x1[i] = float32(rand.Float64()) }
+
+	order := binary.LittleEndian
+	fname := filepath.Join(t.TempDir(), "checksum_test.gup")
+
+	fakeFile, _ := snapio.NewFakeFile(
+		[]string{"x"}, []interface{}{[]float32{}}, 1000, order,
+	)
+	fakeHd, _ := fakeFile.ReadHeader()
+
+	buf := NewBuffer(0)
+	wr := NewWriter(fname, fakeHd, span64, [3]int64{},
+		[3]int64{100, 100, 100}, buf, []byte{ }, order)
+	fields := []particles.Field{
+		particles.NewFloat32("x{0}", x0), particles.NewFloat32("x{1}", x1),
+	}
+	for i := range fields {
+		err := wr.AddField(fields[i], NewLagrangianDelta(span, 1e-3, 0))
+		if err != nil { t.Fatalf("Error in AddField(): %s", err.Error()) }
+	}
+	if _, err := wr.Flush(); err != nil {
+		t.Fatalf("Error in Flush(): %s", err.Error())
+	}
+
+	rd, err := NewReader(fname, buf, []byte{ })
+	if err != nil { t.Fatalf("Error in NewReader(): %s", err.Error()) }
+	if !rd.HasChecksums() {
+		t.Errorf("Expected a newly written file to have checksums.")
+	}
+	bad, err := rd.Verify()
+	if err != nil {
+		t.Errorf("Error in Verify(): %s", err.Error())
+	} else if len(bad) != 0 {
+		t.Errorf("Expected no bad blocks in an uncorrupted file, got %d.",
+			len(bad))
+	}
+	rd.Close()
+
+	// Flip a bit in the last byte of the data block of x{1}, which is right
+	// before the end-of-file marker.
+	b, err := os.ReadFile(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	b[len(b) - footerSize - 1] ^= 0x10
+	if err := os.WriteFile(fname, b, 0644); err != nil { t.Fatalf(err.Error()) }
+
+	rd, err = NewReader(fname, buf, []byte{ })
+	if err != nil { t.Fatalf("Error in NewReader(): %s", err.Error()) }
+	defer rd.Close()
+
+	if _, err := rd.ReadField("x{0}"); err != nil {
+		t.Errorf("Expected x{0} to be readable, got: %s", err.Error())
+	}
+
+	_, err = rd.ReadField("x{1}")
+	if csErr, ok := err.(*ChecksumError); !ok {
+		t.Errorf("Expected ReadField('x{1}') to return a ChecksumError, " +
+			"got %v.", err)
+	} else if csErr.Field != "x{1}" || csErr.Block != "data" {
+		t.Errorf("Expected a bad data block in x{1}, got a bad %s block " +
+			"in %s.", csErr.Block, csErr.Field)
+	}
+
+	bad, err = rd.Verify()
+	if err != nil {
+		t.Errorf("Error in Verify(): %s", err.Error())
+	} else if len(bad) != 1 || bad[0].Field != "x{1}" {
+		t.Errorf("Expected Verify() to find one bad block in x{1}, got %v.",
+			bad)
+	}
+}
+
+func TestByteOrders(t *testing.T) {
+	span := [3]int{ 4, 4, 4 }
+	span64 := [3]int64{ 4, 4, 4 }
+	n := span[0]*span[1]*span[2]
+	x0, x1 := make([]float32, n), make([]float64, n)
+	x2, x3 := make([]uint32, n), make([]uint64, n)
+	for i := range x0 { x0[i] = 100*float32(rand.Float64()) }
+	for i := range x1 { x1[i] = rand.Float64() - 0.5 }
+	for i := range x2 { x2[i] = uint32(rand.Intn(1000)) }
+	for i := range x3 { x3[i] = uint64(rand.Intn(1000)) + 1<<40 }
+
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	dir := t.TempDir()
+	out := make([][]particles.Field, len(orders))
+
+	for j, order := range orders {
+		fname := filepath.Join(dir, fmt.Sprintf("order_test.%d.gup", j))
+
+		fakeFile, _ := snapio.NewFakeFile(
+			[]string{"x"}, []interface{}{[]float32{}}, 1000, order,
+		)
+		fakeHd, _ := fakeFile.ReadHeader()
+
+		buf := NewBuffer(0)
+		wr := NewWriter(fname, fakeHd, span64, [3]int64{1, 2, 3},
+			[3]int64{100, 100, 100}, buf, []byte{ }, order)
+		wr.Metadata.SetInt("Seed", -7)
+		wr.Metadata.SetFloat("Softening", 0.25)
+		wr.Metadata.SetString("Simulation", "order_test")
+
+		fields := []particles.Field{
+			particles.NewFloat32("x{0}", x0), particles.NewFloat64("v{0}", x1),
+			particles.NewUint32("a", x2), particles.NewUint64("b", x3),
+		}
+		methods := []Method{
+			NewLagrangianDelta(span, 1e-3, 100), NewLagrangianDelta(span, 1e-4, 0),
+			NewLagrangianDelta(span, 0, 0), NewLagrangianDelta(span, 0, 0),
+		}
+		for i := range fields {
+			err := wr.AddField(fields[i], methods[i])
+			if err != nil { t.Fatalf("Error in AddField(): %s", err.Error()) }
+		}
+		if _, err := wr.Flush(); err != nil {
+			t.Fatalf("Error in Flush(): %s", err.Error())
+		}
+
+		rd, err := NewReader(fname, NewBuffer(0), []byte{ })
+		if err != nil {
+			t.Fatalf("%s) Error in NewReader(): %s", order, err.Error())
+		}
+
+		if rd.order != order {
+			t.Errorf("%s) File was read with byte order %s.", order, rd.order)
+		} else if rd.Offset != [3]int64{1, 2, 3} || rd.N != int64(n) ||
+			rd.L != fakeHd.L() {
+			t.Errorf("%s) Read header %v.", order, rd.FixedWidthHeader)
+		} else if !eq.Float64s(rd.Periods, []float64{100, 0, 0, 0, 0}) {
+			t.Errorf("%s) Read periods %g.", order, rd.Periods)
+		}
+
+		if seed, ok := rd.Metadata.Int("Seed"); !ok || seed != -7 {
+			t.Errorf("%s) Read Seed = %d, %v.", order, seed, ok)
+		} else if soft, ok := rd.Metadata.Float("Softening"); !ok ||
+			soft != 0.25 {
+			t.Errorf("%s) Read Softening = %g, %v.", order, soft, ok)
+		} else if sim, ok := rd.Metadata.String("Simulation"); !ok ||
+			sim != "order_test" {
+			t.Errorf("%s) Read Simulation = %s, %v.", order, sim, ok)
+		}
+
+		bad, err := rd.Verify()
+		if err != nil || len(bad) != 0 {
+			t.Errorf("%s) Verify() returned %v, %v.", order, bad, err)
+		}
+
+		for _, name := range rd.Names {
+			f, err := rd.ReadField(name)
+			if err != nil {
+				t.Fatalf("%s) Error in ReadField('%s'): %s",
+					order, name, err.Error())
+			}
+			f, _ = particles.NewGenericField(name, copyData(f.Data()))
+			out[j] = append(out[j], f)
+		}
+		rd.Close()
+
+		data := out[j]
+		if !eq.Float32sEps(data[0].Data().([]float32), x0, 1e-3) {
+			t.Errorf("%s) Read x{0} incorrectly.", order)
+		} else if !eq.Float64sEps(data[1].Data().([]float64), x1, 1e-4) {
+			t.Errorf("%s) Read v{0} incorrectly.", order)
+		} else if !eq.Uint32s(data[2].Data().([]uint32), x2) {
+			t.Errorf("%s) Read a incorrectly.", order)
+		} else if !eq.Uint64s(data[3].Data().([]uint64), x3) {
+			t.Errorf("%s) Read b incorrectly.", order)
+		}
+	}
+
+	// Decompression is deterministic, so files with different byte orders
+	// should decode to identical values.
+	for i := range out[0] {
+		if !eq.Generic(out[0][i].Data(), out[1][i].Data()) {
+			t.Errorf("Field '%s' differs between byte orders.",
+				out[0][i].Name())
+		}
+	}
+}
+
+// copyData copies the array underlying a particles.Field so that it isn't
+// overwritten by the next call to ReadField.
+func copyData(x interface{}) interface{} {
+	switch xx := x.(type) {
+	case []float32: return append([]float32{}, xx...)
+	case []float64: return append([]float64{}, xx...)
+	case []uint32: return append([]uint32{}, xx...)
+	case []uint64: return append([]uint64{}, xx...)
+	}
+	panic("Impossible type configuration.")
+}
+
 func TestLargeFiles(t *testing.T) {
 	fileNames := []string{
 		"../../large_test_data/L125_sheet000_snap_100.gadget2.dat",
@@ -0,0 +1,210 @@
+package compress
+
+/* This file handles the metadata section of .gup headers. The metadata section
+is a list of typed key/value pairs that can hold information which doesn't fit
+in FixedWidthHeader (units, softening lengths, simulation names, config files,
+etc.) without requiring a format change every time someone needs a new field.
+
+On disk, the section is a uint32 giving the number of entries, followed by
+each entry. An entry is a uint32 key length, the key, a 3-byte type string,
+a uint32 value length, and the value. Every value is length-prefixed so that
+older readers can skip over entry types that were added after they were
+written.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MetadataEntry is a single typed key/value pair stored in the metadata
+// section of a file. Type is "i64", "f64", or "str", in which case Value is
+// an int64, float64, or string, respectively. If the file was written by a
+// newer version of guppy and uses a type that this version doesn't know
+// about, Type is kept as-is and Value is the raw []byte stored in the file.
+type MetadataEntry struct {
+	Key, Type string
+	Value interface{}
+}
+
+// Metadata is the list of key/value pairs stored in a file's header. Keys
+// are unique and entries are kept in the order they were first set.
+type Metadata []MetadataEntry
+
+// SetInt sets the given key to an integer value.
+func (md *Metadata) SetInt(key string, x int64) { md.set(key, "i64", x) }
+
+// SetFloat sets the given key to a floating point value.
+func (md *Metadata) SetFloat(key string, x float64) { md.set(key, "f64", x) }
+
+// SetString sets the given key to a string value.
+func (md *Metadata) SetString(key, x string) { md.set(key, "str", x) }
+
+func (md *Metadata) set(key, typ string, x interface{}) {
+	for i := range *md {
+		if (*md)[i].Key == key {
+			(*md)[i] = MetadataEntry{ key, typ, x }
+			return
+		}
+	}
+	*md = append(*md, MetadataEntry{ key, typ, x })
+}
+
+// Get returns the entry associated with a given key. The second return value
+// is false if there is no such entry.
+func (md Metadata) Get(key string) (MetadataEntry, bool) {
+	for i := range md {
+		if md[i].Key == key { return md[i], true }
+	}
+	return MetadataEntry{ }, false
+}
+
+// Int returns the value of an integer entry. The second return value is false
+// if the key doesn't exist or isn't an integer.
+func (md Metadata) Int(key string) (int64, bool) {
+	e, ok := md.Get(key)
+	x, isInt := e.Value.(int64)
+	return x, ok && isInt
+}
+
+// Float returns the value of a floating point entry. The second return value
+// is false if the key doesn't exist or isn't a float.
+func (md Metadata) Float(key string) (float64, bool) {
+	e, ok := md.Get(key)
+	x, isFloat := e.Value.(float64)
+	return x, ok && isFloat
+}
+
+// String returns the value of a string entry. The second return value is
+// false if the key doesn't exist or isn't a string.
+func (md Metadata) String(key string) (string, bool) {
+	e, ok := md.Get(key)
+	x, isString := e.Value.(string)
+	return x, ok && isString
+}
+
+// encodeValue converts the entry's value to the bytes stored on disk.
+func (e *MetadataEntry) encodeValue(order binary.ByteOrder) ([]byte, error) {
+	switch x := e.Value.(type) {
+	case int64:
+		b := make([]byte, 8)
+		order.PutUint64(b, uint64(x))
+		return b, nil
+	case float64:
+		b := make([]byte, 8)
+		order.PutUint64(b, math.Float64bits(x))
+		return b, nil
+	case string:
+		return []byte(x), nil
+	case []byte:
+		return x, nil
+	}
+	return nil, fmt.Errorf("The metadata entry '%s' has a value of type " +
+		"%T. Only int64, float64, and string values can be stored.",
+		e.Key, e.Value)
+}
+
+// decodeValue sets the entry's value from the bytes stored on disk.
+func (e *MetadataEntry) decodeValue(order binary.ByteOrder, b []byte) error {
+	switch e.Type {
+	case "i64", "f64":
+		if len(b) != 8 {
+			return fmt.Errorf("The metadata entry '%s' has type '%s' but " +
+				"is stored in %d bytes instead of 8.", e.Key, e.Type, len(b))
+		}
+		if e.Type == "i64" {
+			e.Value = int64(order.Uint64(b))
+		} else {
+			e.Value = math.Float64frombits(order.Uint64(b))
+		}
+	case "str":
+		e.Value = string(b)
+	default:
+		e.Value = b
+	}
+	return nil
+}
+
+// write writes the metadata section and returns the number of bytes written.
+func (md Metadata) write(f io.Writer, order binary.ByteOrder) (int, error) {
+	n := 0
+	if err := binary.Write(f, order, uint32(len(md))); err != nil {
+		return 0, err
+	}
+	n += 4
+
+	for i := range md {
+		if len(md[i].Type) != 3 {
+			return 0, fmt.Errorf("The metadata entry '%s' has the type " +
+				"'%s', but types must be three characters long.",
+				md[i].Key, md[i].Type)
+		}
+
+		value, err := md[i].encodeValue(order)
+		if err != nil { return 0, err }
+
+		key := []byte(md[i].Key)
+		err = binary.Write(f, order, uint32(len(key)))
+		if err != nil { return 0, err }
+		if _, err = f.Write(key); err != nil { return 0, err }
+		if _, err = f.Write([]byte(md[i].Type)); err != nil { return 0, err }
+		err = binary.Write(f, order, uint32(len(value)))
+		if err != nil { return 0, err }
+		if _, err = f.Write(value); err != nil { return 0, err }
+
+		n += 4 + len(key) + 3 + 4 + len(value)
+	}
+
+	return n, nil
+}
+
+// minEntrySize is the smallest number of bytes a metadata entry can take up:
+// an empty key, a type, and an empty value.
+const minEntrySize = 4 + 3 + 4
+
+// readMetadata reads a metadata section. f.N is the number of bytes left in
+// the file, and an error is returned if any count or length stored in the
+// section couldn't fit in them. This keeps corrupted files from causing huge
+// allocations.
+func readMetadata(
+	f *io.LimitedReader, order binary.ByteOrder,
+) (Metadata, error) {
+	var nEntries uint32
+	if err := binary.Read(f, order, &nEntries); err != nil { return nil, err }
+	if int64(nEntries)*minEntrySize > f.N {
+		return nil, fmt.Errorf("The metadata section says it has %d entries, but only %d bytes are left in the file, so the header is corrupted.", nEntries, f.N)
+	}
+
+	md := make(Metadata, nEntries)
+	for i := range md {
+		key, err := readLengthPrefixed(f, order)
+		if err != nil { return nil, err }
+
+		typ := make([]byte, 3)
+		if _, err = io.ReadFull(f, typ); err != nil { return nil, err }
+
+		value, err := readLengthPrefixed(f, order)
+		if err != nil { return nil, err }
+
+		md[i].Key, md[i].Type = string(key), string(typ)
+		if err = md[i].decodeValue(order, value); err != nil { return nil, err }
+	}
+
+	return md, nil
+}
+
+// readLengthPrefixed reads a uint32 length followed by that many bytes. An
+// error is returned if the length is larger than the f.N bytes left in the
+// file.
+func readLengthPrefixed(
+	f *io.LimitedReader, order binary.ByteOrder,
+) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(f, order, &n); err != nil { return nil, err }
+	if int64(n) > f.N { return nil, headerLengthError(n, f.N) }
+	b := make([]byte, n)
+	if _, err := io.ReadFull(f, b); err != nil { return nil, err }
+	return b, nil
+}
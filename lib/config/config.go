@@ -46,6 +46,17 @@ file.
         // Handle error
     }
 
+Config files can include other config files with the same title, and values
+can use environment variables:
+
+    [cat_info]
+    Include = base_cat.config # CatName, FurColors, etc. are set here.
+    Age = $CAT_AGE
+
+Variables set in the including file override the included file. Variables
+can also be overridden with ReadOverrides, e.g. with values passed on the
+command line.
+
 A careful read of the above example will show that the supplied config file
 does not consider the config file missing one or more variables an error. This
 will be annoying in some cases, but is usually the desired behavior. You will
@@ -58,6 +69,8 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -108,6 +121,9 @@ type ConfigVars struct {
 	varNames        []string
 	varTypes        []varType
 	conversionFuncs []conversionFunc
+	// assigned is every assignment that has been converted, with later
+	// assignments to a variable replacing earlier ones.
+	assigned []assignment
 }
 
 func intConv(ptr *int64) conversionFunc {
@@ -278,15 +294,55 @@ func (vars *ConfigVars) Bools(ptr *[]bool, name string, value []bool) {
 // Parsing Code //
 //////////////////
 
+// IncludeName is the name of the directive that includes other config files,
+// e.g. "Include = base.config". Included files must have the same title and
+// are read first, so variables in the including file override them. Relative
+// paths are relative to the directory of the including file, and several
+// files can be included as a comma-separated list, with later files
+// overriding earlier ones.
+const IncludeName = "Include"
+
+// assignment is a single Variable = Value pair, along with a description of
+// where it was set for error messages.
+type assignment struct {
+	name, val, loc string
+}
+
 // ReadConfig parses the config file specified by fname using the set of
 // variables vars. If successful nil is returned, otherwise an error is
-// returned.
+// returned. Environment variables written as $NAME or ${NAME} are replaced
+// by their values, and $$ is replaced by $.
 func ReadConfig(fname string, vars *ConfigVars) error {
+	assigns, err := readAssignments(fname, vars, []string{})
+	if err != nil {
+		return err
+	}
+	return convertAssignments(assigns, vars)
+}
+
+// readAssignments reads the assignments in a config file and every file it
+// includes. parents are the absolute paths of the files that included it.
+func readAssignments(
+	fname string, vars *ConfigVars, parents []string,
+) ([]assignment, error) {
 	// I/O
 
+	absName, err := filepath.Abs(fname)
+	if err != nil {
+		return nil, err
+	}
+	for _, parent := range parents {
+		if parent == absName {
+			return nil, fmt.Errorf(
+				"The config file %s includes itself through the chain of "+
+					"includes %s.", fname, strings.Join(parents, " -> "),
+			)
+		}
+	}
+
 	bs, err := ioutil.ReadFile(fname)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Begin tokenization; remember line numbers for better errors.
@@ -298,7 +354,7 @@ func ReadConfig(fname string, vars *ConfigVars) error {
 	}
 
 	if len(lines) == 0 || lines[0] != fmt.Sprintf("[%s]", vars.name) {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"I expected the config file %s to have the header "+
 				"[%s] at the top, but didn't find it.", fname, vars.name,
 		)
@@ -309,53 +365,208 @@ func ReadConfig(fname string, vars *ConfigVars) error {
 
 	names, vals, errLine := associationList(lines)
 	if errLine != -1 {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"I could not parse line %d of the config file %s because it "+
 				"did not take the form of a variable assignment.",
 			lineNums[errLine+1], fname,
 		)
 	}
 
-	if errLine = checkValidNames(names, vars); errLine != -1 {
-		return fmt.Errorf(
-			"Line %d of the config file %s assigns a value to the "+
-				"variable '%s', but config files of type %s don't have that "+
-				"variable.", lineNums[errLine+1], fname, names[errLine], vars.name,
+	includes, own := []assignment{}, []assignment{}
+	for i := range names {
+		loc := fmt.Sprintf("line %d of the config file %s",
+			lineNums[i+1], fname)
+		val, err := expandEnv(vals[i])
+		if err != nil {
+			return nil, fmt.Errorf("I could not parse %s because %s",
+				loc, err.Error())
+		}
+
+		if strings.ToLower(names[i]) == strings.ToLower(IncludeName) {
+			includes = append(includes, assignment{names[i], val, loc})
+		} else {
+			own = append(own, assignment{names[i], val, loc})
+		}
+	}
+
+	if len(includes) > 1 {
+		return nil, fmt.Errorf(
+			"The config file %s has more than one %s line. Use a "+
+				"comma-separated list to include several files.",
+			fname, IncludeName,
 		)
 	}
 
-	if errLine1, errLine2 := checkDuplicateNames(names); errLine1 != -1 {
-		return fmt.Errorf(
+	ownNames := make([]string, len(own))
+	for i := range own {
+		ownNames[i] = own[i].name
+	}
+
+	if errLine = checkValidNames(ownNames, vars); errLine != -1 {
+		return nil, fmt.Errorf(
+			"%s assigns a value to the variable '%s', but config files of "+
+				"type %s don't have that variable.",
+			capitalize(own[errLine].loc), own[errLine].name, vars.name,
+		)
+	}
+
+	if errLine1, errLine2 := checkDuplicateNames(ownNames); errLine1 != -1 {
+		return nil, fmt.Errorf(
 			"Lines %d and %d of the config file %s both assign a value to "+
-				"the variable '%s'.", lineNums[errLine1+1], lineNums[errLine2+1],
-			fname, names[errLine1],
+				"the variable '%s'.", lineNums[errLine1+1],
+			lineNums[errLine2+1], fname, ownNames[errLine1],
 		)
 	}
 
-	// Convert every variable in the associate list.
+	// Read included files, which are overridden by this file.
 
-	if errLine = convertAssoc(names, vals, vars); errLine != -1 {
+	out := []assignment{}
+	for _, inc := range includes {
+		for _, incName := range strToList(inc.val) {
+			if !filepath.IsAbs(incName) {
+				incName = filepath.Join(filepath.Dir(fname), incName)
+			}
+
+			incAssigns, err := readAssignments(
+				incName, vars, append(parents, absName),
+			)
+			if err != nil {
+				return nil, fmt.Errorf("I could not read the file included "+
+					"on %s. %s", inc.loc, err.Error())
+			}
+			out = mergeAssignments(out, incAssigns)
+		}
+	}
+
+	return mergeAssignments(out, own), nil
+}
+
+// mergeAssignments returns base with every assignment in over either
+// replacing the assignment to the same variable or appended to the end.
+func mergeAssignments(base, over []assignment) []assignment {
+	out := append([]assignment{}, base...)
+OverLoop:
+	for _, a := range over {
+		for i := range out {
+			if strings.ToLower(out[i].name) == strings.ToLower(a.name) {
+				out[i] = a
+				continue OverLoop
+			}
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// convertAssignments converts every assignment with vars' conversion
+// functions.
+func convertAssignments(assigns []assignment, vars *ConfigVars) error {
+	for _, a := range assigns {
 		j := 0
 		for ; j < len(vars.varNames); j++ {
-			if strings.ToLower(vars.varNames[j]) ==
-				strings.ToLower(names[errLine]) {
+			if strings.ToLower(vars.varNames[j]) == strings.ToLower(a.name) {
 				break
 			}
 		}
-		typeName := vars.varTypes[j].String()
-		a := "a"
-		if typeName[0] == 'i' {
-			a = "an"
+
+		if ok := vars.conversionFuncs[j](a.val); !ok {
+			typeName := vars.varTypes[j].String()
+			an := "a"
+			if typeName[0] == 'i' {
+				an = "an"
+			}
+			return fmt.Errorf(
+				"I could not parse %s because '%s' expects values of type "+
+					"%s and '%s' cannnot be converted to %s %s.", a.loc,
+				vars.varNames[j], typeName, a.val, an, typeName,
+			)
+		}
+	}
+	vars.assigned = mergeAssignments(vars.assigned, assigns)
+	return nil
+}
+
+// Text returns the variables set by ReadConfig and ReadOverrides as the text
+// of a config file. This is the config after includes have been resolved,
+// environment variables have been expanded, and overrides have been applied.
+// Variables which were never assigned are left out.
+func (vars *ConfigVars) Text() string {
+	lines := []string{fmt.Sprintf("[%s]", vars.name)}
+	for _, a := range vars.assigned {
+		lines = append(lines, fmt.Sprintf("%s = %s", a.name, a.val))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// expandEnv replaces environment variables in s. An error is returned if
+// any of them aren't set.
+func expandEnv(s string) (string, error) {
+	missing := []string{}
+	out := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
 		}
+		return val
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf(
+			"it uses the environment variable '%s', which isn't set. "+
+				"Write $$ if you need a literal '$'.", missing[0],
+		)
+	}
+	return out, nil
+}
+
+// capitalize capitalizes the first letter of s.
+func capitalize(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// ReadOverrides sets variables from a list of Var=Value strings, such as
+// those passed to --set on the command line. Values are converted in the
+// same way as values in config files and override them, so ReadOverrides
+// should be called after ReadConfig.
+func ReadOverrides(overrides []string, vars *ConfigVars) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	names, vals, errLine := associationList(overrides)
+	if errLine != -1 {
 		return fmt.Errorf(
-			"I could not parse line %d of the config file %s because '%s' "+
-				"expects values of type %s and '%s' cannnot be converted to "+
-				"%s %s.", lineNums[errLine+1], fname, vars.varNames[j], typeName,
-			vals[j], a, typeName,
+			"The override '%s' isn't written as Variable=Value.",
+			overrides[errLine],
 		)
 	}
 
-	return nil
+	if errLine = checkValidNames(names, vars); errLine != -1 {
+		return fmt.Errorf(
+			"The override '%s' sets the variable '%s', but config files of "+
+				"type %s don't have that variable.", overrides[errLine],
+			names[errLine], vars.name,
+		)
+	}
+
+	if errLine1, _ := checkDuplicateNames(names); errLine1 != -1 {
+		return fmt.Errorf(
+			"The variable '%s' was overridden twice.", names[errLine1],
+		)
+	}
+
+	assigns := make([]assignment, len(names))
+	for i := range names {
+		loc := fmt.Sprintf("the override '%s'", overrides[i])
+		assigns[i] = assignment{names[i], vals[i], loc}
+	}
+	return convertAssignments(assigns, vars)
 }
 
 func ReadFlags(args []string, vars *ConfigVars) error {
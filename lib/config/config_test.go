@@ -2,7 +2,10 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -390,6 +393,10 @@ func TestInvalidConfig(t *testing.T) {
 		"config_test_files/dupicates.config",
 		"config_test_files/invalid_var.config",
 		"config_test_files/invalid_type.config",
+		"config_test_files/include_cycle_a.config",
+		"config_test_files/missing_env.config",
+		"config_test_files/double_include.config",
+		"config_test_files/include_wrong_header.config",
 	}
 
 	for i := range fnames {
@@ -404,6 +411,133 @@ func TestInvalidConfig(t *testing.T) {
 	}
 }
 
+func TestIncludeConfig(t *testing.T) {
+	os.Setenv("GUPPY_TEST_WORD", "meow")
+	os.Setenv("GUPPY_TEST_FLOAT", "3.5")
+	defer os.Unsetenv("GUPPY_TEST_WORD")
+	defer os.Unsetenv("GUPPY_TEST_FLOAT")
+
+	config, vars := makeTestConfig()
+	err := ReadConfig("config_test_files/include.config", vars)
+	if err != nil {
+		t.Fatalf("Expected successful read of config file, but got "+
+			"error:\n %s", err.Error())
+	}
+
+	switch {
+	case config.num != 3:
+		t.Errorf("Expected num = 3 from the included file, got %d.",
+			config.num)
+	case !stringsEq(config.words, []string{"a", "b"}):
+		t.Errorf("Expected words = [a b] from the included file, got %v.",
+			config.words)
+	case config.word != "meow":
+		t.Errorf("Expected word = meow, got %s.", config.word)
+	case !floatsEq(config.floats, []float64{2.5, 3.5}, 0.001):
+		t.Errorf("Expected floats = [2.5 3.5], got %v.", config.floats)
+	case !int64sEq(config.nums, []int64{1, 2}):
+		t.Errorf("Expected nums = [1 2], got %v.", config.nums)
+	}
+}
+
+func TestConfigText(t *testing.T) {
+	os.Setenv("GUPPY_TEST_WORD", "meow")
+	os.Setenv("GUPPY_TEST_FLOAT", "3.5")
+	defer os.Unsetenv("GUPPY_TEST_WORD")
+	defer os.Unsetenv("GUPPY_TEST_FLOAT")
+
+	_, vars := makeTestConfig()
+	err := ReadConfig("config_test_files/include.config", vars)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = ReadOverrides([]string{"NUM=7", "okay = true"}, vars)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	exp := "[config]\nNUM = 7\nword = meow\nwords = a, b\n" +
+		"floats = 2.5, 3.5\nnums = 1, 2\nokay = true\n"
+	if text := vars.Text(); text != exp {
+		t.Errorf("Expected Text() = %q, got %q.", exp, text)
+	}
+
+	// The text is itself a valid config file with the same values.
+	fname := filepath.Join(t.TempDir(), "resolved.config")
+	if err := ioutil.WriteFile(fname, []byte(exp), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	config, vars := makeTestConfig()
+	if err := ReadConfig(fname, vars); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if config.num != 7 || config.word != "meow" || !config.okay ||
+		!floatsEq(config.floats, []float64{2.5, 3.5}, 0.001) {
+		t.Errorf("Reading Text() gave a different config, %v.", config)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("GUPPY_TEST_DIR", "/data/box1")
+	defer os.Unsetenv("GUPPY_TEST_DIR")
+
+	tests := []struct {
+		s, out string
+		valid  bool
+	}{
+		{"snap_{%03d,snapshot}", "snap_{%03d,snapshot}", true},
+		{"$GUPPY_TEST_DIR/snap", "/data/box1/snap", true},
+		{"${GUPPY_TEST_DIR}_out", "/data/box1_out", true},
+		{"cost: $$5", "cost: $5", true},
+		{"$/", "$/", true},
+		{"$GUPPY_TEST_UNSET_VARIABLE", "", false},
+	}
+
+	for i := range tests {
+		out, err := expandEnv(tests[i].s)
+		if tests[i].valid && err != nil {
+			t.Errorf("%d) Expected '%s' could be expanded, but got error %s",
+				i, tests[i].s, err.Error())
+		} else if !tests[i].valid && err == nil {
+			t.Errorf("%d) Expected '%s' would fail, but got no error.",
+				i, tests[i].s)
+		} else if out != tests[i].out {
+			t.Errorf("%d) Expected '%s' to expand to '%s', got '%s'.",
+				i, tests[i].s, tests[i].out, out)
+		}
+	}
+}
+
+func TestReadOverrides(t *testing.T) {
+	config, vars := makeTestConfig()
+	err := ReadConfig("config_test_files/success.config", vars)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	err = ReadOverrides([]string{"NUM=7", "words = a=b, c"}, vars)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if config.num != 7 || !stringsEq(config.words, []string{"a=b", "c"}) {
+		t.Errorf("Expected num = 7 and words = [a=b c], got %d and %v.",
+			config.num, config.words)
+	} else if config.word != "meow" {
+		t.Errorf("Overrides changed the variable word.")
+	}
+
+	invalid := [][]string{
+		{"num"}, {"=7"}, {"cats=7"}, {"num=seven"}, {"num=1", "Num=2"},
+		{"Include=success.config"},
+	}
+	for i := range invalid {
+		if err := ReadOverrides(invalid[i], vars); err == nil {
+			t.Errorf("%d) Expected error for the overrides %v.",
+				i, invalid[i])
+		}
+	}
+}
+
 func TestValidFlags(t *testing.T) {
 	config, vars := makeTestConfig()
 	flags := []string{
@@ -0,0 +1,351 @@
+package lib
+
+/* This file contains the functions used by guppy's confirm mode, which checks
+that .gup files match the snapshots they were created from. */
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/particles"
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+// FieldError accumulates the differences between the original values of a
+// field and the values stored in .gup files.
+type FieldError struct {
+	// Name is the name of the field in the .gup files, e.g. "x{0}".
+	Name string
+	// Accuracy is the accuracy the field was supposed to be stored to and
+	// Period is its periodicity (non-positive if it isn't periodic).
+	Accuracy, Period float64
+	// N is the number of values that were checked and NBad is the number
+	// that were less accurate than Accuracy.
+	N, NBad int64
+	// Max is the largest error.
+	Max float64
+
+	sumSqr float64
+	// ulp is the relative precision of the field's type. Rounding means that
+	// values can be off by a few of these on top of Accuracy.
+	ulp float64
+	// variable and dim give the variable in the input files that this field
+	// comes from, and which component of it the field is.
+	variable string
+	dim int
+}
+
+// NewFieldErrors returns a FieldError for every field that cfg will write to
+// .gup files, along with one for "id". accuracies are the accuracies of
+// cfg.Vars in the snapshot being checked. (See SnapshotAccuracies.)
+func NewFieldErrors(cfg *WriteConfig, accuracies []float64) []*FieldError {
+	out := []*FieldError{ }
+	for i := range cfg.Vars {
+		if cfg.Vars[i] == "id" { continue }
+
+		var ulp float64
+		switch cfg.Types[i] {
+		case "f32", "v32": ulp = math.Pow(2, -23)
+		case "f64", "v64": ulp = math.Pow(2, -52)
+		}
+
+		switch cfg.Types[i] {
+		case "v32", "v64":
+			for dim := 0; dim < 3; dim++ {
+				out = append(out, &FieldError{
+					Name: fmt.Sprintf("%s{%d}", cfg.Vars[i], dim),
+					Accuracy: accuracies[i],
+					ulp: ulp, variable: cfg.Vars[i], dim: dim,
+				})
+			}
+		default:
+			out = append(out, &FieldError{
+				Name: cfg.Vars[i], Accuracy: accuracies[i],
+				ulp: ulp, variable: cfg.Vars[i],
+			})
+		}
+	}
+
+	return append(out, &FieldError{ Name: "id", variable: "id" })
+}
+
+// Add adds a value to the FieldError. x is the original value and dx is the
+// difference between it and the stored value.
+func (e *FieldError) Add(x, dx float64) {
+	dx = math.Abs(dx)
+	if e.Period > 0 {
+		dx = math.Mod(dx, e.Period)
+		if dx > e.Period/2 { dx = e.Period - dx }
+	}
+
+	e.N++
+	e.sumSqr += dx*dx
+	if dx > e.Max { e.Max = dx }
+	if dx > e.Accuracy + 4*e.ulp*math.Abs(x) { e.NBad++ }
+}
+
+// RMS returns the root-mean-square error of the field.
+func (e *FieldError) RMS() float64 {
+	if e.N == 0 { return 0 }
+	return math.Sqrt(e.sumSqr / float64(e.N))
+}
+
+// Merge adds the values in another FieldError for the same field to e.
+func (e *FieldError) Merge(other *FieldError) {
+	e.N += other.N
+	e.NBad += other.NBad
+	e.sumSqr += other.sumSqr
+	if other.Max > e.Max { e.Max = other.Max }
+	if other.Period > 0 { e.Period = other.Period }
+}
+
+// ConfirmInput holds the particles read from an input file and the location
+// of each of them in the .gup files.
+type ConfirmInput struct {
+	// Name is the name of the input file.
+	Name string
+	buf *snapio.Buffer
+	id []uint64
+	nTot int64
+	// from[j] and to[j] are the indices of the particles written to the j-th
+	// .gup file in the input file and in the .gup file, respectively.
+	from, to [][]int
+}
+
+// NewConfirmInput creates a ConfirmInput that can read files with the given
+// header.
+func NewConfirmInput(hd snapio.Header) (*ConfirmInput, error) {
+	buf, err := snapio.NewBuffer(hd)
+	if err != nil { return nil, err }
+	return &ConfirmInput{ "", buf, []uint64{ }, 0, nil, nil }, nil
+}
+
+// Read reads every variable in cfg from an input file and finds where each
+// particle was written in the snapshot's nOutputs .gup files. Particles are
+// matched to their .gup file using cfg's IDOrder.
+func (in *ConfirmInput) Read(
+	cfg *WriteConfig, input string, nOutputs int,
+) error {
+	f, err := OpenSnapioFile(cfg, input)
+	if err != nil { return err }
+	hd, err := f.ReadHeader()
+	if err != nil {
+		return fmt.Errorf("Cannot read %s: %s", input, err.Error())
+	}
+	in.Name, in.nTot = input, hd.NTot()
+
+	// Read the original particles.
+	in.buf.Reset()
+	vars := []string{ "id" }
+	for i := range cfg.Vars {
+		if cfg.Vars[i] != "id" { vars = append(vars, cfg.Vars[i]) }
+	}
+	for _, v := range vars {
+		if err := f.Read(v, in.buf); err != nil {
+			return fmt.Errorf("Cannot read %s: %s", input, err.Error())
+		}
+	}
+
+	idGeneric, err := in.buf.Get("id")
+	if err != nil { return err }
+	switch x := idGeneric.(type) {
+	case []uint32:
+		in.id = resizeUint64s(in.id, len(x))
+		for i := range x { in.id[i] = uint64(x[i]) }
+	case []uint64:
+		in.id = x
+	}
+
+	// Find where each particle was written.
+	order, err := NewIDOrder(cfg.IDOrder, hd.NTot())
+	if err != nil { return err }
+	scheme, err := particles.NewEqualSplitUnigrid(hd, order,
+		int(cfg.OutputGridWidth), []string{ })
+	if err != nil {
+		return fmt.Errorf("Cannot split %s: %s", input, err.Error())
+	}
+
+	if len(in.from) != nOutputs {
+		in.from = make([][]int, nOutputs)
+		in.to = make([][]int, nOutputs)
+	}
+	in.from, in.to, err = scheme.Indices(in.id, in.from, in.to)
+	if err != nil {
+		return fmt.Errorf("Cannot split %s: %s", input, err.Error())
+	}
+
+	return nil
+}
+
+// Overlaps returns true if any of the particles in the input were written to
+// the j-th .gup file.
+func (in *ConfirmInput) Overlaps(j int) bool { return len(in.from[j]) > 0 }
+
+// ConfirmBuffer contains the buffers used by ConfirmFile and ConfirmOutput.
+// Each thread calling them needs its own.
+type ConfirmBuffer struct {
+	Input *ConfirmInput
+	Compress *compress.Buffer
+	MidBuf []byte
+}
+
+// NewConfirmBuffer creates a ConfirmBuffer that can read files with the given
+// header.
+func NewConfirmBuffer(hd snapio.Header) (*ConfirmBuffer, error) {
+	in, err := NewConfirmInput(hd)
+	if err != nil { return nil, err }
+	return &ConfirmBuffer{ in, compress.NewBuffer(0), []byte{ } }, nil
+}
+
+// ConfirmFile compares every particle in the input file against the
+// compressed value stored in outputs, the .gup files for that snapshot. The
+// differences are added to errs, which should have been created with
+// NewFieldErrors.
+//
+// Each .gup file that the input overlaps is decompressed, so checking every
+// input this way decompresses each .gup file once per input that overlaps
+// it. Use ConfirmInput and ConfirmOutput to check a whole snapshot.
+func ConfirmFile(
+	cfg *WriteConfig, input string, outputs []string,
+	buf *ConfirmBuffer, errs []*FieldError,
+) error {
+	if err := buf.Input.Read(cfg, input, len(outputs)); err != nil {
+		return err
+	}
+
+	inputs := []*ConfirmInput{ buf.Input }
+	for j := range outputs {
+		if !buf.Input.Overlaps(j) { continue }
+		err := ConfirmOutput(cfg, outputs[j], j, inputs, buf, errs)
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// ConfirmOutput compares the particles in output, the j-th .gup file of a
+// snapshot, against the particles in every input that overlaps it. The file
+// is only decompressed once. The differences are added to errs, which should
+// have been created with NewFieldErrors.
+func ConfirmOutput(
+	cfg *WriteConfig, output string, j int, inputs []*ConfirmInput,
+	buf *ConfirmBuffer, errs []*FieldError,
+) error {
+	overlapping := []*ConfirmInput{ }
+	for _, in := range inputs {
+		if in.Overlaps(j) { overlapping = append(overlapping, in) }
+	}
+	if len(overlapping) == 0 { return nil }
+
+	rd, err := compress.NewReader(output, buf.Compress, buf.MidBuf)
+	if err != nil { return err }
+	defer func() {
+		rd.Close()
+		buf.MidBuf = rd.ReuseMidBuf()
+	}()
+
+	gw := cfg.OutputGridWidth
+	n := overlapping[0].nTot / (gw*gw*gw)
+	if rd.N != n {
+		return fmt.Errorf("The file %s contains %d particles, but it " +
+			"should contain %d.", output, rd.N, n)
+	}
+
+	for _, e := range errs {
+		i := -1
+		for k := range rd.Names {
+			if rd.Names[k] == e.Name { i = k }
+		}
+		if i == -1 {
+			return fmt.Errorf("The field '%s' is not in the file %s. It " +
+				"only contains the fields %s.", e.Name, output, rd.Names)
+		}
+		if rd.Periods[i] > 0 { e.Period = rd.Periods[i] }
+
+		field, err := rd.ReadField(e.Name)
+		if err != nil {
+			return fmt.Errorf("Cannot read '%s' from %s: %s",
+				e.Name, output, err.Error())
+		}
+
+		for _, in := range overlapping {
+			var x interface{} = in.id
+			if e.variable != "id" {
+				x, err = in.buf.Get(e.variable)
+				if err != nil { return err }
+			}
+
+			if !addErrors(e, x, field.Data(), in.from[j], in.to[j]) {
+				return fmt.Errorf("The field '%s' in %s has type %s, " +
+					"which doesn't match the type of '%s' in %s.",
+					e.Name, output, rd.Types[i], e.variable, in.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addErrors adds the differences between x[from] and y[to] to e. x is the
+// original array and y is the array read from the .gup file. false is
+// returned if the two arrays don't have compatible types.
+func addErrors(e *FieldError, x, y interface{}, from, to []int) bool {
+	dim := e.dim
+	switch xx := x.(type) {
+	case []uint32:
+		yy, ok := y.([]uint32)
+		if !ok { return false }
+		for k := range from {
+			xk, yk := xx[from[k]], yy[to[k]]
+			e.Add(float64(xk), float64(int64(yk) - int64(xk)))
+		}
+	case []uint64:
+		yy, ok := y.([]uint64)
+		if !ok { return false }
+		for k := range from {
+			// Subtract first so large IDs don't lose precision.
+			xk, yk := xx[from[k]], yy[to[k]]
+			e.Add(float64(xk), float64(int64(yk - xk)))
+		}
+	case []float32:
+		yy, ok := y.([]float32)
+		if !ok { return false }
+		for k := range from {
+			xk := float64(xx[from[k]])
+			e.Add(xk, float64(yy[to[k]]) - xk)
+		}
+	case []float64:
+		yy, ok := y.([]float64)
+		if !ok { return false }
+		for k := range from {
+			xk := xx[from[k]]
+			e.Add(xk, yy[to[k]] - xk)
+		}
+	case [][3]float32:
+		yy, ok := y.([]float32)
+		if !ok { return false }
+		for k := range from {
+			xk := float64(xx[from[k]][dim])
+			e.Add(xk, float64(yy[to[k]]) - xk)
+		}
+	case [][3]float64:
+		yy, ok := y.([]float64)
+		if !ok { return false }
+		for k := range from {
+			xk := xx[from[k]][dim]
+			e.Add(xk, yy[to[k]] - xk)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// resizeUint64s resizes a buffer to have length n.
+func resizeUint64s(x []uint64, n int) []uint64 {
+	if m := n - cap(x); m > 0 {
+		x = append(x[:cap(x)], make([]uint64, m)...)
+	}
+	return x[:n]
+}
@@ -0,0 +1,288 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/particles"
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+func TestFieldError(t *testing.T) {
+	e := &FieldError{ Name: "x{0}", Accuracy: 0.1, Period: 10 }
+	e.Add(5, 0.05)
+	e.Add(9.99, -9.97) // Wraps around the box: the real error is 0.03.
+	e.Add(1, 0.2)
+
+	if e.N != 3 || e.NBad != 1 {
+		t.Errorf("Expected N = 3 and NBad = 1, got %d and %d.", e.N, e.NBad)
+	} else if math.Abs(e.Max - 0.2) > 1e-12 {
+		t.Errorf("Expected Max = 0.2, got %g.", e.Max)
+	}
+
+	rms := math.Sqrt((0.05*0.05 + 0.03*0.03 + 0.2*0.2) / 3)
+	if math.Abs(e.RMS() - rms) > 1e-12 {
+		t.Errorf("Expected RMS() = %g, got %g.", rms, e.RMS())
+	}
+
+	other := &FieldError{ Name: "x{0}", Accuracy: 0.1, Period: 10 }
+	other.Add(3, 0.5)
+	e.Merge(other)
+	if e.N != 4 || e.NBad != 2 || e.Max != 0.5 {
+		t.Errorf("Expected N = 4, NBad = 2 and Max = 0.5 after Merge(), " +
+			"got %d, %d, and %g.", e.N, e.NBad, e.Max)
+	}
+}
+
+// writeConfirmTestFiles writes a simulation with width^3 particles split
+// across two LGadget-2 files and compresses it into gw^3 .gup files, storing
+// positions to accuracy dx and velocities to accuracy dv. It returns the
+// input and output file names.
+func writeConfirmTestFiles(
+	dir string, width, gw int, L, dx, dv float64,
+) (inputs, outputs []string, err error) {
+	n := width*width*width
+	x, v := make([][3]float32, n), make([][3]float32, n)
+	id := make([]uint32, n)
+	for i, j := range rand.Perm(n) {
+		id[i] = uint32(j + 1)
+		for dim := 0; dim < 3; dim++ {
+			x[i][dim] = float32(L*rand.Float64())
+			v[i][dim] = float32(200*rand.Float64() - 100)
+		}
+	}
+
+	names, types := []string{ "x", "v", "id" }, []string{ "v32", "v32", "u32" }
+	files := []snapio.File{ }
+	for i := 0; i < 2; i++ {
+		start, end := i*n/2, (i + 1)*n/2
+		inputs = append(inputs, path.Join(dir, fmt.Sprintf("snap.%d", i)))
+		err := snapio.WriteLGadget2(inputs[i], n, 2, L, 0,
+			x[start: end], v[start: end], id[start: end])
+		if err != nil { return nil, nil, err }
+
+		f, err := snapio.NewLGadget2(inputs[i], names, types,
+			binary.LittleEndian)
+		if err != nil { return nil, nil, err }
+		files = append(files, f)
+	}
+
+	hd, err := files[0].ReadHeader()
+	if err != nil { return nil, nil, err }
+	order := particles.NewZMajorUnigridPlusOne(width)
+	scheme, err := particles.NewEqualSplitUnigrid(hd, order, gw, names)
+	if err != nil { return nil, nil, err }
+	p, err, _ := particles.Split(scheme, files, names)
+	if err != nil { return nil, nil, err }
+
+	sub := width / gw
+	span := [3]int{ sub, sub, sub }
+	for j := range p {
+		outputs = append(outputs, path.Join(dir, fmt.Sprintf("snap.%d.gup", j)))
+
+		offset := [3]int64{
+			int64(sub*(j % gw)), int64(sub*((j / gw) % gw)),
+			int64(sub*(j / (gw*gw))),
+		}
+		wr := compress.NewWriter(outputs[j], hd,
+			[3]int64{ int64(sub), int64(sub), int64(sub) }, offset,
+			[3]int64{ int64(width), int64(width), int64(width) },
+			compress.NewBuffer(0), []byte{ }, binary.LittleEndian)
+
+		for dim := 0; dim < 3; dim++ {
+			xName, vName := fmt.Sprintf("x{%d}", dim), fmt.Sprintf("v{%d}", dim)
+			err := wr.AddField(p[j][xName],
+				compress.NewLagrangianDelta(span, dx, L))
+			if err != nil { return nil, nil, err }
+			err = wr.AddField(p[j][vName],
+				compress.NewLagrangianDelta(span, dv, 0))
+			if err != nil { return nil, nil, err }
+		}
+
+		if _, err := wr.Flush(); err != nil { return nil, nil, err }
+	}
+
+	return inputs, outputs, nil
+}
+
+func TestConfirmFile(t *testing.T) {
+	width, gw, L := 8, 2, 100.0
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "v", "id" },
+		Types: []string{ "v32", "v32", "u32" },
+		Accuracies: []float64{ 1e-3, 1e-2, 0 },
+		OutputGridWidth: int64(gw), ByteOrder: "LittleEndian",
+		FileType: "LGadget-2",
+		GadgetVars: []string{ "x", "v", "id" },
+		GadgetTypes: []string{ "v32", "v32", "u32" },
+		IDOrder: "ZUnigridPlusOne",
+	}
+
+	tests := []struct{
+		dx, dv float64
+		bad []string
+	} {
+		{ 1e-3, 1e-2, []string{ } },
+		{ 1e-3, 1e-1, []string{ "v{0}", "v{1}", "v{2}" } },
+	}
+
+	for i := range tests {
+		dir := t.TempDir()
+		inputs, outputs, err := writeConfirmTestFiles(dir, width, gw, L,
+			tests[i].dx, tests[i].dv)
+		if err != nil { t.Fatalf("%d) Could not write files: %s", i, err) }
+
+		hd, err := GetSnapioHeader(cfg, inputs[0])
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		buf, err := NewConfirmBuffer(hd)
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+
+		errs := NewFieldErrors(cfg, cfg.Accuracies)
+		for _, input := range inputs {
+			err := ConfirmFile(cfg, input, outputs, buf, errs)
+			if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		}
+
+		if len(errs) != 7 {
+			t.Fatalf("%d) Expected 7 fields, got %d.", i, len(errs))
+		}
+		for _, e := range errs {
+			expectBad := containsString(tests[i].bad, e.Name)
+			if e.N != int64(width*width*width) {
+				t.Errorf("%d) Expected %d values of %s to be checked, " +
+					"got %d.", i, width*width*width, e.Name, e.N)
+			} else if expectBad && e.NBad == 0 {
+				t.Errorf("%d) Expected %s to be inaccurate, but it wasn't.",
+					i, e.Name)
+			} else if !expectBad && e.NBad != 0 {
+				t.Errorf("%d) Expected %s to be accurate, but %d values " +
+					"had errors larger than %g. (Max error = %g)",
+					i, e.Name, e.NBad, e.Accuracy, e.Max)
+			}
+		}
+
+		if errs[0].Period != L {
+			t.Errorf("%d) Expected x{0} to have period %g, got %g.",
+				i, L, errs[0].Period)
+		} else if errs[6].Max != 0 {
+			t.Errorf("%d) IDs were matched incorrectly: max ID error is %g.",
+				i, errs[6].Max)
+		}
+	}
+}
+
+func TestConfirmOutput(t *testing.T) {
+	width, gw, L := 8, 2, 100.0
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "v", "id" },
+		Types: []string{ "v32", "v32", "u32" },
+		Accuracies: []float64{ 1e-3, 1e-2, 0 },
+		OutputGridWidth: int64(gw), ByteOrder: "LittleEndian",
+		FileType: "LGadget-2",
+		GadgetVars: []string{ "x", "v", "id" },
+		GadgetTypes: []string{ "v32", "v32", "u32" },
+		IDOrder: "ZUnigridPlusOne",
+	}
+
+	tests := []struct{
+		dx, dv float64
+		bad []string
+	} {
+		{ 1e-3, 1e-2, []string{ } },
+		{ 1e-3, 1e-1, []string{ "v{0}", "v{1}", "v{2}" } },
+	}
+
+	for i := range tests {
+		dir := t.TempDir()
+		inputs, outputs, err := writeConfirmTestFiles(dir, width, gw, L,
+			tests[i].dx, tests[i].dv)
+		if err != nil { t.Fatalf("%d) Could not write files: %s", i, err) }
+
+		hd, err := GetSnapioHeader(cfg, inputs[0])
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		buf, err := NewConfirmBuffer(hd)
+		if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+
+		// Every output overlaps both inputs, so each output is compared
+		// against both of them.
+		in := make([]*ConfirmInput, len(inputs))
+		for k := range inputs {
+			in[k], err = NewConfirmInput(hd)
+			if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+			err = in[k].Read(cfg, inputs[k], len(outputs))
+			if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		}
+
+		errs := NewFieldErrors(cfg, cfg.Accuracies)
+		for j := range outputs {
+			err := ConfirmOutput(cfg, outputs[j], j, in, buf, errs)
+			if err != nil { t.Fatalf("%d) %s", i, err.Error()) }
+		}
+
+		for _, e := range errs {
+			expectBad := containsString(tests[i].bad, e.Name)
+			if e.N != int64(width*width*width) {
+				t.Errorf("%d) Expected %d values of %s to be checked, " +
+					"got %d.", i, width*width*width, e.Name, e.N)
+			} else if expectBad && e.NBad == 0 {
+				t.Errorf("%d) Expected %s to be inaccurate, but it wasn't.",
+					i, e.Name)
+			} else if !expectBad && e.NBad != 0 {
+				t.Errorf("%d) Expected %s to be accurate, but %d values " +
+					"had errors larger than %g. (Max error = %g)",
+					i, e.Name, e.NBad, e.Accuracy, e.Max)
+			}
+		}
+
+		if errs[0].Period != L {
+			t.Errorf("%d) Expected x{0} to have period %g, got %g.",
+				i, L, errs[0].Period)
+		} else if errs[6].Max != 0 {
+			t.Errorf("%d) IDs were matched incorrectly: max ID error is %g.",
+				i, errs[6].Max)
+		}
+
+		os.Remove(outputs[3])
+		err = ConfirmOutput(cfg, outputs[3], 3, in, buf,
+			NewFieldErrors(cfg, cfg.Accuracies))
+		if err == nil {
+			t.Errorf("%d) Expected ConfirmOutput() to fail when a .gup " +
+				"file is missing.", i)
+		}
+	}
+}
+
+func TestConfirmFileMissingOutput(t *testing.T) {
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "v", "id" },
+		Types: []string{ "v32", "v32", "u32" },
+		Accuracies: []float64{ 1e-3, 1e-2, 0 },
+		OutputGridWidth: 2, ByteOrder: "LittleEndian",
+		FileType: "LGadget-2",
+		GadgetVars: []string{ "x", "v", "id" },
+		GadgetTypes: []string{ "v32", "v32", "u32" },
+		IDOrder: "ZUnigridPlusOne",
+	}
+
+	dir := t.TempDir()
+	inputs, outputs, err := writeConfirmTestFiles(dir, 8, 2, 100, 1e-3, 1e-2)
+	if err != nil { t.Fatalf("Could not write files: %s", err) }
+	os.Remove(outputs[3])
+
+	hd, err := GetSnapioHeader(cfg, inputs[0])
+	if err != nil { t.Fatalf(err.Error()) }
+	buf, err := NewConfirmBuffer(hd)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	err = ConfirmFile(cfg, inputs[0], outputs, buf,
+		NewFieldErrors(cfg, cfg.Accuracies))
+	if err == nil {
+		t.Errorf("Expected ConfirmFile() to fail when a .gup file is missing.")
+	}
+}
@@ -0,0 +1,467 @@
+package lib
+
+/* This file contains the functions used by guppy's convert mode, which turns
+.gup files back into Gadget-2 and LGadget-2 snapshots. */
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/config"
+	"github.com/phil-mansfield/guppy/lib/format"
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+func ExampleConvertConfig() string {
+	return `[convert]
+
+###########################
+# Input/Output parameters #
+###########################
+
+# Input gives the location of the .gup files that will be converted. It uses
+# the same format as the Input variable in write configs: variables in braces,
+# {print-format,variable-description}, are either "snapshot" or an inclusive
+# range of numbers. The example below describes the files written by the
+# example write config.
+Input = /path/to/output/snapdir_{%03d,snapshot}/snap_{%03d,snapshot}.{%d,0..63}.gup
+
+# Output gives the location of the snapshot files that will be created. The
+# number of files in each snapshot is set by the range of numbers in Output,
+# so you can choose a different number of files than the original simulation
+# used. Each file contains a contiguous range of IDs, sorted by ID. The
+# example below would split each snapshot into 512 files that looked like
+# /path/to/gadget/snapdir_015/snap_015.31.
+Output = /path/to/gadget/snapdir_{%03d,snapshot}/snap_{%03d,snapshot}.{%d,0..511}
+
+# Snaps lists the snapshots that you want to convert. It uses the same format
+# as the Snaps variable in write configs.
+Snaps = 0..100 - 63, 200
+
+# FormatVars declares extra variables that can be used in Input and Output. It
+# uses the same format as the FormatVars variable in write configs.
+# FormatVars = run:L0125, a:@/path/to/output_scale_factors.txt
+
+# CreateMissingDirectories tells guppy to create any directories it needs that
+# don't already exist when generating output files.
+# CreateMissingDirectories = false
+
+# ByteOrder specifies what byte ordering the output files will use. This can be
+# SystemOrder, BigEndian, or LittleEndian.
+# ByteOrder = SystemOrder
+
+#####################
+# File Type Options #
+#####################
+
+# FileType tells guppy what type of files to create. Currently the only
+# supported types are Gadget-2 and LGadget-2. The header of each file is
+# copied from the header of the original files, which guppy stores in every
+# .gup file, so this should be the same type the .gup files were created
+# from.
+FileType = LGadget-2
+
+# IDOrder tells guppy how to convert locations in Lagrangian space back into
+# IDs. This should be the same IDOrder that was used to write the .gup files.
+# IDOrder = ZUnigridPlusOne
+
+# GadgetVars gives the names of the blocks that will be written to each file,
+# in order. "id" is always available, and all the other variables must have
+# been stored in the .gup files.
+# GadgetVars = x, v, id
+
+# GadgetTypes gives the type of each block. v32 and v64 blocks are made out of
+# the {0}, {1}, and {2} components of the variable in the .gup files. If your
+# simulation has >=4 billion particles, the IDs must be u64.
+# GadgetTypes = v32, v32, u32
+
+#######################
+# Performance Options #
+#######################
+
+# Threads sets the number of threads used to convert files. -1 uses one thread
+# per core.
+# Threads = -1
+`
+}
+
+// ConvertConfig contains the variables in a convert config file. See
+// ExampleConvertConfig() for descriptions.
+type ConvertConfig struct {
+	Input, Output string
+	Snaps []string
+	FormatVars []string
+	CreateMissingDirectories bool
+	ByteOrder string
+
+	FileType string
+	IDOrder string
+	GadgetVars, GadgetTypes []string
+
+	Threads int64
+}
+
+func ParseConvertConfig(configName string) (*ConvertConfig, error) {
+	cfg := &ConvertConfig{ }
+	vars := config.NewConfigVars("convert")
+
+	vars.String(&cfg.Input, "Input", "")
+	vars.String(&cfg.Output, "Output", "")
+	vars.Strings(&cfg.Snaps, "Snaps", []string{})
+	vars.Strings(&cfg.FormatVars, "FormatVars", []string{})
+	vars.Bool(&cfg.CreateMissingDirectories, "CreateMissingDirectories", false)
+	vars.String(&cfg.ByteOrder, "ByteOrder", "SystemOrder")
+
+	vars.String(&cfg.FileType, "FileType", "")
+	vars.String(&cfg.IDOrder, "IDOrder", "ZUnigridPlusOne")
+	vars.Strings(&cfg.GadgetVars, "GadgetVars", []string{"x", "v", "id"})
+	vars.Strings(&cfg.GadgetTypes, "GadgetTypes",
+		[]string{"v32", "v32", "u32"})
+	vars.Int(&cfg.Threads, "Threads", -1)
+
+	err := config.ReadConfig(configName, vars)
+	if err != nil { return nil, err }
+
+	return cfg, nil
+}
+
+func CheckConvertConfig(cfg *ConvertConfig) error {
+	// Input, Output, and Snaps
+	if cfg.Input == "" {
+		return fmt.Errorf("The Input variable was not set.")
+	} else if cfg.Output == "" {
+		return fmt.Errorf("The Output variable was not set.")
+	} else if len(cfg.Snaps) == 0 {
+		return fmt.Errorf("The Snaps variable was not set.")
+	}
+
+	_, inputs, outputs, err := ExpandConvertFileNames(cfg)
+	if err != nil { return err }
+
+	for i := range inputs {
+		for _, input := range inputs[i] {
+			if !fileAccessible(input) {
+				return fmt.Errorf("The Input variable, %s, generated the " +
+					"file %s, which does not exist or isn't readable.",
+					cfg.Input, input)
+			}
+		}
+		if !cfg.CreateMissingDirectories &&
+			!parentDirWritable(outputs[i][0]) {
+			return fmt.Errorf("The Output variable, %s, generated files in " +
+				"the directory %s, but this directory does not exist is " +
+				"not writable, or is a non-directory file. If the directory " +
+				"does not exist and you would like guppy to create it for " +
+				"you, rerun guppy with CreateMissingDirectories = true.",
+				cfg.Output, path.Dir(outputs[i][0]))
+		}
+	}
+
+	// FileType, GadgetVars, and GadgetTypes
+	switch cfg.FileType {
+	case "Gadget-2", "LGadget-2":
+	default:
+		return fmt.Errorf("The variable FileType is set to %s, but the only " +
+			"supported files types are currently Gadget-2 and LGadget-2",
+			cfg.FileType)
+	}
+
+	if len(cfg.GadgetVars) != len(cfg.GadgetTypes) {
+		return fmt.Errorf("The GadgetVars variable has length %d, but " +
+			"the GadgetTypes variable has length %d.",
+			len(cfg.GadgetVars), len(cfg.GadgetTypes))
+	} else if ok, i := validTypes(cfg.GadgetTypes); !ok {
+		return fmt.Errorf("The GadgetTypes variable, %s, has '%s' at index " +
+			"%d, but the only supported types are u32 u64, f32, f64, v32, " +
+			"and v64.", cfg.GadgetTypes, cfg.GadgetTypes[i], i)
+	}
+
+	if i := containsStringIndex(cfg.GadgetVars, "id"); i == -1 {
+		return fmt.Errorf("The GadgetVars variable, %s, doesn't contain " +
+			"'id'.", cfg.GadgetVars)
+	} else if t := cfg.GadgetTypes[i]; t != "u32" && t != "u64" {
+		return fmt.Errorf("'id' has the type %s in GadgetTypes, but it " +
+			"must be u32 or u64.", t)
+	}
+
+	// IDOrder
+	if !containsString(SupportedIDOrders, cfg.IDOrder) {
+		return fmt.Errorf("The IDOrder variable was set to %s, " +
+			"but only supported orderings are: %s", cfg.IDOrder,
+			SupportedIDOrders)
+	}
+
+	// Threads
+	if cfg.Threads < -1 || cfg.Threads == 0 {
+		return fmt.Errorf("The Threads variable was set to %d, but the " +
+			"only valid values are -1 or a positive integer.", cfg.Threads)
+	}
+
+	// ByteOrder
+	switch cfg.ByteOrder {
+	case "SystemOrder", "BigEndian", "LittleEndian":
+	default:
+		return fmt.Errorf("The ByteOrder variable was set to %s, but the " +
+			"only valid values are SystemOrder, LittleEndian, and BigEndian",
+			cfg.ByteOrder)
+	}
+
+	return nil
+}
+
+// ExpandConvertFileNames returns the snapshots in cfg along with the .gup
+// files and output files in each snapshot.
+func ExpandConvertFileNames(cfg *ConvertConfig) (
+	snaps []int, inputs, outputs [][]string, err error,
+) {
+	snaps, err = expandSnaps(cfg.Snaps)
+	if err != nil { return nil, nil, nil, err }
+	formatVars, err := parseFormatVars(cfg.FormatVars, snaps)
+	if err != nil { return nil, nil, nil, err }
+
+	for _, snap := range snaps {
+		vals, _ := snapFormatVals(formatVars, snap)
+
+		snapInputs, err := format.ExpandFormatVars(cfg.Input, vals)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("The Input variable, %s, could " +
+				"not be parsed. %s", cfg.Input, err.Error())
+		}
+		snapOutputs, err := format.ExpandFormatVars(cfg.Output, vals)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("The Output variable, %s, " +
+				"could not be parsed. %s", cfg.Output, err.Error())
+		}
+
+		inputs = append(inputs, snapInputs)
+		outputs = append(outputs, snapOutputs)
+	}
+
+	return snaps, inputs, outputs, nil
+}
+
+// ReadConvertHeaders reads the headers of the .gup files in a snapshot and
+// checks that they all belong to the same simulation.
+func ReadConvertHeaders(inputs []string) ([]*compress.Header, error) {
+	hds := make([]*compress.Header, len(inputs))
+	for i := range inputs {
+		rd, err := compress.NewReader(inputs[i], compress.NewBuffer(0),
+			[]byte{ })
+		if err != nil { return nil, err }
+		hd := rd.Header
+		hds[i] = &hd
+		rd.Close()
+
+		if hds[i].TotalSpan != hds[0].TotalSpan {
+			return nil, fmt.Errorf("The file %s covers a simulation with " +
+				"dimensions %d, but %s covers a simulation with dimensions " +
+				"%d.", inputs[i], hds[i].TotalSpan, inputs[0],
+				hds[0].TotalSpan)
+		}
+	}
+	return hds, nil
+}
+
+// ConvertBuffer contains the buffers used by ConvertFile. Each thread calling
+// ConvertFile needs its own.
+type ConvertBuffer struct {
+	Compress *compress.Buffer
+	MidBuf []byte
+	from, to []int
+	idx [][3]int
+}
+
+// NewConvertBuffer creates a new ConvertBuffer.
+func NewConvertBuffer() *ConvertBuffer {
+	return &ConvertBuffer{ compress.NewBuffer(0), []byte{ }, nil, nil, nil }
+}
+
+// ConvertFile writes outputs[k] from the .gup files inputs, which have the
+// headers hds (see ReadConvertHeaders). The particles in the snapshot are
+// ordered by their location in Lagrangian space and split evenly between the
+// outputs so that each file contains a contiguous range of them.
+func ConvertFile(
+	cfg *ConvertConfig, inputs []string, hds []*compress.Header,
+	outputs []string, k int, buf *ConvertBuffer,
+) error {
+	span := hds[0].TotalSpan
+	nTot := span[0]*span[1]*span[2]
+	lo := nTot*int64(k) / int64(len(outputs))
+	hi := nTot*int64(k + 1) / int64(len(outputs))
+	n := hi - lo
+
+	order, err := NewIDOrder(cfg.IDOrder, nTot)
+	if err != nil { return err }
+
+	blocks := make([]interface{}, len(cfg.GadgetVars))
+	for i := range blocks {
+		if cfg.GadgetTypes[i] == "u32" && cfg.GadgetVars[i] == "id" &&
+			nTot > math.MaxUint32 {
+			return fmt.Errorf("The simulation has %d particles, so 'id' " +
+				"must have type u64 in GadgetTypes.", nTot)
+		}
+		blocks[i] = makeBlock(cfg.GadgetTypes[i], int(n))
+	}
+
+	// All the particles in [lo, hi) have x-indices in this range.
+	xLo, xHi := lo / (span[1]*span[2]), (hi - 1) / (span[1]*span[2])
+
+	nFound := 0
+	for j := range inputs {
+		hd := hds[j]
+		if hd.Offset[0] > xHi || hd.Offset[0] + hd.Span[0] <= xLo { continue }
+
+		lagrangianTransfer(hd, lo, hi, buf)
+		if len(buf.from) == 0 { continue }
+		nFound += len(buf.from)
+
+		err := convertInput(cfg, inputs[j], blocks, buf)
+		if err != nil { return err }
+
+		for i := range cfg.GadgetVars {
+			if cfg.GadgetVars[i] != "id" { continue }
+			for m := range buf.to {
+				id := order.IndexToID(buf.idx[m], 0)
+				switch x := blocks[i].(type) {
+				case []uint32: x[buf.to[m]] = uint32(id)
+				case []uint64: x[buf.to[m]] = id
+				}
+			}
+		}
+	}
+
+	if int64(nFound) != n {
+		return fmt.Errorf("%s should contain %d particles, but only %d " +
+			"were found in the .gup files for its snapshot. Some of the " +
+			"files described by the Input variable, %s, are probably " +
+			"missing.", outputs[k], n, nFound, cfg.Input)
+	}
+
+	raw := hds[0].OriginalHeader
+	hdOrder, err := snapio.Gadget2HeaderByteOrder(raw, hds[0].L)
+	if err != nil {
+		return fmt.Errorf("Could not read the original header stored in " +
+			"%s: %s", inputs[0], err.Error())
+	}
+	outOrder := byteOrder(cfg.ByteOrder)
+	header := snapio.ResizeGadget2Header(raw, hdOrder, int(n),
+		len(outputs), outOrder)
+
+	if cfg.CreateMissingDirectories {
+		err := os.MkdirAll(path.Dir(outputs[k]), 0755)
+		if err != nil { return err }
+	}
+
+	return snapio.WriteGadget2(outputs[k], header, blocks, outOrder)
+}
+
+// lagrangianTransfer finds the particles in a .gup file with the header hd
+// whose z-major Lagrangian indices are in the range [lo, hi). The indices of
+// the particles in the file are written to buf.from, their indices in the
+// output file to buf.to, and their 3D Lagrangian indices to buf.idx.
+func lagrangianTransfer(
+	hd *compress.Header, lo, hi int64, buf *ConvertBuffer,
+) {
+	buf.from, buf.to, buf.idx = buf.from[:0], buf.to[:0], buf.idx[:0]
+	span, total := hd.Span, hd.TotalSpan
+
+	for i := int64(0); i < hd.N; i++ {
+		// Same ordering as compress.Reader's IDs.
+		ix := i % span[0] + hd.Offset[0]
+		iy := (i / span[0]) % span[1] + hd.Offset[1]
+		iz := i / (span[0] * span[1]) + hd.Offset[2]
+		j := iz + iy*total[2] + ix*total[2]*total[1]
+
+		if j >= lo && j < hi {
+			buf.from = append(buf.from, int(i))
+			buf.to = append(buf.to, int(j - lo))
+			buf.idx = append(buf.idx, [3]int{ int(ix), int(iy), int(iz) })
+		}
+	}
+}
+
+// convertInput copies the particles at buf.from in the .gup file input to
+// buf.to in each of the non-id blocks.
+func convertInput(
+	cfg *ConvertConfig, input string, blocks []interface{},
+	buf *ConvertBuffer,
+) error {
+	rd, err := compress.NewReader(input, buf.Compress, buf.MidBuf)
+	if err != nil { return err }
+	defer func() {
+		rd.Close()
+		buf.MidBuf = rd.ReuseMidBuf()
+	}()
+
+	for i, name := range cfg.GadgetVars {
+		if name == "id" { continue }
+
+		names := []string{ name }
+		switch cfg.GadgetTypes[i] {
+		case "v32", "v64":
+			names = []string{ name + "{0}", name + "{1}", name + "{2}" }
+		}
+
+		for dim := range names {
+			field, err := rd.ReadField(names[dim])
+			if err != nil { return err }
+			if !copyBlock(field.Data(), blocks[i], dim, buf.from, buf.to) {
+				return fmt.Errorf("The variable '%s' has type %s in " +
+					"GadgetTypes, but '%s' in %s doesn't have a matching " +
+					"type.", name, cfg.GadgetTypes[i], names[dim], input)
+			}
+		}
+	}
+
+	return nil
+}
+
+// makeBlock allocates an array with the given type string and length.
+func makeBlock(typ string, n int) interface{} {
+	switch typ {
+	case "u32": return make([]uint32, n)
+	case "u64": return make([]uint64, n)
+	case "f32": return make([]float32, n)
+	case "f64": return make([]float64, n)
+	case "v32": return make([][3]float32, n)
+	case "v64": return make([][3]float64, n)
+	}
+	panic(fmt.Sprintf("Internal error: unrecognized type string '%s'", typ))
+}
+
+// copyBlock copies x[from] to y[to]. If y is an array of vectors, x is copied
+// to the dim component. false is returned if x and y have incompatible types.
+func copyBlock(x, y interface{}, dim int, from, to []int) bool {
+	switch yy := y.(type) {
+	case []uint32:
+		xx, ok := x.([]uint32)
+		if !ok { return false }
+		for k := range from { yy[to[k]] = xx[from[k]] }
+	case []uint64:
+		xx, ok := x.([]uint64)
+		if !ok { return false }
+		for k := range from { yy[to[k]] = xx[from[k]] }
+	case []float32:
+		xx, ok := x.([]float32)
+		if !ok { return false }
+		for k := range from { yy[to[k]] = xx[from[k]] }
+	case []float64:
+		xx, ok := x.([]float64)
+		if !ok { return false }
+		for k := range from { yy[to[k]] = xx[from[k]] }
+	case [][3]float32:
+		xx, ok := x.([]float32)
+		if !ok { return false }
+		for k := range from { yy[to[k]][dim] = xx[from[k]] }
+	case [][3]float64:
+		xx, ok := x.([]float64)
+		if !ok { return false }
+		for k := range from { yy[to[k]][dim] = xx[from[k]] }
+	default:
+		return false
+	}
+	return true
+}
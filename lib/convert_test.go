@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+// readLGadget2Particles reads the x, v, and id blocks of an LGadget-2 file.
+func readLGadget2Particles(fname string) (
+	hd snapio.Header, x, v [][3]float32, id []uint32, err error,
+) {
+	f, err := snapio.NewLGadget2(fname, []string{ "x", "v", "id" },
+		[]string{ "v32", "v32", "u32" }, binary.LittleEndian)
+	if err != nil { return nil, nil, nil, nil, err }
+	hd, err = f.ReadHeader()
+	if err != nil { return nil, nil, nil, nil, err }
+	buf, err := snapio.NewBuffer(hd)
+	if err != nil { return nil, nil, nil, nil, err }
+
+	for _, name := range []string{ "x", "v", "id" } {
+		err := f.Read(name, buf)
+		if err != nil { return nil, nil, nil, nil, err }
+	}
+	xg, _ := buf.Get("x")
+	vg, _ := buf.Get("v")
+	idg, _ := buf.Get("id")
+
+	return hd, xg.([][3]float32), vg.([][3]float32), idg.([]uint32), nil
+}
+
+func TestConvertFile(t *testing.T) {
+	width, gw, L, dx, dv := 8, 2, 100.0, 1e-3, 1e-2
+	n := width*width*width
+	dir := t.TempDir()
+	origs, gups, err := writeConfirmTestFiles(dir, width, gw, L, dx, dv)
+	if err != nil { t.Fatalf("Could not write files: %s", err) }
+
+	// Map IDs to the original particles.
+	x0, v0 := make([][3]float32, n), make([][3]float32, n)
+	for _, orig := range origs {
+		_, x, v, id, err := readLGadget2Particles(orig)
+		if err != nil { t.Fatalf(err.Error()) }
+		for i := range id { x0[id[i] - 1], v0[id[i] - 1] = x[i], v[i] }
+	}
+
+	hds, err := ReadConvertHeaders(gups)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	for _, nFiles := range []int{ 1, 3, 8 } {
+		cfg := &ConvertConfig{
+			FileType: "LGadget-2", IDOrder: "ZUnigridPlusOne",
+			ByteOrder: "LittleEndian",
+			GadgetVars: []string{ "x", "v", "id" },
+			GadgetTypes: []string{ "v32", "v32", "u32" },
+		}
+
+		outputs := make([]string, nFiles)
+		for k := range outputs {
+			outputs[k] = path.Join(dir, fmt.Sprintf("out_%d.%d", nFiles, k))
+		}
+
+		buf := NewConvertBuffer()
+		for k := range outputs {
+			err := ConvertFile(cfg, gups, hds, outputs, k, buf)
+			if err != nil { t.Fatalf("%d files) %s", nFiles, err.Error()) }
+		}
+
+		nextID := uint32(1)
+		for k := range outputs {
+			hd, x, v, id, err := readLGadget2Particles(outputs[k])
+			if err != nil { t.Fatalf("%d files) %s", nFiles, err.Error()) }
+
+			if hd.NTot() != int64(n) {
+				t.Errorf("%d files) Expected %s to have NTot = %d, got %d.",
+					nFiles, outputs[k], n, hd.NTot())
+			}
+
+			for i := range id {
+				if id[i] != nextID {
+					t.Fatalf("%d files) Expected particle %d in %s to have " +
+						"ID %d, got %d.", nFiles, i, outputs[k], nextID, id[i])
+				}
+				nextID++
+
+				for dim := 0; dim < 3; dim++ {
+					ddx := math.Abs(float64(x[i][dim] - x0[id[i]-1][dim]))
+					if ddx > L/2 { ddx = L - ddx }
+					ddv := math.Abs(float64(v[i][dim] - v0[id[i]-1][dim]))
+					if ddx > 1.01*dx || ddv > 1.01*dv {
+						t.Fatalf("%d files) Particle %d in %s has x = %g " +
+							"and v = %g, but expected %g and %g.", nFiles, i,
+							outputs[k], x[i], v[i], x0[id[i]-1], v0[id[i]-1])
+					}
+				}
+			}
+		}
+
+		if nextID != uint32(n + 1) {
+			t.Errorf("%d files) Expected %d particles, got %d.",
+				nFiles, n, nextID - 1)
+		}
+	}
+}
+
+func TestConvertFileMissingInput(t *testing.T) {
+	dir := t.TempDir()
+	_, gups, err := writeConfirmTestFiles(dir, 8, 2, 100, 1e-3, 1e-2)
+	if err != nil { t.Fatalf("Could not write files: %s", err) }
+	cfg := &ConvertConfig{
+		FileType: "LGadget-2", IDOrder: "ZUnigridPlusOne",
+		ByteOrder: "LittleEndian",
+		GadgetVars: []string{ "x", "v", "id" },
+		GadgetTypes: []string{ "v32", "v32", "u32" },
+	}
+
+	hds, err := ReadConvertHeaders(gups[1:])
+	if err != nil { t.Fatalf(err.Error()) }
+	outputs := []string{ path.Join(dir, "out.0") }
+	err = ConvertFile(cfg, gups[1:], hds, outputs, 0, NewConvertBuffer())
+	if err == nil {
+		t.Errorf("Expected ConvertFile() to fail when a .gup file is missing.")
+	}
+}
+
+func TestExpandConvertFileNamesFormatVars(t *testing.T) {
+	cfg := &ConvertConfig{
+		Input: "{%s,run}/snap_a{%.4f,a}.{%d,0..1}.gup",
+		Output: "out_{%s,hr|lr}/snap_{%03d,snapshot}",
+		Snaps: []string{ "1..2" },
+		FormatVars: []string{ "run:L0125", "a:0.25|0.5|1.0" },
+	}
+
+	snaps, inputs, outputs, err := ExpandConvertFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	expInputs := [][]string{
+		{ "L0125/snap_a0.5000.0.gup", "L0125/snap_a0.5000.1.gup" },
+		{ "L0125/snap_a1.0000.0.gup", "L0125/snap_a1.0000.1.gup" },
+	}
+	expOutputs := [][]string{
+		{ "out_hr/snap_001", "out_lr/snap_001" },
+		{ "out_hr/snap_002", "out_lr/snap_002" },
+	}
+	if len(snaps) != 2 || fmt.Sprint(inputs) != fmt.Sprint(expInputs) ||
+		fmt.Sprint(outputs) != fmt.Sprint(expOutputs) {
+		t.Errorf("Expected inputs %s and outputs %s, got %s and %s.",
+			expInputs, expOutputs, inputs, outputs)
+	}
+
+	cfg.Snaps = []string{ "1..3" }
+	if _, _, _, err = ExpandConvertFileNames(cfg); err == nil {
+		t.Errorf("Expected error for a snapshot without a scale factor.")
+	}
+}
@@ -0,0 +1,419 @@
+package lib
+
+/* This file contains the functions used by guppy's estimate mode, which
+predicts the size of .gup files and the cost of writing them by compressing
+sub-cubes taken from a small sample of the input files. */
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/particles"
+	"github.com/phil-mansfield/guppy/lib/snapio"
+	"github.com/phil-mansfield/guppy/lib/thread"
+)
+
+const (
+	// EstimateCubeWidth is the largest width of the Lagrangian sub-cubes
+	// that estimate mode compresses. Smaller cubes are used if the sampled
+	// files don't contain any complete cubes this large.
+	EstimateCubeWidth = 16
+	// EstimateMaxCubes is the largest number of sub-cubes that are
+	// compressed for each snapshot.
+	EstimateMaxCubes = 256
+	// EstimateMinParticles is the number of compressed particles below
+	// which the fixed overhead of the entropy coder makes estimates
+	// unreliable.
+	EstimateMinParticles = 4096
+)
+
+// SnapshotEstimate is the projected cost of compressing a snapshot.
+type SnapshotEstimate struct {
+	// Names are the fields that will be written to the .gup files and
+	// Accuracies are the accuracies they'll be stored to.
+	Names []string
+	Accuracies []float64
+	// BytesPerParticle is the compressed size of each field per particle.
+	BytesPerParticle []float64
+
+	// NTot is the number of particles in the snapshot and NFile is the
+	// largest number of particles in a sampled file.
+	NTot, NFile int64
+	// Files is the number of input files that were sampled. Cubes is the
+	// number of sub-cubes with CubeWidth^3 particles that were compressed.
+	Files, Cubes, CubeWidth int
+
+	// ReadBytes and ReadParticles are the amount of data read from the
+	// sampled files and CompressedParticles is the number of particles in
+	// the compressed sub-cubes. ReadTime and CompressTime are the time spent
+	// reading and compressing, summed over every thread.
+	ReadBytes, ReadParticles, CompressedParticles int64
+	ReadTime, CompressTime time.Duration
+}
+
+// Bytes returns the projected size of the snapshot's .gup files.
+func (est *SnapshotEstimate) Bytes() float64 {
+	sum := 0.0
+	for i := range est.BytesPerParticle {
+		sum += est.BytesPerParticle[i] * float64(est.NTot)
+	}
+	return sum
+}
+
+// ReadRate returns the number of bytes that a single thread reads per
+// second.
+func (est *SnapshotEstimate) ReadRate() float64 {
+	return float64(est.ReadBytes) / est.ReadTime.Seconds()
+}
+
+// CompressRate returns the number of particles that a single thread
+// compresses per second.
+func (est *SnapshotEstimate) CompressRate() float64 {
+	return float64(est.CompressedParticles) / est.CompressTime.Seconds()
+}
+
+// Time returns the projected time needed to read and compress the whole
+// snapshot with the given number of threads. Every pass reads each input
+// file again. (See PlanWrite.)
+func (est *SnapshotEstimate) Time(
+	cfg *WriteConfig, passes []WritePass, workers int,
+) time.Duration {
+	readBytes := int64(0)
+	for i := range passes { readBytes += passes[i].FileBytes(cfg) }
+
+	readSec := est.ReadTime.Seconds() / float64(est.ReadBytes) *
+		float64(readBytes)
+	compressSec := est.CompressTime.Seconds() /
+		float64(est.CompressedParticles)
+
+	sec := (readSec + compressSec) * float64(est.NTot) / float64(workers)
+	return time.Duration(sec * float64(time.Second))
+}
+
+// Plan returns the passes that guppy write will split the snapshot into
+// with the given number of threads, along with the peak memory used by
+// those passes, in bytes. (See PlanWrite.)
+func (est *SnapshotEstimate) Plan(
+	cfg *WriteConfig, workers int,
+) ([]WritePass, int64, error) {
+	gw := cfg.OutputGridWidth
+	outputs := make([]int, gw*gw*gw)
+	for i := range outputs { outputs[i] = i }
+	nSub := est.NTot / int64(len(outputs))
+	outputBytes := int64(math.Ceil(est.Bytes() / float64(len(outputs))))
+
+	passes, err := PlanWrite(cfg, outputs, est.NTot, est.NFile,
+		outputBytes, workers)
+	if err != nil { return nil, 0, err }
+
+	memory := int64(0)
+	for i := range passes {
+		mem := passes[i].Memory(cfg, nSub, est.NFile, outputBytes, workers)
+		if mem > memory { memory = mem }
+	}
+	return passes, memory, nil
+}
+
+// estimateSample contains the particles read from one sampled input file.
+type estimateSample struct {
+	id []uint64
+	fields []particles.Field
+	// cube and sub are the sub-cube containing each particle and its index
+	// within that sub-cube.
+	cube []int64
+	sub []int
+}
+
+// EstimateSnapshot projects the compressed size of a snapshot and the time
+// and memory needed to write it from a sample of its input files. acc are
+// the accuracies of cfg.Vars in the snapshot (see SnapshotAccuracies), and
+// workers threads are used.
+//
+// The sampled particles are split into small Lagrangian sub-cubes, and
+// complete sub-cubes are quantized and delta-encoded exactly like
+// LagrangianDelta does. The integers from every sub-cube are then entropy
+// coded together, so the estimate doesn't include the overhead of the tiny
+// blocks.
+func EstimateSnapshot(
+	cfg *WriteConfig, files []string, acc []float64, workers int,
+) (*SnapshotEstimate, error) {
+	hd, err := GetSnapioHeader(cfg, files[0])
+	if err != nil { return nil, err }
+	nTot := hd.NTot()
+	order, err := NewIDOrder(cfg.IDOrder, nTot)
+	if err != nil { return nil, err }
+
+	nAll := int(math.Round(math.Cbrt(float64(nTot))))
+	if int64(nAll)*int64(nAll)*int64(nAll) != nTot {
+		return nil, fmt.Errorf("The simulation has %d particles, but " +
+			"estimate mode needs the number of particles to be a perfect " +
+			"cube.", nTot)
+	}
+	nSub := nAll / int(cfg.OutputGridWidth)
+
+	est := &SnapshotEstimate{ NTot: nTot, Files: len(files) }
+	for i := range cfg.Vars {
+		if cfg.Vars[i] == "id" { continue }
+		switch cfg.Types[i] {
+		case "v32", "v64":
+			for dim := 0; dim < 3; dim++ {
+				est.Names = append(est.Names,
+					fmt.Sprintf("%s{%d}", cfg.Vars[i], dim))
+				est.Accuracies = append(est.Accuracies, acc[i])
+			}
+		default:
+			est.Names = append(est.Names, cfg.Vars[i])
+			est.Accuracies = append(est.Accuracies, acc[i])
+		}
+	}
+
+	// Read the sampled files.
+	samples := make([]estimateSample, len(files))
+	readBytes := make([]int64, len(files))
+	readTimes := make([]time.Duration, len(files))
+	errs := make([]error, len(files))
+	thread.WorkerQueue(len(files), workers, func(worker, job int) {
+		t0 := time.Now()
+		samples[job], readBytes[job], errs[job] = readEstimateSample(
+			cfg, files[job])
+		readTimes[job] = time.Since(t0)
+	})
+
+	for i := range files {
+		if errs[i] != nil { return nil, errs[i] }
+		n := int64(len(samples[i].id))
+		est.ReadBytes += readBytes[i]
+		est.ReadTime += readTimes[i]
+		est.ReadParticles += n
+		if n > est.NFile { est.NFile = n }
+	}
+
+	// Find the largest sub-cubes that are completely contained in the
+	// sample.
+	var complete []int64
+	est.CubeWidth = EstimateCubeWidth
+	if nSub < est.CubeWidth { est.CubeWidth = nSub }
+	for ; est.CubeWidth >= 2; est.CubeWidth /= 2 {
+		err := assignEstimateCubes(samples, order, nAll, est.CubeWidth)
+		if err != nil { return nil, err }
+		complete = completeEstimateCubes(samples, est.CubeWidth)
+		if len(complete) > 0 { break }
+	}
+	if len(complete) == 0 {
+		return nil, fmt.Errorf("The %d sampled input files don't contain " +
+			"any complete Lagrangian sub-cubes, so their compression can't " +
+			"be estimated. Try sampling more files.", len(files))
+	}
+
+	// Spread the compressed sub-cubes evenly through the sample.
+	if len(complete) > EstimateMaxCubes {
+		spread := make([]int64, EstimateMaxCubes)
+		for i := range spread {
+			spread[i] = complete[i*len(complete) / EstimateMaxCubes]
+		}
+		complete = spread
+	}
+	est.Cubes = len(complete)
+
+	cubes, err := gatherEstimateCubes(samples, complete, est.CubeWidth)
+	if err != nil { return nil, err }
+	est.CompressedParticles = int64(len(cubes)) *
+		int64(est.CubeWidth*est.CubeWidth*est.CubeWidth)
+
+	// Compress each field on its own thread.
+	est.BytesPerParticle = make([]float64, len(est.Names))
+	compressTimes := make([]time.Duration, len(est.Names))
+	errs = make([]error, len(est.Names))
+	w := est.CubeWidth
+	span := [3]int{ w, w, w }
+	thread.WorkerQueue(len(est.Names), workers, func(worker, job int) {
+		t0 := time.Now()
+
+		period := 0.0
+		if est.Names[job] == "x" || strings.HasPrefix(est.Names[job], "x{") {
+			period = hd.L()
+		}
+
+		buf := compress.NewBuffer(0)
+		ints := []int64{ }
+		for i := range cubes {
+			m := compress.NewLagrangianDelta(span, est.Accuracies[job],
+				period)
+			ints = m.AppendEncoded(cubes[i][est.Names[job]], buf, ints)
+		}
+
+		counter := &byteCounter{ }
+		b := make([]byte, len(ints))
+		_, errs[job] = compress.WriteCompressedIntsZStd(ints, b, nil, counter)
+		est.BytesPerParticle[job] = float64(counter.n) /
+			float64(est.CompressedParticles)
+
+		compressTimes[job] = time.Since(t0)
+	})
+
+	for i := range errs {
+		if errs[i] != nil { return nil, errs[i] }
+		est.CompressTime += compressTimes[i]
+	}
+
+	return est, nil
+}
+
+// readEstimateSample reads the variables in cfg from an input file. It
+// returns the number of bytes read.
+func readEstimateSample(
+	cfg *WriteConfig, fname string,
+) (estimateSample, int64, error) {
+	sample := estimateSample{ }
+
+	f, err := OpenSnapioFile(cfg, fname)
+	if err != nil { return sample, 0, err }
+	hd, err := f.ReadHeader()
+	if err != nil {
+		return sample, 0, fmt.Errorf("Cannot read %s: %s", fname, err.Error())
+	}
+	buf, err := snapio.NewBuffer(hd)
+	if err != nil { return sample, 0, err }
+
+	vars := []string{ "id" }
+	for i := range cfg.Vars {
+		if cfg.Vars[i] != "id" { vars = append(vars, cfg.Vars[i]) }
+	}
+	for _, v := range vars {
+		if err := f.Read(v, buf); err != nil {
+			return sample, 0, fmt.Errorf("Cannot read %s: %s",
+				fname, err.Error())
+		}
+	}
+
+	bytes := int64(0)
+	for i, v := range vars {
+		x, err := buf.Get(v)
+		if err != nil { return sample, 0, err }
+
+		if i == 0 {
+			switch id := x.(type) {
+			case []uint32:
+				sample.id = make([]uint64, len(id))
+				for j := range id { sample.id[j] = uint64(id[j]) }
+				bytes += 4*int64(len(id))
+			case []uint64:
+				sample.id = id
+				bytes += 8*int64(len(id))
+			}
+			continue
+		}
+
+		field, err := particles.NewGenericField(v, x)
+		if err != nil { return sample, 0, err }
+		sample.fields = append(sample.fields, field)
+		bytes += typeSize(cfg.Types[containsStringIndex(cfg.Vars, v)]) *
+			int64(field.Len())
+	}
+
+	return sample, bytes, nil
+}
+
+// assignEstimateCubes finds the width^3 sub-cube that each sampled particle
+// belongs to. Particles that aren't in a complete sub-cube are assigned to
+// -1.
+func assignEstimateCubes(
+	samples []estimateSample, order particles.IDOrder, nAll, width int,
+) error {
+	nCube := int64(nAll / width)
+	for i := range samples {
+		s := &samples[i]
+		s.cube = make([]int64, len(s.id))
+		s.sub = make([]int, len(s.id))
+
+		for j := range s.id {
+			idx, level := order.IDToIndex(s.id[j])
+			if level != 0 {
+				return fmt.Errorf("ID %d has level %d, but estimate mode " +
+					"only supports uniform grids.", s.id[j], level)
+			}
+
+			s.cube[j] = 0
+			sub := 0
+			for k := 2; k >= 0; k-- {
+				c := int64(idx[k] / width)
+				if c >= nCube { s.cube[j] = -1; break }
+				s.cube[j] = s.cube[j]*nCube + c
+				sub = sub*width + idx[k] % width
+			}
+			s.sub[j] = sub
+		}
+	}
+	return nil
+}
+
+// completeEstimateCubes returns the sub-cubes that contain all width^3 of
+// their particles in sorted order.
+func completeEstimateCubes(samples []estimateSample, width int) []int64 {
+	counts := map[int64]int{ }
+	for i := range samples {
+		for _, c := range samples[i].cube {
+			if c >= 0 { counts[c]++ }
+		}
+	}
+
+	complete := []int64{ }
+	for c, n := range counts {
+		if n == width*width*width { complete = append(complete, c) }
+	}
+	sort.Slice(complete, func(i, j int) bool {
+		return complete[i] < complete[j]
+	})
+	return complete
+}
+
+// gatherEstimateCubes copies the particles in the given sub-cubes into
+// their own Particles maps.
+func gatherEstimateCubes(
+	samples []estimateSample, cubes []int64, width int,
+) ([]particles.Particles, error) {
+	slot := map[int64]int{ }
+	for i, c := range cubes { slot[c] = i }
+
+	out := make([]particles.Particles, len(cubes))
+	for i := range out {
+		out[i] = particles.Particles{ }
+		for _, field := range samples[0].fields {
+			field.CreateDestination(out[i], width*width*width)
+		}
+	}
+
+	from, to := make([][]int, len(cubes)), make([][]int, len(cubes))
+	for _, s := range samples {
+		for i := range from { from[i], to[i] = from[i][:0], to[i][:0] }
+		for j, c := range s.cube {
+			i, ok := slot[c]
+			if !ok { continue }
+			from[i] = append(from[i], j)
+			to[i] = append(to[i], s.sub[j])
+		}
+
+		for i := range out {
+			for _, field := range s.fields {
+				err := field.Transfer(out[i], from[i], to[i])
+				if err != nil { return nil, err }
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// byteCounter is an io.Writer that counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateSnapshot(t *testing.T) {
+	width, gw, L := 16, 2, 100.0
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "v", "id" },
+		Types: []string{ "v32", "v32", "u32" },
+		OutputGridWidth: int64(gw), ByteOrder: "LittleEndian",
+		FileType: "LGadget-2",
+		GadgetVars: []string{ "x", "v", "id" },
+		GadgetTypes: []string{ "v32", "v32", "u32" },
+		IDOrder: "ZUnigridPlusOne",
+	}
+
+	dir := t.TempDir()
+	inputs, _, err := writeConfirmTestFiles(dir, width, gw, L,
+		1e-3, 1e-2)
+	if err != nil { t.Fatalf("Could not write files: %s", err) }
+
+	est, err := EstimateSnapshot(cfg, inputs, []float64{ 1e-3, 1e-2, 0 }, 2)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	n := int64(width*width*width)
+	if est.NTot != n || est.NFile != n/2 {
+		t.Errorf("Expected NTot = %d and NFile = %d, got %d and %d.",
+			n, n/2, est.NTot, est.NFile)
+	} else if est.CubeWidth != 8 || est.Cubes != 8 {
+		t.Errorf("Expected 8 sub-cubes with width 8, got %d with width %d.",
+			est.Cubes, est.CubeWidth)
+	} else if est.CompressedParticles != n || est.ReadParticles != n {
+		t.Errorf("Expected every particle to be read and compressed, got " +
+			"%d and %d.", est.ReadParticles, est.CompressedParticles)
+	} else if est.ReadBytes != n*(12 + 12 + 4) {
+		t.Errorf("Expected %d bytes to be read, got %d.",
+			n*(12 + 12 + 4), est.ReadBytes)
+	}
+
+	names := []string{ "x{0}", "x{1}", "x{2}", "v{0}", "v{1}", "v{2}" }
+	if len(est.Names) != len(names) {
+		t.Fatalf("Expected fields %s, got %s.", names, est.Names)
+	}
+	for i := range names {
+		if est.Names[i] != names[i] {
+			t.Errorf("Expected fields %s, got %s.", names, est.Names)
+		}
+	}
+
+	// The test particles are uniformly distributed, so each field needs at
+	// least log2(range/accuracy) bits per particle.
+	for i := range est.Names {
+		bits := math.Log2(L/1e-3)
+		if i >= 3 { bits = math.Log2(200/1e-2) }
+		ratio := est.BytesPerParticle[i] / (bits/8)
+		if ratio < 1 || ratio > 1.25 {
+			t.Errorf("Expected %s to need about %.3g bytes per particle, " +
+				"got %.3g.", est.Names[i], bits/8, est.BytesPerParticle[i])
+		}
+	}
+
+	coarse, err := EstimateSnapshot(cfg, inputs,
+		[]float64{ 1e-1, 1e-2, 0 }, 2)
+	if err != nil { t.Fatalf(err.Error()) }
+	if coarse.BytesPerParticle[0] >= est.BytesPerParticle[0] ||
+		coarse.BytesPerParticle[3] != est.BytesPerParticle[3] {
+		t.Errorf("Expected only x to shrink with a coarser accuracy, got " +
+			"%.3g -> %.3g and %.3g -> %.3g bytes per particle.",
+			est.BytesPerParticle[0], coarse.BytesPerParticle[0],
+			est.BytesPerParticle[3], coarse.BytesPerParticle[3])
+	}
+}
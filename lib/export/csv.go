@@ -0,0 +1,120 @@
+package export
+
+/* This file contains functions for writing CSV files. */
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WriteCSV writes the variables in f to w as a CSV file with one column per
+// component and one row per particle. Vectors are split into their
+// components, e.g. "x" becomes "x{0}", "x{1}", and "x{2}". The attributes and
+// metadata are written first as comment lines starting with '#'.
+func WriteCSV(w io.Writer, f *File) error {
+	if err := f.Check(); err != nil { return err }
+	wr := bufio.NewWriter(w)
+
+	columns := []string{ }
+	for _, v := range f.Variables {
+		if isVector(v.Data) {
+			for dim := 0; dim < 3; dim++ {
+				columns = append(columns, fmt.Sprintf("%s{%d}", v.Name, dim))
+			}
+		} else {
+			columns = append(columns, v.Name)
+		}
+	}
+	for i := range columns {
+		for j := 0; j < i; j++ {
+			if columns[i] == columns[j] {
+				return fmt.Errorf("The column '%s' is included more than " +
+					"once.", columns[i])
+			}
+		}
+	}
+
+	for _, attr := range f.Attributes {
+		fmt.Fprintf(wr, "# %s = %s\n", attr.Name, csvAttribute(attr.Value))
+	}
+	for _, attr := range f.Metadata {
+		fmt.Fprintf(wr, "# Metadata.%s = %s\n", attr.Name,
+			csvAttribute(attr.Value))
+	}
+	for _, v := range f.Variables {
+		for _, attr := range v.Attributes {
+			fmt.Fprintf(wr, "# %s.%s = %s\n", v.Name, attr.Name,
+				csvAttribute(attr.Value))
+		}
+	}
+
+	for i := range columns {
+		// Names like "{RadialVelocity:0,0,0}" need to be quoted.
+		if strings.ContainsAny(columns[i], ",\"") {
+			columns[i] = "\"" +
+				strings.ReplaceAll(columns[i], "\"", "\"\"") + "\""
+		}
+	}
+	wr.WriteString(strings.Join(columns, ",") + "\n")
+
+	if len(f.Variables) == 0 { return wr.Flush() }
+
+	n := Len(f.Variables[0].Data)
+	line := []byte{ }
+	for i := 0; i < n; i++ {
+		line = line[:0]
+		for j, v := range f.Variables {
+			if j > 0 { line = append(line, ',') }
+			line = appendCSVValue(line, v.Data, i)
+		}
+		line = append(line, '\n')
+		if _, err := wr.Write(line); err != nil { return err }
+	}
+
+	return wr.Flush()
+}
+
+// appendCSVValue appends the i-th element of x to line. Each component of a
+// vector is written as its own column.
+func appendCSVValue(line []byte, x interface{}, i int) []byte {
+	switch xx := x.(type) {
+	case []uint32: return strconv.AppendUint(line, uint64(xx[i]), 10)
+	case []uint64: return strconv.AppendUint(line, xx[i], 10)
+	case []float32:
+		return strconv.AppendFloat(line, float64(xx[i]), 'g', -1, 32)
+	case []float64:
+		return strconv.AppendFloat(line, xx[i], 'g', -1, 64)
+	case [][3]float32:
+		for dim := 0; dim < 3; dim++ {
+			if dim > 0 { line = append(line, ',') }
+			line = strconv.AppendFloat(line, float64(xx[i][dim]), 'g', -1, 32)
+		}
+	case [][3]float64:
+		for dim := 0; dim < 3; dim++ {
+			if dim > 0 { line = append(line, ',') }
+			line = strconv.AppendFloat(line, xx[i][dim], 'g', -1, 64)
+		}
+	}
+	return line
+}
+
+// csvAttribute formats an attribute's value for a comment line.
+func csvAttribute(x interface{}) string {
+	switch xx := x.(type) {
+	case string: return strconv.Quote(xx)
+	case []byte: return base64.StdEncoding.EncodeToString(xx)
+	case []int64:
+		tok := make([]string, len(xx))
+		for i := range xx { tok[i] = strconv.FormatInt(xx[i], 10) }
+		return "[" + strings.Join(tok, ", ") + "]"
+	case []float64:
+		tok := make([]string, len(xx))
+		for i := range xx { tok[i] = strconv.FormatFloat(xx[i], 'g', -1, 64) }
+		return "[" + strings.Join(tok, ", ") + "]"
+	}
+	return fmt.Sprint(x)
+}
@@ -0,0 +1,156 @@
+/*package export writes particle data to formats that can be read without a
+guppy reader: HDF5, numpy's .npy and .npz, and CSV.*/
+package export
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Attribute is a named piece of metadata. Value must be an int64, float64,
+// string, []int64, []float64, or []byte.
+type Attribute struct {
+	Name string
+	Value interface{}
+}
+
+// Variable is a named array along with its metadata. Data must be a []uint32,
+// []uint64, []float32, []float64, [][3]float32, or [][3]float64.
+type Variable struct {
+	Name string
+	Data interface{}
+	Attributes []Attribute
+}
+
+// File contains everything written to an exported file. Attributes describe
+// the file as a whole, and Metadata contains the key/value metadata stored in
+// a .gup header. All the variables must have the same length.
+type File struct {
+	Attributes, Metadata []Attribute
+	Variables []Variable
+}
+
+// Check returns an error if f contains values with unsupported types or
+// variables with different lengths.
+func (f *File) Check() error {
+	attrs := append(append([]Attribute{ }, f.Attributes...), f.Metadata...)
+	for _, v := range f.Variables {
+		attrs = append(attrs, v.Attributes...)
+	}
+	for _, attr := range attrs {
+		switch attr.Value.(type) {
+		case int64, float64, string, []int64, []float64, []byte:
+		default:
+			return fmt.Errorf("Internal error: the attribute '%s' has the " +
+				"unsupported type %T.", attr.Name, attr.Value)
+		}
+	}
+
+	for i, v := range f.Variables {
+		if n := Len(v.Data); n < 0 {
+			return fmt.Errorf("Internal error: the variable '%s' has the " +
+				"unsupported type %T.", v.Name, v.Data)
+		} else if n != Len(f.Variables[0].Data) {
+			return fmt.Errorf("The variable '%s' has %d elements, but '%s' " +
+				"has %d.", v.Name, n, f.Variables[0].Name,
+				Len(f.Variables[0].Data))
+		} else if v.Name == "" {
+			return fmt.Errorf("Variable %d doesn't have a name.", i)
+		}
+
+		for j := 0; j < i; j++ {
+			if f.Variables[j].Name == v.Name {
+				return fmt.Errorf("The variable '%s' is included more than " +
+					"once.", v.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of elements in an array, or -1 if it doesn't have a
+// supported type.
+func Len(x interface{}) int {
+	switch xx := x.(type) {
+	case []uint32: return len(xx)
+	case []uint64: return len(xx)
+	case []float32: return len(xx)
+	case []float64: return len(xx)
+	case [][3]float32: return len(xx)
+	case [][3]float64: return len(xx)
+	}
+	return -1
+}
+
+// isVector returns true if x is an array of 3-vectors.
+func isVector(x interface{}) bool {
+	switch x.(type) {
+	case [][3]float32, [][3]float64: return true
+	}
+	return false
+}
+
+// WriteJSONHeader writes f's attributes, metadata, and variable attributes to
+// w as a JSON object. []byte values are base64 encoded. This is used for the
+// formats that can't store metadata alongside their arrays.
+func WriteJSONHeader(w io.Writer, f *File) error {
+	vars := make([]Attribute, len(f.Variables))
+	for i, v := range f.Variables {
+		vars[i] = Attribute{ v.Name, v.Attributes }
+	}
+
+	top := append([]Attribute{ }, f.Attributes...)
+	top = append(top, Attribute{ "Metadata", f.Metadata })
+	top = append(top, Attribute{ "Variables", vars })
+
+	buf := &bytes.Buffer{ }
+	if err := writeJSONObject(buf, top, "", "    "); err != nil { return err }
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeJSONObject writes a list of attributes as a JSON object. Unlike
+// encoding/json's maps, this keeps the attributes in order. An Attribute's
+// value may also be a []Attribute, which is written as a nested object.
+func writeJSONObject(
+	buf *bytes.Buffer, attrs []Attribute, prefix, indent string,
+) error {
+	if len(attrs) == 0 {
+		buf.WriteString("{ }")
+		return nil
+	}
+
+	buf.WriteString("{\n")
+	for i, attr := range attrs {
+		key, err := json.Marshal(attr.Name)
+		if err != nil { return err }
+		buf.WriteString(prefix + indent)
+		buf.Write(key)
+		buf.WriteString(": ")
+
+		switch x := attr.Value.(type) {
+		case []Attribute:
+			err = writeJSONObject(buf, x, prefix + indent, indent)
+			if err != nil { return err }
+		case []byte:
+			val, err := json.Marshal(base64.StdEncoding.EncodeToString(x))
+			if err != nil { return err }
+			buf.Write(val)
+		default:
+			val, err := json.Marshal(x)
+			if err != nil { return err }
+			buf.Write(val)
+		}
+
+		if i != len(attrs) - 1 { buf.WriteString(",") }
+		buf.WriteString("\n")
+	}
+	buf.WriteString(prefix + "}")
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFile returns a small File which uses every supported type.
+func testFile() *File {
+	return &File{
+		Attributes: []Attribute{
+			{ "N", int64(3) }, { "Z", 0.5 }, { "Name", "test" },
+			{ "Span", []int64{ 1, 1, 3 } }, { "L", []float64{ 1.5, 2.5 } },
+			{ "OriginalHeader", []byte{ 0, 1, 255 } },
+		},
+		Metadata: []Attribute{ { "Code", "Gadget-2" } },
+		Variables: []Variable{
+			{ "id", []uint64{ 1, 2, 1<<40 }, nil },
+			{ "rank", []uint32{ 5, 6, 7 }, nil },
+			{ "phi", []float32{ -1, 0.25, 3e7 },
+				[]Attribute{ { "Accuracy", 0.01 } } },
+			{ "mass", []float64{ 1e10, 2e10, 3.5 }, nil },
+			{ "x", [][3]float32{ { 1, 2, 3 }, { 4, 5, 6 }, { 7, 8, 9 } },
+				[]Attribute{ { "Units", "cMpc/h" } } },
+			{ "v", [][3]float64{ { -1, -2, -3 }, { 0, 0, 0 }, { 1, 2, 3 } },
+				nil },
+		},
+	}
+}
+
+// readNpy parses a .npy file written by WriteNpy and returns its header
+// dictionary and data.
+func readNpy(t *testing.T, b []byte) (dict string, data []byte) {
+	if len(b) < 10 || string(b[:6]) != npyMagic {
+		t.Fatalf("Invalid .npy magic string.")
+	} else if b[6] != 1 || b[7] != 0 {
+		t.Fatalf("Expected .npy version 1.0, got %d.%d.", b[6], b[7])
+	}
+	n := int(binary.LittleEndian.Uint16(b[8:]))
+	if (10 + n) % npyAlignment != 0 {
+		t.Errorf("Data starts at byte %d, which isn't aligned.", 10 + n)
+	} else if b[10 + n - 1] != '\n' {
+		t.Errorf(".npy header doesn't end in a newline.")
+	}
+	return strings.TrimSpace(string(b[10:10 + n])), b[10 + n:]
+}
+
+func TestCheck(t *testing.T) {
+	if err := testFile().Check(); err != nil { t.Fatalf(err.Error()) }
+
+	f := testFile()
+	f.Variables[1].Data = []uint32{ 1 }
+	if err := f.Check(); err == nil {
+		t.Errorf("Expected error for variables with different lengths.")
+	}
+
+	f = testFile()
+	f.Variables[1].Data = []int{ 1, 2, 3 }
+	if err := f.Check(); err == nil {
+		t.Errorf("Expected error for unsupported variable type.")
+	}
+
+	f = testFile()
+	f.Variables[1].Name = f.Variables[0].Name
+	if err := f.Check(); err == nil {
+		t.Errorf("Expected error for duplicate variable names.")
+	}
+
+	f = testFile()
+	f.Metadata[0].Value = 1
+	if err := f.Check(); err == nil {
+		t.Errorf("Expected error for unsupported attribute type.")
+	}
+}
+
+func TestWriteJSONHeader(t *testing.T) {
+	buf := &bytes.Buffer{ }
+	if err := WriteJSONHeader(buf, testFile()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	out := map[string]interface{}{ }
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("Could not parse JSON header: %s", err)
+	}
+
+	if out["N"] != 3.0 || out["Name"] != "test" {
+		t.Errorf("Got N = %v, Name = %v.", out["N"], out["Name"])
+	}
+	if out["OriginalHeader"] != "AAH/" {
+		t.Errorf("Got OriginalHeader = %v.", out["OriginalHeader"])
+	}
+	meta := out["Metadata"].(map[string]interface{})
+	if meta["Code"] != "Gadget-2" {
+		t.Errorf("Got Metadata = %v.", meta)
+	}
+	vars := out["Variables"].(map[string]interface{})
+	x := vars["x"].(map[string]interface{})
+	if len(vars) != 6 || x["Units"] != "cMpc/h" {
+		t.Errorf("Got Variables = %v.", vars)
+	}
+
+	// Keys stay in order.
+	s := buf.String()
+	if strings.Index(s, "\"Z\"") > strings.Index(s, "\"Name\"") {
+		t.Errorf("Attributes were written out of order:\n%s", s)
+	}
+}
+
+func TestWriteNpy(t *testing.T) {
+	tests := []struct{
+		x interface{}
+		dict string
+	} {
+		{ []uint32{ 1, 2 },
+			"{'descr': '<u4', 'fortran_order': False, 'shape': (2,), }" },
+		{ []float64{ },
+			"{'descr': '<f8', 'fortran_order': False, 'shape': (0,), }" },
+		{ [][3]float32{ { 1, 2, 3 } },
+			"{'descr': '<f4', 'fortran_order': False, 'shape': (1, 3), }" },
+	}
+
+	for i := range tests {
+		buf := &bytes.Buffer{ }
+		if err := WriteNpy(buf, tests[i].x); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		dict, data := readNpy(t, buf.Bytes())
+		if dict != tests[i].dict {
+			t.Errorf("%d) Expected header %s, got %s.", i, tests[i].dict, dict)
+		}
+
+		x := reflect.New(reflect.TypeOf(tests[i].x)).Elem()
+		x.Set(reflect.MakeSlice(x.Type(), Len(tests[i].x), Len(tests[i].x)))
+		err := binary.Read(bytes.NewReader(data), binary.LittleEndian,
+			x.Interface())
+		if err != nil { t.Fatalf(err.Error()) }
+		if !reflect.DeepEqual(x.Interface(), tests[i].x) {
+			t.Errorf("%d) Expected data %v, got %v.", i, tests[i].x, x)
+		}
+	}
+
+	if err := WriteNpy(&bytes.Buffer{ }, []int{ 1 }); err == nil {
+		t.Errorf("Expected error for unsupported type.")
+	}
+}
+
+func TestWriteNpz(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.npz")
+	f := testFile()
+	if err := WriteNpz(fileName, f); err != nil { t.Fatalf(err.Error()) }
+
+	zr, err := zip.OpenReader(fileName)
+	if err != nil { t.Fatalf(err.Error()) }
+	defer zr.Close()
+
+	if len(zr.File) != len(f.Variables) + 1 {
+		t.Fatalf("Expected %d entries, got %d.",
+			len(f.Variables) + 1, len(zr.File))
+	}
+
+	for i, v := range f.Variables {
+		if zr.File[i].Name != v.Name + ".npy" {
+			t.Errorf("Expected entry %s.npy, got %s.", v.Name, zr.File[i].Name)
+		}
+		rd, err := zr.File[i].Open()
+		if err != nil { t.Fatalf(err.Error()) }
+		b, err := ioutil.ReadAll(rd)
+		rd.Close()
+		if err != nil { t.Fatalf(err.Error()) }
+
+		_, data := readNpy(t, b)
+		if len(data) != binary.Size(v.Data) {
+			t.Errorf("Expected %d bytes of data for %s, got %d.",
+				binary.Size(v.Data), v.Name, len(data))
+		}
+	}
+
+	if zr.File[len(f.Variables)].Name != jsonHeaderName {
+		t.Errorf("Expected final entry %s, got %s.", jsonHeaderName,
+			zr.File[len(f.Variables)].Name)
+	}
+}
+
+func TestWriteNpyDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	f := testFile()
+	if err := WriteNpyDir(dir, f); err != nil { t.Fatalf(err.Error()) }
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "x.npy"))
+	if err != nil { t.Fatalf(err.Error()) }
+	dict, data := readNpy(t, b)
+	if !strings.Contains(dict, "(3, 3)") || len(data) != 9*4 {
+		t.Errorf("Got header %s and %d bytes of data for x.", dict, len(data))
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, jsonHeaderName))
+	if err != nil { t.Fatalf(err.Error()) }
+	if !json.Valid(b) { t.Errorf("%s isn't valid JSON.", jsonHeaderName) }
+}
+
+func TestWriteCSV(t *testing.T) {
+	buf := &bytes.Buffer{ }
+	if err := WriteCSV(buf, testFile()); err != nil { t.Fatalf(err.Error()) }
+
+	comments, rows := []string{ }, []string{ }
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			comments = append(comments, line)
+		} else {
+			rows = append(rows, line)
+		}
+	}
+
+	expComments := []string{
+		"# N = 3", "# Z = 0.5", "# Name = \"test\"", "# Span = [1, 1, 3]",
+		"# L = [1.5, 2.5]", "# OriginalHeader = AAH/",
+		"# Metadata.Code = \"Gadget-2\"", "# phi.Accuracy = 0.01",
+		"# x.Units = \"cMpc/h\"",
+	}
+	expRows := []string{
+		"id,rank,phi,mass,x{0},x{1},x{2},v{0},v{1},v{2}",
+		"1,5,-1,1e+10,1,2,3,-1,-2,-3",
+		"2,6,0.25,2e+10,4,5,6,0,0,0",
+		"1099511627776,7,3e+07,3.5,7,8,9,1,2,3",
+	}
+
+	if !reflect.DeepEqual(comments, expComments) {
+		t.Errorf("Expected comments %q, got %q.", expComments, comments)
+	}
+	if !reflect.DeepEqual(rows, expRows) {
+		t.Errorf("Expected rows %q, got %q.", expRows, rows)
+	}
+
+	f := testFile()
+	f.Variables[0].Name = "x{1}"
+	if err := WriteCSV(&bytes.Buffer{ }, f); err == nil {
+		t.Errorf("Expected error for duplicate column names.")
+	}
+
+	f = testFile()
+	f.Variables[1].Name = "{RadialVelocity:0,0,0}"
+	buf = &bytes.Buffer{ }
+	if err := WriteCSV(buf, f); err != nil { t.Fatalf(err.Error()) }
+	exp := "id,\"{RadialVelocity:0,0,0}\",phi,"
+	if !strings.Contains(buf.String(), exp) {
+		t.Errorf("Expected column names to start with %q, got %q.",
+			exp, buf.String())
+	}
+}
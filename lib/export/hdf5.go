@@ -0,0 +1,389 @@
+package export
+
+/* This file contains a minimal HDF5 writer. It doesn't depend on the HDF5 C
+library, and it only supports what guppy needs: a root group containing
+contiguous datasets, a "Metadata" subgroup, and attributes on each of them.
+
+Files use the layout written by HDF5 1.8 and later with the "latest" format
+setting: a version 2 superblock and version 2 object headers, with the links
+of each group stored directly in its object header. This lets the writer avoid
+B-trees and heaps entirely. The format is described at
+https://docs.hdfgroup.org/hdf5/develop/_f_m_t3.html */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	hdf5Signature = "\x89HDF\r\n\x1a\n"
+	// hdf5SuperblockSize is the size of a version 2 superblock.
+	hdf5SuperblockSize = 48
+	// hdf5Undefined is the "undefined address" value.
+	hdf5Undefined = math.MaxUint64
+	// hdf5MaxMessageSize is the largest object header message. Larger
+	// attributes would need to be stored in a fractal heap.
+	hdf5MaxMessageSize = math.MaxUint16
+	// hdf5MetadataGroup is the name of the group that contains f.Metadata.
+	hdf5MetadataGroup = "Metadata"
+)
+
+// Object header message types.
+const (
+	hdf5MsgDataspace = 0x0001
+	hdf5MsgLinkInfo = 0x0002
+	hdf5MsgDatatype = 0x0003
+	hdf5MsgFillValue = 0x0005
+	hdf5MsgLink = 0x0006
+	hdf5MsgLayout = 0x0008
+	hdf5MsgGroupInfo = 0x000a
+	hdf5MsgAttribute = 0x000c
+)
+
+// hdf5Message is a single object header message.
+type hdf5Message struct {
+	typ uint8
+	data []byte
+}
+
+// WriteHDF5 writes f to an HDF5 file. Each variable is written as a dataset in
+// the root group, and vectors have the shape (n, 3). f.Attributes are
+// attributes of the root group, f.Metadata are attributes of the "Metadata"
+// group, and each variable's attributes are attributes of its dataset.
+func WriteHDF5(fileName string, f *File) error {
+	if err := f.Check(); err != nil { return err }
+	for _, v := range f.Variables {
+		if v.Name == hdf5MetadataGroup {
+			return fmt.Errorf("A variable can't be named '%s' in an HDF5 " +
+				"file, since that name is used for the metadata group.",
+				hdf5MetadataGroup)
+		} else if len(v.Name) > math.MaxUint8 {
+			return fmt.Errorf("The variable name '%s' is too long to be " +
+				"written to an HDF5 file.", v.Name)
+		}
+	}
+
+	// The object headers are laid out after the superblock in the order root
+	// group, metadata group, datasets, and the data follows them. Building
+	// the headers once with placeholder addresses gives their sizes.
+	objects, dataAddrs, err := hdf5Objects(f, nil, nil)
+	if err != nil { return err }
+
+	addrs := make([]uint64, len(objects))
+	addr := uint64(hdf5SuperblockSize)
+	for i := range objects {
+		addrs[i] = addr
+		addr += uint64(len(objects[i]))
+	}
+	for i, v := range f.Variables {
+		dataAddrs[i] = addr
+		addr += uint64(binary.Size(v.Data))
+	}
+	eof := addr
+
+	objects, _, err = hdf5Objects(f, addrs, dataAddrs)
+	if err != nil { return err }
+
+	return writeFile(fileName, func(w io.Writer) error {
+		wr := bufio.NewWriter(w)
+		wr.Write(hdf5Superblock(eof, addrs[0]))
+		for _, obj := range objects { wr.Write(obj) }
+		for _, v := range f.Variables {
+			err := binary.Write(wr, binary.LittleEndian, v.Data)
+			if err != nil { return err }
+		}
+		return wr.Flush()
+	})
+}
+
+// hdf5Objects returns the object headers in the file. addrs are the addresses
+// of the object headers and dataAddrs are the addresses of each dataset's
+// data. If they're nil, placeholder addresses are used.
+func hdf5Objects(
+	f *File, addrs, dataAddrs []uint64,
+) (objects [][]byte, outDataAddrs []uint64, err error) {
+	nObj := 2 + len(f.Variables)
+	if addrs == nil { addrs = make([]uint64, nObj) }
+	if dataAddrs == nil { dataAddrs = make([]uint64, len(f.Variables)) }
+
+	// Root group
+	msgs := hdf5GroupMessages()
+	msgs = append(msgs, hdf5LinkMessage(hdf5MetadataGroup, addrs[1]))
+	for i, v := range f.Variables {
+		msgs = append(msgs, hdf5LinkMessage(v.Name, addrs[2 + i]))
+	}
+	msgs, err = hdf5AppendAttributes(msgs, f.Attributes)
+	if err != nil { return nil, nil, err }
+	objects = append(objects, hdf5ObjectHeader(msgs))
+
+	// Metadata group
+	msgs, err = hdf5AppendAttributes(hdf5GroupMessages(), f.Metadata)
+	if err != nil { return nil, nil, err }
+	objects = append(objects, hdf5ObjectHeader(msgs))
+
+	// Datasets
+	for i, v := range f.Variables {
+		n := uint64(Len(v.Data))
+		dims := []uint64{ n }
+		if isVector(v.Data) { dims = []uint64{ n, 3 } }
+
+		layout := make([]byte, 18)
+		layout[0], layout[1] = 3, 1 // Version 3, contiguous
+		size := uint64(binary.Size(v.Data))
+		if size == 0 {
+			binary.LittleEndian.PutUint64(layout[2:], hdf5Undefined)
+		} else {
+			binary.LittleEndian.PutUint64(layout[2:], dataAddrs[i])
+		}
+		binary.LittleEndian.PutUint64(layout[10:], size)
+
+		msgs := []hdf5Message{
+			{ hdf5MsgDataspace, hdf5Dataspace(dims) },
+			{ hdf5MsgDatatype, hdf5DatatypeOf(v.Data) },
+			// Version 3, late space allocation, fill values written only
+			// if the user sets them.
+			{ hdf5MsgFillValue, []byte{ 3, 0x0a } },
+			{ hdf5MsgLayout, layout },
+		}
+		msgs, err = hdf5AppendAttributes(msgs, v.Attributes)
+		if err != nil { return nil, nil, err }
+		objects = append(objects, hdf5ObjectHeader(msgs))
+	}
+
+	return objects, dataAddrs, nil
+}
+
+// hdf5Superblock returns a version 2 superblock.
+func hdf5Superblock(eof, rootAddr uint64) []byte {
+	b := make([]byte, hdf5SuperblockSize)
+	copy(b, hdf5Signature)
+	b[8] = 2 // Version
+	b[9] = 8 // Size of offsets
+	b[10] = 8 // Size of lengths
+	b[11] = 0 // File consistency flags
+	binary.LittleEndian.PutUint64(b[12:], 0) // Base address
+	binary.LittleEndian.PutUint64(b[20:], hdf5Undefined) // Extension address
+	binary.LittleEndian.PutUint64(b[28:], eof)
+	binary.LittleEndian.PutUint64(b[36:], rootAddr)
+	binary.LittleEndian.PutUint32(b[44:], hdf5Checksum(b[:44]))
+	return b
+}
+
+// hdf5ObjectHeader returns a version 2 object header containing msgs.
+func hdf5ObjectHeader(msgs []hdf5Message) []byte {
+	chunkSize := 0
+	for _, msg := range msgs { chunkSize += 4 + len(msg.data) }
+
+	b := make([]byte, 0, 10 + chunkSize + 4)
+	b = append(b, "OHDR"...)
+	b = append(b, 2) // Version
+	b = append(b, 2) // Flags: the chunk size is stored in 4 bytes.
+	b = appendUint32(b, uint32(chunkSize))
+	for _, msg := range msgs {
+		b = append(b, msg.typ)
+		b = appendUint16(b, uint16(len(msg.data)))
+		b = append(b, 0) // Message flags
+		b = append(b, msg.data...)
+	}
+	return appendUint32(b, hdf5Checksum(b))
+}
+
+// hdf5GroupMessages returns the messages that mark an object header as a
+// group whose links are stored in the header.
+func hdf5GroupMessages() []hdf5Message {
+	linkInfo := []byte{ 0, 0 } // Version 0, no creation order
+	linkInfo = appendUint64(linkInfo, hdf5Undefined) // Fractal heap
+	linkInfo = appendUint64(linkInfo, hdf5Undefined) // Name index B-tree
+	groupInfo := []byte{ 0, 0 } // Version 0, default values
+
+	return []hdf5Message{
+		{ hdf5MsgLinkInfo, linkInfo },
+		{ hdf5MsgGroupInfo, groupInfo },
+	}
+}
+
+// hdf5LinkMessage returns a message for a hard link to the object at addr.
+func hdf5LinkMessage(name string, addr uint64) hdf5Message {
+	// Version 1 and flags of 0: the name's length is stored in one byte, and
+	// the link is a hard link with an ASCII name.
+	b := []byte{ 1, 0, uint8(len(name)) }
+	b = append(b, name...)
+	return hdf5Message{ hdf5MsgLink, appendUint64(b, addr) }
+}
+
+// hdf5AppendAttributes appends an attribute message for each attribute to
+// msgs.
+func hdf5AppendAttributes(
+	msgs []hdf5Message, attrs []Attribute,
+) ([]hdf5Message, error) {
+	for _, attr := range attrs {
+		if len(attr.Name) == 0 {
+			return nil, fmt.Errorf("HDF5 attributes must have names.")
+		}
+
+		var dtype, data []byte
+		var dims []uint64
+		switch x := attr.Value.(type) {
+		case int64:
+			dtype, data = hdf5IntType(8, true), appendUint64(nil, uint64(x))
+		case float64:
+			dtype = hdf5FloatType(8)
+			data = appendUint64(nil, math.Float64bits(x))
+		case string:
+			// Fixed-length strings can't be empty.
+			data = []byte(x)
+			if len(data) == 0 { data = []byte{ 0 } }
+			dtype = hdf5StringType(len(data))
+		case []int64:
+			dtype, dims = hdf5IntType(8, true), []uint64{ uint64(len(x)) }
+			for i := range x { data = appendUint64(data, uint64(x[i])) }
+		case []float64:
+			dtype, dims = hdf5FloatType(8), []uint64{ uint64(len(x)) }
+			for i := range x {
+				data = appendUint64(data, math.Float64bits(x[i]))
+			}
+		case []byte:
+			dtype, dims = hdf5IntType(1, false), []uint64{ uint64(len(x)) }
+			data = x
+		}
+		space := hdf5Dataspace(dims)
+
+		// Version 3, no flags, ASCII name. The name is null-terminated.
+		b := []byte{ 3, 0 }
+		b = appendUint16(b, uint16(len(attr.Name) + 1))
+		b = appendUint16(b, uint16(len(dtype)))
+		b = appendUint16(b, uint16(len(space)))
+		b = append(b, 0)
+		b = append(b, attr.Name...)
+		b = append(b, 0)
+		b = append(b, dtype...)
+		b = append(b, space...)
+		b = append(b, data...)
+
+		if len(b) > hdf5MaxMessageSize {
+			return nil, fmt.Errorf("The attribute '%s' is %d bytes long, " +
+				"but HDF5 attributes can only be written if they're at most " +
+				"%d bytes.", attr.Name, len(b), hdf5MaxMessageSize)
+		}
+
+		msgs = append(msgs, hdf5Message{ hdf5MsgAttribute, b })
+	}
+
+	return msgs, nil
+}
+
+// hdf5Dataspace returns a version 2 dataspace message with the given
+// dimensions. nil dims gives a scalar dataspace.
+func hdf5Dataspace(dims []uint64) []byte {
+	typ := uint8(1) // Simple
+	if dims == nil { typ = 0 } // Scalar
+	b := []byte{ 2, uint8(len(dims)), 0, typ }
+	for _, dim := range dims { b = appendUint64(b, dim) }
+	return b
+}
+
+// hdf5DatatypeOf returns the datatype message for the elements of an array.
+func hdf5DatatypeOf(x interface{}) []byte {
+	switch x.(type) {
+	case []uint32: return hdf5IntType(4, false)
+	case []uint64: return hdf5IntType(8, false)
+	case []float32, [][3]float32: return hdf5FloatType(4)
+	case []float64, [][3]float64: return hdf5FloatType(8)
+	}
+	panic(fmt.Sprintf("Internal error: unsupported array type %T.", x))
+}
+
+// hdf5IntType returns a datatype message for a little-endian integer with the
+// given size in bytes.
+func hdf5IntType(size int, signed bool) []byte {
+	flags := uint8(0)
+	if signed { flags |= 0x08 }
+	b := []byte{ 0x10, flags, 0, 0 } // Version 1, fixed-point class
+	b = appendUint32(b, uint32(size))
+	b = appendUint16(b, 0) // Bit offset
+	return appendUint16(b, uint16(8*size)) // Bit precision
+}
+
+// hdf5FloatType returns a datatype message for a little-endian IEEE float
+// with a size of 4 or 8 bytes.
+func hdf5FloatType(size int) []byte {
+	// Sign bit, exponent location and size, mantissa size, and exponent bias.
+	sign, expLoc, expSize, mantSize, bias := 31, 23, 8, 23, 127
+	if size == 8 {
+		sign, expLoc, expSize, mantSize, bias = 63, 52, 11, 52, 1023
+	}
+
+	// Version 1, floating-point class. The mantissa's most significant bit is
+	// implied.
+	b := []byte{ 0x11, 0x20, uint8(sign), 0 }
+	b = appendUint32(b, uint32(size))
+	b = appendUint16(b, 0) // Bit offset
+	b = appendUint16(b, uint16(8*size)) // Bit precision
+	b = append(b, uint8(expLoc), uint8(expSize), 0, uint8(mantSize))
+	return appendUint32(b, uint32(bias))
+}
+
+// hdf5StringType returns a datatype message for a null-padded ASCII string
+// with the given length.
+func hdf5StringType(size int) []byte {
+	b := []byte{ 0x13, 0x01, 0, 0 } // Version 1, string class, null-padded
+	return appendUint32(b, uint32(size))
+}
+
+func appendUint16(b []byte, x uint16) []byte {
+	return append(b, uint8(x), uint8(x >> 8))
+}
+
+func appendUint32(b []byte, x uint32) []byte {
+	return append(b, uint8(x), uint8(x >> 8), uint8(x >> 16), uint8(x >> 24))
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(x)), uint32(x >> 32))
+}
+
+// hdf5Checksum is Bob Jenkins' lookup3 hash (hashlittle() with an initial
+// value of 0), which HDF5 uses to check its metadata.
+func hdf5Checksum(k []byte) uint32 {
+	rot := func(x uint32, k uint) uint32 { return (x << k) | (x >> (32 - k)) }
+
+	a := 0xdeadbeef + uint32(len(k))
+	b, c := a, a
+
+	for len(k) > 12 {
+		a += binary.LittleEndian.Uint32(k[0:])
+		b += binary.LittleEndian.Uint32(k[4:])
+		c += binary.LittleEndian.Uint32(k[8:])
+
+		a -= c; a ^= rot(c, 4); c += b
+		b -= a; b ^= rot(a, 6); a += c
+		c -= b; c ^= rot(b, 8); b += a
+		a -= c; a ^= rot(c, 16); c += b
+		b -= a; b ^= rot(a, 19); a += c
+		c -= b; c ^= rot(b, 4); b += a
+
+		k = k[12:]
+	}
+
+	if len(k) == 0 { return c }
+
+	// Zero-pad the last block.
+	last := make([]byte, 12)
+	copy(last, k)
+	a += binary.LittleEndian.Uint32(last[0:])
+	b += binary.LittleEndian.Uint32(last[4:])
+	c += binary.LittleEndian.Uint32(last[8:])
+
+	c ^= b; c -= rot(b, 14)
+	a ^= c; a -= rot(c, 11)
+	b ^= a; b -= rot(a, 25)
+	c ^= b; c -= rot(b, 16)
+	a ^= c; a -= rot(c, 4)
+	b ^= a; b -= rot(a, 14)
+	c ^= b; c -= rot(b, 24)
+
+	return c
+}
@@ -0,0 +1,298 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// hdf5Object is an object header parsed by readHDF5Object.
+type hdf5Object struct {
+	links map[string]uint64
+	linkOrder []string
+	attrs map[string][]byte
+	dims []uint64
+	dtype []byte
+	dataAddr, dataSize uint64
+}
+
+// readHDF5Object parses the version 2 object header at addr and checks its
+// checksum. This only understands the messages written by WriteHDF5.
+func readHDF5Object(t *testing.T, b []byte, addr uint64) *hdf5Object {
+	h := b[addr:]
+	if string(h[:4]) != "OHDR" || h[4] != 2 || h[5] != 2 {
+		t.Fatalf("Invalid object header at %d.", addr)
+	}
+	size := int(binary.LittleEndian.Uint32(h[6:]))
+	end := 10 + size
+	sum := binary.LittleEndian.Uint32(h[end:])
+	if sum != hdf5Checksum(h[:end]) {
+		t.Errorf("Object header at %d has an invalid checksum.", addr)
+	}
+
+	obj := &hdf5Object{
+		links: map[string]uint64{ }, attrs: map[string][]byte{ },
+	}
+	for i := 10; i < end; {
+		typ := h[i]
+		n := int(binary.LittleEndian.Uint16(h[i + 1:]))
+		msg := h[i + 4: i + 4 + n]
+		i += 4 + n
+
+		switch typ {
+		case hdf5MsgLink:
+			name := string(msg[3: 3 + int(msg[2])])
+			obj.links[name] = binary.LittleEndian.Uint64(msg[3 + len(name):])
+			obj.linkOrder = append(obj.linkOrder, name)
+		case hdf5MsgDataspace:
+			for j := 0; j < int(msg[1]); j++ {
+				obj.dims = append(obj.dims,
+					binary.LittleEndian.Uint64(msg[4 + 8*j:]))
+			}
+		case hdf5MsgDatatype:
+			obj.dtype = msg
+		case hdf5MsgLayout:
+			obj.dataAddr = binary.LittleEndian.Uint64(msg[2:])
+			obj.dataSize = binary.LittleEndian.Uint64(msg[10:])
+		case hdf5MsgAttribute:
+			nameSize := int(binary.LittleEndian.Uint16(msg[2:]))
+			typeSize := int(binary.LittleEndian.Uint16(msg[4:]))
+			spaceSize := int(binary.LittleEndian.Uint16(msg[6:]))
+			name := string(msg[9: 9 + nameSize - 1])
+			obj.attrs[name] = msg[9 + nameSize + typeSize + spaceSize:]
+		}
+	}
+
+	return obj
+}
+
+func TestHDF5Checksum(t *testing.T) {
+	tests := []struct{
+		s string
+		sum uint32
+	} {
+		{ "", 0xdeadbeef },
+		{ "Four score and seven years ago", 0x17770551 },
+	}
+
+	for i := range tests {
+		sum := hdf5Checksum([]byte(tests[i].s))
+		if sum != tests[i].sum {
+			t.Errorf("%d) Expected checksum 0x%08x for %q, got 0x%08x.",
+				i, tests[i].sum, tests[i].s, sum)
+		}
+	}
+}
+
+func TestWriteHDF5(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.hdf5")
+	f := testFile()
+	if err := WriteHDF5(fileName, f); err != nil { t.Fatalf(err.Error()) }
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	// Superblock
+	if string(b[:8]) != hdf5Signature || b[8] != 2 {
+		t.Fatalf("Invalid superblock.")
+	}
+	if binary.LittleEndian.Uint32(b[44:]) != hdf5Checksum(b[:44]) {
+		t.Errorf("Superblock has an invalid checksum.")
+	}
+	if eof := binary.LittleEndian.Uint64(b[28:]); eof != uint64(len(b)) {
+		t.Errorf("Superblock has EOF %d, but the file is %d bytes.",
+			eof, len(b))
+	}
+	root := readHDF5Object(t, b, binary.LittleEndian.Uint64(b[36:]))
+
+	// Root group
+	expLinks := []string{ hdf5MetadataGroup }
+	for _, v := range f.Variables { expLinks = append(expLinks, v.Name) }
+	if !reflect.DeepEqual(root.linkOrder, expLinks) {
+		t.Fatalf("Expected links %v, got %v.", expLinks, root.linkOrder)
+	}
+	if len(root.attrs) != len(f.Attributes) {
+		t.Errorf("Expected %d root attributes, got %d.",
+			len(f.Attributes), len(root.attrs))
+	}
+	if n := binary.LittleEndian.Uint64(root.attrs["N"]); n != 3 {
+		t.Errorf("Expected N = 3, got %d.", n)
+	}
+	z := math.Float64frombits(binary.LittleEndian.Uint64(root.attrs["Z"]))
+	if z != 0.5 { t.Errorf("Expected Z = 0.5, got %g.", z) }
+	if s := string(root.attrs["Name"]); s != "test" {
+		t.Errorf("Expected Name = 'test', got '%s'.", s)
+	}
+	if hd := root.attrs["OriginalHeader"]; !bytes.Equal(hd, []byte{0,1,255}) {
+		t.Errorf("Expected OriginalHeader = [0 1 255], got %v.", hd)
+	}
+
+	// Metadata group
+	meta := readHDF5Object(t, b, root.links[hdf5MetadataGroup])
+	if s := string(meta.attrs["Code"]); s != "Gadget-2" {
+		t.Errorf("Expected Metadata/Code = 'Gadget-2', got '%s'.", s)
+	}
+
+	// Datasets
+	for _, v := range f.Variables {
+		obj := readHDF5Object(t, b, root.links[v.Name])
+
+		expDims := []uint64{ 3 }
+		if isVector(v.Data) { expDims = []uint64{ 3, 3 } }
+		if !reflect.DeepEqual(obj.dims, expDims) {
+			t.Errorf("Expected %s to have shape %v, got %v.",
+				v.Name, expDims, obj.dims)
+		}
+		if !bytes.Equal(obj.dtype, hdf5DatatypeOf(v.Data)) {
+			t.Errorf("%s has the wrong datatype.", v.Name)
+		}
+
+		buf := &bytes.Buffer{ }
+		binary.Write(buf, binary.LittleEndian, v.Data)
+		data := b[obj.dataAddr: obj.dataAddr + obj.dataSize]
+		if !bytes.Equal(data, buf.Bytes()) {
+			t.Errorf("%s has the wrong data.", v.Name)
+		}
+
+		if len(obj.attrs) != len(v.Attributes) {
+			t.Errorf("Expected %d attributes for %s, got %d.",
+				len(v.Attributes), v.Name, len(obj.attrs))
+		}
+	}
+
+	x := readHDF5Object(t, b, root.links["x"])
+	if s := string(x.attrs["Units"]); s != "cMpc/h" {
+		t.Errorf("Expected x/Units = 'cMpc/h', got '%s'.", s)
+	}
+
+	f.Variables[0].Name = hdf5MetadataGroup
+	if err := WriteHDF5(fileName, f); err == nil {
+		t.Errorf("Expected error for variable named '%s'.", hdf5MetadataGroup)
+	}
+}
+
+// h5pyScript prints the contents of the HDF5 file given as its first argument
+// as JSON, using h5py (and so libhdf5) to read it.
+const h5pyScript = `
+import sys, json, h5py
+
+def conv(x):
+    if isinstance(x, bytes): return x.decode()
+    if hasattr(x, "tolist"): return conv(x.tolist())
+    if isinstance(x, list): return [conv(y) for y in x]
+    return x
+
+def attrs(obj): return { k: conv(v) for k, v in obj.attrs.items() }
+
+with h5py.File(sys.argv[1], "r") as f:
+    out = { "attrs": attrs(f), "metadata": attrs(f["Metadata"]),
+        "datasets": { } }
+    for name, obj in f.items():
+        if isinstance(obj, h5py.Dataset):
+            out["datasets"][name] = { "data": conv(obj[()]),
+                "attrs": attrs(obj) }
+    print(json.dumps(out))
+`
+
+// jsonValue converts x to the value it would have after being written to
+// and read from JSON. []byte is converted to a list of numbers rather than a
+// base64 string.
+func jsonValue(t *testing.T, x interface{}) interface{} {
+	if b, ok := x.([]byte); ok {
+		out := make([]interface{}, len(b))
+		for i := range b { out[i] = float64(b[i]) }
+		return out
+	}
+
+	b, err := json.Marshal(x)
+	if err != nil { t.Fatalf(err.Error()) }
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil { t.Fatalf(err.Error()) }
+	return out
+}
+
+// jsonAttributes converts a list of attributes to a JSON-style map.
+func jsonAttributes(
+	t *testing.T, attrs []Attribute,
+) map[string]interface{} {
+	out := map[string]interface{}{ }
+	for _, attr := range attrs { out[attr.Name] = jsonValue(t, attr.Value) }
+	return out
+}
+
+// TestHDF5ExternalReaders checks that files written by WriteHDF5 can be read
+// by libhdf5 through h5py and h5dump. Each check is skipped if the tool isn't
+// installed.
+func TestHDF5ExternalReaders(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.hdf5")
+	f := testFile()
+	if err := WriteHDF5(fileName, f); err != nil { t.Fatalf(err.Error()) }
+
+	t.Run("h5py", func(t *testing.T) {
+		python, err := exec.LookPath("python3")
+		if err != nil { t.Skip("python3 isn't installed.") }
+		if exec.Command(python, "-c", "import h5py").Run() != nil {
+			t.Skip("h5py isn't installed.")
+		}
+
+		b, err := exec.Command(python, "-c", h5pyScript, fileName).Output()
+		if err != nil { t.Fatalf("h5py couldn't read the file: %s", err) }
+		out := map[string]interface{}{ }
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		datasets := map[string]interface{}{ }
+		for _, v := range f.Variables {
+			attrs := jsonAttributes(t, v.Attributes)
+			datasets[v.Name] = map[string]interface{}{
+				"data": jsonValue(t, v.Data),
+				"attrs": jsonValue(t, attrs),
+			}
+		}
+		exp := map[string]interface{}{
+			"attrs": jsonValue(t, jsonAttributes(t, f.Attributes)),
+			"metadata": jsonValue(t, jsonAttributes(t, f.Metadata)),
+			"datasets": datasets,
+		}
+
+		for _, key := range []string{ "attrs", "metadata", "datasets" } {
+			if !reflect.DeepEqual(out[key], exp[key]) {
+				t.Errorf("Expected h5py to read %s = %v, got %v.",
+					key, exp[key], out[key])
+			}
+		}
+	})
+
+	t.Run("h5dump", func(t *testing.T) {
+		h5dump, err := exec.LookPath("h5dump")
+		if err != nil { t.Skip("h5dump isn't installed.") }
+
+		b, err := exec.Command(h5dump, fileName).CombinedOutput()
+		if err != nil {
+			t.Fatalf("h5dump couldn't read the file: %s\n%s", err, b)
+		}
+
+		out := string(b)
+		exp := []string{
+			`GROUP "/"`, `GROUP "Metadata"`, `ATTRIBUTE "Code"`,
+			`"Gadget-2"`, `ATTRIBUTE "Units"`, `"cMpc/h"`, "1099511627776",
+		}
+		for _, v := range f.Variables {
+			exp = append(exp, `DATASET "` + v.Name + `"`)
+		}
+		for _, s := range exp {
+			if !strings.Contains(out, s) {
+				t.Errorf("Expected h5dump's output to contain %s, got:\n%s",
+					s, out)
+			}
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package export
+
+/* This file contains functions for writing numpy's .npy and .npz formats. The
+.npy format is described at
+https://numpy.org/doc/stable/reference/generated/numpy.lib.format.html */
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// npyMagic starts every .npy file. It's followed by the major and minor
+	// version numbers.
+	npyMagic = "\x93NUMPY"
+	// npyAlignment is the alignment of the start of the data, in bytes.
+	npyAlignment = 64
+	// jsonHeaderName is the name of the JSON file that stores the header in
+	// .npz archives and .npy directories.
+	jsonHeaderName = "header.json"
+)
+
+// npyDescr returns the numpy dtype string and shape of an array.
+func npyDescr(x interface{}) (descr string, shape string) {
+	n := Len(x)
+	switch x.(type) {
+	case []uint32: return "<u4", fmt.Sprintf("(%d,)", n)
+	case []uint64: return "<u8", fmt.Sprintf("(%d,)", n)
+	case []float32: return "<f4", fmt.Sprintf("(%d,)", n)
+	case []float64: return "<f8", fmt.Sprintf("(%d,)", n)
+	case [][3]float32: return "<f4", fmt.Sprintf("(%d, 3)", n)
+	case [][3]float64: return "<f8", fmt.Sprintf("(%d, 3)", n)
+	}
+	panic(fmt.Sprintf("Internal error: unsupported array type %T.", x))
+}
+
+// WriteNpy writes an array to w in the .npy format.
+func WriteNpy(w io.Writer, x interface{}) error {
+	if Len(x) < 0 {
+		return fmt.Errorf("Internal error: cannot write an array with type " +
+			"%T to a .npy file.", x)
+	}
+
+	descr, shape := npyDescr(x)
+	dict := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, " +
+		"'shape': %s, }", descr, shape)
+
+	// The magic string, version, and header length take 10 bytes, and the
+	// header is padded with spaces and ends in a newline.
+	pad := npyAlignment - (10 + len(dict) + 1) % npyAlignment
+	if pad == npyAlignment { pad = 0 }
+	dict += strings.Repeat(" ", pad) + "\n"
+
+	wr := bufio.NewWriter(w)
+	wr.WriteString(npyMagic)
+	wr.Write([]byte{ 1, 0 })
+	binary.Write(wr, binary.LittleEndian, uint16(len(dict)))
+	wr.WriteString(dict)
+	if err := binary.Write(wr, binary.LittleEndian, x); err != nil {
+		return err
+	}
+
+	return wr.Flush()
+}
+
+// WriteNpyDir writes each variable in f to its own .npy file in the directory
+// dir, which is created if it doesn't exist. The header is written to
+// header.json.
+func WriteNpyDir(dir string, f *File) error {
+	if err := f.Check(); err != nil { return err }
+	if err := os.MkdirAll(dir, 0755); err != nil { return err }
+
+	for _, v := range f.Variables {
+		err := writeFile(filepath.Join(dir, v.Name + ".npy"),
+			func(w io.Writer) error { return WriteNpy(w, v.Data) })
+		if err != nil { return err }
+	}
+
+	return writeFile(filepath.Join(dir, jsonHeaderName),
+		func(w io.Writer) error { return WriteJSONHeader(w, f) })
+}
+
+// WriteNpz writes each variable in f to a .npz archive. The header is stored
+// as header.json inside the archive. numpy.load() returns the arrays for the
+// .npy entries and the raw bytes for header.json.
+func WriteNpz(fileName string, f *File) error {
+	if err := f.Check(); err != nil { return err }
+
+	return writeFile(fileName, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+
+		for _, v := range f.Variables {
+			entry, err := zw.CreateHeader(&zip.FileHeader{
+				Name: v.Name + ".npy", Method: zip.Store,
+			})
+			if err != nil { return err }
+			if err := WriteNpy(entry, v.Data); err != nil { return err }
+		}
+
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name: jsonHeaderName, Method: zip.Deflate,
+		})
+		if err != nil { return err }
+		if err := WriteJSONHeader(entry, f); err != nil { return err }
+
+		return zw.Close()
+	})
+}
+
+// writeFile creates a file and writes to it with the function write.
+func writeFile(fileName string, write func(w io.Writer) error) error {
+	fp, err := os.Create(fileName)
+	if err != nil { return err }
+
+	wr := bufio.NewWriter(fp)
+	err = write(wr)
+	if err == nil { err = wr.Flush() }
+	if closeErr := fp.Close(); err == nil { err = closeErr }
+
+	return err
+}
@@ -10,11 +10,31 @@ File format strings are a combination of fixed text and variables. Fixed text is
 always the same, and variables can change from file to file. Variables are
 written as {verb,rule}. "verb" is a printf() verb (e.g. %03d) that specifies
 how the variable should be printed. "rule" is text that specifies what values
-the variable should take on. There are currently three rules:
+the variable should take on. There are currently six rules:
 
   "snapshot" - The variable is equal to the currently-analysed snapshot.
   "output" - The variable ranges over Guppy output file indices.
+  named variables - The variable is equal to a value declared by the user.
   sequence format - The variable ranges over a user-specified range.
+  string sequences - The variable ranges over a list of strings separated by
+      "|", e.g. {%s,A|B|C}.
+  "*" - The variable ranges over the numbers in the names of files that
+      already exist, e.g. {%d,*} or {%03d,*}. Matching files are sorted
+      numerically.
+
+Verbs can be integer verbs (%d, %03i, etc.), float verbs (%.4f, %g, etc.),
+or %s. Integer values can be printed with any verb, floats can be printed
+with float verbs and %s, and strings can only be printed with %s.
+
+Named variables are declared with NamedVars. Each one either has a single
+value or a table of values indexed by snapshot, such as a list of scale
+factors:
+
+  run:L0125
+  a:0.25|0.5|1.0
+  a:@/path/to/output_scale_factors.txt
+
+The "@" form reads the table from a file with one value per line.
 
 Sequence formats are a generic way to specify non-contiguous sequences of
 natural numbers. They consist of a series of n tokens separated by "+" or "-".
@@ -36,6 +56,9 @@ package format
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -45,6 +68,9 @@ const (
 	// Any expanded formats which would have more than BigNumber elements are
 	// assumed to be bugs.
 	BigNumber = 1<<20
+	// GlobRule is the rule for variables which are found by searching for
+	// files on disk.
+	GlobRule = "*"
 )
 
 var (
@@ -247,6 +273,16 @@ func parseSequenceFormatToken(tok string) []int {
 // expanded individually, meaning that n = \prod n_i, where n_i is the length
 // of each sequence.
 func ExpandFormatString(format string, vals map[string]int) ([]string, error) {
+	ivals := map[string]interface{}{ }
+	for name, val := range vals { ivals[name] = val }
+	return ExpandFormatVars(format, ivals)
+}
+
+// ExpandFormatVars is identical to ExpandFormatString, except that named
+// variables can have int, float64, string, or Value values.
+func ExpandFormatVars(
+	format string, vals map[string]interface{},
+) ([]string, error) {
 	// Toeknize components of the format string:
 	starts, ends, err := startsEndsFormatString(format)
 	if err != nil { return nil, err }
@@ -255,38 +291,202 @@ func ExpandFormatString(format string, vals map[string]int) ([]string, error) {
 	// Parse each variable
 	verb, rule := make([]string, len(vars)), make([]string, len(vars))
 	isSeq := make([]bool, len(vars))
+	seqVals := make([][]interface{}, len(vars))
 	for i := range vars {
 		verb[i], rule[i], isSeq[i], err = splitFormatStringVar(vars[i], vals)
 		if err != nil {
 			return nil, fmt.Errorf("Could not parse variable %d, {%s}, because %s",
 				i+1, vars[i], err.Error())
 		}
+		if isSeq[i] { seqVals[i] = sequenceValues(rule[i]) }
 	}
 
-	expSeq, nTot := expandSeqValues(rule, isSeq)
+	// Sequences are expanded by index so that string sequences can be
+	// expanded alongside numeric ones.
+	idxRule := make([]string, len(rule))
+	for i := range rule {
+		if isSeq[i] { idxRule[i] = fmt.Sprintf("0..%d", len(seqVals[i]) - 1) }
+	}
+	expSeq, nTot := expandSeqValues(idxRule, isSeq)
 	if nTot == 0 { nTot = 1 }
 	
-	// Construct the strings from the various rules and format verbs.
-	out := make([]string, nTot)
-	for i := range out {
+	// Construct the strings from the various rules and format verbs. Glob
+	// variables split the strings into parts that are matched against files
+	// on disk.
+	out := []string{ }
+	for i := 0; i < nTot; i++ {
+		parts, globVerbs := []string{ }, []string{ }
 		tok := []string{ }
 		for j := range rule {
 			tok = append(tok, text[j])
-			if isSeq[j] {
-				tok = append(tok, fmt.Sprintf(verb[j], expSeq[j][i]))
+			if rule[j] == GlobRule {
+				parts = append(parts, strings.Join(tok, ""))
+				globVerbs = append(globVerbs, verb[j])
+				tok = []string{ }
+			} else if isSeq[j] {
+				tok = append(tok,
+					formatValue(verb[j], seqVals[j][expSeq[j][i]]))
 			} else {
-				tok = append(tok, fmt.Sprintf(verb[j], vals[rule[j]]))
+				tok = append(tok, formatValue(verb[j], vals[rule[j]]))
 			}
 		}
 		
 		tok = append(tok, text[len(text) - 1])
-		
-		out[i] = strings.Join(tok, "")
+		parts = append(parts, strings.Join(tok, ""))
+
+		if len(globVerbs) == 0 {
+			out = append(out, parts[0])
+			continue
+		}
+
+		files, err := discoverFiles(parts, globVerbs)
+		if err != nil { return nil, err }
+		out = append(out, files...)
 	}
 	
 	return out, nil
 }
 
+// discoverFiles returns the files on disk whose names are made up of parts
+// separated by integers printed with globVerbs. Files are sorted by their
+// integers, with earlier integers being more significant.
+func discoverFiles(parts, globVerbs []string) ([]string, error) {
+	glob := globEscape(parts[0])
+	expr := "^" + regexp.QuoteMeta(parts[0])
+	for i := range globVerbs {
+		glob += "*" + globEscape(parts[i+1])
+		expr += "([+-]? *[0-9]+)" + regexp.QuoteMeta(parts[i+1])
+	}
+	expr += "$"
+	re := regexp.MustCompile(expr)
+
+	matches, err := filepath.Glob(glob)
+	if err != nil { return nil, err }
+
+	type file struct {
+		name string
+		n []int
+	}
+	files := []file{ }
+MatchLoop:
+	for _, match := range matches {
+		groups := re.FindStringSubmatch(match)
+		if groups == nil { continue }
+
+		n := make([]int, len(globVerbs))
+		for i := range n {
+			n[i], err = strconv.Atoi(strings.Trim(groups[i+1], " "))
+			// Make sure the number is printed the same way as the verb
+			// would print it, e.g. with the right amount of padding.
+			if err != nil || fmt.Sprintf(globVerbs[i], n[i]) != groups[i+1] {
+				continue MatchLoop
+			}
+		}
+		files = append(files, file{ match, n })
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No files on disk match the pattern %s.",
+			strings.Join(parts, "{*}"))
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		for k := range files[i].n {
+			if files[i].n[k] != files[j].n[k] {
+				return files[i].n[k] < files[j].n[k]
+			}
+		}
+		return files[i].name < files[j].name
+	})
+
+	out := make([]string, len(files))
+	for i := range files { out[i] = files[i].name }
+	return out, nil
+}
+
+// globEscape escapes the characters in s that filepath.Glob treats
+// specially.
+func globEscape(s string) string {
+	out := []byte{ }
+	for i := range s {
+		switch s[i] {
+		case '*', '?', '[', '\\':
+			out = append(out, '\\')
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// sequenceValues returns the values of a sequence rule, which has already
+// been checked by splitFormatStringVar.
+func sequenceValues(rule string) []interface{} {
+	if isStringSequence(rule) {
+		tok := strings.Split(rule, "|")
+		out := make([]interface{}, len(tok))
+		for i := range tok { out[i] = strings.Trim(tok[i], " ") }
+		return out
+	}
+
+	seq, _ := ExpandSequenceFormat(rule)
+	out := make([]interface{}, len(seq))
+	for i := range seq { out[i] = seq[i] }
+	return out
+}
+
+// isStringSequence returns true if a rule is a string sequence.
+func isStringSequence(rule string) bool {
+	return strings.Contains(rule, "|")
+}
+
+// formatValue prints a value with a verb. The verb and value must have
+// already been checked by checkVerbValue.
+func formatValue(verb string, val interface{}) string {
+	if v, ok := val.(Value); ok {
+		if verbKind(verb) == 's' { return fmt.Sprintf(verb, v.Text) }
+		val = v.Parsed
+	}
+
+	switch verbKind(verb) {
+	case 'f':
+		if x, ok := val.(int); ok { return fmt.Sprintf(verb, float64(x)) }
+	case 's':
+		if _, ok := val.(string); !ok {
+			return fmt.Sprintf(verb, fmt.Sprint(val))
+		}
+	}
+	return fmt.Sprintf(verb, val)
+}
+
+// verbKind returns 'd' for integer verbs, 'f' for float verbs, and 's' for
+// string verbs.
+func verbKind(verb string) byte {
+	switch verb[len(verb) - 1] {
+	case 'e', 'E', 'f', 'F', 'g', 'G': return 'f'
+	case 's': return 's'
+	}
+	return 'd'
+}
+
+// checkVerbValue returns an error if val can't be printed with verb. The
+// error message assumes it is printed after a trailing "because".
+func checkVerbValue(verb string, val interface{}) error {
+	kind := verbKind(verb)
+	switch v := val.(type) {
+	case Value:
+		return checkVerbValue(verb, v.Parsed)
+	case int:
+		return nil
+	case float64:
+		if kind != 'd' { return nil }
+		return fmt.Errorf("%s is an integer verb, but the variable has the non-integer value %g.", verb, val)
+	case string:
+		if kind == 's' { return nil }
+		return fmt.Errorf("%s is a numeric verb, but the variable has the string value '%s'. Use %%s instead.", verb, val)
+	}
+	return fmt.Errorf("the variable has the value %v, which has the unsupported type %T.", val, val)
+}
+
 
 // startsEndsFormatString returns the indices of the beginning and end of each
 // format variable. The end index is exclusive, making it useful for slicing
@@ -360,7 +560,7 @@ func splitFormatString(
 // splitFormatStringVar splits the components of the variable v into a printf
 // verb and a variable
 func splitFormatStringVar(
-	v string, m map[string]int,
+	v string, m map[string]interface{},
 ) (verb, rule string, isSeq bool, err error) {
 	tok := strings.Split(v, ",")
 	if len(tok) == 1 {
@@ -373,6 +573,18 @@ func splitFormatStringVar(
 	verb, err = fixVerb(verb)
 	if err != nil { return "", "", false, err }
 
+	if strings.Trim(rule, " ") == GlobRule {
+		if verb[len(verb) - 1] != 'd' {
+			return "", "", false, fmt.Errorf("files can only be discovered with {%%d,*}, but the verb %s isn't a %%d verb.", verb)
+		}
+		return verb, GlobRule, false, nil
+	} else if isStringSequence(rule) {
+		if verbKind(verb) != 's' {
+			return "", "", false, fmt.Errorf("'%s' is a string sequence, so it must be printed with %%s, not %s.", rule, verb)
+		}
+		return verb, rule, true, nil
+	}
+
 	isSeq = !strings.ContainsAny(rule, AllLetters)
 
 	if isSeq {		
@@ -382,9 +594,12 @@ func splitFormatStringVar(
 			)
 		}
 	} else {
-		if _, ok := m[rule]; !ok {
+		val, ok := m[rule]
+		if !ok {
 			return "", "", false, fmt.Errorf("'%s' is not a valid variable name. The only valid variable names are %s.",
 				rule, allVars(m))
+		} else if err := checkVerbValue(verb, val); err != nil {
+			return "", "", false, err
 		}
 	}
 
@@ -392,7 +607,7 @@ func splitFormatStringVar(
 }
 
 // allVars returns a sorted array of a map's keys.
-func allVars(m map[string]int) []string {
+func allVars(m map[string]interface{}) []string {
 	keys := []string{ }
 	for key, _ := range m { keys = append(keys, key) }
 	sort.Strings(keys)
@@ -410,14 +625,10 @@ func fixVerb(v string) (string, error) {
 		return "", err
 	}
 
-	// In C, i and d are synonyms.
-	v = strings.ReplaceAll(v, "i", "d") 
-	// In C, l is required for long ints
+	// In C, l is required for long ints and doubles.
 	v = strings.ReplaceAll(v, "l", "") 
 	// In C, h is required for short ints
 	v = strings.ReplaceAll(v, "h", "")
-	// In C, both . and 0 allow for zero-padding
-	v = strings.ReplaceAll(v, ".", "0")
 	// In Python there are obscure characters that no-one uses. Throw an error
 	// if someone tries. In principle these aren't hard to implement, but I bet
 	// no one will ever need them.
@@ -426,46 +637,65 @@ func fixVerb(v string) (string, error) {
 	} else if strings.ContainsAny(v, "_,") {
 		return "", fmt.Errorf("'%s' contains obscure Python-3 format characters that Guppy hasn't implemented. Please submit an issue requesting this feature.", v)
 	}
+
+	// Floats and strings can have a precision after the padding, written
+	// as '.' followed by an integer.
+	switch v[len(v) - 1] {
+	case 'e', 'E', 'f', 'F', 'g', 'G', 's':
+		mod := v[1:len(v) - 1]
+		if i := strings.Index(mod, "."); i >= 0 {
+			prec := mod[i+1:]
+			if len(prec) == 0 || strings.Trim(prec, "0123456789") != "" {
+				return "", err
+			}
+			mod = mod[:i]
+		}
+		if !validVerbFlags(mod) { return "", err }
+		return v, nil
+	}
+
+	// In C, i and d are synonyms.
+	v = strings.ReplaceAll(v, "i", "d") 
+	// In C, both . and 0 allow for zero-padding
+	v = strings.ReplaceAll(v, ".", "0")
 		
-	// Only ints are supported for now.
 	switch v[len(v) - 1] {
 	case 'b', 'c', 'd', 'o', 'O', 'q', 'x', 'X', 'U':
 	default: return "", err
 	}
 
-	// Try our best to figure out if the modifier is legal.
-	mod := v[1:len(v) - 1]
+	if !validVerbFlags(v[1:len(v) - 1]) { return "", err }
+	return v, nil
+}
+
+// validVerbFlags tries our best to figure out if the flags and padding
+// between the '%' and the end of a verb are legal.
+func validVerbFlags(mod string) bool {
 	prevFlag := "none"
-ModLoop:
 	for i, c := range mod {
 		switch c {
 		case '+', '-':
 			if prevFlag != "none" {
-				return "", err
+				return false
 			}
 			prevFlag = "sign"
 		case '#':
 			if prevFlag != "none" && prevFlag != "sign" {
-				return "", err
+				return false
 			}
 			prevFlag = "alt"
 		case '0', ' ':
 			if prevFlag != "none" && prevFlag != "sign" && prevFlag != "alt" {
-				return "", err
+				return false
 			}
 			prevFlag = "padding"
 		default:
 			_, atoiErr:= strconv.Atoi(mod[i:len(mod)])
-			if atoiErr != nil {
-				return "", err
-			}
-			prevFlag = "paddingSize"
-
-			break ModLoop
+			return atoiErr == nil
 		}
 	}
 	
-	return v, nil
+	return true
 }
 
 // expandSeqValues multiplicatively expands seqeunce rules. For example, if you
@@ -512,3 +742,132 @@ func expandSeqValues(rule []string, isSeq []bool) ([][]int, int) {
 
 	return expVals, nTot
 }
+
+// ReservedVarNames are the names of variables that are set by guppy and
+// can't be declared by users.
+var ReservedVarNames = []string{ "snapshot", "output" }
+
+// NamedVars is a set of user-declared variables that can be used in format
+// strings.
+type NamedVars struct {
+	Names []string
+	// Values[i] are the values of Names[i]. If there's only one value, it's
+	// used for every snapshot. Otherwise, Values[i][snap] is the value at
+	// snapshot snap.
+	Values [][]Value
+}
+
+// Value is the value of a user-declared variable. Parsed is an int if
+// possible, then a float64, and then a string. Text is the string it was
+// parsed from, which is what %s prints, so "007" isn't printed as "7".
+type Value struct {
+	Parsed interface{}
+	Text string
+}
+
+// ParseNamedVars parses a list of variable declarations. Each declaration
+// has the form name:value, name:value0|value1|..., or name:@file, where file
+// has one value per line. Values are parsed with ParseValue.
+func ParseNamedVars(decls []string) (*NamedVars, error) {
+	nv := &NamedVars{ }
+	for i, decl := range decls {
+		if len(strings.Trim(decl, " ")) == 0 { continue }
+
+		tok := strings.SplitN(decl, ":", 2)
+		if len(tok) != 2 {
+			return nil, fmt.Errorf("Variable declaration %d, '%s', isn't written as name:value.", i+1, decl)
+		}
+		name, val := strings.Trim(tok[0], " "), strings.Trim(tok[1], " ")
+
+		if err := checkVarName(name, nv.Names); err != nil {
+			return nil, fmt.Errorf("Variable declaration %d, '%s', can't be used because %s", i+1, decl, err.Error())
+		}
+
+		var vals []string
+		if len(val) > 0 && val[0] == '@' {
+			var err error
+			vals, err = readValueTable(val[1:])
+			if err != nil {
+				return nil, fmt.Errorf("Could not read the values of the variable '%s' from %s: %s", name, val[1:], err.Error())
+			}
+		} else {
+			vals = strings.Split(val, "|")
+		}
+
+		parsed := make([]Value, len(vals))
+		for j := range vals { parsed[j] = ParseValue(vals[j]) }
+
+		nv.Names = append(nv.Names, name)
+		nv.Values = append(nv.Values, parsed)
+	}
+
+	return nv, nil
+}
+
+// checkVarName returns an error if name can't be used as a variable name.
+// The error message assumes it is printed after a trailing "because".
+func checkVarName(name string, prevNames []string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("the name is empty.")
+	} else if !strings.ContainsAny(name[:1], AllLetters) {
+		return fmt.Errorf("names must start with a letter.")
+	} else if strings.Trim(name, AllLetters + "0123456789_") != "" {
+		return fmt.Errorf("names can only contain letters, numbers, and '_'.")
+	}
+
+	for _, reserved := range ReservedVarNames {
+		if name == reserved {
+			return fmt.Errorf("'%s' is set by guppy.", name)
+		}
+	}
+	for _, prev := range prevNames {
+		if name == prev {
+			return fmt.Errorf("'%s' was already declared.", name)
+		}
+	}
+
+	return nil
+}
+
+// readValueTable reads a file with one value per line. Empty lines and
+// text after '#' are ignored.
+func readValueTable(fname string) ([]string, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil { return nil, err }
+
+	vals := []string{ }
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 { line = line[:i] }
+		line = strings.Trim(line, " \t\r")
+		if len(line) > 0 { vals = append(vals, line) }
+	}
+
+	if len(vals) == 0 { return nil, fmt.Errorf("the file is empty.") }
+	return vals, nil
+}
+
+// ParseValue converts a string into an int if possible, then a float64, and
+// otherwise leaves it as a string. The trimmed string is kept as Text.
+func ParseValue(s string) Value {
+	s = strings.Trim(s, " ")
+	if x, err := strconv.Atoi(s); err == nil { return Value{ x, s } }
+	if x, err := strconv.ParseFloat(s, 64); err == nil { return Value{ x, s } }
+	return Value{ s, s }
+}
+
+// Vals returns the values of every variable at a given snapshot. Each value
+// is a Value.
+func (nv *NamedVars) Vals(snap int) (map[string]interface{}, error) {
+	vals := map[string]interface{}{ }
+	for i, name := range nv.Names {
+		switch {
+		case len(nv.Values[i]) == 1:
+			vals[name] = nv.Values[i][0]
+		case snap >= 0 && snap < len(nv.Values[i]):
+			vals[name] = nv.Values[i][snap]
+		default:
+			return nil, fmt.Errorf("The variable '%s' has values for snapshots 0 to %d, so it doesn't have a value for snapshot %d.", name, len(nv.Values[i]) - 1, snap)
+		}
+	}
+	return vals, nil
+}
@@ -1,6 +1,9 @@
 package format
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -298,12 +301,25 @@ func TestFixVerb(t *testing.T) {
 		{"%+.41hi", "%+041d", true},
 		{"%+#031li", "%+#031d", true},
 
+		{"%f", "%f", true},
+		{"%.4f", "%.4f", true},
+		{"%lf", "%f", true},
+		{"%08.3f", "%08.3f", true},
+		{"%+e", "%+e", true},
+		{"%G", "%G", true},
+		{"%s", "%s", true},
+		{"%-10s", "%-10s", true},
+
 		// I'm not going to be able to enumerate every incorrect format string
 		{"", "", false},
 		{"d", "", false},
 		{"i", "", false},
-		{"%f", "", false},
 		{"%???d", "", false},
+		{"%.f", "", false},
+		{"%.4.2f", "", false},
+		{"%.a3f", "", false},
+		{"%03+f", "", false},
+		{"%p", "", false},
 		{"%<d", "", false},
 		{"%>d", "", false},
 		{"%=d", "", false},
@@ -331,7 +347,7 @@ func TestFixVerb(t *testing.T) {
 }
 
 func TestSplitFormatStringVar(t *testing.T) {
-	m :=  map[string]int{ "aa": 10, "bb": 20}
+	m :=  map[string]interface{}{ "aa": 10, "bb": 20, "cc": 0.5, "dd": "x" }
 	tests := []struct{
 		v, verb, rule string
 		isSeq, valid bool
@@ -352,6 +368,17 @@ func TestSplitFormatStringVar(t *testing.T) {
 		{"%p,1a", "", "", false, false},
 		{"% 10d,1..100 + 200..210..1 - 50", "", "", false, false},
 
+		{"%.4f,cc", "%.4f", "cc", false, true},
+		{"%.4f,aa", "%.4f", "aa", false, true},
+		{"%s,dd", "%s", "dd", false, true},
+		{"%s,aa", "%s", "aa", false, true},
+		{"%s,A|B|C", "%s", "A|B|C", true, true},
+		{"%s,1..3", "%s", "1..3", true, true},
+		{"%d,cc", "", "", false, false},
+		{"%d,dd", "", "", false, false},
+		{"%f,dd", "", "", false, false},
+		{"%d,A|B", "", "", false, false},
+
 	}
 
 	for i := range tests {
@@ -515,6 +542,208 @@ func TestExpandFormatString(t *testing.T) {
 	}
 }
 
+func TestExpandFormatVars(t *testing.T) {
+	m := map[string]interface{}{
+		"snapshot": 7, "a": 0.5, "run": "L0125", "z": 1.25,
+	}
+	tests := []struct {
+		format string
+		out []string
+		valid bool
+	} {
+		{"snap_a{%.4f,a}", []string{"snap_a0.5000"}, true},
+		{"{%s,run}/snap_{%03d,snapshot}", []string{"L0125/snap_007"}, true},
+		{"z{%g,z}", []string{"z1.25"}, true},
+		{"{%.1f,snapshot}", []string{"7.0"}, true},
+		{"{%s,snapshot}", []string{"7"}, true},
+		{"{%s,A|B|C}", []string{"A", "B", "C"}, true},
+		{"{%s, A | B }", []string{"A", "B"}, true},
+		{"{%s,box|}", []string{"box", ""}, true},
+		{"{%s,A|B}{%d,1..2}", []string{"A1", "B1", "A2", "B2"}, true},
+		{"{%d,1..2}_{%s,hr|lr}_{%.2f,a}",
+			[]string{"1_hr_0.50", "2_hr_0.50", "1_lr_0.50", "2_lr_0.50"},
+			true},
+		{"{%.2f,1..2}", []string{"1.00", "2.00"}, true},
+
+		{"{%d,a}", nil, false},
+		{"{%d,run}", nil, false},
+		{"{%f,run}", nil, false},
+		{"{%d,A|B}", nil, false},
+		{"{%s,box}", nil, false},
+	}
+
+	for i := range tests {
+		out, err := ExpandFormatVars(tests[i].format, m)
+		if tests[i].valid && err != nil {
+			t.Errorf("%d) Expected '%s' could be expanded, but got error %s.",
+				i, tests[i].format, err.Error())
+		} else if !tests[i].valid && err == nil {
+			t.Errorf("%d) Expected '%s' would fail, but got not error.",
+				i, tests[i].format)
+		} else if !stringsEq(out, tests[i].out) {
+			t.Errorf("%d) Expected '%s' would expand to %q, but got %q.",
+				i, tests[i].format, tests[i].out, out)
+		}
+	}
+}
+
+func TestExpandFormatGlob(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"snap_000/snap.0", "snap_000/snap.2", "snap_000/snap.10",
+		"snap_000/snap.10.bak", "snap_000/snap.x", "snap_001/snap.0",
+		"snap_001/snap.1", "snap_1/snap.7", "run[1]/007.gup",
+		"run[1]/7.gup", "run[1]/100.gup",
+	}
+	for _, file := range files {
+		fname := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := os.WriteFile(fname, []byte{ }, 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	m := map[string]interface{}{ "snapshot": 0 }
+	tests := []struct {
+		format string
+		out []string
+		valid bool
+	} {
+		{"snap_{%03d,snapshot}/snap.{%d,*}",
+			[]string{"snap_000/snap.0", "snap_000/snap.2", "snap_000/snap.10"},
+			true},
+		{"snap_{%03d,*}/snap.{%d,*}",
+			[]string{"snap_000/snap.0", "snap_000/snap.2", "snap_000/snap.10",
+				"snap_001/snap.0", "snap_001/snap.1"}, true},
+		{"snap_{%d,*}/snap.{%d,*}", []string{"snap_1/snap.7"}, true},
+		{"snap_{%03d,0..1}/snap.{%d,0..1}",
+			[]string{"snap_000/snap.0", "snap_001/snap.0",
+				"snap_000/snap.1", "snap_001/snap.1"}, true},
+		{"snap_{%03d,0..1}/snap.{%d,*}",
+			[]string{"snap_000/snap.0", "snap_000/snap.2", "snap_000/snap.10",
+				"snap_001/snap.0", "snap_001/snap.1"}, true},
+		{"run[1]/{%03d,*}.gup", []string{"run[1]/007.gup", "run[1]/100.gup"},
+			true},
+
+		{"snap_{%03d,snapshot}/snap.{%s,*}", nil, false},
+		{"snap_{%03d,snapshot}/snap.{%x,*}", nil, false},
+		{"snap_{%03d,snapshot}/snapshot.{%d,*}", nil, false},
+	}
+
+	for i := range tests {
+		out, err := ExpandFormatVars(filepath.Join(dir, tests[i].format), m)
+		if tests[i].valid && err != nil {
+			t.Errorf("%d) Expected '%s' could be expanded, but got error %s.",
+				i, tests[i].format, err.Error())
+			continue
+		} else if !tests[i].valid && err == nil {
+			t.Errorf("%d) Expected '%s' would fail, but got not error.",
+				i, tests[i].format)
+			continue
+		} else if !tests[i].valid {
+			continue
+		}
+
+		for j := range out {
+			out[j], _ = filepath.Rel(dir, out[j])
+		}
+		if !stringsEq(out, tests[i].out) {
+			t.Errorf("%d) Expected '%s' would expand to %s, but got %s.",
+				i, tests[i].format, tests[i].out, out)
+		}
+	}
+}
+
+func TestParseNamedVars(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "scale_factors.txt")
+	err := os.WriteFile(table, []byte("# a\n0.25\n\n0.5 # snap 1\n1.0\n"),
+		0644)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	nv, err := ParseNamedVars([]string{
+		"run:L0125", "a: @" + table, "res:hr|lr|hr", "n:2048",
+	})
+	if err != nil { t.Fatalf(err.Error()) }
+
+	tests := []struct {
+		snap int
+		vals map[string]interface{}
+	} {
+		{ 0, map[string]interface{}{
+			"run": Value{ "L0125", "L0125" }, "a": Value{ 0.25, "0.25" },
+			"res": Value{ "hr", "hr" }, "n": Value{ 2048, "2048" } } },
+		{ 2, map[string]interface{}{
+			"run": Value{ "L0125", "L0125" }, "a": Value{ 1.0, "1.0" },
+			"res": Value{ "hr", "hr" }, "n": Value{ 2048, "2048" } } },
+	}
+	for i := range tests {
+		vals, err := nv.Vals(tests[i].snap)
+		if err != nil { t.Fatalf(err.Error()) }
+		if !reflect.DeepEqual(vals, tests[i].vals) {
+			t.Errorf("%d) Expected Vals(%d) = %v, got %v.",
+				i, tests[i].snap, tests[i].vals, vals)
+		}
+	}
+
+	if _, err := nv.Vals(3); err == nil {
+		t.Errorf("Expected error for a snapshot past the end of a table.")
+	}
+
+	invalid := [][]string{
+		{ "run" }, { ":L0125" }, { "1run:L0125" }, { "r-n:L0125" },
+		{ "snapshot:1" }, { "output:1" }, { "run:a", "run:b" },
+		{ "a:@" + table + ".missing" },
+	}
+	for i := range invalid {
+		if _, err := ParseNamedVars(invalid[i]); err == nil {
+			t.Errorf("%d) Expected error for declarations %q.", i, invalid[i])
+		}
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		s string
+		val interface{}
+		text string
+	} {
+		{ "12", 12, "12" }, { " -3 ", -3, "-3" }, { "0.5000", 0.5, "0.5000" },
+		{ "1e3", 1e3, "1e3" }, { "007", 7, "007" },
+		{ "L0125", "L0125", "L0125" }, { "", "", "" },
+	}
+	for i := range tests {
+		val := ParseValue(tests[i].s)
+		if val.Parsed != tests[i].val || val.Text != tests[i].text {
+			t.Errorf("%d) Expected ParseValue('%s') = %v (%T) from '%s', " +
+				"got %v (%T) from '%s'.", i, tests[i].s, tests[i].val,
+				tests[i].val, tests[i].text, val.Parsed, val.Parsed, val.Text)
+		}
+	}
+
+	// %s prints values the way they were written, and numeric verbs print
+	// the parsed value.
+	vals := map[string]interface{}{
+		"run": ParseValue("007"), "n": ParseValue("1e3"),
+	}
+	fmtTests := []struct {
+		format, out string
+	} {
+		{ "{%s,run}_{%s,n}", "007_1e3" },
+		{ "{%03d,run}_{%.1f,n}", "007_1000.0" },
+		{ "{%d,run}", "7" },
+	}
+	for i := range fmtTests {
+		out, err := ExpandFormatVars(fmtTests[i].format, vals)
+		if err != nil { t.Fatalf(err.Error()) }
+		if len(out) != 1 || out[0] != fmtTests[i].out {
+			t.Errorf("%d) Expected '%s' to expand to %s, got %s.",
+				i, fmtTests[i].format, fmtTests[i].out, out)
+		}
+	}
+}
+
 //////////////////////
 // Helper functions //
 //////////////////////
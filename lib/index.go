@@ -0,0 +1,164 @@
+package lib
+
+/* This file contains the simulation index that guppy's write mode creates
+next to its output files, which describes every .gup file in a run. */
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+)
+
+// IndexVersion is the version of the simulation index format.
+const IndexVersion = 1
+
+// SimulationIndexName is the default name of the file that a
+// SimulationIndex is stored in.
+const SimulationIndexName = "guppy_index.json"
+
+// SimulationIndexPattern is the pattern for the name of the index that
+// guppy's write mode creates. The verb is replaced by OutputPatternID().
+const SimulationIndexPattern = "guppy_index.%s.json"
+
+// SimulationIndex describes every .gup file written by a run of guppy's
+// write mode, so that readers can find files without knowing the Output
+// pattern used to write them. It's stored as JSON.
+type SimulationIndex struct {
+	Version int64
+	// NTot, TotalSpan, L, OmegaM, OmegaL, H100, and Mass are the same for
+	// every file in the simulation.
+	NTot int64
+	TotalSpan [3]int64
+	L, OmegaM, OmegaL, H100, Mass float64
+	// Snapshots is sorted by snapshot.
+	Snapshots []SnapshotIndex
+}
+
+// SnapshotIndex describes the files in a single snapshot.
+type SnapshotIndex struct {
+	Snapshot int64
+	Z float64
+	Files []FileIndex
+}
+
+// FileIndex describes a single .gup file.
+type FileIndex struct {
+	// Name is the path to the file relative to the index's directory.
+	Name string
+	// N is the number of particles in the file, and Span and Offset give
+	// the Lagrangian sub-cube that they came from.
+	N int64
+	Span, Offset [3]int64
+	// Bounds is the periodic bounding box of the particles' positions, in
+	// the format used by PeriodicBounds in the Go reader. It's empty if the
+	// file doesn't contain "x".
+	Bounds []float32 `json:",omitempty"`
+	// Size is the size of the file in bytes and CRC32C is the CRC32C
+	// checksum of its contents.
+	Size int64
+	CRC32C uint32
+}
+
+// IndexFileName returns the name of the simulation index for cfg. Like the
+// progress manifest, it's stored in the deepest directory that contains
+// every output file and its name contains OutputPatternID().
+func IndexFileName(cfg *WriteConfig) string {
+	return filepath.Join(outputDir(cfg),
+		fmt.Sprintf(SimulationIndexPattern, OutputPatternID(cfg)))
+}
+
+// NewSimulationIndex creates the index for a write job from the records of
+// its output files. snaps are the snapshots, and records[i] are the records
+// of the files in snaps[i], in order. dir is the directory that the index
+// will be written to, and file names are stored relative to it.
+func NewSimulationIndex(
+	snaps []int, records [][]OutputRecord, dir string,
+) (*SimulationIndex, error) {
+	idx := &SimulationIndex{ Version: IndexVersion }
+	idx.Snapshots = make([]SnapshotIndex, len(records))
+
+	first := true
+	for i := range records {
+		files := make([]FileIndex, len(records[i]))
+		for j, rec := range records[i] {
+			name, err := filepath.Rel(dir, rec.File)
+			if err != nil {
+				return nil, fmt.Errorf("%s can't be written relative to " +
+					"the index directory %s: %s", rec.File, dir, err.Error())
+			}
+
+			hd := rec.Header
+			files[j] = FileIndex{
+				Name: name, N: hd.N, Span: hd.Span, Offset: hd.Offset,
+				Bounds: rec.Bounds, Size: rec.Size, CRC32C: rec.CRC32C,
+			}
+
+			if first {
+				idx.NTot, idx.TotalSpan, idx.L = hd.NTot, hd.TotalSpan, hd.L
+				idx.OmegaM, idx.OmegaL = hd.OmegaM, hd.OmegaL
+				idx.H100, idx.Mass = hd.H100, hd.Mass
+				first = false
+			}
+		}
+
+		idx.Snapshots[i].Snapshot = int64(snaps[i])
+		idx.Snapshots[i].Files = files
+		if len(records[i]) > 0 { idx.Snapshots[i].Z = records[i][0].Header.Z }
+	}
+
+	sort.SliceStable(idx.Snapshots, func(i, j int) bool {
+		return idx.Snapshots[i].Snapshot < idx.Snapshots[j].Snapshot
+	})
+
+	return idx, nil
+}
+
+// FileChecksum returns the size of a file and the CRC32C checksum of its
+// contents.
+func FileChecksum(fname string) (size int64, checksum uint32, err error) {
+	f, err := os.Open(fname)
+	if err != nil { return 0, 0, err }
+	defer f.Close()
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	size, err = io.Copy(h, f)
+	if err != nil { return 0, 0, err }
+	return size, h.Sum32(), nil
+}
+
+// WriteSimulationIndex writes idx to fname with compress.AtomicWrite, so an
+// interrupted write never leaves a partial index behind.
+func WriteSimulationIndex(fname string, idx *SimulationIndex) error {
+	b, err := json.MarshalIndent(idx, "", "    ")
+	if err != nil { return err }
+
+	return compress.AtomicWrite(fname, func(f io.Writer) error {
+		_, err := f.Write(append(b, '\n'))
+		return err
+	})
+}
+
+// ReadSimulationIndex reads a SimulationIndex written by
+// WriteSimulationIndex.
+func ReadSimulationIndex(fname string) (*SimulationIndex, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil { return nil, err }
+
+	idx := &SimulationIndex{ }
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, fmt.Errorf("Could not parse the simulation index %s: %s",
+			fname, err.Error())
+	} else if idx.Version > IndexVersion {
+		return nil, fmt.Errorf("The simulation index %s uses version %d of " +
+			"the index format, but this version of guppy only understands " +
+			"versions up to %d.", fname, idx.Version, IndexVersion)
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+)
+
+func TestIndexFileName(t *testing.T) {
+	cfg := &WriteConfig{ Output: "/out/snap_{%03d,snapshot}/{%d,output}.gup" }
+	exp := "/out/guppy_index." + OutputPatternID(cfg) + ".json"
+	if name := IndexFileName(cfg); name != exp {
+		t.Errorf("Expected IndexFileName() = %s, got %s.", exp, name)
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "file")
+	data := []byte("guppy checksum test")
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	size, checksum, err := FileChecksum(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	exp := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	if size != int64(len(data)) || checksum != exp {
+		t.Errorf("Expected FileChecksum() = (%d, %x), got (%d, %x).",
+			len(data), exp, size, checksum)
+	}
+
+	if _, _, err = FileChecksum(fname + ".missing"); err == nil {
+		t.Errorf("Expected error for a missing file.")
+	}
+}
+
+func TestSimulationIndex(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, SimulationIndexName)
+
+	idx := &SimulationIndex{
+		Version: IndexVersion, NTot: 64, TotalSpan: [3]int64{ 4, 4, 4 },
+		L: 100, OmegaM: 0.3, OmegaL: 0.7, H100: 0.7, Mass: 1e10,
+		Snapshots: []SnapshotIndex{
+			{ 0, 1.5, []FileIndex{
+				{ Name: "snap_000/0.gup", N: 32, Span: [3]int64{ 4, 4, 2 },
+					Bounds: []float32{ 0, 0, 0, 100, 100, 50 },
+					Size: 1000, CRC32C: 0xdeadbeef },
+				{ Name: "snap_000/1.gup", N: 32, Span: [3]int64{ 4, 4, 2 },
+					Offset: [3]int64{ 0, 0, 2 }, Size: 2000, CRC32C: 12 },
+			} },
+			{ 1, 0, []FileIndex{ } },
+		},
+	}
+
+	if err := WriteSimulationIndex(fname, idx); err != nil {
+		t.Fatalf(err.Error())
+	}
+	read, err := ReadSimulationIndex(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	if !reflect.DeepEqual(idx, read) {
+		t.Errorf("Expected ReadSimulationIndex() = %v, got %v.", idx, read)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil { t.Fatalf(err.Error()) }
+	if len(entries) != 1 {
+		t.Errorf("Expected only the index in %s, found %d files.",
+			dir, len(entries))
+	}
+
+	idx.Version = IndexVersion + 1
+	if err := WriteSimulationIndex(fname, idx); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = ReadSimulationIndex(fname); err == nil {
+		t.Errorf("Expected error for a newer index version.")
+	}
+
+	if err := os.WriteFile(fname, []byte("{"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = ReadSimulationIndex(fname); err == nil {
+		t.Errorf("Expected error for a malformed index.")
+	}
+}
+
+func TestIndexAndProgressPermissions(t *testing.T) {
+	dir := t.TempDir()
+
+	// The index and manifest should have the same permissions as any other
+	// file created by the process, so other users can read them.
+	probe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(probe, []byte{ }, 0666); err != nil {
+		t.Fatalf(err.Error())
+	}
+	probeInfo, err := os.Stat(probe)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	index := filepath.Join(dir, SimulationIndexName)
+	err = WriteSimulationIndex(index, &SimulationIndex{ Version: IndexVersion })
+	if err != nil { t.Fatalf(err.Error()) }
+
+	manifest := filepath.Join(dir, "guppy_write.progress")
+	p, err := OpenWriteProgress(manifest, false)
+	if err != nil { t.Fatalf(err.Error()) }
+	p.Close()
+
+	for _, fname := range []string{ index, manifest } {
+		info, err := os.Stat(fname)
+		if err != nil { t.Fatalf(err.Error()) }
+		if info.Mode().Perm() != probeInfo.Mode().Perm() {
+			t.Errorf("Expected %s to have permissions %s, got %s.", fname,
+				probeInfo.Mode().Perm(), info.Mode().Perm())
+		}
+	}
+}
+
+func TestNewSimulationIndex(t *testing.T) {
+	hd := compress.FixedWidthHeader{
+		N: 32, NTot: 64, Span: [3]int64{ 4, 4, 2 },
+		TotalSpan: [3]int64{ 4, 4, 4 }, L: 100, OmegaM: 0.3, OmegaL: 0.7,
+		H100: 0.7, Mass: 1e10,
+	}
+	hd0, hd1 := hd, hd
+	hd0.Z, hd1.Z, hd1.Offset = 1.5, 1.5, [3]int64{ 0, 0, 2 }
+
+	records := [][]OutputRecord{
+		{ },
+		{
+			{ Snapshot: 0, Output: 0, File: "/out/snap_000/0.gup",
+				Size: 1000, CRC32C: 0xdeadbeef,
+				Bounds: []float32{ 0, 0, 0, 100, 100, 50 }, Header: hd0 },
+			{ Snapshot: 0, Output: 1, File: "/out/snap_000/1.gup",
+				Size: 2000, CRC32C: 12, Header: hd1 },
+		},
+	}
+	idx, err := NewSimulationIndex([]int{ 1, 0 }, records, "/out")
+	if err != nil { t.Fatalf(err.Error()) }
+
+	exp := &SimulationIndex{
+		Version: IndexVersion, NTot: 64, TotalSpan: [3]int64{ 4, 4, 4 },
+		L: 100, OmegaM: 0.3, OmegaL: 0.7, H100: 0.7, Mass: 1e10,
+		Snapshots: []SnapshotIndex{
+			{ 0, 1.5, []FileIndex{
+				{ Name: "snap_000/0.gup", N: 32, Span: [3]int64{ 4, 4, 2 },
+					Bounds: []float32{ 0, 0, 0, 100, 100, 50 },
+					Size: 1000, CRC32C: 0xdeadbeef },
+				{ Name: "snap_000/1.gup", N: 32, Span: [3]int64{ 4, 4, 2 },
+					Offset: [3]int64{ 0, 0, 2 }, Size: 2000, CRC32C: 12 },
+			} },
+			{ 1, 0, []FileIndex{ } },
+		},
+	}
+	if !reflect.DeepEqual(idx, exp) {
+		t.Errorf("Expected NewSimulationIndex() = %v, got %v.", exp, idx)
+	}
+}
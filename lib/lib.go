@@ -6,18 +6,22 @@ of the heavy lifting is done by lib/'s subpackages.
 package lib
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"path"
 	
 	"reflect"
+	"strings"
 	"unsafe"
 
 	"github.com/phil-mansfield/guppy/lib/config"
 	"github.com/phil-mansfield/guppy/lib/format"
+	"github.com/phil-mansfield/guppy/lib/particles"
 	"github.com/phil-mansfield/guppy/lib/snapio"
 	"github.com/phil-mansfield/guppy/lib/compress"
 )
@@ -26,7 +30,11 @@ var (
 	// Version is the version of the software. This can potentially be used
 	// to differentiate between breaking changes to the input/output format.
 	Version uint64 = 0x1
+	// *FormatCode values are written to PipeHeader.Format to indicate the
+	// layout of the data after the header. (See PipeFormat.)
 	RockstarFormatCode uint64 = 0xffffffff00000001
+	ArraysFormatCode uint64 = 0xffffffff00000002
+	PotentialFormatCode uint64 = 0xffffffff00000003
 
 	SupportedCompressionMethods = []string{ "LagrangianDelta" }
 	SupportedIDOrders = []string{ "ZUnigridPlusOne" }
@@ -39,6 +47,8 @@ type RockstarParticle struct {
 	X, V [3]float32
 }
 
+// PipeHeader is the header written before data when guppy pipes particles
+// to other programs.
 type PipeHeader struct {
     Version, Format uint64
     N, NTot int64
@@ -46,13 +56,24 @@ type PipeHeader struct {
     Z, OmegaM, OmegaL, H100, L, Mass float64
 }
 
+// WriteAsBytes writes a buffer to f using the system's byte order. This is the
+// format that guppy uses when piping data to other programs. buf must be
+// []uint32, []uint64, []float32, []float64, [][3]float32, [][3]float64, or
+// []RockstarParticle.
 func WriteAsBytes(f io.Writer, buf interface{}) error {
-	sysOrder := SystemByteOrder()
+	return WriteAsBytesOrder(f, SystemByteOrder(), buf)
+}
+
+// WriteAsBytesOrder is identical to WriteAsBytes, except that it writes buf
+// using the given byte order.
+func WriteAsBytesOrder(
+	f io.Writer, order binary.ByteOrder, buf interface{},
+) error {
 	switch x := buf.(type) {
-	case []uint32: return binary.Write(f, sysOrder, x)
-	case []uint64: return binary.Write(f, sysOrder, x)
-	case []float32: return binary.Write(f, sysOrder, x)
-	case []float64: return binary.Write(f, sysOrder, x)
+	case []uint32: return binary.Write(f, order, x)
+	case []uint64: return binary.Write(f, order, x)
+	case []float32: return binary.Write(f, order, x)
+	case []float64: return binary.Write(f, order, x)
 	case [][3]float32:
 		// Go uses the reflect package to write non-primitive data through
 		// the binary package. This is slow and makes tons of heap allocations.
@@ -62,7 +83,7 @@ func WriteAsBytes(f io.Writer, buf interface{}) error {
         hd.Cap *= 3
 
         f32x := *(*[]float32)(unsafe.Pointer(&hd))
-        err := binary.Write(f, sysOrder, f32x)
+        err := binary.Write(f, order, f32x)
 
         hd.Len /= 3
         hd.Cap /= 3
@@ -75,7 +96,7 @@ func WriteAsBytes(f io.Writer, buf interface{}) error {
         hd.Cap *= 3
 
         f64x := *(*[]float64)(unsafe.Pointer(&hd))
-        err := binary.Write(f, sysOrder, f64x)
+        err := binary.Write(f, order, f64x)
 
         hd.Len /= 3
         hd.Cap /= 3
@@ -83,6 +104,11 @@ func WriteAsBytes(f io.Writer, buf interface{}) error {
 		return err
 		
 	case []RockstarParticle:
+		if order != SystemByteOrder() {
+			_, err := f.Write(encodeRockstarParticles(order, x))
+			return err
+		}
+
 		particleSize := int(unsafe.Sizeof(RockstarParticle{ }))
 		
 		hd := *(*reflect.SliceHeader)(unsafe.Pointer(&x))
@@ -103,13 +129,24 @@ func WriteAsBytes(f io.Writer, buf interface{}) error {
 	panic("Internal error: unrecognized type of interal buffer.")
 }
 
+// ReadAsBytes reads a buffer written by WriteAsBytes from f. buf must be
+// []uint32, []uint64, []float32, []float64, [][3]float32, [][3]float64, or
+// []RockstarParticle and must already have the right length.
 func ReadAsBytes(f io.Reader, buf interface{}) error {
-	sysOrder := SystemByteOrder()
+	return ReadAsBytesOrder(f, SystemByteOrder(), buf)
+}
+
+// ReadAsBytesOrder is identical to ReadAsBytes, except that it reads buf
+// using the given byte order. This is needed if the data was written on a
+// machine with a different byte order. (See ReadPipeHeader.)
+func ReadAsBytesOrder(
+	f io.Reader, order binary.ByteOrder, buf interface{},
+) error {
 	switch x := buf.(type) {
-	case []uint32: return binary.Read(f, sysOrder, x)
-	case []uint64: return binary.Read(f, sysOrder, x)
-	case []float32: return binary.Read(f, sysOrder, x)
-	case []float64: return binary.Read(f, sysOrder, x)
+	case []uint32: return binary.Read(f, order, x)
+	case []uint64: return binary.Read(f, order, x)
+	case []float32: return binary.Read(f, order, x)
+	case []float64: return binary.Read(f, order, x)
 	case [][3]float32:
 		// Go uses the reflect package to write non-primitive data through
 		// the binary package. This is slow and makes tons of heap allocations.
@@ -119,7 +156,7 @@ func ReadAsBytes(f io.Reader, buf interface{}) error {
         hd.Cap *= 3
 
         f32x := *(*[]float32)(unsafe.Pointer(&hd))
-        err := binary.Read(f, sysOrder, f32x)
+        err := binary.Read(f, order, f32x)
 
         hd.Len /= 3
         hd.Cap /= 3
@@ -132,7 +169,7 @@ func ReadAsBytes(f io.Reader, buf interface{}) error {
         hd.Cap *= 3
 
         f64x := *(*[]float64)(unsafe.Pointer(&hd))
-        err := binary.Read(f, sysOrder, f64x)
+        err := binary.Read(f, order, f64x)
 
         hd.Len /= 3
         hd.Cap /= 3
@@ -140,6 +177,13 @@ func ReadAsBytes(f io.Reader, buf interface{}) error {
 		return err
 		
 	case []RockstarParticle:
+		if order != SystemByteOrder() {
+			b := make([]byte, rockstarParticleSize*len(x))
+			if _, err := io.ReadFull(f, b); err != nil { return err }
+			decodeRockstarParticles(order, b, x)
+			return nil
+		}
+
 		particleSize := int(unsafe.Sizeof(RockstarParticle{ }))
 		
 		hd := *(*reflect.SliceHeader)(unsafe.Pointer(&x))
@@ -160,6 +204,82 @@ func ReadAsBytes(f io.Reader, buf interface{}) error {
 	panic("Internal error: unrecognized type of interal buffer.")
 }
 
+// rockstarParticleSize is the number of bytes used by a RockstarParticle.
+const rockstarParticleSize = 32
+
+// encodeRockstarParticles converts particles to bytes using a byte order
+// other than the system's, which means they can't be cast directly.
+func encodeRockstarParticles(
+	order binary.ByteOrder, x []RockstarParticle,
+) []byte {
+	b := make([]byte, rockstarParticleSize*len(x))
+	for i := range x {
+		bi := b[i*rockstarParticleSize: (i+1)*rockstarParticleSize]
+		order.PutUint64(bi, x[i].ID)
+		for dim := 0; dim < 3; dim++ {
+			order.PutUint32(bi[8 + 4*dim:], math.Float32bits(x[i].X[dim]))
+			order.PutUint32(bi[20 + 4*dim:], math.Float32bits(x[i].V[dim]))
+		}
+	}
+	return b
+}
+
+// decodeRockstarParticles is the inverse of encodeRockstarParticles.
+func decodeRockstarParticles(
+	order binary.ByteOrder, b []byte, x []RockstarParticle,
+) {
+	for i := range x {
+		bi := b[i*rockstarParticleSize: (i+1)*rockstarParticleSize]
+		x[i].ID = order.Uint64(bi)
+		for dim := 0; dim < 3; dim++ {
+			x[i].X[dim] = math.Float32frombits(order.Uint32(bi[8 + 4*dim:]))
+			x[i].V[dim] = math.Float32frombits(order.Uint32(bi[20 + 4*dim:]))
+		}
+	}
+}
+
+// WritePipeHeader writes a PipeHeader to f using the given byte order.
+func WritePipeHeader(
+	f io.Writer, order binary.ByteOrder, hd *PipeHeader,
+) error {
+	return binary.Write(f, order, hd)
+}
+
+// ReadPipeHeader reads a PipeHeader written by WritePipeHeader and returns it
+// along with the byte order it was written in. The byte order is inferred
+// from the Version field, which is small enough to fit in the lower four
+// bytes.
+func ReadPipeHeader(f io.Reader) (*PipeHeader, binary.ByteOrder, error) {
+	b := make([]byte, binary.Size(PipeHeader{ }))
+	if _, err := io.ReadFull(f, b); err != nil { return nil, nil, err }
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint64(b) <= math.MaxUint32:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint64(b) <= math.MaxUint32:
+		order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("Could not read the header of the " +
+			"guppy pipe: its version number, %x, is not valid in either " +
+			"byte order. The data probably didn't come from guppy.",
+			binary.LittleEndian.Uint64(b))
+	}
+
+	hd := &PipeHeader{ }
+	err := binary.Read(bytes.NewReader(b), order, hd)
+	if err != nil { return nil, nil, err }
+
+	if hd.Version > Version {
+		return nil, nil, fmt.Errorf("The guppy pipe uses version %d of the " +
+			"pipe format, but this version of guppy only understands " +
+			"versions up to %d. You can download the latest version of " +
+			"guppy at github.com/phil-mansfield/guppy.", hd.Version, Version)
+	}
+
+	return hd, order, nil
+}
+
 func SystemByteOrder() binary.ByteOrder {
 	// See https://stackoverflow.com/questions/51332658/any-better-way-to-check-endianness-in-go/51332762
 	b := [2]byte{ }
@@ -174,6 +294,13 @@ func SystemByteOrder() binary.ByteOrder {
 func ExampleWriteConfig() string {
 	return `[write]
 
+# Include reads variables from another write config, which is useful when
+# many simulations share most of their settings. Variables set in this file
+# override the included file. Values can also use environment variables,
+# written as $NAME or ${NAME}, and 'guppy write --set Var=Value' overrides
+# variables from the command line.
+# Include = /path/to/base.config
+
 #######################
 # Compression Options #
 #######################
@@ -193,15 +320,47 @@ Types = v32, v32, u32
 
 # Accuracies tells guppy how accurately these variables should be stored. All
 # of these are done in guppy's code units: comoving Mpc/h for positions and
-# comoving km/s for velocities. (Other variables aren't supported yet.) For
-# integers, you must always set the accuracy to 0.
+# Gadget's km/s/sqrt(a) for velocities, i.e. the peculiar velocity divided by
+# sqrt(a). (Other variables aren't supported yet.) For integers, you must
+# always set the accuracy to 0.
 #
 # I /strongly suggest/ skimming the code paper, Mansfield & Abel (2021),
 # before choosing your accuracy levels, as we ran many tests on the impact of
 # different accuracy levels on halo properties and on the comrpession ratios
-# that different accuracies can achieve.
+# that different accuracies can achieve. guppy will warn you if your position
+# accuracy is coarser than 1/30 of the mean interparticle spacing.
 Accuracies = 0.001, 1, 0
 
+# AccuracyPreset can be used instead of Accuracies to have guppy choose the
+# accuracies of x and v for you from each snapshot's header. The presets are
+# conservative, fiducial, and aggressive. They set the position accuracy to
+# 0.1, 0.5, and 1 times the force softening, and the velocity accuracy to
+# 0.01, 0.05, and 0.2 times the circular velocity of a 100-particle halo
+# (defined using 200 times the mean matter density at that redshift). Integer
+# variables like id always have an accuracy of 0. Presets can only be used if
+# every non-integer variable is x or v.
+# AccuracyPreset = fiducial
+
+# ForceSoftening is your simulation's force softening length in comoving
+# Mpc/h, which is used by AccuracyPreset. If it isn't set, guppy assumes that
+# it's 1/40 of the mean interparticle spacing.
+# ForceSoftening = 0.001
+
+# AccuracyScaling lets Accuracies change with redshift. It has one scaling law
+# for each variable, which multiplies the corresponding Accuracy. Scaling laws
+# can be 1, a^p, or (1+z)^p, where a is the scale factor and p is any number,
+# so Accuracies are the accuracies at z = 0. a and z are read from the header
+# of each snapshot. For example, to store positions to a fixed physical
+# accuracy and velocities to an accuracy that grows like (1+z)^-0.5:
+# AccuracyScaling = a^-1, (1+z)^-0.5, 1
+
+# AccuracyTable can be used instead of Accuracies to read accuracies from a
+# text file. Each line of the file has a scale factor followed by the accuracy
+# of each variable, and lines must be in order of increasing scale factor.
+# Accuracies are interpolated linearly in a between lines, and snapshots
+# outside the range of the table are an error. '#' starts a comment.
+# AccuracyTable = accuracies.txt
+
 ###########################
 # Input/Output parameters #
 ###########################
@@ -214,8 +373,11 @@ Accuracies = 0.001, 1, 0
 # an inclusive range of numbers (e.g. 0..511). The example string below
 # would describe files that looked like /path/to/input/snapdir_015/snap_015.31,
 # with the first two numbers being the snapshot and the last one being the
-# index of the file in the snapshot.
-Input = /path/to/input/snapdir_{%03d,snaphot}/snap_{%03d,snapshot}.{%d,0..511}
+# index of the file in the snapshot. If the number of files changes from
+# snapshot to snapshot, you can use {%d,*} instead of a range, and guppy will
+# use every file on disk that matches, sorted numerically. Running
+# 'guppy write --check' reports how many files were found in each snapshot.
+Input = /path/to/input/snapdir_{%03d,snapshot}/snap_{%03d,snapshot}.{%d,0..511}
 
 # Output gives the location of the output files and is formatted identically
 # to Input. You should add an "output" variable somewhere to the file name
@@ -223,7 +385,7 @@ Input = /path/to/input/snapdir_{%03d,snaphot}/snap_{%03d,snapshot}.{%d,0..511}
 # a good idea to use the same naming scheme as your normal files, except with
 # '.gup' appended to the end of the files. The example string below would
 # describe files that looked like /path/to/output/snapdir_015/snap_015.31.gup.
-Output = /path/to/output/snapdir_{%03d,snaphot}/snap_{%03d,snapshot}.{%d,output}.gup
+Output = /path/to/output/snapdir_{%03d,snapshot}/snap_{%03d,snapshot}.{%d,output}.gup
 
 # Snaps lists the snapshots that you want to run guppy on. This is a
 # comma-separated list of either numbers or (inclusive) particle ranges written
@@ -232,6 +394,16 @@ Output = /path/to/output/snapdir_{%03d,snaphot}/snap_{%03d,snapshot}.{%d,output}
 # except for the corrupted snapshot 63, and then also on snapshot 200.
 Snaps = 0..100 - 63, 200
 
+# FormatVars declares extra variables that can be used in Input and Output,
+# written as name:value. A variable can have a single value, or one value for
+# each snapshot separated by '|' (starting at snapshot 0), or it can read one
+# value per line from a file with name:@/path/to/file. Values can be printed
+# with integer verbs, float verbs like %.4f, or %s, which prints the value
+# exactly as it's written here, e.g. 007 stays 007. With the example below,
+# Output could be /path/to/{%s,run}/snap_a{%.4f,a}.{%d,output}.gup. Input and
+# Output can also range over a list of strings, e.g. {%s,hr|lr}.
+# FormatVars = run:L0125, a:@/path/to/output_scale_factors.txt
+
 # OutputGridWdith is the width of the output grid of files in each dimension.
 # particles will be evenly distributed among OutputGridWidth^3 files.
 OutputGridWidth = 4
@@ -248,6 +420,12 @@ OutputGridWidth = 4
 # can usually catch when you're wrong and tell you.
 # ByteOrder = SystemOrder
 
+# SimulationName is the name of your simulation. It's stored in the metadata
+# of every output file, along with the values in this config file, the version
+# of guppy, and the force softening, so that files can be traced back to where
+# they came from.
+# SimulationName = Erebos_CBol_L125
+
 #####################
 # File Type Options #
 #####################
@@ -291,6 +469,16 @@ FileType = LGadget-2
 # will use one thread per core. I'd only suggest changing this if you're on a
 # shared machine without queueing and don't want to interfere with other jobs.
 # Threads = -1
+
+# MaxMemory limits the amount of memory guppy tries to use, e.g. 64GB or
+# 512MB. (Units are powers of 1024.) By default, guppy holds every particle in
+# a snapshot in memory at once. If that would use more than MaxMemory, guppy
+# splits each snapshot into several passes which each write a subset of the
+# output files, or a subset of the variables in one output file, re-reading
+# the input files in each pass. Set this a bit lower than the memory you
+# request from your job scheduler, since guppy's accounting is approximate.
+# Run guppy estimate to see how many passes a config file needs.
+# MaxMemory = 64GB
 `
 }
 
@@ -298,21 +486,37 @@ type WriteConfig struct {
 	CompressionMethod string
 	Vars, Types []string
 	Accuracies []float64
+	AccuracyPreset string
+	ForceSoftening float64
+	AccuracyScaling []string
+	AccuracyTable string
 	
 	Input, Output string
 	Snaps []string
+	FormatVars []string
 	OutputGridWidth int64
 	CreateMissingDirectories bool
 	ByteOrder string
+	SimulationName string
 	
 	FileType string
 	GadgetVars, GadgetTypes []string
 	IDOrder string
 
 	Threads int64
+	MaxMemory string
+
+	// ConfigText is the resolved config: every variable set by the config
+	// file, the files it includes, and the overrides, after environment
+	// variables have been expanded. It isn't a config variable.
+	ConfigText string
 }
 
-func ParseWriteConfig(configName string) (*WriteConfig, error) {
+// ParseWriteConfig parses a write config file. overrides are Var=Value
+// strings which override the values in the file.
+func ParseWriteConfig(
+	configName string, overrides ...string,
+) (*WriteConfig, error) {
 	cfg := &WriteConfig{ }
 	vars := config.NewConfigVars("write")
 	
@@ -320,13 +524,19 @@ func ParseWriteConfig(configName string) (*WriteConfig, error) {
 	vars.Strings(&cfg.Vars, "Vars", []string{})
 	vars.Strings(&cfg.Types, "Types", []string{})
 	vars.Floats(&cfg.Accuracies, "Accuracies", []float64{})
+	vars.String(&cfg.AccuracyPreset, "AccuracyPreset", "")
+	vars.Float(&cfg.ForceSoftening, "ForceSoftening", -1)
+	vars.Strings(&cfg.AccuracyScaling, "AccuracyScaling", []string{})
+	vars.String(&cfg.AccuracyTable, "AccuracyTable", "")
 	
 	vars.String(&cfg.Input, "Input", "")
 	vars.String(&cfg.Output, "Output", "")
 	vars.Strings(&cfg.Snaps, "Snaps", []string{})
+	vars.Strings(&cfg.FormatVars, "FormatVars", []string{})
 	vars.Int(&cfg.OutputGridWidth, "OutputGridWidth", -1)
 	vars.Bool(&cfg.CreateMissingDirectories, "CreateMissingDirectories", false)
 	vars.String(&cfg.ByteOrder, "ByteOrder", "SystemOrder")
+	vars.String(&cfg.SimulationName, "SimulationName", "")
 	
 	vars.String(&cfg.FileType, "FileType", "")
 	vars.Strings(&cfg.GadgetVars, "GadgetVars", []string{"x", "v", "id"})
@@ -334,13 +544,37 @@ func ParseWriteConfig(configName string) (*WriteConfig, error) {
 		[]string{"v32", "v32", "u32"})
 	vars.String(&cfg.IDOrder, "IDOrder", "ZUnigridPlusOne")
 	vars.Int(&cfg.Threads, "Threads", -1)
+	vars.String(&cfg.MaxMemory, "MaxMemory", "")
 	
 	err := config.ReadConfig(configName, vars)
 	if err != nil { return nil, err }
+	err = config.ReadOverrides(overrides, vars)
+	if err != nil { return nil, err }
+
+	cfg.ConfigText = vars.Text()
 
 	return cfg, nil
 }
 
+// OutputMetadata returns the metadata stored in the header of every output
+// file written from the snapshot with header hd: the simulation name, the
+// resolved config, the version of guppy, and the force softening. If
+// ForceSoftening isn't set, the softening is DefaultSofteningFraction of the
+// mean interparticle spacing.
+func OutputMetadata(cfg *WriteConfig, hd snapio.Header) compress.Metadata {
+	softening := cfg.ForceSoftening
+	if softening <= 0 {
+		softening = DefaultSofteningFraction * MeanSpacing(hd)
+	}
+
+	md := compress.Metadata{ }
+	md.SetString("Simulation", cfg.SimulationName)
+	md.SetString("Config", cfg.ConfigText)
+	md.SetInt("GuppyVersion", int64(Version))
+	md.SetFloat("Softening", softening)
+	return md
+}
+
 func CheckWriteConfig(cfg *WriteConfig) error {
 	// CompressionMethod
 	if cfg.CompressionMethod == "" {
@@ -357,8 +591,15 @@ func CheckWriteConfig(cfg *WriteConfig) error {
 		return fmt.Errorf("The Vars variable was not set.")
 	} else if len(cfg.Types) == 0 {
 		return fmt.Errorf("The Types variable was not set.")
+	} else if cfg.AccuracyPreset != "" || cfg.AccuracyTable != "" {
+		if len(cfg.Vars) != len(cfg.Types) {
+			return fmt.Errorf("Vars and Types should have the same length, " +
+				"but they have lengths %d and %d.", len(cfg.Vars),
+				len(cfg.Types))
+		}
 	} else if len(cfg.Accuracies) == 0 {
-		return fmt.Errorf("The Accuracies variable was not set.")
+		return fmt.Errorf("None of the Accuracies, AccuracyPreset, or " +
+			"AccuracyTable variables were set.")
 	} else if !sameLength([]int{len(cfg.Vars), len(cfg.Types),
 		len(cfg.Accuracies)}) {
 		return fmt.Errorf("Vars, Types, and Accuracies should all have the" +
@@ -370,9 +611,13 @@ func CheckWriteConfig(cfg *WriteConfig) error {
 		return fmt.Errorf("The Types variable, %s, has '%s' at index %d, " +
 			"but the only supported types are u32 u63, f32, f64, v32, and " +
 			"v64.", cfg.Types, cfg.Types[i], i)
-	} else if err := checkAccuracies(cfg.Vars, cfg.Types,
-		cfg.Accuracies); err != nil {
+	} else if err := checkAccuracyPreset(cfg); err != nil {
 		return err
+	} else if err := checkAccuracyScaling(cfg); err != nil {
+		return err
+	} else if cfg.AccuracyPreset == "" && cfg.AccuracyTable == "" {
+		err := checkAccuracies(cfg.Vars, cfg.Types, cfg.Accuracies)
+		if err != nil { return err }
 	}
 
 	// Input, Output, and Snaps
@@ -428,6 +673,12 @@ func CheckWriteConfig(cfg *WriteConfig) error {
 			"only valid values are -1 or a positive integer.", cfg.Threads)
 	}
 
+	// MaxMemory
+	if _, err := ParseMemory(cfg.MaxMemory); err != nil {
+		return fmt.Errorf("The MaxMemory variable was set to %s. %s",
+			cfg.MaxMemory, err.Error())
+	}
+
 	// ByteOrder
 	switch cfg.ByteOrder {
 	case "SystemOrder", "BigEndian", "LittleEndian":
@@ -460,15 +711,18 @@ func checkInputOutputSnaps(cfg *WriteConfig) error {
 	snaps, err := expandSnaps(cfg.Snaps)
 	if err != nil { return err }
 
+	formatVars, err := parseFormatVars(cfg.FormatVars, snaps)
+	if err != nil { return err }
+
 	end := len(snaps) - 1
 	testSnaps := []int{snaps[0], snaps[end / 2], snaps[end]}
 
 	for _, testSnap := range testSnaps {
-		inputs, err := format.ExpandFormatString(cfg.Input,
-			map[string]int{"snapshot": testSnap})
+		vals, _ := snapFormatVals(formatVars, testSnap)
+		inputs, err := format.ExpandFormatVars(cfg.Input, vals)
 		if err != nil {
-			fmt.Errorf("The Input variable, %s, could not be parsed. %s",
-				cfg.Input, err.Error())
+			return fmt.Errorf("The Input variable, %s, could not be " +
+				"parsed. %s", cfg.Input, err.Error())
 		}
 		
 		end := len(inputs) - 1
@@ -483,8 +737,8 @@ func checkInputOutputSnaps(cfg *WriteConfig) error {
 			}
 		}
 
-		outputMap := map[string]int{"snapshot": testSnap, "output": 0}
-		outputs, err :=  format.ExpandFormatString(cfg.Output, outputMap)
+		vals["output"] = 0
+		outputs, err :=  format.ExpandFormatVars(cfg.Output, vals)
 		if err != nil {
 			return fmt.Errorf("The Output variable, %s, could not be " +
 				"parsed. %s", cfg.Output, err.Error())
@@ -499,20 +753,51 @@ func checkInputOutputSnaps(cfg *WriteConfig) error {
 				"the directory %s, but this directory does not exist is " +
 				"not writable, or is a non-directory file. If the directory " +
 				"does not exist and you would like guppy to create it for " +
-				"you, rerun guppy with CreateMissingDirectories = true.")
+				"you, rerun guppy with CreateMissingDirectories = true.",
+				cfg.Output, path.Dir(outputs[0]))
 		}
 	}
 
 	return nil
 }
 
+// parseFormatVars parses the FormatVars variable of a config file and checks
+// that every variable has a value for each snapshot.
+func parseFormatVars(decls []string, snaps []int) (*format.NamedVars, error) {
+	formatVars, err := format.ParseNamedVars(decls)
+	if err != nil {
+		return nil, fmt.Errorf("The FormatVars variable, %s, could not be " +
+			"parsed. %s", decls, err.Error())
+	}
+
+	for _, snap := range snaps {
+		if _, err := formatVars.Vals(snap); err != nil {
+			return nil, fmt.Errorf("The FormatVars variable, %s, can't be " +
+				"used with the Snaps variable. %s", decls, err.Error())
+		}
+	}
+
+	return formatVars, nil
+}
+
+// snapFormatVals returns the values of the variables that can be used in
+// Input and Output for a given snapshot.
+func snapFormatVals(
+	formatVars *format.NamedVars, snap int,
+) (map[string]interface{}, error) {
+	vals, err := formatVars.Vals(snap)
+	if err != nil { return nil, err }
+	vals["snapshot"] = snap
+	return vals, nil
+}
+
 func fileAccessible(file string) bool {
 	_, err := os.Stat(file)
 	return err == nil
 }
 
 func parentDirWritable(file string) bool {
-	dir := path.Base(file)
+	dir := path.Dir(file)
 	_, err := os.Stat(dir)
 	if err != nil { return false }
 
@@ -600,8 +885,8 @@ func InputBuffers(hd snapio.Header, workers int) []*snapio.Buffer {
 	return out
 }
 
-func byteOrder(cfg *WriteConfig) binary.ByteOrder {
-	switch cfg.ByteOrder {
+func byteOrder(name string) binary.ByteOrder {
+	switch name {
 	case "LittleEndian":
 		return binary.LittleEndian
 	case "BigEndian":
@@ -609,8 +894,7 @@ func byteOrder(cfg *WriteConfig) binary.ByteOrder {
 	case "SystemOrder":
 		return SystemByteOrder()
 	}
-	panic(fmt.Sprintf("Internal error: unrecognized ByteOrder %s",
-		cfg.ByteOrder))
+	panic(fmt.Sprintf("Internal error: unrecognized ByteOrder %s", name))
 }
 
 
@@ -618,41 +902,54 @@ type OutputBuffer struct {
 	Buffer *compress.Buffer
 	B []byte
 	Writer *compress.Writer
+	// Bounds is the periodic bounding box of the positions in Writer. It's
+	// nil until they've been added.
+	Bounds []float32
 }
 
 func OutputBuffers(cfg *WriteConfig, workers int) []*OutputBuffer {
 	out := make([]*OutputBuffer, workers)
 	for i := range out {
-		out[i] = &OutputBuffer{ compress.NewBuffer(0), []byte{ }, nil }
+		out[i] = &OutputBuffer{ compress.NewBuffer(0), []byte{ }, nil, nil }
 	}
 	return out
 }
 
+// ExpandFileNames returns the snapshots in cfg along with the input and
+// output files in each snapshot. Input files found with {%d,*} rules are
+// discovered on disk.
 func ExpandFileNames(cfg *WriteConfig) (
-	snaps []int, inputs, outputs [][]string,
+	snaps []int, inputs, outputs [][]string, err error,
 ) {
-	snaps, err := expandSnaps(cfg.Snaps)
-	if err != nil { panic(fmt.Sprintf("Internal error: %s", err.Error())) }
+	snaps, err = expandSnaps(cfg.Snaps)
+	if err != nil { return nil, nil, nil, err }
+	formatVars, err := parseFormatVars(cfg.FormatVars, snaps)
+	if err != nil { return nil, nil, nil, err }
 
 	gw := cfg.OutputGridWidth
 	nOutputs := int(gw*gw*gw)
 	
 	inputs, outputs = [][]string{}, [][]string{}
 	for _, snap := range snaps {
-		inputMap := map[string]int{ "snap": snap }
-		snapInputs, err := format.ExpandFormatString(cfg.Input, inputMap)
-		if err != nil { panic(fmt.Sprintf("Internal error: %s", err.Error())) }
+		vals, _ := snapFormatVals(formatVars, snap)
+		snapInputs, err := format.ExpandFormatVars(cfg.Input, vals)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("The Input variable, %s, " +
+				"could not be expanded for snapshot %d. %s", cfg.Input, snap,
+				err.Error())
+		}
 
 		inputs = append(inputs, snapInputs)
 
 		snapOutputs := make([]string, nOutputs)
 		for i := 0; i < nOutputs; i++ {
-			outputMap := map[string]int{ "snap": snap, "output": i }
+			vals["output"] = i
 
-			iSnapOutputs, err := format.ExpandFormatString(
-				cfg.Output, outputMap)
+			iSnapOutputs, err := format.ExpandFormatVars(cfg.Output, vals)
 			if err != nil {
-				panic(fmt.Sprintf("Internal error: %s", err.Error()))
+				return nil, nil, nil, fmt.Errorf("The Output variable, %s, " +
+					"could not be expanded for snapshot %d. %s", cfg.Output,
+					snap, err.Error())
 			}
 			snapOutputs[i] = iSnapOutputs[0]
 		}
@@ -660,16 +957,40 @@ func ExpandFileNames(cfg *WriteConfig) (
 		outputs = append(outputs, snapOutputs)
 	}
 
-	return snaps, inputs, outputs
+	return snaps, inputs, outputs, nil
 }
 
-func GetSnapioHeader(cfg *WriteConfig, file string) (snapio.Header, error) {
+// InputCountSummary describes the number of input files in each snapshot.
+// Consecutive snapshots with the same number of files are grouped together.
+func InputCountSummary(snaps []int, inputs [][]string) string {
+	lines := []string{ }
+	for start := 0; start < len(snaps); {
+		end := start + 1
+		for end < len(snaps) && len(inputs[end]) == len(inputs[start]) {
+			end++
+		}
+
+		if end - start == 1 {
+			lines = append(lines, fmt.Sprintf("Snapshot %d: %d input files",
+				snaps[start], len(inputs[start])))
+		} else {
+			lines = append(lines, fmt.Sprintf("Snapshots %d to %d (%d " +
+				"snapshots): %d input files each", snaps[start],
+				snaps[end-1], end - start, len(inputs[start])))
+		}
+		start = end
+	}
+	return strings.Join(lines, "\n")
+}
+
+// OpenSnapioFile opens one of the input files specified by cfg.
+func OpenSnapioFile(cfg *WriteConfig, file string) (snapio.File, error) {
 	var(
 		err error
 		f snapio.File
 	)
 
-	order := byteOrder(cfg)
+	order := byteOrder(cfg.ByteOrder)
 
 	switch cfg.FileType {
 	case "Gadget-2":
@@ -678,11 +999,20 @@ func GetSnapioHeader(cfg *WriteConfig, file string) (snapio.Header, error) {
 	case "LGadget-2":
 		f, err = snapio.NewLGadget2(file, cfg.GadgetVars,
 			cfg.GadgetTypes, order)
+	default:
+		panic(fmt.Sprintf("Internal error: unrecognized FileType %s",
+			cfg.FileType))
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("Cannot read %s: %s", file, err.Error())
 	}
+	return f, nil
+}
+
+func GetSnapioHeader(cfg *WriteConfig, file string) (snapio.Header, error) {
+	f, err := OpenSnapioFile(cfg, file)
+	if err != nil { return nil, err }
 
 	hd, err := f.ReadHeader()
 	if err != nil {
@@ -691,6 +1021,39 @@ func GetSnapioHeader(cfg *WriteConfig, file string) (snapio.Header, error) {
 	return hd, nil
 }
 
+// SnapshotHeaders returns the header of the first input file of each
+// snapshot, which is used to find the snapshot's redshift.
+func SnapshotHeaders(
+	cfg *WriteConfig, inputs [][]string,
+) ([]snapio.Header, error) {
+	hds := make([]snapio.Header, len(inputs))
+	for i := range inputs {
+		if len(inputs[i]) == 0 {
+			return nil, fmt.Errorf("Snapshot index %d has no input files.", i)
+		}
+		hd, err := GetSnapioHeader(cfg, inputs[i][0])
+		if err != nil { return nil, err }
+		hds[i] = hd
+	}
+	return hds, nil
+}
+
+// NewIDOrder returns the IDOrder with the given name (e.g. the IDOrder
+// config variable) for a simulation with nTot particles.
+func NewIDOrder(name string, nTot int64) (particles.IDOrder, error) {
+	switch name {
+	case "ZUnigridPlusOne":
+		n := int64(math.Round(math.Cbrt(float64(nTot))))
+		if n*n*n != nTot {
+			return nil, fmt.Errorf("The IDOrder variable is set to %s, " +
+				"which requires the number of particles to be a perfect " +
+				"cube, but the simulation has %d particles.", name, nTot)
+		}
+		return particles.NewZMajorUnigridPlusOne(int(n)), nil
+	}
+	panic(fmt.Sprintf("Internal error: unrecognized IDOrder %s", name))
+}
+
 func RandomFileName(files [][]string) string {
 	i := rand.Intn(len(files))
 	j := rand.Intn(len(files[i]))
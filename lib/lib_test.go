@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/eq"
+)
+
+func TestPipeByteOrders(t *testing.T) {
+	n := 50
+	u32, u64 := make([]uint32, n), make([]uint64, n)
+	f32, f64 := make([]float32, n), make([]float64, n)
+	v32, v64 := make([][3]float32, n), make([][3]float64, n)
+	rs := make([]RockstarParticle, n)
+	for i := 0; i < n; i++ {
+		u32[i], u64[i] = rand.Uint32(), rand.Uint64()
+		f32[i], f64[i] = rand.Float32(), rand.Float64()
+		rs[i].ID = rand.Uint64()
+		for dim := 0; dim < 3; dim++ {
+			v32[i][dim], v64[i][dim] = rand.Float32(), rand.Float64()
+			rs[i].X[dim], rs[i].V[dim] = rand.Float32(), rand.Float32()
+		}
+	}
+	bufs := []interface{}{ u32, u64, f32, f64, v32, v64, rs }
+
+	hd := &PipeHeader{
+		Version, RockstarFormatCode, int64(n), 1000,
+		[3]int64{1, 2, 3}, [3]int64{4, 5, 6}, [3]int64{10, 10, 10},
+		0.5, 0.27, 0.73, 0.7, 125.0, 1e9,
+	}
+
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	for _, order := range orders {
+		b := &bytes.Buffer{ }
+		if err := WritePipeHeader(b, order, hd); err != nil {
+			t.Fatalf("%s) Error in WritePipeHeader(): %s", order, err.Error())
+		}
+		for i := range bufs {
+			if err := WriteAsBytesOrder(b, order, bufs[i]); err != nil {
+				t.Fatalf("%s) Error in WriteAsBytesOrder(): %s",
+					order, err.Error())
+			}
+		}
+
+		hdOut, orderOut, err := ReadPipeHeader(b)
+		if err != nil {
+			t.Fatalf("%s) Error in ReadPipeHeader(): %s", order, err.Error())
+		} else if orderOut != order {
+			t.Errorf("%s) ReadPipeHeader() found byte order %s.",
+				order, orderOut)
+		} else if *hdOut != *hd {
+			t.Errorf("%s) Wrote header %v, but read %v.", order, hd, hdOut)
+		}
+
+		u32Out, u64Out := make([]uint32, n), make([]uint64, n)
+		f32Out, f64Out := make([]float32, n), make([]float64, n)
+		v32Out, v64Out := make([][3]float32, n), make([][3]float64, n)
+		rsOut := make([]RockstarParticle, n)
+		bufsOut := []interface{}{
+			u32Out, u64Out, f32Out, f64Out, v32Out, v64Out, rsOut,
+		}
+		for i := range bufsOut {
+			if err := ReadAsBytesOrder(b, orderOut, bufsOut[i]); err != nil {
+				t.Fatalf("%s) Error in ReadAsBytesOrder(): %s",
+					order, err.Error())
+			}
+		}
+
+		if b.Len() != 0 {
+			t.Errorf("%s) %d bytes left unread.", order, b.Len())
+		}
+		for i := range bufs[:4] {
+			if !eq.Generic(bufs[i], bufsOut[i]) {
+				t.Errorf("%s) Buffer %d was %v, but read as %v.",
+					order, i, bufs[i], bufsOut[i])
+			}
+		}
+		for i := 0; i < n; i++ {
+			if v32[i] != v32Out[i] || v64[i] != v64Out[i] || rs[i] != rsOut[i] {
+				t.Errorf("%s) Vector or particle %d read incorrectly.",
+					order, i)
+				break
+			}
+		}
+	}
+}
+
+func TestRockstarParticleEncoding(t *testing.T) {
+	// The byte-swapping path needs to produce the same layout as the direct
+	// memory cast used for the system's byte order.
+	rs := []RockstarParticle{
+		{ 0x0102030405060708, [3]float32{1, 2, 3}, [3]float32{-1, -2, -3} },
+		{ 42, [3]float32{0.5, 0.25, 0.125}, [3]float32{100, 200, 300} },
+	}
+
+	b := &bytes.Buffer{ }
+	if err := WriteAsBytes(b, rs); err != nil {
+		t.Fatalf("Error in WriteAsBytes(): %s", err.Error())
+	}
+
+	encoded := encodeRockstarParticles(SystemByteOrder(), rs)
+	if !eq.Bytes(b.Bytes(), encoded) {
+		t.Errorf("System-order particles written as %x, but encoded as %x.",
+			b.Bytes(), encoded)
+	}
+}
+
+func TestExpandFileNamesGlob(t *testing.T) {
+	dir := t.TempDir()
+	nFiles := []int{ 3, 3, 2 }
+	for snap := range nFiles {
+		for i := 0; i < nFiles[snap]; i++ {
+			fname := filepath.Join(dir, fmt.Sprintf("snap_%d.%d", snap, i))
+			if err := os.WriteFile(fname, []byte{ }, 0644); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+
+	cfg := &WriteConfig{
+		Input: filepath.Join(dir, "snap_{%d,snapshot}.{%d,*}"),
+		Output: filepath.Join(dir, "snap_{%d,snapshot}.{%d,output}.gup"),
+		Snaps: []string{ "0..2" }, OutputGridWidth: 1,
+	}
+	snaps, inputs, outputs, err := ExpandFileNames(cfg)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	for snap := range nFiles {
+		if len(inputs[snap]) != nFiles[snap] || len(outputs[snap]) != 1 {
+			t.Errorf("Expected %d inputs and 1 output in snapshot %d, got " +
+				"%d and %d.", nFiles[snap], snap, len(inputs[snap]),
+				len(outputs[snap]))
+		}
+	}
+
+	exp := "Snapshots 0 to 1 (2 snapshots): 3 input files each\n" +
+		"Snapshot 2: 2 input files"
+	if summary := InputCountSummary(snaps, inputs); summary != exp {
+		t.Errorf("Expected InputCountSummary() = '%s', got '%s'.",
+			exp, summary)
+	}
+
+	cfg.Snaps = []string{ "0..3" }
+	if _, _, _, err = ExpandFileNames(cfg); err == nil {
+		t.Errorf("Expected error for a snapshot without any files.")
+	}
+}
+
+func TestParseWriteConfigText(t *testing.T) {
+	os.Setenv("GUPPY_TEST_DIR", "/data/box1")
+	defer os.Unsetenv("GUPPY_TEST_DIR")
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.config": "[write]\nVars = x, v\nThreads = 4\n",
+		"write.config": "[write]\nInclude = base.config\n" +
+			"Output = $GUPPY_TEST_DIR/{%d,output}.gup # comment\n",
+	}
+	for name, text := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644)
+		if err != nil { t.Fatalf(err.Error()) }
+	}
+
+	cfg, err := ParseWriteConfig(filepath.Join(dir, "write.config"),
+		"Threads=8")
+	if err != nil { t.Fatalf(err.Error()) }
+
+	// The stored config contains every value that was actually used.
+	exp := "[write]\nVars = x, v\nThreads = 8\n" +
+		"Output = /data/box1/{%d,output}.gup\n"
+	if cfg.ConfigText != exp {
+		t.Errorf("Expected ConfigText = %q, got %q.", exp, cfg.ConfigText)
+	}
+}
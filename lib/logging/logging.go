@@ -0,0 +1,372 @@
+/*package logging writes structured log records for guppy's long-running
+modes, like guppy write and guppy read. Each record has a time, the mode that
+wrote it, an event name, and a list of key-value fields. Records can either be
+written as text, with one "key=value" list per line, or as JSON, with one
+object per line, which is easier for scripts to follow.
+
+Progress tracks the files that a mode has finished and estimates how much
+longer the rest will take. It can also write a periodic progress line, which
+is driven by a thread.Counter shared with the mode's worker queues.*/
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phil-mansfield/guppy/lib/thread"
+)
+
+// Format is the format that log records are written in.
+type Format int
+const (
+	Text Format = iota
+	JSON
+)
+
+// ParseFormat parses the name of a Format, "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text": return Text, nil
+	case "json": return JSON, nil
+	}
+	return Text, fmt.Errorf("'%s' isn't a valid log format. It should be " +
+		"either 'text' or 'json'.", s)
+}
+
+// Logger writes log records to an io.Writer. It can be used by multiple
+// threads at once. A nil Logger doesn't write anything.
+type Logger struct {
+	mu sync.Mutex
+	w io.Writer
+	format Format
+	mode string
+	// now returns the current time. It can be replaced during tests.
+	now func() time.Time
+}
+
+// New returns a Logger which writes records for the given mode to w.
+func New(w io.Writer, format Format, mode string) *Logger {
+	return &Logger{ w: w, format: format, mode: mode, now: time.Now }
+}
+
+// Log writes a record for an event. kv is a list of alternating keys and
+// values. Durations are written in seconds in JSON records.
+func (l *Logger) Log(event string, kv ...interface{}) {
+	if l == nil { return }
+	if len(kv) % 2 != 0 {
+		panic(fmt.Sprintf("Internal error: odd number of key-value " +
+			"arguments passed to Log(%s).", event))
+	}
+
+	t := l.now().UTC().Format(time.RFC3339)
+
+	var line string
+	switch l.format {
+	case Text: line = l.textLine(t, event, kv)
+	case JSON: line = l.jsonLine(t, event, kv)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// There's nowhere to report a failed log write, so it's ignored.
+	io.WriteString(l.w, line)
+}
+
+func (l *Logger) textLine(t, event string, kv []interface{}) string {
+	sb := &strings.Builder{ }
+	fmt.Fprintf(sb, "%s %s %s", t, l.mode, event)
+	for i := 0; i < len(kv); i += 2 {
+		fmt.Fprintf(sb, " %v=%s", kv[i], textValue(kv[i+1]))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func (l *Logger) jsonLine(t, event string, kv []interface{}) string {
+	// The fields are written by hand so they stay in the order they were
+	// given.
+	sb := &strings.Builder{ }
+	fmt.Fprintf(sb, `{"time":%s,"mode":%s,"event":%s`, jsonValue(t),
+		jsonValue(l.mode), jsonValue(event))
+	for i := 0; i < len(kv); i += 2 {
+		fmt.Fprintf(sb, ",%s:%s", jsonValue(fmt.Sprint(kv[i])),
+			jsonValue(kv[i+1]))
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// textValue formats a value in a text record.
+func textValue(x interface{}) string {
+	switch v := x.(type) {
+	case time.Duration: return textDuration(v)
+	case float64: return strconv.FormatFloat(v, 'g', 4, 64)
+	case string:
+		if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+			return strconv.Quote(v)
+		}
+		return v
+	}
+	return fmt.Sprint(x)
+}
+
+// jsonValue formats a value in a JSON record.
+func jsonValue(x interface{}) string {
+	switch v := x.(type) {
+	case time.Duration: x = v.Seconds()
+	case error: x = v.Error()
+	}
+	if f, ok := x.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+		return "null"
+	}
+
+	b, err := json.Marshal(x)
+	if err != nil { return strconv.Quote(fmt.Sprint(x)) }
+	return string(b)
+}
+
+// textDuration rounds a duration so it's easy to read. Per-file times can
+// be much shorter than a second, so they keep a few significant digits.
+func textDuration(t time.Duration) string {
+	switch {
+	case t >= time.Minute: return t.Round(time.Second).String()
+	case t >= time.Second: return t.Round(time.Millisecond).String()
+	}
+	return t.Round(time.Microsecond).String()
+}
+
+// ParseJSON parses a log written in the JSON format, returning one map per
+// record. As with any JSON object, a field with the same key as an earlier
+// one, like "time", replaces it.
+func ParseJSON(log string) ([]map[string]interface{}, error) {
+	out := []map[string]interface{}{ }
+	for _, line := range logLines(log) {
+		rec := map[string]interface{}{ }
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, fmt.Errorf("Could not parse the log line %q: %s",
+				line, err.Error())
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// ParseText parses a log written in the text format, returning one map per
+// record. The time, mode, and event are stored under the keys "time",
+// "mode", and "event", and quoted values are unquoted. Like in ParseJSON, a
+// field with the same key as an earlier one replaces it.
+func ParseText(log string) ([]map[string]string, error) {
+	out := []map[string]string{ }
+	for _, line := range logLines(log) {
+		err := fmt.Errorf("Could not parse the log line %q.", line)
+		tok := strings.SplitN(line, " ", 4)
+		if len(tok) < 3 { return nil, err }
+
+		rec := map[string]string{
+			"time": tok[0], "mode": tok[1], "event": tok[2],
+		}
+		rest := ""
+		if len(tok) == 4 { rest = tok[3] }
+
+		for rest = strings.TrimLeft(rest, " "); rest != ""; {
+			i := strings.Index(rest, "=")
+			if i <= 0 { return nil, err }
+			key, val := rest[:i], rest[i+1:]
+
+			if strings.HasPrefix(val, "\"") {
+				quoted, qErr := strconv.QuotedPrefix(val)
+				if qErr != nil { return nil, err }
+				rest = val[len(quoted):]
+				val, _ = strconv.Unquote(quoted)
+			} else if j := strings.Index(val, " "); j >= 0 {
+				val, rest = val[:j], val[j:]
+			} else {
+				rest = ""
+			}
+
+			rec[key] = val
+			if rest != "" && rest[0] != ' ' { return nil, err }
+			rest = strings.TrimLeft(rest, " ")
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// logLines returns the non-empty lines of a log.
+func logLines(log string) []string {
+	out := []string{ }
+	for _, line := range strings.Split(log, "\n") {
+		if strings.TrimSpace(line) != "" { out = append(out, line) }
+	}
+	return out
+}
+
+// FileStats are the timings and sizes of a single file processed by a mode.
+// Times and sizes which are zero aren't logged.
+type FileStats struct {
+	File string
+	// ReadTime, CompressTime, and WriteTime are the time spent reading,
+	// compressing (or decompressing), and writing the file's data.
+	ReadTime, CompressTime, WriteTime time.Duration
+	// BytesIn and BytesOut are the sizes of the data before and after the
+	// file was processed.
+	BytesIn, BytesOut int64
+	// Decompressed is true if the file was decompressed, so BytesIn is the
+	// compressed size and BytesOut is the uncompressed size.
+	Decompressed bool
+}
+
+// Ratio returns the compression ratio: the uncompressed size divided by the
+// compressed size. It's zero if either isn't known.
+func (s *FileStats) Ratio() float64 {
+	if s.BytesIn <= 0 || s.BytesOut <= 0 { return 0 }
+	if s.Decompressed { return float64(s.BytesOut) / float64(s.BytesIn) }
+	return float64(s.BytesIn) / float64(s.BytesOut)
+}
+
+// Fields returns the file name and non-zero statistics as key-value pairs
+// which can be passed to Log. The name is skipped if it's empty.
+func (s *FileStats) Fields() []interface{} {
+	kv := []interface{}{ }
+	if s.File != "" { kv = append(kv, "file", s.File) }
+	times := []time.Duration{ s.ReadTime, s.CompressTime, s.WriteTime }
+	timeNames := []string{ "read_time", "compress_time", "write_time" }
+	for i := range times {
+		if times[i] > 0 { kv = append(kv, timeNames[i], times[i]) }
+	}
+	if s.BytesIn > 0 { kv = append(kv, "bytes_in", s.BytesIn) }
+	if s.BytesOut > 0 { kv = append(kv, "bytes_out", s.BytesOut) }
+	if ratio := s.Ratio(); ratio > 0 { kv = append(kv, "ratio", ratio) }
+	return kv
+}
+
+// Progress tracks a mode's progress through its jobs. Counter should be
+// passed to the thread.CountedWorkerQueue calls which run the jobs, or
+// updated with Counter.Finish() for jobs run outside of them.
+type Progress struct {
+	Counter *thread.Counter
+	log *Logger
+	start time.Time
+
+	mu sync.Mutex
+	files, bytesIn, bytesOut int64
+	// ratio is the total size of the files whose compression ratio is
+	// known.
+	ratio FileStats
+
+	stop, stopped chan bool
+}
+
+// NewProgress starts tracking the progress of the given number of jobs. l
+// may be nil, in which case nothing is logged.
+func NewProgress(l *Logger, jobs int) *Progress {
+	p := &Progress{ Counter: thread.NewCounter(jobs), log: l }
+	p.start = p.now()
+	return p
+}
+
+func (p *Progress) now() time.Time {
+	if p.log == nil { return time.Now() }
+	return p.log.now()
+}
+
+// ETA estimates the time until every job is finished from the average time
+// taken by the finished jobs. ok is false if no jobs have finished yet.
+func (p *Progress) ETA() (eta time.Duration, ok bool) {
+	return p.eta(p.Counter.Finished())
+}
+
+// eta estimates the time until every job is finished if done jobs have
+// finished.
+func (p *Progress) eta(done int64) (eta time.Duration, ok bool) {
+	jobs := p.Counter.Jobs()
+	if done == 0 { return 0, false }
+	if done >= jobs { return 0, true }
+
+	elapsed := p.now().Sub(p.start)
+	return time.Duration(float64(elapsed) * float64(jobs - done) /
+		float64(done)), true
+}
+
+// File logs the statistics of a finished file as a "file" event, followed
+// by the fields in kv and the ETA. Each job should log one file. Files are
+// often logged from inside jobs that Counter hasn't recorded yet, so the
+// ETA is found from the number of logged files instead.
+func (p *Progress) File(stats *FileStats, kv ...interface{}) {
+	p.mu.Lock()
+	p.files++
+	p.bytesIn += stats.BytesIn
+	p.bytesOut += stats.BytesOut
+	if stats.Ratio() > 0 {
+		p.ratio.BytesIn += stats.BytesIn
+		p.ratio.BytesOut += stats.BytesOut
+		p.ratio.Decompressed = stats.Decompressed
+	}
+	files := p.files
+	p.mu.Unlock()
+
+	fields := append(stats.Fields(), kv...)
+	if eta, ok := p.eta(files); ok { fields = append(fields, "eta", eta) }
+	p.log.Log("file", fields...)
+}
+
+// Start writes a "progress" event every interval until Stop is called. It
+// does nothing if interval isn't positive.
+func (p *Progress) Start(interval time.Duration) {
+	if interval <= 0 || p.log == nil || p.stop != nil { return }
+	p.stop, p.stopped = make(chan bool), make(chan bool)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.log.Log("progress", p.fields()...)
+			case <-p.stop:
+				p.stopped <- true
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the progress events started by Start and logs a "finish" event
+// summarizing every file.
+func (p *Progress) Stop() {
+	if p.stop != nil {
+		p.stop <- true
+		<-p.stopped
+		p.stop = nil
+	}
+	p.log.Log("finish", p.fields()...)
+}
+
+// fields returns the key-value pairs of a progress or finish event.
+func (p *Progress) fields() []interface{} {
+	done, jobs := p.Counter.Finished(), p.Counter.Jobs()
+	percent := 100.0
+	if jobs > 0 { percent = 100 * float64(done) / float64(jobs) }
+
+	p.mu.Lock()
+	files, bytesIn, bytesOut := p.files, p.bytesIn, p.bytesOut
+	ratio := p.ratio.Ratio()
+	p.mu.Unlock()
+
+	kv := []interface{}{
+		"done", done, "jobs", jobs, "percent", percent,
+		"elapsed", p.now().Sub(p.start), "files", files,
+	}
+	if bytesIn > 0 { kv = append(kv, "bytes_in", bytesIn) }
+	if bytesOut > 0 { kv = append(kv, "bytes_out", bytesOut) }
+	if ratio > 0 { kv = append(kv, "ratio", ratio) }
+	if eta, ok := p.ETA(); ok && done < jobs { kv = append(kv, "eta", eta) }
+	return kv
+}
@@ -0,0 +1,207 @@
+package logging
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger returns a Logger which writes to a buffer and whose clock only
+// moves when the returned pointer is changed.
+func testLogger(format Format) (*Logger, *bytes.Buffer, *time.Time) {
+	buf := &bytes.Buffer{ }
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := New(buf, format, "write")
+	l.now = func() time.Time { return now }
+	return l, buf, &now
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct{
+		s string
+		format Format
+		valid bool
+	} {
+		{ "text", Text, true },
+		{ "JSON", JSON, true },
+		{ "", Text, false },
+		{ "xml", Text, false },
+	}
+
+	for i := range tests {
+		format, err := ParseFormat(tests[i].s)
+		if tests[i].valid != (err == nil) {
+			t.Errorf("%d) Expected valid = %v for ParseFormat(%q), got %v.",
+				i, tests[i].valid, tests[i].s, err == nil)
+		} else if format != tests[i].format {
+			t.Errorf("%d) Expected ParseFormat(%q) = %d, got %d.",
+				i, tests[i].s, tests[i].format, format)
+		}
+	}
+}
+
+func TestLogText(t *testing.T) {
+	l, buf, _ := testLogger(Text)
+	l.Log("file", "file", "snap.0.gup", "time", 1500*time.Millisecond,
+		"ratio", 3.14159, "n", 10, "msg", "two words")
+
+	exp := "2026-01-02T03:04:05Z write file file=snap.0.gup time=1.5s " +
+		"ratio=3.142 n=10 msg=\"two words\"\n"
+	if buf.String() != exp {
+		t.Errorf("Expected %q, got %q.", exp, buf.String())
+	}
+
+	var nilLogger *Logger
+	nilLogger.Log("file", "n", 1)
+
+	recs, err := ParseText(buf.String())
+	if err != nil { t.Fatalf(err.Error()) }
+	expRec := map[string]string{
+		"time": "1.5s", "mode": "write", "event": "file",
+		"file": "snap.0.gup", "ratio": "3.142", "n": "10", "msg": "two words",
+	}
+	if len(recs) != 1 || !reflect.DeepEqual(recs[0], expRec) {
+		t.Errorf("Expected ParseText() = [%v], got %v.", expRec, recs)
+	}
+}
+
+func TestParseText(t *testing.T) {
+	invalid := []string{
+		"2026-01-02T03:04:05Z write\n",
+		"2026-01-02T03:04:05Z write file n\n",
+		"2026-01-02T03:04:05Z write file =1\n",
+		"2026-01-02T03:04:05Z write file msg=\"unterminated\n",
+		"2026-01-02T03:04:05Z write file msg=\"a\"b\n",
+	}
+	for i := range invalid {
+		if _, err := ParseText(invalid[i]); err == nil {
+			t.Errorf("%d) Expected error for %q.", i, invalid[i])
+		}
+	}
+
+	recs, err := ParseText("\n2026-01-02T03:04:05Z read finish\n\n")
+	if err != nil { t.Fatalf(err.Error()) }
+	if len(recs) != 1 || len(recs[0]) != 3 || recs[0]["event"] != "finish" {
+		t.Errorf("Expected one record without fields, got %v.", recs)
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	l, buf, _ := testLogger(JSON)
+	l.Log("file", "file", "snap.0.gup", "time", 1500*time.Millisecond,
+		"n", 10)
+	l.Log("finish")
+
+	exp := `{"time":"2026-01-02T03:04:05Z","mode":"write","event":"file",` +
+		`"file":"snap.0.gup","time":1.5,"n":10}` + "\n" +
+		`{"time":"2026-01-02T03:04:05Z","mode":"write","event":"finish"}` +
+		"\n"
+	if buf.String() != exp {
+		t.Errorf("Expected %q, got %q.", exp, buf.String())
+	}
+
+	recs, err := ParseJSON(buf.String())
+	if err != nil { t.Fatalf(err.Error()) }
+	if len(recs) != 2 || recs[0]["time"] != 1.5 || recs[0]["n"] != 10.0 ||
+		recs[1]["event"] != "finish" {
+		t.Errorf("ParseJSON() returned %v.", recs)
+	}
+	if _, err := ParseJSON(exp + "{\n"); err == nil {
+		t.Errorf("Expected error for a malformed JSON record.")
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	s := &FileStats{ File: "a.gup", CompressTime: time.Second,
+		BytesIn: 400, BytesOut: 100 }
+	if s.Ratio() != 4 {
+		t.Errorf("Expected Ratio() = 4, got %g.", s.Ratio())
+	}
+
+	kv := s.Fields()
+	exp := []interface{}{ "file", "a.gup", "compress_time", time.Second,
+		"bytes_in", int64(400), "bytes_out", int64(100), "ratio", 4.0 }
+	if len(kv) != len(exp) {
+		t.Fatalf("Expected Fields() = %v, got %v.", exp, kv)
+	}
+	for i := range exp {
+		if kv[i] != exp[i] {
+			t.Errorf("Expected Fields() = %v, got %v.", exp, kv)
+			break
+		}
+	}
+
+	s.Decompressed = true
+	if s.Ratio() != 0.25 {
+		t.Errorf("Expected Ratio() = 0.25 after decompressing, got %g.",
+			s.Ratio())
+	}
+
+	empty := &FileStats{ }
+	if len(empty.Fields()) != 0 || empty.Ratio() != 0 {
+		t.Errorf("Expected empty FileStats to have no fields and a ratio " +
+			"of 0, got %v and %g.", empty.Fields(), empty.Ratio())
+	}
+}
+
+func TestProgress(t *testing.T) {
+	l, buf, now := testLogger(Text)
+	p := NewProgress(l, 4)
+
+	if _, ok := p.ETA(); ok {
+		t.Errorf("Expected no ETA before any jobs finished.")
+	}
+
+	*now = now.Add(10*time.Second)
+	p.Counter.Finish()
+	p.File(&FileStats{ File: "a", BytesIn: 300, BytesOut: 100 })
+
+	if eta, ok := p.ETA(); !ok || eta != 30*time.Second {
+		t.Errorf("Expected an ETA of 30s after 1 of 4 jobs, got %s.", eta)
+	}
+
+	p.Counter.Finish()
+	p.File(&FileStats{ File: "b", BytesIn: 100, BytesOut: 100 })
+	// Files whose compressed size isn't known don't change the ratio.
+	p.File(&FileStats{ File: "c", BytesOut: 100 })
+	p.Stop()
+
+	exp := "2026-01-02T03:04:15Z write file file=a bytes_in=300 " +
+		"bytes_out=100 ratio=3 eta=30s\n" +
+		"2026-01-02T03:04:15Z write file file=b bytes_in=100 " +
+		"bytes_out=100 ratio=1 eta=10s\n" +
+		"2026-01-02T03:04:15Z write file file=c bytes_out=100 " +
+		"eta=3.333s\n" +
+		"2026-01-02T03:04:15Z write finish done=2 jobs=4 percent=50 " +
+		"elapsed=10s files=3 bytes_in=400 bytes_out=300 ratio=2 eta=10s\n"
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%s\ngot:\n%s", exp, buf.String())
+	}
+}
+
+func TestProgressStart(t *testing.T) {
+	buf := &bytes.Buffer{ }
+	l := New(buf, Text, "read")
+	p := NewProgress(l, 2)
+
+	p.Start(time.Millisecond)
+	time.Sleep(20*time.Millisecond)
+	p.Counter.Finish()
+	p.Counter.Finish()
+	p.Stop()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Expected progress events before finish, got %q.",
+			buf.String())
+	}
+	if !strings.Contains(lines[0], " read progress done=0 jobs=2 ") {
+		t.Errorf("Expected a progress event, got %q.", lines[0])
+	}
+	last := lines[len(lines) - 1]
+	if !strings.Contains(last, " read finish done=2 jobs=2 percent=100 ") {
+		t.Errorf("Expected a finish event, got %q.", last)
+	}
+}
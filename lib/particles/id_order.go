@@ -26,6 +26,7 @@ type IDOrder interface {
 // Type assertions
 var (
 	_ IDOrder = &ZMajorUnigrid{ }
+	_ IDOrder = &ZMajorUnigridPlusOne{ }
 )
 
 // ZMajorUnigrid is the IDOrder of a z-major uniform-mass grid. This is the
@@ -68,3 +69,25 @@ func (g *ZMajorUnigrid) LevelSpan(level int) [3]int {
 }
 
 func (g *ZMajorUnigrid) NTot() int64 { return int64(g.n64*g.n64*g.n64) }
+
+// ZMajorUnigridPlusOne is identical to ZMajorUnigrid, except that IDs start
+// at 1 instead of 0. This is the convention used by Gadget-2 and most of the
+// codes that generate initial conditions for it. See the IDOrder interface
+// for documentation of the methods.
+type ZMajorUnigridPlusOne struct {
+	ZMajorUnigrid
+}
+
+// NewZMajorUnigridPlusOne returns a z-major uniform density grid with width n
+// on each side whose IDs start at 1.
+func NewZMajorUnigridPlusOne(n int) *ZMajorUnigridPlusOne {
+	return &ZMajorUnigridPlusOne{ ZMajorUnigrid{ n, uint64(n) } }
+}
+
+func (g *ZMajorUnigridPlusOne) IDToIndex(id uint64) (idx [3]int, level int) {
+	return g.ZMajorUnigrid.IDToIndex(id - 1)
+}
+
+func (g *ZMajorUnigridPlusOne) IndexToID(i [3]int, level int) uint64 {
+	return g.ZMajorUnigrid.IndexToID(i, level) + 1
+}
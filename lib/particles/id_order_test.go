@@ -43,3 +43,36 @@ func TestZMajorUnigridIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestZMajorUnigridPlusOneIndex(t *testing.T) {
+	n := 10
+	order := NewZMajorUnigridPlusOne(n)
+	tests := []struct{
+		idx [3]int
+		id uint64
+	} {
+		{[3]int{0, 0, 0}, 1},
+		{[3]int{9, 9, 9}, 1000},
+		{[3]int{1, 1, 1}, 112},
+		{[3]int{3, 2, 1}, 322},
+	}
+
+	for i := range tests {
+		id := order.IndexToID(tests[i].idx, 0)
+		idx, level := order.IDToIndex(tests[i].id)
+		if level != 0 {
+			t.Errorf("%d) Expected id %d to have level %d, got %d",
+				i, tests[i].id, 0, level)
+		} else if id != tests[i].id {
+			t.Errorf("%d) Expected index %d to have id %d, got %d.",
+				i, tests[i].idx, tests[i].id, id)
+		} else if idx != tests[i].idx {
+			t.Errorf("%d) Expected id %d to have index %d, got %d.",
+				i, tests[i].id, tests[i].idx, idx)
+		}
+	}
+
+	if nTot := order.NTot(); nTot != 1000 {
+		t.Errorf("Expected order.NTot() = 1000, got %d.", nTot)
+	}
+}
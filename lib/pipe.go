@@ -0,0 +1,381 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// PipeFormat is a layout for the particle data written after a PipeHeader
+// when particles are piped between guppy and other programs. Each format has
+// its own code, which is written to PipeHeader.Format so that the reader can
+// check that it's getting the layout it expects. All values are written in
+// the byte order of the PipeHeader.
+//
+// The built-in formats are:
+//
+// "rockstar" (RockstarFormatCode): N 32-byte RockstarParticle structs, each
+// containing id (uint64), x (3 float32), and v (3 float32).
+//
+// "arrays" (ArraysFormatCode): one contiguous array of N values for each
+// requested variable, in the order the variables were requested. Vectors are
+// written as N groups of three components. This is the same layout that
+// "guppy read" writes to stdout.
+//
+// "potential" (PotentialFormatCode): N 40-byte PotentialParticle structs,
+// each containing id (uint64), x (3 float32), v (3 float32), phi (float32),
+// and four bytes of zero padding. This matches the layout C compilers use for
+// the equivalent struct.
+type PipeFormat interface {
+	// Name returns the name used to select the format in config files.
+	Name() string
+	// Code returns the value written to PipeHeader.Format.
+	Code() uint64
+	// Vars returns the names and types of the variables sent through the
+	// pipe. names and types are the variables requested by the user, which
+	// are ignored by formats with a fixed layout.
+	Vars(names, types []string) (outNames, outTypes []string, err error)
+	// Write writes the particles in bufs to f. bufs has the same order and
+	// types as the variables returned by Vars.
+	Write(f io.Writer, order binary.ByteOrder, bufs []interface{}) error
+	// Read reads particles written by Write into bufs, which must already
+	// have the right types and lengths.
+	Read(f io.Reader, order binary.ByteOrder, bufs []interface{}) error
+}
+
+// PotentialParticle is a particle with the structure used by the "potential"
+// pipe format.
+type PotentialParticle struct {
+	ID uint64
+	X, V [3]float32
+	Phi float32
+}
+
+// potentialParticleSize is the number of bytes used by a PotentialParticle
+// in a pipe, including padding.
+const potentialParticleSize = 40
+
+// pipeChunkSize is the number of particles that struct-based formats convert
+// at once. This keeps them from needing a second copy of every particle.
+const pipeChunkSize = 1 << 14
+
+var (
+	pipeFormatMutex = &sync.Mutex{ }
+	pipeFormats = []PipeFormat{
+		rockstarPipeFormat{ }, arraysPipeFormat{ }, potentialPipeFormat{ },
+	}
+)
+
+// RegisterPipeFormat adds a new format to the list of formats that can be
+// looked up with PipeFormatByName and PipeFormatByCode. An error is returned
+// if another format already uses the same name or code.
+func RegisterPipeFormat(format PipeFormat) error {
+	pipeFormatMutex.Lock()
+	defer pipeFormatMutex.Unlock()
+
+	for _, f := range pipeFormats {
+		if f.Name() == format.Name() {
+			return fmt.Errorf("A pipe format named '%s' already exists.",
+				format.Name())
+		} else if f.Code() == format.Code() {
+			return fmt.Errorf("The pipe formats '%s' and '%s' both use the " +
+				"code %x.", f.Name(), format.Name(), format.Code())
+		}
+	}
+
+	pipeFormats = append(pipeFormats, format)
+	return nil
+}
+
+// PipeFormats returns every registered pipe format.
+func PipeFormats() []PipeFormat {
+	pipeFormatMutex.Lock()
+	defer pipeFormatMutex.Unlock()
+	return append([]PipeFormat{ }, pipeFormats...)
+}
+
+// PipeFormatByName returns the pipe format with the given name.
+func PipeFormatByName(name string) (PipeFormat, error) {
+	formats := PipeFormats()
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		if f.Name() == name { return f, nil }
+		names[i] = f.Name()
+	}
+	return nil, fmt.Errorf("Unrecognized pipe format, '%s'. The supported " +
+		"formats are %s.", name, names)
+}
+
+// PipeFormatByCode returns the pipe format with the given code, which is
+// usually read from PipeHeader.Format.
+func PipeFormatByCode(code uint64) (PipeFormat, error) {
+	for _, f := range PipeFormats() {
+		if f.Code() == code { return f, nil }
+	}
+	return nil, fmt.Errorf("Unrecognized pipe format code, %x. The pipe " +
+		"may have been written by a newer version of guppy.", code)
+}
+
+// checkPipeBuffers checks that bufs have the given types and all have the
+// same length.
+func checkPipeBuffers(
+	format string, bufs []interface{}, types []string,
+) error {
+	if len(bufs) != len(types) {
+		return fmt.Errorf("The '%s' pipe format needs %d buffers, but was " +
+			"given %d.", format, len(types), len(bufs))
+	}
+
+	for i := range bufs {
+		if typ := pipeBufferType(bufs[i]); typ == "" || typ != types[i] {
+			return fmt.Errorf("Buffer %d of the '%s' pipe format must " +
+				"have type '%s', but has type %T.", i, format, types[i],
+				bufs[i])
+		}
+		n0 := reflect.ValueOf(bufs[0]).Len()
+		if n := reflect.ValueOf(bufs[i]).Len(); n != n0 {
+			return fmt.Errorf("Buffer %d of the '%s' pipe format has length " +
+				"%d, but buffer 0 has length %d.", i, format, n, n0)
+		}
+	}
+
+	return nil
+}
+
+// pipeBufferType returns the type string of a buffer that can be written by
+// WriteAsBytes, or "" if it can't be.
+func pipeBufferType(buf interface{}) string {
+	switch buf.(type) {
+	case []uint32: return "u32"
+	case []uint64: return "u64"
+	case []float32: return "f32"
+	case []float64: return "f64"
+	case [][3]float32: return "v32"
+	case [][3]float64: return "v64"
+	case []RockstarParticle: return "{RockstarParticle}"
+	}
+	return ""
+}
+
+// rockstarPipeFormat implements the "rockstar" pipe format.
+type rockstarPipeFormat struct{ }
+
+func (rockstarPipeFormat) Name() string { return "rockstar" }
+func (rockstarPipeFormat) Code() uint64 { return RockstarFormatCode }
+
+func (rockstarPipeFormat) Vars(
+	names, types []string,
+) (outNames, outTypes []string, err error) {
+	return []string{ "id", "x", "v" }, []string{ "u64", "v32", "v32" }, nil
+}
+
+func (format rockstarPipeFormat) Write(
+	f io.Writer, order binary.ByteOrder, bufs []interface{},
+) error {
+	_, types, _ := format.Vars(nil, nil)
+	err := checkPipeBuffers(format.Name(), bufs, types)
+	if err != nil { return err }
+
+	id, x, v := bufs[0].([]uint64), bufs[1].([][3]float32),
+		bufs[2].([][3]float32)
+	p := make([]RockstarParticle, pipeChunkSize)
+	for start := 0; start < len(id); start += pipeChunkSize {
+		end := start + pipeChunkSize
+		if end > len(id) { end = len(id) }
+
+		chunk := p[:end - start]
+		for i := range chunk {
+			chunk[i] = RockstarParticle{ id[start+i], x[start+i], v[start+i] }
+		}
+		if err := WriteAsBytesOrder(f, order, chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (format rockstarPipeFormat) Read(
+	f io.Reader, order binary.ByteOrder, bufs []interface{},
+) error {
+	_, types, _ := format.Vars(nil, nil)
+	err := checkPipeBuffers(format.Name(), bufs, types)
+	if err != nil { return err }
+
+	id, x, v := bufs[0].([]uint64), bufs[1].([][3]float32),
+		bufs[2].([][3]float32)
+	p := make([]RockstarParticle, pipeChunkSize)
+	for start := 0; start < len(id); start += pipeChunkSize {
+		end := start + pipeChunkSize
+		if end > len(id) { end = len(id) }
+
+		chunk := p[:end - start]
+		if err := ReadAsBytesOrder(f, order, chunk); err != nil { return err }
+		for i := range chunk {
+			id[start+i], x[start+i], v[start+i] = chunk[i].ID,
+				chunk[i].X, chunk[i].V
+		}
+	}
+
+	return nil
+}
+
+// arraysPipeFormat implements the "arrays" pipe format.
+type arraysPipeFormat struct{ }
+
+func (arraysPipeFormat) Name() string { return "arrays" }
+func (arraysPipeFormat) Code() uint64 { return ArraysFormatCode }
+
+func (arraysPipeFormat) Vars(
+	names, types []string,
+) (outNames, outTypes []string, err error) {
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("The 'arrays' pipe format needs at " +
+			"least one variable.")
+	} else if len(names) != len(types) {
+		return nil, nil, fmt.Errorf("The 'arrays' pipe format was given " +
+			"%d variables, but %d types.", len(names), len(types))
+	}
+	return names, types, nil
+}
+
+func (format arraysPipeFormat) Write(
+	f io.Writer, order binary.ByteOrder, bufs []interface{},
+) error {
+	types := make([]string, len(bufs))
+	for i := range bufs { types[i] = pipeBufferType(bufs[i]) }
+	err := checkPipeBuffers(format.Name(), bufs, types)
+	if err != nil { return err }
+
+	for i := range bufs {
+		if err := WriteAsBytesOrder(f, order, bufs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (format arraysPipeFormat) Read(
+	f io.Reader, order binary.ByteOrder, bufs []interface{},
+) error {
+	types := make([]string, len(bufs))
+	for i := range bufs { types[i] = pipeBufferType(bufs[i]) }
+	err := checkPipeBuffers(format.Name(), bufs, types)
+	if err != nil { return err }
+
+	for i := range bufs {
+		if err := ReadAsBytesOrder(f, order, bufs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// potentialPipeFormat implements the "potential" pipe format.
+type potentialPipeFormat struct{ }
+
+func (potentialPipeFormat) Name() string { return "potential" }
+func (potentialPipeFormat) Code() uint64 { return PotentialFormatCode }
+
+func (potentialPipeFormat) Vars(
+	names, types []string,
+) (outNames, outTypes []string, err error) {
+	return []string{ "id", "x", "v", "phi" },
+		[]string{ "u64", "v32", "v32", "f32" }, nil
+}
+
+func (format potentialPipeFormat) Write(
+	f io.Writer, order binary.ByteOrder, bufs []interface{},
+) error {
+	_, types, _ := format.Vars(nil, nil)
+	err := checkPipeBuffers(format.Name(), bufs, types)
+	if err != nil { return err }
+
+	id, x, v := bufs[0].([]uint64), bufs[1].([][3]float32),
+		bufs[2].([][3]float32)
+	phi := bufs[3].([]float32)
+	p := make([]PotentialParticle, pipeChunkSize)
+	b := make([]byte, potentialParticleSize*pipeChunkSize)
+	for start := 0; start < len(id); start += pipeChunkSize {
+		end := start + pipeChunkSize
+		if end > len(id) { end = len(id) }
+
+		chunk := p[:end - start]
+		for i := range chunk {
+			chunk[i] = PotentialParticle{
+				id[start+i], x[start+i], v[start+i], phi[start+i],
+			}
+		}
+
+		bChunk := b[:potentialParticleSize*len(chunk)]
+		encodePotentialParticles(order, chunk, bChunk)
+		if _, err := f.Write(bChunk); err != nil { return err }
+	}
+
+	return nil
+}
+
+func (format potentialPipeFormat) Read(
+	f io.Reader, order binary.ByteOrder, bufs []interface{},
+) error {
+	_, types, _ := format.Vars(nil, nil)
+	err := checkPipeBuffers(format.Name(), bufs, types)
+	if err != nil { return err }
+
+	id, x, v := bufs[0].([]uint64), bufs[1].([][3]float32),
+		bufs[2].([][3]float32)
+	phi := bufs[3].([]float32)
+	p := make([]PotentialParticle, pipeChunkSize)
+	b := make([]byte, potentialParticleSize*pipeChunkSize)
+	for start := 0; start < len(id); start += pipeChunkSize {
+		end := start + pipeChunkSize
+		if end > len(id) { end = len(id) }
+
+		chunk := p[:end - start]
+		bChunk := b[:potentialParticleSize*len(chunk)]
+		if _, err := io.ReadFull(f, bChunk); err != nil { return err }
+		decodePotentialParticles(order, bChunk, chunk)
+
+		for i := range chunk {
+			id[start+i], x[start+i] = chunk[i].ID, chunk[i].X
+			v[start+i], phi[start+i] = chunk[i].V, chunk[i].Phi
+		}
+	}
+
+	return nil
+}
+
+// encodePotentialParticles converts particles to bytes, including the
+// trailing padding.
+func encodePotentialParticles(
+	order binary.ByteOrder, x []PotentialParticle, b []byte,
+) {
+	for i := range x {
+		bi := b[i*potentialParticleSize: (i+1)*potentialParticleSize]
+		order.PutUint64(bi, x[i].ID)
+		for dim := 0; dim < 3; dim++ {
+			order.PutUint32(bi[8 + 4*dim:], math.Float32bits(x[i].X[dim]))
+			order.PutUint32(bi[20 + 4*dim:], math.Float32bits(x[i].V[dim]))
+		}
+		order.PutUint32(bi[32:], math.Float32bits(x[i].Phi))
+		order.PutUint32(bi[36:], 0)
+	}
+}
+
+// decodePotentialParticles is the inverse of encodePotentialParticles.
+func decodePotentialParticles(
+	order binary.ByteOrder, b []byte, x []PotentialParticle,
+) {
+	for i := range x {
+		bi := b[i*potentialParticleSize: (i+1)*potentialParticleSize]
+		x[i].ID = order.Uint64(bi)
+		for dim := 0; dim < 3; dim++ {
+			x[i].X[dim] = math.Float32frombits(order.Uint32(bi[8 + 4*dim:]))
+			x[i].V[dim] = math.Float32frombits(order.Uint32(bi[20 + 4*dim:]))
+		}
+		x[i].Phi = math.Float32frombits(order.Uint32(bi[32:]))
+	}
+}
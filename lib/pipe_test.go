@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/eq"
+)
+
+func TestPipeFormats(t *testing.T) {
+	// Use more particles than pipeChunkSize so chunking is tested.
+	n := pipeChunkSize + 17
+	id, phi := make([]uint64, n), make([]float32, n)
+	x, v := make([][3]float32, n), make([][3]float32, n)
+	u32, f64 := make([]uint32, n), make([]float64, n)
+	for i := 0; i < n; i++ {
+		id[i], phi[i] = rand.Uint64(), rand.Float32()
+		u32[i], f64[i] = rand.Uint32(), rand.Float64()
+		for dim := 0; dim < 3; dim++ {
+			x[i][dim], v[i][dim] = rand.Float32(), rand.Float32()
+		}
+	}
+
+	tests := []struct{
+		name string
+		names, types []string
+		bufs []interface{}
+		size int
+	} {
+		{ "rockstar", nil, nil, []interface{}{ id, x, v }, 32 },
+		{ "potential", nil, nil, []interface{}{ id, x, v, phi }, 40 },
+		{ "arrays", []string{ "x", "a", "b" }, []string{ "v32", "u32", "f64" },
+			[]interface{}{ x, u32, f64 }, 12 + 4 + 8 },
+	}
+
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	for i := range tests {
+		format, err := PipeFormatByName(tests[i].name)
+		if err != nil { t.Fatalf(err.Error()) }
+		byCode, err := PipeFormatByCode(format.Code())
+		if err != nil { t.Fatalf(err.Error()) }
+		if byCode.Name() != format.Name() {
+			t.Errorf("%d) Code %x maps to '%s', not '%s'.", i, format.Code(),
+				byCode.Name(), format.Name())
+		}
+
+		_, types, err := format.Vars(tests[i].names, tests[i].types)
+		if err != nil { t.Fatalf(err.Error()) }
+		if len(types) != len(tests[i].bufs) {
+			t.Fatalf("%d) Expected %d variables, got %d.", i,
+				len(tests[i].bufs), len(types))
+		}
+
+		for _, order := range orders {
+			b := &bytes.Buffer{ }
+			err := format.Write(b, order, tests[i].bufs)
+			if err != nil { t.Fatalf(err.Error()) }
+
+			if b.Len() != n*tests[i].size {
+				t.Errorf("%d, %s) Expected %d bytes, got %d.", i, order,
+					n*tests[i].size, b.Len())
+			}
+
+			out := make([]interface{}, len(types))
+			for j := range out {
+				switch types[j] {
+				case "u32": out[j] = make([]uint32, n)
+				case "u64": out[j] = make([]uint64, n)
+				case "f32": out[j] = make([]float32, n)
+				case "f64": out[j] = make([]float64, n)
+				case "v32": out[j] = make([][3]float32, n)
+				}
+			}
+
+			if err := format.Read(b, order, out); err != nil {
+				t.Fatalf(err.Error())
+			}
+			for j := range out {
+				if !eq.Generic(tests[i].bufs[j], out[j]) {
+					t.Errorf("%d, %s) Buffer %d was read incorrectly.",
+						i, order, j)
+				}
+			}
+		}
+	}
+}
+
+func TestPotentialParticleLayout(t *testing.T) {
+	id, phi := []uint64{ 0x0102030405060708 }, []float32{ 1 }
+	x, v := [][3]float32{ { 2, 3, 4 } }, [][3]float32{ { 5, 6, 7 } }
+
+	format, err := PipeFormatByName("potential")
+	if err != nil { t.Fatalf(err.Error()) }
+	b := &bytes.Buffer{ }
+	err = format.Write(b, binary.LittleEndian, []interface{}{ id, x, v, phi })
+	if err != nil { t.Fatalf(err.Error()) }
+
+	exp := make([]byte, 40)
+	binary.LittleEndian.PutUint64(exp, id[0])
+	for i, f := range []float32{ 2, 3, 4, 5, 6, 7, 1 } {
+		buf := &bytes.Buffer{ }
+		binary.Write(buf, binary.LittleEndian, f)
+		copy(exp[8 + 4*i:], buf.Bytes())
+	}
+
+	if !eq.Bytes(b.Bytes(), exp) {
+		t.Errorf("Expected bytes %x, got %x.", exp, b.Bytes())
+	}
+}
+
+func TestPipeFormatErrors(t *testing.T) {
+	if _, err := PipeFormatByName("foo"); err == nil {
+		t.Errorf("Expected error for unknown format name.")
+	}
+	if _, err := PipeFormatByCode(0); err == nil {
+		t.Errorf("Expected error for unknown format code.")
+	}
+	if err := RegisterPipeFormat(rockstarPipeFormat{ }); err == nil {
+		t.Errorf("Expected error when registering a duplicate format.")
+	}
+
+	format, _ := PipeFormatByName("rockstar")
+	bufs := []interface{}{
+		make([]uint64, 3), make([][3]float32, 3), make([][3]float64, 3),
+	}
+	if err := format.Write(&bytes.Buffer{ }, binary.LittleEndian,
+		bufs); err == nil {
+		t.Errorf("Expected error for buffer with the wrong type.")
+	}
+	bufs[2] = make([][3]float32, 4)
+	if err := format.Write(&bytes.Buffer{ }, binary.LittleEndian,
+		bufs); err == nil {
+		t.Errorf("Expected error for buffers with different lengths.")
+	}
+
+	format, _ = PipeFormatByName("arrays")
+	if _, _, err := format.Vars(nil, nil); err == nil {
+		t.Errorf("Expected error for the arrays format without variables.")
+	}
+}
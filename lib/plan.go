@@ -0,0 +1,242 @@
+package lib
+
+/* This file contains the functions that split guppy write's work on a
+snapshot into passes that fit inside the MaxMemory config variable. */
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// compressBufferBytes is the number of bytes per particle used by a
+	// compress.Buffer.
+	compressBufferBytes = 41
+)
+
+// ParseMemory parses an amount of memory, like "64GB" or "512 MiB", and
+// returns it in bytes. The units K, M, G, T, and P may be followed by "B" or
+// "iB" and are always powers of 1024, like most job schedulers assume. A
+// number without units is a number of bytes. An empty string means that
+// there's no limit and returns -1.
+func ParseMemory(s string) (int64, error) {
+	mem := strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	if mem == "" { return -1, nil }
+
+	mem = strings.TrimSuffix(mem, "B")
+	mem = strings.TrimSuffix(mem, "I")
+
+	unit := float64(1)
+	if n := len(mem); n > 0 {
+		if i := strings.IndexByte("KMGTP", mem[n-1]); i >= 0 {
+			unit = math.Pow(1024, float64(i + 1))
+			mem = mem[:n-1]
+		}
+	}
+
+	x, err := strconv.ParseFloat(mem, 64)
+	if err != nil || x <= 0 {
+		return 0, fmt.Errorf("'%s' isn't a valid amount of memory. It " +
+			"should be a positive number followed by an optional unit, " +
+			"like 64GB.", s)
+	}
+	return int64(x*unit), nil
+}
+
+// WritePass is a single pass over the input files of a snapshot. Every input
+// file is read during every pass, but only the particles in Outputs and the
+// variables in Vars are kept.
+type WritePass struct {
+	// Outputs are the indices of the output files written by the pass.
+	Outputs []int
+	// Vars are the variables read during the pass. IDs are always read, so
+	// "id" is never included.
+	Vars []string
+	// Flush is true if the files in Outputs are finished at the end of the
+	// pass. Otherwise, later passes will add more variables to them.
+	Flush bool
+}
+
+// Memory estimates the peak memory, in bytes, used by the pass. nSub is
+// the number of particles in each output file, nFile is the number of
+// particles in the largest input file, outputBytes is the size of the
+// largest .gup file, and workers is the number of threads.
+func (pass *WritePass) Memory(
+	cfg *WriteConfig, nSub, nFile, outputBytes int64, workers int,
+) int64 {
+	fileBytes := pass.FileBytes(cfg)
+	particleBytes := fileBytes - idSize(cfg)
+
+	// Each thread reads one input file at a time and compresses one output
+	// file at a time, and the particles for every output in the pass are
+	// held in memory until the input files have been read.
+	writers := int64(workers)
+	if n := int64(len(pass.Outputs)); n < writers { writers = n }
+
+	input := int64(workers) * nFile*fileBytes
+	part := int64(len(pass.Outputs)) * nSub*particleBytes
+	output := writers * (nSub*compressBufferBytes + outputBytes)
+	return input + part + output
+}
+
+// FileBytes returns the number of bytes per particle read from the input
+// files during the pass.
+func (pass *WritePass) FileBytes(cfg *WriteConfig) int64 {
+	bytes := idSize(cfg)
+	for _, v := range pass.Vars {
+		bytes += typeSize(cfg.Types[containsStringIndex(cfg.Vars, v)])
+	}
+	return bytes
+}
+
+// PlanWrite splits the work of writing outputs, the indices of a snapshot's
+// output files, into passes whose memory fits in cfg.MaxMemory. nTot is the
+// number of particles in the snapshot, nFile is the number of particles in
+// the largest input file, and workers is the number of threads. outputBytes
+// is the size of the largest .gup file. If it isn't positive, the size of
+// the uncompressed particles is used instead.
+//
+// Since every pass re-reads every input file, PlanWrite uses as few passes
+// as it can. It first tries to split the outputs into groups that can be
+// written with every variable at once. If even a single output file is too
+// large, each output is written over several passes that each read a
+// subset of its variables.
+func PlanWrite(
+	cfg *WriteConfig, outputs []int, nTot, nFile, outputBytes int64,
+	workers int,
+) ([]WritePass, error) {
+	maxMemory, err := ParseMemory(cfg.MaxMemory)
+	if err != nil { return nil, err }
+
+	vars := []string{ }
+	for i := range cfg.Vars {
+		if cfg.Vars[i] != "id" { vars = append(vars, cfg.Vars[i]) }
+	}
+
+	if maxMemory <= 0 || len(outputs) == 0 {
+		return []WritePass{ { outputs, vars, true } }, nil
+	}
+
+	gw := cfg.OutputGridWidth
+	nSub := nTot / (gw*gw*gw)
+	if outputBytes <= 0 {
+		all := &WritePass{ Vars: vars }
+		outputBytes = nSub * (all.FileBytes(cfg) - idSize(cfg))
+	}
+
+	memory := func(pass *WritePass) int64 {
+		return pass.Memory(cfg, nSub, nFile, outputBytes, workers)
+	}
+
+	// Find the largest number of outputs that fit in a pass. Memory only
+	// grows with the number of outputs, so this can be a binary search.
+	lo, hi := 0, len(outputs)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if memory(&WritePass{ outputs[:mid], vars, true }) <= maxMemory {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	if lo > 0 {
+		// Spread the outputs evenly across the passes.
+		nPass := (len(outputs) + lo - 1) / lo
+		perPass := (len(outputs) + nPass - 1) / nPass
+
+		passes := []WritePass{ }
+		for start := 0; start < len(outputs); start += perPass {
+			end := start + perPass
+			if end > len(outputs) { end = len(outputs) }
+			passes = append(passes, WritePass{
+				outputs[start: end], vars, true,
+			})
+		}
+		return passes, nil
+	}
+
+	// Group the variables so each group fits in a pass with one output.
+	groups := [][]string{ }
+	for _, v := range vars {
+		n := len(groups)
+		if n > 0 {
+			group := append(append([]string{ }, groups[n-1]...), v)
+			if memory(&WritePass{ outputs[:1], group, true }) <= maxMemory {
+				groups[n-1] = group
+				continue
+			}
+		}
+
+		pass := &WritePass{ outputs[:1], []string{ v }, true }
+		if mem := memory(pass); mem > maxMemory {
+			return nil, fmt.Errorf("MaxMemory is %s, but writing the " +
+				"variable %s to a single output file with %d threads needs " +
+				"about %d bytes. Increase MaxMemory, decrease Threads, or " +
+				"increase OutputGridWidth.", cfg.MaxMemory, v, workers, mem)
+		}
+		groups = append(groups, []string{ v })
+	}
+
+	passes := []WritePass{ }
+	for _, out := range outputs {
+		for i := range groups {
+			passes = append(passes, WritePass{
+				[]int{ out }, groups[i], i == len(groups) - 1,
+			})
+		}
+	}
+	return passes, nil
+}
+
+// MaxInputParticles returns an upper limit on the number of particles in
+// the largest of a set of input files, found from the sizes of the files
+// and cfg.GadgetTypes.
+func MaxInputParticles(cfg *WriteConfig, files []string) (int64, error) {
+	particleBytes := int64(0)
+	for i := range cfg.GadgetTypes {
+		particleBytes += typeSize(cfg.GadgetTypes[i])
+	}
+	if particleBytes == 0 {
+		return 0, fmt.Errorf("The GadgetTypes variable wasn't set.")
+	}
+
+	maxSize := int64(0)
+	for i := range files {
+		info, err := os.Stat(files[i])
+		if err != nil { return 0, err }
+		if info.Size() > maxSize { maxSize = info.Size() }
+	}
+
+	return (maxSize + particleBytes - 1) / particleBytes, nil
+}
+
+// ParticleBytes returns the number of bytes needed to store every variable
+// in cfg.Vars for a single particle before compression.
+func ParticleBytes(cfg *WriteConfig) int64 {
+	bytes := int64(0)
+	for i := range cfg.Types { bytes += typeSize(cfg.Types[i]) }
+	return bytes
+}
+
+// idSize returns the number of bytes needed to store an ID.
+func idSize(cfg *WriteConfig) int64 {
+	if i := containsStringIndex(cfg.Vars, "id"); i >= 0 {
+		return typeSize(cfg.Types[i])
+	}
+	return 8
+}
+
+// typeSize returns the size in bytes of a single value with the given type.
+func typeSize(typ string) int64 {
+	switch typ {
+	case "u32", "f32": return 4
+	case "u64", "f64": return 8
+	case "v32": return 12
+	case "v64": return 24
+	}
+	panic(fmt.Sprintf("Internal error: unrecognized type %s", typ))
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct{
+		s string
+		mem int64
+		valid bool
+	} {
+		{ "", -1, true },
+		{ "1000", 1000, true },
+		{ "64GB", 64<<30, true },
+		{ "64G", 64<<30, true },
+		{ "512 MiB", 512<<20, true },
+		{ "1.5k", 1536, true },
+		{ "2TB", 2<<40, true },
+		{ "GB", 0, false },
+		{ "-4GB", 0, false },
+		{ "4XB", 0, false },
+		{ "lots", 0, false },
+	}
+
+	for i := range tests {
+		mem, err := ParseMemory(tests[i].s)
+		if !tests[i].valid {
+			if err == nil {
+				t.Errorf("%d) Expected ParseMemory(%q) to fail.",
+					i, tests[i].s)
+			}
+		} else if err != nil {
+			t.Errorf("%d) Got error '%s' for ParseMemory(%q).",
+				i, err.Error(), tests[i].s)
+		} else if mem != tests[i].mem {
+			t.Errorf("%d) Expected ParseMemory(%q) = %d, got %d.",
+				i, tests[i].s, tests[i].mem, mem)
+		}
+	}
+}
+
+func TestWritePassMemory(t *testing.T) {
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "v", "phi", "id" },
+		Types: []string{ "v32", "v32", "f64", "u64" },
+	}
+
+	// Each input file has 12 + 12 + 8 + 8 = 40 bytes/particle, each output
+	// has 32 bytes/particle, and each writer needs 41 bytes/particle plus the
+	// output file.
+	pass := &WritePass{ []int{ 0, 1, 2, 3, 4 }, []string{ "x", "v", "phi" },
+		true }
+	nSub, nFile, outputBytes := int64(1<<12), int64(1000), int64(5000)
+	expected := 3*nFile*40 + 5*nSub*32 + 3*(nSub*41 + outputBytes)
+
+	memory := pass.Memory(cfg, nSub, nFile, outputBytes, 3)
+	if memory != expected {
+		t.Errorf("Expected Memory() = %d, got %d.", expected, memory)
+	}
+	if bytes := ParticleBytes(cfg); bytes != 40 {
+		t.Errorf("Expected ParticleBytes() = 40, got %d.", bytes)
+	}
+
+	// Only one thread can write when there's one output.
+	pass = &WritePass{ []int{ 7 }, []string{ "phi" }, false }
+	expected = 3*nFile*16 + nSub*8 + (nSub*41 + outputBytes)
+
+	memory = pass.Memory(cfg, nSub, nFile, outputBytes, 3)
+	if memory != expected {
+		t.Errorf("Expected Memory() = %d, got %d.", expected, memory)
+	}
+}
+
+func TestPlanWrite(t *testing.T) {
+	cfg := &WriteConfig{
+		Vars: []string{ "x", "v", "phi", "id" },
+		Types: []string{ "v32", "v32", "f64", "u64" },
+		OutputGridWidth: 2,
+	}
+	outputs := []int{ 0, 1, 2, 3, 4, 5, 6, 7 }
+	vars := []string{ "x", "v", "phi" }
+	nTot, nFile, outputBytes := int64(8000), int64(100), int64(10000)
+
+	tests := []struct{
+		maxMemory string
+		passes []WritePass
+	} {
+		{ "", []WritePass{ { outputs, vars, true } } },
+		// Reading takes 4*100*40 = 16000 bytes, and each output adds
+		// 1000*32 + (1000*41 + 10000) = 83000 bytes until there are as many
+		// outputs as threads. Three outputs fit, so three passes are needed.
+		{ "270000", []WritePass{
+			{ outputs[0:3], vars, true },
+			{ outputs[3:6], vars, true },
+			{ outputs[6:8], vars, true },
+		} },
+		// x and v take 4*100*32 + 1000*24 + 51000 = 87800 bytes, but adding
+		// phi needs 99000 bytes.
+		{ "90000", []WritePass{
+			{ []int{ 0 }, []string{ "x", "v" }, false },
+			{ []int{ 0 }, []string{ "phi" }, true },
+			{ []int{ 1 }, []string{ "x", "v" }, false },
+			{ []int{ 1 }, []string{ "phi" }, true },
+			{ []int{ 2 }, []string{ "x", "v" }, false },
+			{ []int{ 2 }, []string{ "phi" }, true },
+			{ []int{ 3 }, []string{ "x", "v" }, false },
+			{ []int{ 3 }, []string{ "phi" }, true },
+			{ []int{ 4 }, []string{ "x", "v" }, false },
+			{ []int{ 4 }, []string{ "phi" }, true },
+			{ []int{ 5 }, []string{ "x", "v" }, false },
+			{ []int{ 5 }, []string{ "phi" }, true },
+			{ []int{ 6 }, []string{ "x", "v" }, false },
+			{ []int{ 6 }, []string{ "phi" }, true },
+			{ []int{ 7 }, []string{ "x", "v" }, false },
+			{ []int{ 7 }, []string{ "phi" }, true },
+		} },
+		{ "1000", nil },
+	}
+
+	for i := range tests {
+		cfg.MaxMemory = tests[i].maxMemory
+		passes, err := PlanWrite(cfg, outputs, nTot, nFile, outputBytes, 4)
+		if tests[i].passes == nil {
+			if err == nil {
+				t.Errorf("%d) Expected PlanWrite() to fail.", i)
+			}
+		} else if err != nil {
+			t.Errorf("%d) Got error '%s'.", i, err.Error())
+		} else if !reflect.DeepEqual(passes, tests[i].passes) {
+			t.Errorf("%d) Expected passes %v, got %v.",
+				i, tests[i].passes, passes)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package lib
+
+/* This file contains the progress manifest used by guppy's write mode to
+resume jobs that were interrupted. */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+)
+
+// ProgressManifestPattern is the pattern for the name of the file that
+// WriteProgress is stored in. The verb is replaced by OutputPatternID().
+const ProgressManifestPattern = "guppy_write.%s.progress"
+
+// progressHeader is the first line of every progress manifest.
+const progressHeader = "# guppy write progress: one OutputRecord per line"
+
+// WriteProgress records which output files of a write job have been written
+// and verified, so that an interrupted job can skip them when it's resumed.
+// It's stored as a text file with one JSON-encoded OutputRecord per finished
+// file. Lines are appended and synced as each file finishes, so a job that's
+// killed loses at most the line that was being written.
+type WriteProgress struct {
+	// FileName is the name of the manifest file.
+	FileName string
+
+	done map[[2]int]OutputRecord
+	f *os.File
+	mutex sync.Mutex
+}
+
+// OutputRecord describes an output file that has been written and verified.
+// It contains everything the simulation index needs to know about the file,
+// so the index can be written without reading the output files again.
+type OutputRecord struct {
+	Snapshot, Output int
+	// File is the name of the file. Size is its size in bytes and CRC32C is
+	// the CRC32C checksum of its contents.
+	File string
+	Size int64
+	CRC32C uint32
+	// Bounds is the periodic bounding box of the particles' positions (see
+	// FileIndex). It's empty if the file doesn't contain "x".
+	Bounds []float32 `json:",omitempty"`
+	// Header is the fixed-width header of the file.
+	Header compress.FixedWidthHeader
+}
+
+// ProgressFileName returns the name of the progress manifest for cfg. It's
+// stored in the deepest directory that contains every output file, and its
+// name contains OutputPatternID(), so configs that write to the same
+// directory don't share a manifest.
+func ProgressFileName(cfg *WriteConfig) string {
+	return filepath.Join(outputDir(cfg),
+		fmt.Sprintf(ProgressManifestPattern, OutputPatternID(cfg)))
+}
+
+// OutputPatternID returns a short identifier for cfg's Output pattern: the
+// CRC32C checksum of its absolute path, in hex. Configs which write the same
+// files have the same ID.
+func OutputPatternID(cfg *WriteConfig) string {
+	pattern, err := filepath.Abs(cfg.Output)
+	if err != nil { pattern = cfg.Output }
+	checksum := crc32.Checksum([]byte(pattern),
+		crc32.MakeTable(crc32.Castagnoli))
+	return fmt.Sprintf("%08x", checksum)
+}
+
+// outputDir returns the deepest directory that contains every output file
+// of cfg.
+func outputDir(cfg *WriteConfig) string {
+	prefix := cfg.Output
+	if i := strings.Index(prefix, "{"); i >= 0 { prefix = prefix[:i] }
+	return filepath.Dir(prefix)
+}
+
+// OpenWriteProgress opens the progress manifest with the given name. If
+// resume is true, the files recorded in an existing manifest are treated as
+// finished. Otherwise, any existing manifest is cleared and every file will
+// be written again.
+func OpenWriteProgress(fname string, resume bool) (*WriteProgress, error) {
+	p := &WriteProgress{ FileName: fname, done: map[[2]int]OutputRecord{ } }
+
+	if resume {
+		if err := p.read(); err != nil { return nil, err }
+	}
+
+	// Rewrite the manifest so that any partial line left by a killed job is
+	// removed before new lines are appended.
+	if err := p.rewrite(); err != nil {
+		return nil, fmt.Errorf("Could not write the progress manifest %s: %s",
+			fname, err.Error())
+	}
+
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil { return nil, err }
+	p.f = f
+
+	return p, nil
+}
+
+// rewrite atomically replaces the manifest with one containing the current
+// entries, sorted by snapshot and output index.
+func (p *WriteProgress) rewrite() error {
+	keys := make([][2]int, 0, len(p.done))
+	for key := range p.done { keys = append(keys, key) }
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] { return keys[i][0] < keys[j][0] }
+		return keys[i][1] < keys[j][1]
+	})
+
+	return compress.AtomicWrite(p.FileName, func(f io.Writer) error {
+		wr := bufio.NewWriter(f)
+		fmt.Fprintln(wr, progressHeader)
+		for _, key := range keys {
+			b, err := json.Marshal(p.done[key])
+			if err != nil { return err }
+			wr.Write(append(b, '\n'))
+		}
+		return wr.Flush()
+	})
+}
+
+// read reads the entries of an existing manifest. Missing manifests are
+// treated as empty. A malformed final line is ignored, since it's what a
+// job killed in the middle of Record() leaves behind.
+func (p *WriteProgress) read() error {
+	f, err := os.Open(p.FileName)
+	if err != nil {
+		if os.IsNotExist(err) { return nil }
+		return err
+	}
+	defer f.Close()
+
+	lines := []string{ }
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() { lines = append(lines, scanner.Text()) }
+	if err := scanner.Err(); err != nil { return err }
+
+	for i, line := range lines {
+		if len(line) == 0 || line[0] == '#' { continue }
+
+		rec := OutputRecord{ }
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			if i == len(lines) - 1 { break }
+			return fmt.Errorf("Line %d of the progress manifest %s, '%s', " +
+				"is malformed.", i+1, p.FileName, line)
+		}
+		p.done[[2]int{ rec.Snapshot, rec.Output }] = rec
+	}
+
+	return nil
+}
+
+// Done returns true if the output file with the given snapshot and index
+// was recorded as finished, and the file on disk still has the recorded name
+// and size.
+func (p *WriteProgress) Done(snap, output int, file string) bool {
+	rec, ok := p.Get(snap, output)
+	if !ok || rec.File != file { return false }
+	info, err := os.Stat(file)
+	return err == nil && info.Size() == rec.Size
+}
+
+// Get returns the record of the output file with the given snapshot and
+// index. false is returned if the file hasn't been recorded.
+func (p *WriteProgress) Get(snap, output int) (OutputRecord, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	rec, ok := p.done[[2]int{ snap, output }]
+	return rec, ok
+}
+
+// Record records that an output file has been written and verified.
+func (p *WriteProgress) Record(rec OutputRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil { return err }
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, err = p.f.Write(append(b, '\n'))
+	if err == nil { err = p.f.Sync() }
+	if err != nil {
+		return fmt.Errorf("Could not update the progress manifest %s: %s",
+			p.FileName, err.Error())
+	}
+
+	p.done[[2]int{ rec.Snapshot, rec.Output }] = rec
+	return nil
+}
+
+// Close closes the manifest file.
+func (p *WriteProgress) Close() error { return p.f.Close() }
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProgressFileName(t *testing.T) {
+	tests := []struct{
+		output, dir string
+	} {
+		{ "/out/snap_{%03d,snapshot}/snap.{%d,output}.gup", "/out" },
+		{ "/out/dir/snap_{%03d,snapshot}.{%d,output}.gup", "/out/dir" },
+		{ "snap.{%d,output}.gup", "." },
+	}
+
+	for i := range tests {
+		cfg := &WriteConfig{ Output: tests[i].output }
+		exp := filepath.Join(tests[i].dir,
+			fmt.Sprintf(ProgressManifestPattern, OutputPatternID(cfg)))
+		if name := ProgressFileName(cfg); name != exp {
+			t.Errorf("%d) Expected ProgressFileName() = %s, got %s.",
+				i, exp, name)
+		}
+	}
+
+	// Configs which write different files to the same directory need
+	// separate manifests.
+	cfg1 := &WriteConfig{ Output: "/out/a_{%03d,snapshot}.{%d,output}.gup" }
+	cfg2 := &WriteConfig{ Output: "/out/b_{%03d,snapshot}.{%d,output}.gup" }
+	cfg3 := &WriteConfig{ Output: "/out/./a_{%03d,snapshot}.{%d,output}.gup" }
+	if ProgressFileName(cfg1) == ProgressFileName(cfg2) {
+		t.Errorf("Expected different Output patterns to have different " +
+			"manifests, but both use %s.", ProgressFileName(cfg1))
+	}
+	if ProgressFileName(cfg1) != ProgressFileName(cfg3) {
+		t.Errorf("Expected equivalent Output patterns to share a manifest, " +
+			"got %s and %s.", ProgressFileName(cfg1), ProgressFileName(cfg3))
+	}
+}
+
+func TestWriteProgress(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "guppy_write.progress")
+	files := []string{
+		filepath.Join(dir, "a.gup"), filepath.Join(dir, "b c.gup"),
+		filepath.Join(dir, "d.gup"),
+	}
+	for _, file := range files {
+		err := os.WriteFile(file, []byte("data"), 0644)
+		if err != nil { t.Fatalf(err.Error()) }
+	}
+
+	p, err := OpenWriteProgress(fname, true)
+	if err != nil { t.Fatalf(err.Error()) }
+	if p.Done(0, 0, files[0]) {
+		t.Errorf("Empty manifest reported a finished file.")
+	}
+	for i := 0; i < 3; i++ {
+		rec := OutputRecord{ Snapshot: 100, Output: i, File: files[i],
+			Size: 4, CRC32C: uint32(i), Bounds: []float32{ 0, 0, 0, 1, 1, 1 } }
+		if err := p.Record(rec); err != nil { t.Fatalf(err.Error()) }
+	}
+	p.Close()
+
+	// Simulate a job killed while writing a line, and a file that was
+	// changed after it was recorded.
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil { t.Fatalf(err.Error()) }
+	f.WriteString(`{"Snapshot":100,"Output":3,"Fi`)
+	f.Close()
+	err = os.WriteFile(files[2], []byte("truncated"), 0644)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	p, err = OpenWriteProgress(fname, true)
+	if err != nil { t.Fatalf(err.Error()) }
+	expDone := []bool{ true, true, false }
+	for i := range files {
+		if done := p.Done(100, i, files[i]); done != expDone[i] {
+			t.Errorf("Expected Done(100, %d) = %v, got %v.",
+				i, expDone[i], done)
+		}
+	}
+	if p.Done(101, 0, files[0]) || p.Done(100, 0, files[1]) {
+		t.Errorf("Done() matched the wrong snapshot or file.")
+	}
+	rec, ok := p.Get(100, 1)
+	if !ok || rec.File != files[1] || rec.CRC32C != 1 ||
+		!reflect.DeepEqual(rec.Bounds, []float32{ 0, 0, 0, 1, 1, 1 }) {
+		t.Errorf("Expected Get(100, 1) to return the record of %s, got %v.",
+			files[1], rec)
+	}
+	if _, ok := p.Get(100, 3); ok {
+		t.Errorf("Get() returned the partial record.")
+	}
+
+	// The partial line should be gone, so new lines can be appended.
+	rec = OutputRecord{ Snapshot: 100, Output: 2, File: files[2], Size: 9 }
+	if err := p.Record(rec); err != nil { t.Fatalf(err.Error()) }
+	p.Close()
+
+	p, err = OpenWriteProgress(fname, true)
+	if err != nil { t.Fatalf(err.Error()) }
+	if !p.Done(100, 2, files[2]) {
+		t.Errorf("Re-recorded file wasn't finished after resuming.")
+	}
+	p.Close()
+
+	// Without resume, the manifest starts over.
+	p, err = OpenWriteProgress(fname, false)
+	if err != nil { t.Fatalf(err.Error()) }
+	if p.Done(100, 0, files[0]) {
+		t.Errorf("Manifest wasn't cleared without resume.")
+	}
+	p.Close()
+
+	text := `{"Snapshot":1,"Output":2,"File":"a","Size":3}` + "\nbad\n" +
+		`{"Snapshot":4,"Output":5,"File":"b","Size":6}` + "\n"
+	err = os.WriteFile(fname, []byte(text), 0644)
+	if err != nil { t.Fatalf(err.Error()) }
+	if _, err = OpenWriteProgress(fname, true); err == nil {
+		t.Errorf("Expected error for a malformed line in the middle of " +
+			"the manifest.")
+	}
+}
@@ -0,0 +1,175 @@
+package snapio
+
+/* This file contains functions for writing Gadget-2 and LGadget-2 files. It's
+used when converting .gup files back into the original snapshot format. */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// gadget2NumFilesOffset and gadget2BoxSizeOffset are the byte offsets of
+	// the NumFiles and BoxSize fields in the header. They're the same for
+	// Gadget-2 and LGadget-2 headers.
+	gadget2NumFilesOffset = 124
+	gadget2BoxSizeOffset = 128
+)
+
+// Gadget2HeaderByteOrder returns the byte order of a raw Gadget-2 or LGadget-2
+// header, like the one returned by Gadget2Header.ToBytes(). The box size of
+// the simulation, L, is needed to tell the two orders apart. An error is
+// returned if neither byte order gives a box size of L.
+func Gadget2HeaderByteOrder(raw []byte, L float64) (binary.ByteOrder, error) {
+	if len(raw) != gadget2HeaderSize {
+		return nil, fmt.Errorf("The Gadget-2 header has %d bytes instead " +
+			"of %d.", len(raw), gadget2HeaderSize)
+	}
+
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	for _, order := range orders {
+		bits := order.Uint64(raw[gadget2BoxSizeOffset:])
+		if math.Float64frombits(bits) == L { return order, nil }
+	}
+
+	return nil, fmt.Errorf("The Gadget-2 header doesn't have a box size of " +
+		"%g in either byte order, so it can't be decoded.", L)
+}
+
+// ResizeGadget2Header takes a raw Gadget-2 or LGadget-2 header written in the
+// byte order hdOrder and returns a copy written in the byte order order for a
+// file with n particles, which is one of nFiles files in the snapshot. All
+// the other fields, including the total particle counts, are kept.
+func ResizeGadget2Header(
+	raw []byte, hdOrder binary.ByteOrder,
+	n, nFiles int, order binary.ByteOrder,
+) []byte {
+	out := make([]byte, len(raw))
+	copy(out, raw)
+
+	if hdOrder != order { swapGadget2Header(out) }
+
+	for i := 0; i < 6; i++ {
+		order.PutUint32(out[4*i:], 0)
+	}
+	order.PutUint32(out[4:], uint32(n))
+	order.PutUint32(out[gadget2NumFilesOffset:], uint32(nFiles))
+
+	return out
+}
+
+// swapGadget2Header reverses the byte order of every field in a raw header.
+// Both header types have 4-byte fields in [0, 24), [88, 128), and [160, 168),
+// 8-byte fields in [24, 88) and [128, 160), and the remaining bytes are
+// 4-byte fields in Gadget-2 and padding in LGadget-2.
+func swapGadget2Header(b []byte) {
+	swap := func(start, end, width int) {
+		for i := start; i < end; i += width {
+			for j := 0; j < width/2; j++ {
+				b[i+j], b[i+width-1-j] = b[i+width-1-j], b[i+j]
+			}
+		}
+	}
+
+	swap(0, 24, 4)
+	swap(24, 88, 8)
+	swap(88, 128, 4)
+	swap(128, 160, 8)
+	swap(160, gadget2HeaderSize, 4)
+}
+
+// WriteGadget2 writes a Gadget-2 or LGadget-2 file, which have identical data
+// layouts. header is the raw 256-byte header (see ResizeGadget2Header) and
+// blocks are the data blocks in the order they should be written. Each block
+// must be []uint32, []uint64, []float32, []float64, [][3]float32, or
+// [][3]float64.
+//
+// Like compress.Writer, the file is written to a temporary file and renamed
+// once it's complete.
+func WriteGadget2(
+	fileName string, header []byte, blocks []interface{},
+	order binary.ByteOrder,
+) error {
+	if len(header) != gadget2HeaderSize {
+		return fmt.Errorf("The Gadget-2 header has %d bytes instead of %d.",
+			len(header), gadget2HeaderSize)
+	}
+
+	dir, base := filepath.Split(fileName)
+	if dir == "" { dir = "." }
+	fp, err := os.CreateTemp(dir, "." + base + ".tmp*")
+	if err != nil { return err }
+	tmpName := fp.Name()
+
+	err = writeGadget2Blocks(fp, header, blocks, order)
+	if err == nil { err = fp.Sync() }
+	if closeErr := fp.Close(); err == nil { err = closeErr }
+	if err == nil { err = os.Rename(tmpName, fileName) }
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+// WriteLGadget2 writes an LGadget-2 file containing positions, velocities, and
+// 32-bit IDs. The file is one of nFiles files in a snapshot at redshift z that
+// has nTot particles in a box of width L. The cosmology is fixed to
+// Omega_m = 0.27, Omega_L = 0.73, and h = 0.7 and particles have unit mass.
+// It's used to create test snapshots.
+func WriteLGadget2(
+	fileName string, nTot, nFiles int, L, z float64,
+	x, v [][3]float32, id []uint32,
+) error {
+	hd := &rawLGadget2Header{ }
+	hd.NPart[1], hd.NPartTotal[1] = uint32(len(id)), uint32(nTot)
+	hd.Mass[1], hd.Time, hd.Redshift = 1, 1/(1 + z), z
+	hd.NumFiles, hd.BoxSize = uint32(nFiles), L
+	hd.Omega0, hd.OmegaLambda, hd.HubbleParam = 0.27, 0.73, 0.7
+
+	b := &bytes.Buffer{ }
+	err := binary.Write(b, binary.LittleEndian, hd)
+	if err != nil { return err }
+
+	return WriteGadget2(fileName, b.Bytes(),
+		[]interface{}{ x, v, id }, binary.LittleEndian)
+}
+
+// writeGadget2Blocks writes the header and data blocks of a Gadget-2 file to
+// fp, surrounded by Fortran record markers.
+func writeGadget2Blocks(
+	fp *os.File, header []byte, blocks []interface{},
+	order binary.ByteOrder,
+) error {
+	wr := bufio.NewWriter(fp)
+	blocks = append([]interface{}{ header }, blocks...)
+
+	for i, block := range blocks {
+		size := binary.Size(block)
+		if size < 0 {
+			return fmt.Errorf("Internal error: block %d has the " +
+				"unsupported type %T.", i, block)
+		} else if int64(size) > math.MaxUint32 {
+			return fmt.Errorf("Block %d has %d bytes, which is too large " +
+				"to be stored in a Gadget-2 file. Use more output files.",
+				i, size)
+		}
+
+		if err := binary.Write(wr, order, uint32(size)); err != nil {
+			return err
+		}
+		if err := binary.Write(wr, order, block); err != nil { return err }
+		if err := binary.Write(wr, order, uint32(size)); err != nil {
+			return err
+		}
+	}
+
+	return wr.Flush()
+}
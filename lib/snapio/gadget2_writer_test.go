@@ -0,0 +1,157 @@
+package snapio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib/eq"
+)
+
+func TestWriteGadget2(t *testing.T) {
+	n, nTot, L := 10, 1000, 62.5
+	x, v := make([][3]float32, n), make([][3]float32, n)
+	id := make([]uint64, n)
+	for i := 0; i < n; i++ {
+		id[i] = uint64(i*i + 1)
+		for dim := 0; dim < 3; dim++ {
+			x[i][dim] = float32(i + dim)
+			v[i][dim] = -float32(i*dim)
+		}
+	}
+	names, types := []string{ "x", "v", "id" }, []string{ "v32", "v32", "u64" }
+
+	rawLG := &rawLGadget2Header{ NumFiles: 100, BoxSize: L, Omega0: 0.27,
+		OmegaLambda: 0.73, HubbleParam: 0.7, Redshift: 2 }
+	rawLG.NPart[1], rawLG.NPartTotal[1], rawLG.Mass[1] = 7, uint32(nTot), 1.5
+	rawG := &rawGadget2Header{ NumFiles: 100, BoxSize: L, Omega0: 0.27,
+		OmegaLambda: 0.73, HubbleParam: 0.7, Redshift: 2 }
+	rawG.NPart[1], rawG.Nall[1], rawG.Mass[1] = 7, uint32(nTot), 1.5
+
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	for _, hdOrder := range orders {
+		for _, order := range orders {
+			for _, lgadget := range []bool{ true, false } {
+				b := &bytes.Buffer{ }
+				if lgadget {
+					binary.Write(b, hdOrder, rawLG)
+				} else {
+					binary.Write(b, hdOrder, rawG)
+				}
+
+				foundOrder, err := Gadget2HeaderByteOrder(b.Bytes(), L)
+				if err != nil {
+					t.Fatalf("Error in Gadget2HeaderByteOrder(): %s",
+						err.Error())
+				} else if foundOrder != hdOrder {
+					t.Errorf("Header written in %s, but found %s.",
+						hdOrder, foundOrder)
+				}
+
+				hd := ResizeGadget2Header(b.Bytes(), hdOrder, n, 4, order)
+				fname := path.Join(t.TempDir(), "snap.0")
+				err = WriteGadget2(fname, hd,
+					[]interface{}{ x, v, id }, order)
+				if err != nil {
+					t.Fatalf("Error in WriteGadget2(): %s", err.Error())
+				}
+
+				var f File
+				if lgadget {
+					f, err = NewLGadget2(fname, names, types, order)
+				} else {
+					f, err = NewGadget2Cosmological(fname, names, types, order)
+				}
+				if err != nil {
+					t.Fatalf("Could not open written file: %s", err.Error())
+				}
+				checkGadget2Output(t, f, n, nTot, L, x, v, id)
+			}
+		}
+	}
+
+	if _, err := Gadget2HeaderByteOrder(make([]byte, 256), L); err == nil {
+		t.Errorf("Expected Gadget2HeaderByteOrder() to fail on an empty " +
+			"header.")
+	}
+}
+
+func TestWriteLGadget2(t *testing.T) {
+	n, nTot, L, z := 10, 1000, 62.5, 1.5
+	x, v := make([][3]float32, n), make([][3]float32, n)
+	id := make([]uint32, n)
+	for i := 0; i < n; i++ {
+		id[i] = uint32(i*i + 1)
+		for dim := 0; dim < 3; dim++ {
+			x[i][dim] = float32(i + dim)
+			v[i][dim] = -float32(i*dim)
+		}
+	}
+	names, types := []string{ "x", "v", "id" }, []string{ "v32", "v32", "u32" }
+
+	fname := path.Join(t.TempDir(), "snap.0")
+	err := WriteLGadget2(fname, nTot, 4, L, z, x, v, id)
+	if err != nil { t.Fatalf(err.Error()) }
+
+	f, err := NewLGadget2(fname, names, types, binary.LittleEndian)
+	if err != nil { t.Fatalf(err.Error()) }
+	hd, err := f.ReadHeader()
+	if err != nil { t.Fatalf(err.Error()) }
+	if hd.NTot() != int64(nTot) || hd.L() != L || hd.Z() != z ||
+		hd.H100() != 0.7 {
+		t.Errorf("Header read as NTot = %d, L = %g, Z = %g, H100 = %g.",
+			hd.NTot(), hd.L(), hd.Z(), hd.H100())
+	}
+
+	buf, err := NewBuffer(hd)
+	if err != nil { t.Fatalf(err.Error()) }
+	for _, name := range names {
+		if err := f.Read(name, buf); err != nil { t.Fatalf(err.Error()) }
+	}
+
+	xOut, _ := buf.Get("x")
+	vOut, _ := buf.Get("v")
+	idOut, _ := buf.Get("id")
+	if !eq.Uint32s(idOut.([]uint32), id) {
+		t.Errorf("Wrote IDs %d, but read %d.", id, idOut)
+	}
+	for i := 0; i < n; i++ {
+		if xOut.([][3]float32)[i] != x[i] || vOut.([][3]float32)[i] != v[i] {
+			t.Errorf("Particle %d written incorrectly.", i)
+			break
+		}
+	}
+}
+
+func checkGadget2Output(
+	t *testing.T, f File, n, nTot int, L float64,
+	x, v [][3]float32, id []uint64,
+) {
+	hd, err := f.ReadHeader()
+	if err != nil { t.Fatalf(err.Error()) }
+	if hd.NTot() != int64(nTot) || hd.L() != L || hd.Z() != 2 ||
+		hd.Mass() != 1.5e10 || hd.H100() != 0.7 {
+		t.Errorf("Header read as NTot = %d, L = %g, Z = %g, Mass = %g, " +
+			"H100 = %g.", hd.NTot(), hd.L(), hd.Z(), hd.Mass(), hd.H100())
+	}
+
+	buf, err := NewBuffer(hd)
+	if err != nil { t.Fatalf(err.Error()) }
+	for _, name := range []string{ "x", "v", "id" } {
+		if err := f.Read(name, buf); err != nil { t.Fatalf(err.Error()) }
+	}
+
+	xOut, _ := buf.Get("x")
+	vOut, _ := buf.Get("v")
+	idOut, _ := buf.Get("id")
+	if !eq.Uint64s(idOut.([]uint64), id) {
+		t.Errorf("Wrote IDs %d, but read %d.", id, idOut)
+	}
+	for i := 0; i < n; i++ {
+		if xOut.([][3]float32)[i] != x[i] || vOut.([][3]float32)[i] != v[i] {
+			t.Errorf("Particle %d written incorrectly.", i)
+			break
+		}
+	}
+}
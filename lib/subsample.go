@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Subsample specifies which particles are kept when only part of a snapshot
+// is read. Every keeps every Every-th particle in each file, and Fraction
+// keeps a random fraction of the remaining particles. The random selection
+// only depends on Seed and the index of the file, so reading different
+// variables from the same file selects the same particles.
+type Subsample struct {
+	Every int64
+	Fraction float64
+	Seed int64
+}
+
+// Check returns an error if the subsampling parameters are invalid.
+func (s *Subsample) Check() error {
+	if s.Every < 1 {
+		return fmt.Errorf("'every' is set to %d, but it must be at least 1.",
+			s.Every)
+	} else if s.Fraction <= 0 || s.Fraction > 1 {
+		return fmt.Errorf("'fraction' is set to %g, but it must be larger " +
+			"than 0 and no larger than 1.", s.Fraction)
+	}
+	return nil
+}
+
+// All returns true if every particle is kept.
+func (s *Subsample) All() bool {
+	return s.Every == 1 && s.Fraction == 1
+}
+
+// Indices returns the sorted indices of the particles kept in the file with
+// the given index, which contains n particles. nil is returned if every
+// particle is kept.
+func (s *Subsample) Indices(file int, n int64) []int64 {
+	if s.All() { return nil }
+
+	rng := rand.New(rand.NewSource(s.Seed + int64(file)))
+	idx := make([]int64, 0, int(float64(n/s.Every + 1)*s.Fraction))
+	for i := int64(0); i < n; i += s.Every {
+		if s.Fraction < 1 && rng.Float64() >= s.Fraction { continue }
+		idx = append(idx, i)
+	}
+
+	return idx
+}
+
+// Len returns the number of particles kept in the file with the given index,
+// which contains n particles.
+func (s *Subsample) Len(file int, n int64) int64 {
+	if s.All() { return n }
+	return int64(len(s.Indices(file, n)))
+}
+
+// SubsampleBuffer moves the elements of buf at the given indices to the start
+// of the buffer and returns the slice containing them. idx must be sorted, as
+// returned by Subsample.Indices. If idx is nil, buf is returned unchanged.
+// buf must be []uint32, []uint64, []float32, []float64, [][3]float32,
+// [][3]float64, or []RockstarParticle.
+func SubsampleBuffer(buf interface{}, idx []int64) interface{} {
+	if idx == nil { return buf }
+
+	switch x := buf.(type) {
+	case []uint32:
+		for j, i := range idx { x[j] = x[i] }
+		return x[:len(idx)]
+	case []uint64:
+		for j, i := range idx { x[j] = x[i] }
+		return x[:len(idx)]
+	case []float32:
+		for j, i := range idx { x[j] = x[i] }
+		return x[:len(idx)]
+	case []float64:
+		for j, i := range idx { x[j] = x[i] }
+		return x[:len(idx)]
+	case [][3]float32:
+		for j, i := range idx { x[j] = x[i] }
+		return x[:len(idx)]
+	case [][3]float64:
+		for j, i := range idx { x[j] = x[i] }
+		return x[:len(idx)]
+	case []RockstarParticle:
+		for j, i := range idx { x[j] = x[i] }
+		return x[:len(idx)]
+	}
+
+	panic(fmt.Sprintf("Internal error: SubsampleBuffer was called on a " +
+		"buffer with the unsupported type %T.", buf))
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubsampleIndices(t *testing.T) {
+	s := &Subsample{ 1, 1, 0 }
+	if idx := s.Indices(0, 10); idx != nil {
+		t.Errorf("Expected nil indices without subsampling, got %v.", idx)
+	}
+	if n := s.Len(0, 10); n != 10 { t.Errorf("Expected Len 10, got %d.", n) }
+
+	s = &Subsample{ 3, 1, 0 }
+	exp := []int64{ 0, 3, 6, 9 }
+	if idx := s.Indices(0, 10); !reflect.DeepEqual(idx, exp) {
+		t.Errorf("Expected indices %v, got %v.", exp, idx)
+	}
+
+	s = &Subsample{ 2, 0.25, 7 }
+	n := int64(100000)
+	idx := s.Indices(3, n)
+	if !reflect.DeepEqual(idx, s.Indices(3, n)) {
+		t.Errorf("Indices changed between calls.")
+	} else if reflect.DeepEqual(idx, s.Indices(4, n)) {
+		t.Errorf("Different files were given the same indices.")
+	} else if int64(len(idx)) != s.Len(3, n) {
+		t.Errorf("Len = %d, but there are %d indices.", s.Len(3, n), len(idx))
+	}
+
+	exp0 := float64(n/2)*0.25
+	if f := float64(len(idx)); f < 0.95*exp0 || f > 1.05*exp0 {
+		t.Errorf("Expected about %g indices, got %d.", exp0, len(idx))
+	}
+	for i := range idx {
+		if idx[i] % 2 != 0 || (i > 0 && idx[i] <= idx[i-1]) {
+			t.Fatalf("Index %d, %d, isn't a sorted, even number.", i, idx[i])
+		}
+	}
+}
+
+func TestSubsampleSeed(t *testing.T) {
+	n := int64(10000)
+	s1 := &Subsample{ Every: 1, Fraction: 0.5, Seed: 42 }
+	s2 := &Subsample{ Every: 1, Fraction: 0.5, Seed: 42 }
+	s3 := &Subsample{ Every: 1, Fraction: 0.5, Seed: 43 }
+
+	for file := 0; file < 4; file++ {
+		idx := s1.Indices(file, n)
+		if !reflect.DeepEqual(idx, s2.Indices(file, n)) {
+			t.Errorf("File %d: the same seed selected different particles.",
+				file)
+		} else if reflect.DeepEqual(idx, s3.Indices(file, n)) {
+			t.Errorf("File %d: different seeds selected the same particles.",
+				file)
+		}
+	}
+}
+
+func TestSubsampleCheck(t *testing.T) {
+	tests := []struct{
+		s Subsample
+		valid bool
+	} {
+		{ Subsample{ 1, 1, 0 }, true },
+		{ Subsample{ 10, 0.5, 0 }, true },
+		{ Subsample{ 0, 1, 0 }, false },
+		{ Subsample{ 1, 0, 0 }, false },
+		{ Subsample{ 1, 1.5, 0 }, false },
+	}
+
+	for i := range tests {
+		if err := tests[i].s.Check(); (err == nil) != tests[i].valid {
+			t.Errorf("%d) Expected valid = %v, got error %v.",
+				i, tests[i].valid, err)
+		}
+	}
+}
+
+func TestSubsampleBuffer(t *testing.T) {
+	idx := []int64{ 1, 2, 4 }
+
+	x := SubsampleBuffer([]float32{ 0, 1, 2, 3, 4 }, idx)
+	if exp := []float32{ 1, 2, 4 }; !reflect.DeepEqual(x, exp) {
+		t.Errorf("Expected %v, got %v.", exp, x)
+	}
+
+	v := SubsampleBuffer([][3]float64{ {0}, {1}, {2}, {3}, {4} }, idx)
+	if exp := [][3]float64{ {1}, {2}, {4} }; !reflect.DeepEqual(v, exp) {
+		t.Errorf("Expected %v, got %v.", exp, v)
+	}
+
+	p := make([]RockstarParticle, 5)
+	for i := range p { p[i].ID = uint64(i) }
+	p = SubsampleBuffer(p, idx).([]RockstarParticle)
+	if len(p) != 3 || p[0].ID != 1 || p[1].ID != 2 || p[2].ID != 4 {
+		t.Errorf("Expected IDs [1 2 4], got %v.", p)
+	}
+
+	id := []uint64{ 5, 6 }
+	if out := SubsampleBuffer(id, nil); !reflect.DeepEqual(out, id) {
+		t.Errorf("Expected nil indices to leave the buffer unchanged.")
+	}
+}
@@ -4,6 +4,7 @@ package thread
 import (
 	"fmt"
 	"runtime"
+	"sync/atomic"
 )
 
 // Set sets the number of threads used by the process. Will crash if more
@@ -172,3 +173,44 @@ func WorkerQueue(jobs, workers int, work func(job, worker int)) {
 	for i := 0; i < workers; i++ { <-lockChan }
 }
 
+// Counter counts how many of a fixed number of jobs have finished. It can be
+// shared by several calls to CountedWorkerQueue and read from other threads
+// while they run. A nil Counter ignores every job.
+type Counter struct {
+	jobs, finished int64
+}
+
+// NewCounter returns a Counter for the given number of jobs.
+func NewCounter(jobs int) *Counter {
+	return &Counter{ jobs: int64(jobs) }
+}
+
+// Jobs returns the total number of jobs.
+func (c *Counter) Jobs() int64 {
+	if c == nil { return 0 }
+	return atomic.LoadInt64(&c.jobs)
+}
+
+// Finished returns the number of jobs which have finished.
+func (c *Counter) Finished() int64 {
+	if c == nil { return 0 }
+	return atomic.LoadInt64(&c.finished)
+}
+
+// Finish records that a job has finished. It only needs to be called by
+// hand for jobs that don't run inside CountedWorkerQueue.
+func (c *Counter) Finish() {
+	if c == nil { return }
+	atomic.AddInt64(&c.finished, 1)
+}
+
+// CountedWorkerQueue works like WorkerQueue, but also records each job in c
+// once it's finished.
+func CountedWorkerQueue(
+	c *Counter, jobs, workers int, work func(worker, job int),
+) {
+	WorkerQueue(jobs, workers, func(worker, job int) {
+		work(worker, job)
+		c.Finish()
+	})
+}
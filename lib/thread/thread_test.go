@@ -110,3 +110,35 @@ func TestSplitArrayJump(t *testing.T) {
 		}
 	}
 }
+
+func TestCountedWorkerQueue(t *testing.T) {
+	tests := []struct{
+		jobs, workers int
+	} {
+		{ 1, 1 }, { 10, 3 }, { 100, 16 },
+	}
+
+	for i := range tests {
+		jobs, workers := tests[i].jobs, tests[i].workers
+		c := NewCounter(2*jobs)
+
+		// The counter is shared by two queues.
+		CountedWorkerQueue(c, jobs, workers, func(worker, job int) { })
+		if c.Finished() != int64(jobs) {
+			t.Errorf("%d) Expected %d finished jobs, got %d.",
+				i, jobs, c.Finished())
+		}
+		CountedWorkerQueue(c, jobs, workers, func(worker, job int) { })
+		if c.Finished() != int64(2*jobs) || c.Jobs() != int64(2*jobs) {
+			t.Errorf("%d) Expected %d of %d finished jobs, got %d of %d.",
+				i, 2*jobs, 2*jobs, c.Finished(), c.Jobs())
+		}
+	}
+
+	// nil counters still run every job.
+	n := int64(0)
+	CountedWorkerQueue(nil, 10, 1, func(worker, job int) { n++ })
+	if n != 10 {
+		t.Errorf("Expected a nil Counter to run 10 jobs, got %d.", n)
+	}
+}
@@ -0,0 +1,8 @@
+# Build the shared library that read_guppy.py uses to decompress variables.
+# This needs to be run from the python/ directory and requires Go.
+go build -buildmode=c-shared -o libguppy.so ../c &&
+	# go build also generates a C header that isn't needed here.
+	rm -f libguppy.h &&
+	exit 0
+# Uh oh, there's a problem
+exit 1
@@ -0,0 +1,124 @@
+/*make_test_files writes the .gup files used by python/test_read_guppy.py.
+It's called as
+
+    go run ./make_test_files <directory>
+
+and writes little_endian.gup and big_endian.gup to the directory, along with
+the uncompressed values of each variable as little-endian binary files (e.g.
+x.bin and id.bin) that the compressed values can be checked against.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/particles"
+	"github.com/phil-mansfield/guppy/lib/snapio"
+)
+
+const (
+	// Width is the width of the cube of particles in each file.
+	Width = 8
+	// L is the width of the box.
+	L = 100.0
+	XDelta, VDelta, WDelta = 1e-3, 1e-2, 1e-5
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: make_test_files <directory>")
+		os.Exit(1)
+	}
+	dir := os.Args[1]
+
+	n := Width*Width*Width
+	x, v := make([][3]float32, n), make([][3]float32, n)
+	a, b, w := make([]uint32, n), make([]uint64, n), make([]float64, n)
+	for i := 0; i < n; i++ {
+		for dim := 0; dim < 3; dim++ {
+			x[i][dim] = L*rand.Float32()
+			v[i][dim] = 1000*rand.Float32() - 500
+		}
+		a[i] = uint32(rand.Intn(1000))
+		b[i] = uint64(rand.Intn(1000)) + 1<<40
+		w[i] = rand.Float64()
+	}
+
+	writeRaw(path.Join(dir, "x.bin"), x)
+	writeRaw(path.Join(dir, "v.bin"), v)
+	writeRaw(path.Join(dir, "a.bin"), a)
+	writeRaw(path.Join(dir, "b.bin"), b)
+	writeRaw(path.Join(dir, "w.bin"), w)
+
+	writeGuppy(path.Join(dir, "little_endian.gup"),
+		binary.LittleEndian, x, v, a, b, w)
+	writeGuppy(path.Join(dir, "big_endian.gup"),
+		binary.BigEndian, x, v, a, b, w)
+}
+
+// writeRaw writes an uncompressed array to a little-endian binary file.
+func writeRaw(fname string, x interface{}) {
+	f, err := os.Create(fname)
+	if err != nil { panic(err.Error()) }
+	defer f.Close()
+	if err = binary.Write(f, binary.LittleEndian, x); err != nil {
+		panic(err.Error())
+	}
+}
+
+// writeGuppy writes all the test variables to a .gup file.
+func writeGuppy(
+	fname string, order binary.ByteOrder, x, v [][3]float32,
+	a []uint32, b []uint64, w []float64,
+) {
+	span := [3]int{ Width, Width, Width }
+	span64 := [3]int64{ Width, Width, Width }
+
+	fakeFile, err := snapio.NewFakeFile(
+		[]string{"x", "v"}, []interface{}{[]float32{}, []float32{}},
+		1000, order,
+	)
+	if err != nil { panic(err.Error()) }
+	fakeHd, err := fakeFile.ReadHeader()
+	if err != nil { panic(err.Error()) }
+
+	wr := compress.NewWriter(fname, fakeHd, span64, [3]int64{0, 0, Width},
+		[3]int64{Width, Width, 2*Width}, compress.NewBuffer(0), []byte{ },
+		order)
+	wr.Metadata.SetString("Simulation", "python_test")
+	wr.Metadata.SetInt("Seed", 1234)
+
+	vecs := []struct{
+		name string
+		data [][3]float32
+		delta, period float64
+	}{ {"x", x, XDelta, L}, {"v", v, VDelta, 0} }
+
+	for _, vec := range vecs {
+		for dim := 0; dim < 3; dim++ {
+			comp := make([]float32, len(vec.data))
+			for i := range comp { comp[i] = vec.data[i][dim] }
+			name := fmt.Sprintf("%s{%d}", vec.name, dim)
+			addField(wr, particles.NewFloat32(name, comp),
+				compress.NewLagrangianDelta(span, vec.delta, vec.period))
+		}
+	}
+
+	addField(wr, particles.NewUint32("a", a),
+		compress.NewLagrangianDelta(span, 0, 0))
+	addField(wr, particles.NewUint64("b", b),
+		compress.NewLagrangianDelta(span, 0, 0))
+	addField(wr, particles.NewFloat64("w", w),
+		compress.NewLagrangianDelta(span, WDelta, 0))
+
+	if _, err := wr.Flush(); err != nil { panic(err.Error()) }
+}
+
+func addField(wr *compress.Writer, f particles.Field, m compress.Method) {
+	if err := wr.AddField(f, m); err != nil { panic(err.Error()) }
+}
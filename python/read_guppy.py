@@ -0,0 +1,319 @@
+""" read_guppy.py contains functions for reading .gup files from Python.
+
+read_header(fname) reads a file's header and only needs the standard library.
+read_var(fname, name) decompresses a variable into a numpy array. It calls
+guppy's Go decoder through a shared library, which can be built by running
+build_library.sh in this directory. By default the library is loaded from
+libguppy.so next to this file, but a different path can be given through the
+GUPPY_LIBRARY environment variable.
+"""
+
+import ctypes
+import os
+import struct
+
+MAGIC_NUMBER = 0xbadf00d0
+# VERSION is the newest version of the .gup format that this module can read.
+VERSION = 5
+
+# _METHOD_NAMES maps method flags to the names of compression methods.
+_METHOD_NAMES = {0: "LagrangianDelta"}
+# _DEFAULT_UNITS gives the units of fields in guppy's code units. Velocities
+# use Gadget's convention, v_pec/sqrt(a), like lib/compress.DefaultUnits.
+_DEFAULT_UNITS = {"x": "cMpc/h", "v": "km/s/sqrt(a)"}
+
+# _DTYPES maps guppy type strings to numpy dtype strings.
+_DTYPES = {"u32": "u4", "u64": "u8", "f32": "f4", "f64": "f8"}
+# ROCKSTAR_PARTICLE is the numpy dtype of the "{RockstarParticle}" variable.
+# It has the same layout as lib.RockstarParticle and Guppy_RockstarParticle.
+ROCKSTAR_PARTICLE = [("id", "u8"), ("x", "f4", (3,)), ("v", "f4", (3,))]
+
+# _library is the shared library containing the Go decoder. It's loaded the
+# first time it's needed.
+_library = None
+
+class Header(object):
+    """ Header contains the header information of a .gup file.
+
+    original_header - The original header of one of the original simulation
+                      files, as a bytes object.
+    names, types    - The names of the variables stored in the file and their
+                      types. "u32"/"u64" are 32- and 64-bit unsigned integers
+                      and "f32"/"f64" are 32- and 64-bit floats.
+    sizes           - The size of each variable in bytes.
+    methods         - The compression method used for each variable.
+    deltas          - The accuracy each variable is stored to: floating point
+                      values are within deltas[i] of their original values.
+                      Integers, including "id", are exact and have a delta of
+                      0.
+    periods         - The periodicity of each variable. Non-positive for
+                      variables that aren't periodic.
+    units           - The units of each variable.
+    n, n_tot        - The number of particles in the file and in the full
+                      simulation.
+    span, offset, total_span - The dimensions of the slab of particles in the
+                      file, the ID-coordinates of its first particle, and the
+                      dimensions of the whole simulation.
+    z, omega_m, omega_l, h100, l, mass - The redshift, Omega_m, Omega_Lambda,
+                      H0 / (100 km/s/Mpc), box width in comoving Mpc/h, and
+                      particle mass in Msun/h.
+    metadata        - A dict of typed key/value metadata. Values are ints,
+                      floats, or strs. Entries with types this module doesn't
+                      recognize are returned as bytes. Empty for files written
+                      before version 4.
+    metadata_types  - A dict mapping each metadata key to its type string
+                      ("i64", "f64", or "str").
+    version         - The version of the .gup format the file was written
+                      with.
+    """
+    pass
+
+class _FileReader(object):
+    """ _FileReader reads binary values with a fixed byte order. """
+    def __init__(self, f, fname, order):
+        self.f, self.fname, self.order = f, fname, order
+
+    def bytes(self, n):
+        b = self.f.read(n)
+        if len(b) != n:
+            raise ValueError(("The file %s is incomplete: it ended before " +
+                              "guppy finished reading its header.") %
+                             self.fname)
+        return b
+
+    def values(self, fmt, n=1):
+        size = struct.calcsize("<" + fmt)
+        return struct.unpack(self.order + fmt*n, self.bytes(size*n))
+
+    def value(self, fmt):
+        return self.values(fmt)[0]
+
+    def length_prefixed(self):
+        return self.bytes(self.value("I"))
+
+def _check_file(f, fname):
+    """ _check_file reads the magic number and version of a file and returns
+    the struct byte order character and the version.
+    """
+    b = f.read(8)
+    if len(b) != 8:
+        raise ValueError("%s is not a guppy file." % fname)
+
+    if struct.unpack("<I", b[:4])[0] == MAGIC_NUMBER:
+        order = "<"
+    elif struct.unpack(">I", b[:4])[0] == MAGIC_NUMBER:
+        order = ">"
+    else:
+        raise ValueError(("%s is not a guppy file. All guppy files begin " +
+                          "with the 32-bit integer %x.") %
+                         (fname, MAGIC_NUMBER))
+
+    version = struct.unpack(order + "I", b[4:])[0]
+    if version > VERSION:
+        raise ValueError(("The file %s was created with guppy version %d, " +
+                          "but you are trying to read it with guppy version " +
+                          "%d. You can download the latest version of guppy " +
+                          "at github.com/phil-mansfield/guppy.") %
+                         (fname, version, VERSION))
+
+    return order, version
+
+def _read_metadata(rd):
+    """ _read_metadata reads the metadata section of a header and returns the
+    metadata and metadata_types dicts.
+    """
+    metadata, metadata_types = {}, {}
+    for _ in range(rd.value("I")):
+        key = rd.length_prefixed().decode("utf-8")
+        typ = rd.bytes(3).decode("ascii")
+        value = rd.length_prefixed()
+
+        if typ == "i64":
+            value = struct.unpack(rd.order + "q", value)[0]
+        elif typ == "f64":
+            value = struct.unpack(rd.order + "d", value)[0]
+        elif typ == "str":
+            value = value.decode("utf-8")
+
+        metadata[key], metadata_types[key] = value, typ
+
+    return metadata, metadata_types
+
+def _default_units(name):
+    """ _default_units returns the code units of a field with the given name.
+    """
+    for vec, units in _DEFAULT_UNITS.items():
+        if name in [vec] + ["%s{%d}" % (vec, dim) for dim in range(3)]:
+            return units
+    return ""
+
+def _read_legacy_deltas(f, order, hd, header_edges):
+    """ _read_legacy_deltas reads the deltas of files written before version
+    5 out of their LagrangianDelta method headers, which start with a 4-byte
+    method flag and a 24-byte span.
+    """
+    for i in range(len(hd.names) - 1):
+        if hd.types[i] not in ["f32", "f64"]: continue
+        f.seek(header_edges[i] + 28)
+        hd.deltas[i] = struct.unpack(order + "d", f.read(8))[0]
+
+def read_header(fname):
+    """ read_header returns the Header of the .gup file fname.
+    """
+    with open(fname, "rb") as f:
+        order, version = _check_file(f, fname)
+        rd = _FileReader(f, fname, order)
+
+        hd = Header()
+        hd.version = version
+        hd.n, hd.n_tot = rd.values("q", 2)
+        hd.span = rd.values("q", 3)
+        hd.offset = rd.values("q", 3)
+        hd.total_span = rd.values("q", 3)
+        (hd.z, hd.omega_m, hd.omega_l,
+         hd.h100, hd.l, hd.mass) = rd.values("d", 6)
+
+        hd.original_header = rd.length_prefixed()
+
+        n_fields = rd.value("I")
+        name_lengths = rd.values("I", n_fields)
+        hd.names = [rd.bytes(n).decode("utf-8") for n in name_lengths]
+        hd.types = [rd.bytes(3).decode("ascii") for _ in range(n_fields)]
+        hd.names.append("id")
+        hd.types.append("u64")
+
+        hd.metadata, hd.metadata_types = {}, {}
+        if version >= 4:
+            hd.metadata, hd.metadata_types = _read_metadata(rd)
+
+        hd.deltas = [0.0]*(n_fields + 1)
+        hd.periods = [0.0]*(n_fields + 1)
+        hd.units = [""]*(n_fields + 1)
+        if version >= 5:
+            for i in range(n_fields):
+                hd.deltas[i], hd.periods[i] = rd.values("d", 2)
+                hd.units[i] = rd.length_prefixed().decode("utf-8")
+        else:
+            # Older files didn't store this: positions were always periodic
+            # and everything was in code units.
+            for i in range(n_fields):
+                if hd.names[i] in ["x", "x{0}", "x{1}", "x{2}"]:
+                    hd.periods[i] = hd.l
+                hd.units[i] = _default_units(hd.names[i])
+
+        # The methods and sizes of each field come from the navigation
+        # information that follows the header.
+        method_flags = rd.values("I", n_fields)
+        header_edges = rd.values("q", n_fields + 1)
+        data_edges = rd.values("q", n_fields + 1)
+        hd.methods = [_METHOD_NAMES.get(flag, "Unknown(%d)" % flag)
+                      for flag in method_flags] + ["None"]
+        hd.sizes = [(data_edges[i+1] - data_edges[i]) +
+                    (header_edges[i+1] - header_edges[i])
+                    for i in range(n_fields)] + [0]
+
+        if version < 5:
+            _read_legacy_deltas(f, order, hd, header_edges)
+
+    return hd
+
+def _load_library():
+    """ _load_library loads the shared library containing guppy's decoder.
+    """
+    global _library
+    if _library is not None: return _library
+
+    path = os.environ.get("GUPPY_LIBRARY", os.path.join(
+        os.path.dirname(os.path.abspath(__file__)), "libguppy.so"))
+    if not os.path.exists(path):
+        raise IOError(("Could not find guppy's shared library at %s. Run " +
+                       "python/build_library.sh to build it, or set the " +
+                       "GUPPY_LIBRARY environment variable to its location.") %
+                      path)
+
+    lib = ctypes.CDLL(path)
+    lib.ReadVarError.argtypes = [ctypes.c_char_p, ctypes.c_char_p,
+                                 ctypes.c_int, ctypes.c_void_p]
+    # This is a char*, but it needs to be freed, so it can't be converted to
+    # a Python string automatically.
+    lib.ReadVarError.restype = ctypes.c_void_p
+    lib.DerivedVarType.argtypes = [ctypes.c_char_p]
+    lib.DerivedVarType.restype = ctypes.c_void_p
+    lib.free.argtypes = [ctypes.c_void_p]
+
+    _library = lib
+    return _library
+
+def _read_into(fname, name, ptr):
+    """ _read_into decompresses the variable name from the file fname into
+    the buffer at the address ptr, which must be large enough to hold it.
+    """
+    lib = _load_library()
+    msg = lib.ReadVarError(fname.encode("utf-8"), name.encode("utf-8"),
+                           -1, ptr)
+    if msg is not None:
+        err = ctypes.string_at(msg).decode("utf-8")
+        lib.free(msg)
+        raise ValueError(err)
+
+def var_type(hd, name):
+    """ var_type returns the numpy dtype and shape of the array read_var
+    returns for the variable name in a file with the Header hd. Vectors
+    like "x" (made of "x{0}", "x{1}", and "x{2}") have shape (n, 3), and
+    "{RockstarParticle}" is a structured array with the dtype
+    ROCKSTAR_PARTICLE. Other derived variables, like "{Displacement}", get
+    their types from the Go reader, so they need the shared library.
+    Everything else has shape (n,).
+    """
+    if name == "{RockstarParticle}":
+        for comp in ["x{0}", "x{1}", "x{2}", "v{0}", "v{1}", "v{2}"]:
+            if comp not in hd.names or hd.types[hd.names.index(comp)] != "f32":
+                raise ValueError(("{RockstarParticle} can only be read from " +
+                                  "files containing the f32 variables " +
+                                  "x{0}, x{1}, x{2}, v{0}, v{1}, and v{2}. " +
+                                  "This file only contains %s.") % hd.names)
+        return ROCKSTAR_PARTICLE, (hd.n,)
+
+    if name in hd.names:
+        return _DTYPES[hd.types[hd.names.index(name)]], (hd.n,)
+
+    if name.startswith("{"):
+        # Derived variables are listed by the Go reader. Missing
+        # prerequisites are reported by read_var.
+        lib = _load_library()
+        ptr = lib.DerivedVarType(name.encode("utf-8"))
+        if ptr is not None:
+            typ = ctypes.string_at(ptr).decode("utf-8")
+            lib.free(ptr)
+            if typ[0] == "v":
+                return _DTYPES["f" + typ[1:]], (hd.n, 3)
+            return _DTYPES[typ], (hd.n,)
+
+    comps = ["%s{%d}" % (name, dim) for dim in range(3)]
+    if all(comp in hd.names for comp in comps):
+        types = [hd.types[hd.names.index(comp)] for comp in comps]
+        if types[0] in ["f32", "f64"] and types.count(types[0]) == 3:
+            return _DTYPES[types[0]], (hd.n, 3)
+
+    raise ValueError(("The file does not have a variable named '%s'. It only " +
+                      "has the variables %s, along with vectors made from " +
+                      "'{0}', '{1}', and '{2}' components and derived " +
+                      "variables like '{RockstarParticle}'.") %
+                     (name, hd.names))
+
+def read_var(fname, name, hd=None):
+    """ read_var reads the variable name from the .gup file fname and returns
+    it as a numpy array with the dtype and shape given by var_type(). If the
+    file's Header has already been read, it can be passed as hd to avoid
+    reading it again.
+
+    Floating point variables are only accurate to the deltas in the file's
+    Header.
+    """
+    import numpy as np
+
+    if hd is None: hd = read_header(fname)
+    dtype, shape = var_type(hd, name)
+    out = np.empty(shape, dtype=dtype)
+    _read_into(fname, name, out.ctypes.data)
+    return out
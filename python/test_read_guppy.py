@@ -0,0 +1,125 @@
+""" test_read_guppy.py checks read_guppy.py against files written by guppy's
+compress.Writer. Run it from the python/ directory with
+
+    python3 -m unittest test_read_guppy
+
+It requires Go and numpy. The shared library and test files are built in a
+temporary directory, so build_library.sh doesn't need to be run first.
+"""
+
+import os
+import shutil
+import subprocess
+import tempfile
+import unittest
+
+import numpy as np
+
+import read_guppy
+
+# These need to match make_test_files/main.go.
+WIDTH = 8
+L = 100.0
+X_DELTA, V_DELTA, W_DELTA = 1e-3, 1e-2, 1e-5
+OFFSET, TOTAL_SPAN = (0, 0, WIDTH), (WIDTH, WIDTH, 2*WIDTH)
+
+class TestReadGuppy(unittest.TestCase):
+    @classmethod
+    def setUpClass(cls):
+        cls.dir = tempfile.mkdtemp()
+        here = os.path.dirname(os.path.abspath(__file__))
+
+        lib = os.path.join(cls.dir, "libguppy.so")
+        subprocess.check_call(["go", "build", "-buildmode=c-shared",
+                               "-o", lib, "../c"], cwd=here)
+        subprocess.check_call(["go", "run", "./make_test_files", cls.dir],
+                              cwd=here)
+        os.environ["GUPPY_LIBRARY"] = lib
+
+        def raw(name, dtype):
+            return np.fromfile(os.path.join(cls.dir, name + ".bin"),
+                               dtype=np.dtype(dtype).newbyteorder("<"))
+
+        n = WIDTH**3
+        cls.x = raw("x", "f4").reshape(n, 3)
+        cls.v = raw("v", "f4").reshape(n, 3)
+        cls.a, cls.b, cls.w = raw("a", "u4"), raw("b", "u8"), raw("w", "f8")
+
+        i = np.arange(n, dtype=np.uint64)
+        ix, iy, iz = i % WIDTH, (i // WIDTH) % WIDTH, i // (WIDTH*WIDTH)
+        cls.id = (1 + (iz + OFFSET[2]) + (iy + OFFSET[1])*TOTAL_SPAN[2] +
+                  (ix + OFFSET[0])*TOTAL_SPAN[2]*TOTAL_SPAN[1])
+
+        cls.files = [os.path.join(cls.dir, "little_endian.gup"),
+                     os.path.join(cls.dir, "big_endian.gup")]
+
+    def assertPositions(self, x):
+        # Positions are periodic, so values can wrap around the box.
+        dx = np.abs(x - self.x)
+        self.assertTrue(np.all(np.minimum(dx, L - dx) <= X_DELTA))
+
+    @classmethod
+    def tearDownClass(cls):
+        shutil.rmtree(cls.dir)
+
+    def test_header(self):
+        for fname in self.files:
+            hd = read_guppy.read_header(fname)
+            self.assertEqual(hd.n, WIDTH**3)
+            self.assertEqual(tuple(hd.span), (WIDTH, WIDTH, WIDTH))
+            self.assertEqual(tuple(hd.offset), OFFSET)
+            self.assertEqual(tuple(hd.total_span), TOTAL_SPAN)
+            self.assertEqual(hd.names, ["x{0}", "x{1}", "x{2}", "v{0}",
+                                        "v{1}", "v{2}", "a", "b", "w", "id"])
+            self.assertEqual(hd.types, ["f32"]*6 + ["u32", "u64", "f64", "u64"])
+            self.assertEqual(hd.periods, [L]*3 + [0.0]*7)
+            self.assertEqual(hd.units, ["cMpc/h"]*3 + ["km/s/sqrt(a)"]*3 +
+                             [""]*4)
+            self.assertEqual(hd.metadata["Simulation"], "python_test")
+            self.assertEqual(hd.metadata["Seed"], 1234)
+
+    def test_read_var(self):
+        for fname in self.files:
+            x = read_guppy.read_var(fname, "x")
+            self.assertEqual((x.dtype, x.shape), (np.float32, (WIDTH**3, 3)))
+            self.assertPositions(x)
+
+            v1 = read_guppy.read_var(fname, "v{1}")
+            self.assertEqual((v1.dtype, v1.shape), (np.float32, (WIDTH**3,)))
+            self.assertTrue(np.all(np.abs(v1 - self.v[:,1]) <= V_DELTA))
+
+            a = read_guppy.read_var(fname, "a")
+            self.assertEqual(a.dtype, np.uint32)
+            self.assertTrue(np.array_equal(a, self.a))
+
+            b = read_guppy.read_var(fname, "b")
+            self.assertEqual(b.dtype, np.uint64)
+            self.assertTrue(np.array_equal(b, self.b))
+
+            w = read_guppy.read_var(fname, "w")
+            self.assertEqual(w.dtype, np.float64)
+            self.assertTrue(np.all(np.abs(w - self.w) <= W_DELTA))
+
+            ids = read_guppy.read_var(fname, "id")
+            self.assertEqual(ids.dtype, np.uint64)
+            self.assertTrue(np.array_equal(ids, self.id))
+
+    def test_rockstar_particle(self):
+        for fname in self.files:
+            rs = read_guppy.read_var(fname, "{RockstarParticle}")
+            self.assertEqual(rs.dtype.itemsize, 32)
+            self.assertTrue(np.array_equal(rs["id"], self.id))
+            self.assertPositions(rs["x"])
+            self.assertTrue(np.all(np.abs(rs["v"] - self.v) <= V_DELTA))
+
+    def test_errors(self):
+        with self.assertRaises(ValueError):
+            read_guppy.read_var(self.files[0], "not_a_variable")
+        with self.assertRaises(ValueError):
+            # a isn't a vector, so there's no a{0}.
+            read_guppy.var_type(read_guppy.read_header(self.files[0]), "a{0}")
+        with self.assertRaises(IOError):
+            read_guppy.read_header(os.path.join(self.dir, "missing.gup"))
+
+if __name__ == "__main__":
+    unittest.main()
@@ -1,21 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/phil-mansfield/guppy/lib"
+	"github.com/phil-mansfield/guppy/lib/compress"
 	"github.com/phil-mansfield/guppy/lib/config"
 	"github.com/phil-mansfield/guppy/lib/format"
+	"github.com/phil-mansfield/guppy/lib/logging"
+	"github.com/phil-mansfield/guppy/lib/particles"
 	"github.com/phil-mansfield/guppy/lib/thread"
 	guppy "github.com/phil-mansfield/guppy/go"
-
-	"reflect"
-	"unsafe"
 )
 
 const (
@@ -26,17 +31,6 @@ const (
 	ExampleConfigMode
 	CreatePipesMode
 	DeletePipesMode
-
-	// *Format constants are internal values indicating which format
-	// output/input is in.
-	RockstarFormat = iota
-)
-
-var (
-	// Version is the version of the software. This can potentially be used
-	// to differentiate between breaking changes to the input/output format.
-	Version uint64 = 0x1
-	RockstarFormatCode uint64 = 0xffffffff00000001
 )
 
 func main() {
@@ -61,8 +55,12 @@ func main() {
 
 	// Run the server in the selected mode
 	switch mode {
-	case ReadMode: Read(conf, first, last)
-	case WriteMode: Write(conf, first, last)
+	case ReadMode:
+		log, interval := GetLogger(conf, os.Stderr, "server_read")
+		Read(conf, log, interval, first, last)
+	case WriteMode:
+		log, interval := GetLogger(conf, os.Stderr, "server_write")
+		Write(conf, log, interval, first, last)
 	case CreatePipesMode: CreatePipes(conf)
 	case DeletePipesMode: DeletePipes(conf)
 	case ExampleConfigMode: ExampleConfig()
@@ -78,6 +76,9 @@ func main() {
 type Config struct {
 	Format, GuppyFiles, PipeDirectory, Snapshots string
 	Blocks, Threads int64
+	LogFormat, ProgressInterval string
+	Vars, Types []string
+	Accuracies []float64
 }
 
 // ParseConfig parses the config file with the name confName.
@@ -91,6 +92,11 @@ func ParseConfig(confName string) *Config {
 	vars.String(&conf.Snapshots, "Snapshots", "")
 	vars.Int(&conf.Blocks, "Blocks", -1)
 	vars.Int(&conf.Threads, "Threads", -1)
+	vars.String(&conf.LogFormat, "LogFormat", "text")
+	vars.String(&conf.ProgressInterval, "ProgressInterval", "")
+	vars.Strings(&conf.Vars, "Vars", []string{ })
+	vars.Strings(&conf.Types, "Types", []string{ })
+	vars.Floats(&conf.Accuracies, "Accuracies", []float64{ })
 
 	err := config.ReadConfig(confName, vars)
 	if err != nil {
@@ -276,11 +282,18 @@ PipeDirectory = path/to/pipes/
 ## read and write modes    ##
 #############################
 
-# Format tells the server what format to use when writing data to the pipes.
-# currently the only supported format is "rockstar". See the online
-# documentation for a description of this format.
+# Format tells the server what format to use when writing data to the pipes
+# (read mode) or reading data from them (write mode). The supported formats are
+#   rockstar - an array of (id, x, v) structs, as used by Rockstar.
+#   potential - an array of (id, x, v, phi) structs.
+#   arrays - one array for each of the variables listed in Vars.
+# See docs/pipes.md for the byte layout of each format.
 Format = rockstar
 
+# Vars lists the variables sent through the pipes by the "arrays" format. It's
+# ignored by the other formats, which always send the same variables.
+Vars = x, v
+
 # Snapshots is a string representing the snapshots used by the input. In most
 # cases, this string will be MinSnapshot..MaxSnapshot and will enumerate all the
 # snapshots in the range [MinSnapshot, MaxSnapshot].
@@ -298,21 +311,40 @@ Snapshots = 0..100 - 63
 # specify how a value is printed. Input files will generally be at some 
 # extended path with integers at various locations which represent snapshots
 # and blocks. You can specify where these numbers are by placing them in braces 
-# with the form {integer_format:variable_name}. "variable_name" should be either
+# with the form {integer_format,variable_name}. "variable_name" should be either
 # "snapshot"  or "block", and "integer_format" should be a valid C-style printf
 # verb (e.g.  %03d will convert 97 to 097).
-GuppyFiles = path/to/sim/snapdir_{%03d:snapshot}/snapshot_{%03d:snapshot}.{%d:block}.gup
+GuppyFiles = path/to/sim/snapdir_{%03d,snapshot}/snapshot_{%03d,snapshot}.{%d,block}.gup
 
 # Number of threads to use during execution. If set to -1, one thread will be
 # used for each core on the node.
 Threads = -1
 
+# LogFormat is the format of the log written to stderr by the read and write
+# modes: "text" or "json". Each block that's read or written is logged with
+# its timings, sizes, and compression ratio, along with an estimate of the
+# time left.
+LogFormat = text
+
+# If ProgressInterval is set, a progress line with the fraction of blocks
+# finished is logged this often, e.g. 30s or 5m.
+# ProgressInterval = 1m
+
 #########################
 ## Variables needed by ##
 ## the write mode      ##
 #########################
 
-# Not yet implemented
+# Types gives the types of the variables in Vars (u32, u64, f32, f64, v32, or
+# v64). It's only needed by the "arrays" format.
+Types = v32, v32
+
+# Accuracies gives the accuracy that each variable sent through the pipes will
+# be stored to, in the same order the format sends them: id, x, v for
+# "rockstar", id, x, v, phi for "potential", and Vars for "arrays". Integers
+# must have an accuracy of 0. Particle IDs aren't stored directly: particles
+# must be sent in the same Lagrangian order that .gup files use.
+Accuracies = 0, 0.001, 1
 `)
 	os.Exit(0)
 }
@@ -348,37 +380,100 @@ func DeletePipes(conf *Config) {
 	}
 }
 
+
 // Read reads guppy files from disk and writes uncompressed data to pipes.
-func Read(conf *Config, first, last int) {
+// Each block is logged to log, along with a progress line every interval if
+// it's positive.
+func Read(
+	conf *Config, log *logging.Logger, interval time.Duration,
+	first, last int,
+) {
 	snaps := GetSnaps(conf)
+	pipeFormat := GetPipeFormat(conf)
 	
 	workers, jobs := int(conf.Threads), last - first + 1
 	guppy.InitWorkers(workers)
-	//workers = jobs
 
-	bufs := make([][]guppy.RockstarParticle, workers)
-	
-	var format int
-	switch conf.Format {
-	case "rockstar": format = RockstarFormat
-	default:
-		fmt.Fprintf(os.Stderr, "Unrecognized 'Format' variable, '%s'.\n",
-			conf.Format)
-		os.Exit(1)
-	}
+	bufs := make([][]interface{}, workers)
+
+	prog := logging.NewProgress(log, len(snaps)*jobs)
+	prog.Start(interval)
 	
 	for _, snap := range snaps {
 		// Use a queue to assign threads to different pipes.
-		thread.WorkerQueue(workers, jobs, func(worker, job int) {
-			fmt.Fprintf(os.Stderr, "worker %d job %d\n", worker, job)
-			switch format {
-			case RockstarFormat:
-				GuppyToPipeRockstar(conf, worker, job+first, snap, bufs)
-			default:
-				panic("Internal error")
-			}
-		})
+		read := func(worker, job int) {
+			block := job + first
+			stats := GuppyToPipe(conf, log, pipeFormat, worker, block, snap,
+				bufs)
+			prog.File(stats, "snapshot", snap, "block", block,
+				"worker", worker)
+		}
+		thread.CountedWorkerQueue(prog.Counter, jobs, workers, read)
 	}
+
+	prog.Stop()
+}
+
+// Write reads uncompressed particles from pipes and compresses them into
+// .gup files. It logs to log in the same way as Read.
+func Write(
+	conf *Config, log *logging.Logger, interval time.Duration,
+	first, last int,
+) {
+	snaps := GetSnaps(conf)
+	pipeFormat := GetPipeFormat(conf)
+
+	workers, jobs := int(conf.Threads), last - first + 1
+	bufs := make([][]interface{}, workers)
+	compressBufs := make([]*compress.Buffer, workers)
+	midBufs := make([][]byte, workers)
+	for i := range compressBufs {
+		compressBufs[i] = compress.NewBuffer(0)
+		midBufs[i] = []byte{ }
+	}
+
+	prog := logging.NewProgress(log, len(snaps)*jobs)
+	prog.Start(interval)
+
+	for _, snap := range snaps {
+		write := func(worker, job int) {
+			block := job + first
+			var stats *logging.FileStats
+			midBufs[worker], stats = PipeToGuppy(conf, log, pipeFormat,
+				worker, block, snap, bufs, compressBufs[worker],
+				midBufs[worker])
+			prog.File(stats, "snapshot", snap, "block", block,
+				"worker", worker)
+		}
+		thread.CountedWorkerQueue(prog.Counter, jobs, workers, write)
+	}
+
+	prog.Stop()
+}
+
+// GetLogger returns a logger which writes a server mode's log to w and the
+// interval between its progress lines.
+func GetLogger(
+	conf *Config, w io.Writer, mode string,
+) (*logging.Logger, time.Duration) {
+	format, err := logging.ParseFormat(conf.LogFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid 'LogFormat' variable: %s\n",
+			err.Error())
+		os.Exit(1)
+	}
+
+	interval := time.Duration(0)
+	if conf.ProgressInterval != "" {
+		interval, err = time.ParseDuration(conf.ProgressInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot parse the 'ProgressInterval' " +
+				"variable, '%s': %s\n", conf.ProgressInterval, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	return logging.New(w, format, mode), interval
 }
 
 // GetSnaps return the target snapshots.
@@ -393,130 +488,389 @@ func GetSnaps(conf *Config) []int {
 	return snaps
 }
 
-// Write reads uncompressed particles from pipes and compresses them into
-// .gup files.
-func Write(conf *Config, first, last int) {
-	panic("NYI")
+// GetPipeFormat returns the pipe format selected by the config file.
+func GetPipeFormat(conf *Config) lib.PipeFormat {
+	pipeFormat, err := lib.PipeFormatByName(conf.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unrecognized 'Format' variable: %s\n",
+			err.Error())
+		os.Exit(1)
+	}
+	return pipeFormat
 }
 
-/////////////////////////////////////
-// Rockstar-format reading/writing //
-/////////////////////////////////////
-
-// GuppyToPipeRockstar converts a guppy file into a data stream through a
-// pipe formatted as rockstar particles.
-func GuppyToPipeRockstar(
-	conf *Config, worker, block, snap int,
-	buf [][]guppy.RockstarParticle, 
-) {
+// GuppyFileName returns the name of the .gup file for a given snapshot and
+// block.
+func GuppyFileName(conf *Config, snap, block int) string {
 	vars := map[string]int{ "snapshot": snap, "block": block }	
 	guppyName, err := format.ExpandFormatString(conf.GuppyFiles, vars)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not parse 'GuppyFiles': %s", err.Error())
+		fmt.Fprintf(os.Stderr, "Could not parse 'GuppyFiles': %s\n",
+			err.Error())
 		os.Exit(1)
 	} else if len(guppyName) != 1 {
 		fmt.Fprintf(os.Stderr, "Could not parse 'GuppyFiles': '%s' results " +
-			"in %d names per snapshot-block pair.", err.Error())
+			"in %d names per snapshot-block pair.\n", conf.GuppyFiles,
+			len(guppyName))
 		os.Exit(1)
 	}
+	return guppyName[0]
+}
 
-	hd := guppy.ReadHeader(guppyName[0])
-	
-	if len(buf[worker]) == 0 {
-		buf[worker] = make([]guppy.RockstarParticle, hd.N)
-	} else if len(buf[worker]) != int(hd.N) {
-		fmt.Fprintf(os.Stderr, "%s contains %d particles, but the previous " +
-			"the same block in the previously read snapshot had %d " +
-			"particles. Each guppy block must be the same size across all " +
-			"snapshots. You probably got in this situation because someone " +
-			"manually ran guppy on different snapshots with different block " +
-			"sizes. In that case, you'll need to manually read the different " +
-			"snapshots separately, as well.\n", guppyName, hd.N,
-			len(buf[worker]))
-		os.Exit(1)
+// PipeName returns the name of the pipe used by a given block.
+func PipeName(conf *Config, block int) string {
+	return path.Join(conf.PipeDirectory, fmt.Sprintf("pipe.%d", block))
+}
+
+// PipeBuffers returns buffers with the given types and length n, reusing buf
+// if it already has the right types and length.
+func PipeBuffers(buf []interface{}, types []string, n int64) []interface{} {
+	if len(buf) == len(types) {
+		reuse := true
+		for i := range buf {
+			if BufferType(buf[i]) != types[i] || BufferLen(buf[i]) != n {
+				reuse = false
+			}
+		}
+		if reuse { return buf }
 	}
 
-	fmt.Printf("Reading %s with worker %d, block %d, snap %d\n",
-		guppyName[0], worker, block, snap)
-	guppy.ReadVar(guppyName[0], "[RockstarParticle]", -2, buf[worker])
+	buf = make([]interface{}, len(types))
+	for i := range types {
+		switch types[i] {
+		case "u32": buf[i] = make([]uint32, n)
+		case "u64": buf[i] = make([]uint64, n)
+		case "f32": buf[i] = make([]float32, n)
+		case "f64": buf[i] = make([]float64, n)
+		case "v32": buf[i] = make([][3]float32, n)
+		case "v64": buf[i] = make([][3]float64, n)
+		default:
+			fmt.Fprintf(os.Stderr, "Unrecognized variable type, '%s'. Types " +
+				"must be u32, u64, f32, f64, v32, or v64.\n", types[i])
+			os.Exit(1)
+		}
+	}
+	return buf
+}
 
-	WriteRockstarToPipe(conf, hd, buf[worker], worker, block, snap)
+// BufferType returns the type string of a buffer allocated by PipeBuffers.
+func BufferType(buf interface{}) string {
+	switch buf.(type) {
+	case []uint32: return "u32"
+	case []uint64: return "u64"
+	case []float32: return "f32"
+	case []float64: return "f64"
+	case [][3]float32: return "v32"
+	case [][3]float64: return "v64"
+	}
+	return ""
 }
 
-// WriteRockstarToPipe handles the actual disk writes that make up
-// GuppyToPipeRockstar.
-func WriteRockstarToPipe(
-	conf *Config, hd *guppy.Header, buf []guppy.RockstarParticle,
-	worker, block, snap int,
-) {
-	pipeName := path.Join(conf.PipeDirectory, fmt.Sprintf("pipe.%d", block))
-	fmt.Fprintf(os.Stderr, "Trying to open pipe, %s.\n", pipeName)
+// BufferLen returns the length of a buffer allocated by PipeBuffers.
+func BufferLen(buf interface{}) int64 {
+	switch x := buf.(type) {
+	case []uint32: return int64(len(x))
+	case []uint64: return int64(len(x))
+	case []float32: return int64(len(x))
+	case []float64: return int64(len(x))
+	case [][3]float32: return int64(len(x))
+	case [][3]float64: return int64(len(x))
+	}
+	return -1
+}
+
+//////////////////////////////
+// Pipe reading and writing //
+//////////////////////////////
+
+// GuppyToPipe reads a guppy file and writes its particles to a pipe in the
+// given format. It returns the time and size of the file's reads and writes.
+func GuppyToPipe(
+	conf *Config, log *logging.Logger, pipeFormat lib.PipeFormat,
+	worker, block, snap int, bufs [][]interface{},
+) *logging.FileStats {
+	guppyName := GuppyFileName(conf, snap, block)
+	hd := guppy.ReadHeader(guppyName)
+
+	// Only the "arrays" format uses the types of the requested variables.
+	types := make([]string, len(conf.Vars))
+	for i := range types {
+		types[i], _ = guppy.VarType(hd, conf.Vars[i])
+	}
+	names, types, err := pipeFormat.Vars(conf.Vars, types)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid 'Vars' variable: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	for i := range names {
+		typ, err := guppy.VarType(hd, names[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "The '%s' format can't be used with %s: " +
+				"%s\n", pipeFormat.Name(), guppyName, err.Error())
+			os.Exit(1)
+		} else if typ != types[i] {
+			fmt.Fprintf(os.Stderr, "The '%s' format needs '%s' to have " +
+				"type '%s', but it has type '%s' in %s.\n", pipeFormat.Name(),
+				names[i], types[i], typ, guppyName)
+			os.Exit(1)
+		}
+	}
+
+	bufs[worker] = PipeBuffers(bufs[worker], types, hd.N)
+	stats := &logging.FileStats{ File: guppyName, Decompressed: true }
+
+	start := time.Now()
+	for i := range names {
+		guppy.ReadVar(guppyName, names[i], worker, bufs[worker][i])
+	}
+	stats.ReadTime = time.Since(start)
+	if info, err := os.Stat(guppyName); err == nil {
+		stats.BytesIn = info.Size()
+	}
+
+	pipeName := PipeName(conf, block)
+	// Opening a pipe blocks until the other end is opened, so this is
+	// logged in case the server seems to be stuck.
+	log.Log("open_pipe", "pipe", pipeName, "snapshot", snap,
+		"block", block, "worker", worker)
 	pipe, err := os.OpenFile(pipeName, os.O_WRONLY, 0600)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not open pipe '%s': %s",
+		fmt.Fprintf(os.Stderr, "Could not open pipe '%s': %s\n",
 			pipeName, err.Error())
 		os.Exit(1)
 	}
-	fmt.Fprintf(os.Stderr, "Opened pipe, %s.\n", pipeName)
+	defer pipe.Close()
+
+	order := lib.SystemByteOrder()
+	pipeHd := &lib.PipeHeader{
+		Version: lib.Version, Format: pipeFormat.Code(),
+		N: hd.N, NTot: hd.NTot,
+		Span: hd.Span, Origin: hd.Offset, TotalSpan: hd.TotalSpan,
+		Z: hd.Z, OmegaM: hd.OmegaM, OmegaL: hd.OmegaL, H100: hd.H100,
+		L: hd.L, Mass: hd.Mass,
+	}
+
+	start = time.Now()
+	wr := &CountingWriter{ w: pipe }
+	err = lib.WritePipeHeader(wr, order, pipeHd)
+	if err == nil { err = pipeFormat.Write(wr, order, bufs[worker]) }
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Worker %d could not write block %d, snap " +
+			"%d to its pipe: %s\n", worker, block, snap, err.Error())
+		os.Exit(1)
+	}
+	stats.WriteTime, stats.BytesOut = time.Since(start), wr.n
+
+	return stats
+}
 
+// PipeToGuppy reads particles in the given format from a pipe and compresses
+// them into a guppy file. buf and midBuf are the buffers used during
+// compression, and the updated midBuf is returned along with the time and
+// size of the file's reads, compression, and writes.
+func PipeToGuppy(
+	conf *Config, log *logging.Logger, pipeFormat lib.PipeFormat,
+	worker, block, snap int, bufs [][]interface{}, buf *compress.Buffer,
+	midBuf []byte,
+) ([]byte, *logging.FileStats) {
+	pipeName := PipeName(conf, block)
+	log.Log("open_pipe", "pipe", pipeName, "snapshot", snap,
+		"block", block, "worker", worker)
+	pipe, err := os.OpenFile(pipeName, os.O_RDONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open pipe '%s': %s\n",
+			pipeName, err.Error())
+		os.Exit(1)
+	}
 	defer pipe.Close()
 
-	order := GetSystemOrder()
-	rsHeader := GuppyToRockstarHeader(hd)
+	start := time.Now()
+	rd := &CountingReader{ r: pipe }
+	hd, order, err := lib.ReadPipeHeader(rd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read the header of pipe '%s': %s\n",
+			pipeName, err.Error())
+		os.Exit(1)
+	} else if hd.Format != pipeFormat.Code() {
+		fmt.Fprintf(os.Stderr, "The config file uses the '%s' format, " +
+			"which has code %x, but pipe '%s' has format code %x.\n",
+			pipeFormat.Name(), pipeFormat.Code(), pipeName, hd.Format)
+		os.Exit(1)
+	} else if hd.N != hd.Span[0]*hd.Span[1]*hd.Span[2] {
+		fmt.Fprintf(os.Stderr, "Pipe '%s' has N = %d, but Span = %d.\n",
+			pipeName, hd.N, hd.Span)
+		os.Exit(1)
+	}
 
-	fmt.Printf("Writing header with worker %d, block %d, snap %d\n",
-		worker, block, snap)
-	err = binary.Write(pipe, order, rsHeader)
+	names, types, err := pipeFormat.Vars(conf.Vars, conf.Types)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Worker %d could not write the rockstar " +
-			"header of block %d, snap %d to its pipe. %s", worker, block, snap,
+		fmt.Fprintf(os.Stderr, "Invalid 'Vars' or 'Types' variables: %s\n",
 			err.Error())
 		os.Exit(1)
+	} else if len(conf.Accuracies) != len(names) {
+		fmt.Fprintf(os.Stderr, "The '%s' format sends the variables %s, " +
+			"but %d accuracies were given.\n", pipeFormat.Name(), names,
+			len(conf.Accuracies))
+		os.Exit(1)
 	}
 
-	sliceHd := *(*reflect.SliceHeader)(unsafe.Pointer(&buf))
-	sliceHd.Len *= 32
-	sliceHd.Cap *= 32	
+	bufs[worker] = PipeBuffers(bufs[worker], types, hd.N)
 
-	fmt.Printf("Writing particle with worker %d, block %d, snap %d\n",	
-		worker, block, snap)
-	b := *(*[]byte)(unsafe.Pointer(&sliceHd))
-	_, err = pipe.Write(b)
+	err = pipeFormat.Read(rd, order, bufs[worker])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Worker %d could not write the rockstar " +
-			"particles in block %d, snap %d to its pipe. %s.\n", worker, block,
-			snap, err.Error())
+		fmt.Fprintf(os.Stderr, "Worker %d could not read block %d, snap " +
+			"%d from its pipe: %s\n", worker, block, snap, err.Error())
 		os.Exit(1)
 	}
-	
-	sliceHd.Len /= 32
-	sliceHd.Cap /= 32
 
-	fmt.Printf("Finished writing with worker %d, block %d, snap %d\n",	
-		worker, block, snap)
+	guppyName := GuppyFileName(conf, snap, block)
+	stats := &logging.FileStats{ File: guppyName,
+		ReadTime: time.Since(start), BytesIn: rd.n }
+	wr := compress.NewWriter(guppyName, &PipeSnapioHeader{ hd, order },
+		hd.Span, hd.Origin, hd.TotalSpan, buf, midBuf, order)
+
+	start = time.Now()
+	for i := range names {
+		if names[i] == "id" {
+			// IDs are stored implicitly by the particles' order.
+			err = CheckIDs(hd, bufs[worker][i])
+		} else {
+			err = AddFields(wr, hd, names[i], conf.Accuracies[i],
+				bufs[worker][i])
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write '%s' to %s: %s\n",
+				names[i], guppyName, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	stats.CompressTime = time.Since(start)
+
+	start = time.Now()
+	midBuf, err = wr.Flush()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write %s: %s\n",
+			guppyName, err.Error())
+		os.Exit(1)
+	}
+	stats.WriteTime = time.Since(start)
+	if info, err := os.Stat(guppyName); err == nil {
+		stats.BytesOut = info.Size()
+	}
+
+	return midBuf, stats
 }
 
-// GetSystemOrder returns the byte ordering of the current system.
-func GetSystemOrder() binary.ByteOrder {
-    buf := [2]byte{ }
-    *(*uint16)(unsafe.Pointer(&buf[0])) = uint16(1)
-	if buf == [2]byte{ 0, 1 } { return binary.BigEndian }
-	return binary.LittleEndian
+// CountingWriter is an io.Writer which counts the bytes written to it.
+type CountingWriter struct {
+	w io.Writer
+	n int64
 }
 
-// RockstarHeader is the first block of data written to pipes in the Rockstar
-// format.
-type RockstarHeader struct {
-	Version, Format uint64
-	N, NTot int64
-    Span [3]int64
-    Z, OmegaM, OmegaL, H100, L, Mass float64
+func (wr *CountingWriter) Write(b []byte) (int, error) {
+	n, err := wr.w.Write(b)
+	wr.n += int64(n)
+	return n, err
 }
 
-// GuppyToRockstarHeader converts a Guppy header to a Rockstar header.
-func GuppyToRockstarHeader(hd *guppy.Header) *RockstarHeader {
-	return &RockstarHeader{
-		Version, RockstarFormatCode, hd.N, hd.NTot, hd.Span,
-		hd.Z, hd.OmegaM, hd.OmegaL, hd.H100, hd.L, hd.Mass,
+// CountingReader is an io.Reader which counts the bytes read from it.
+type CountingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (rd *CountingReader) Read(b []byte) (int, error) {
+	n, err := rd.r.Read(b)
+	rd.n += int64(n)
+	return n, err
+}
+
+// AddFields adds a variable read from a pipe to a guppy file. Vectors are
+// split into their components, and "x" is treated as periodic.
+func AddFields(
+	wr *compress.Writer, hd *lib.PipeHeader, name string, accuracy float64,
+	buf interface{},
+) error {
+	span := [3]int{ int(hd.Span[0]), int(hd.Span[1]), int(hd.Span[2]) }
+	period := 0.0
+	if name == "x" || strings.HasPrefix(name, "x{") { period = hd.L }
+
+	fields := []particles.Field{ }
+	switch x := buf.(type) {
+	case []uint32: fields = append(fields, particles.NewUint32(name, x))
+	case []uint64: fields = append(fields, particles.NewUint64(name, x))
+	case []float32: fields = append(fields, particles.NewFloat32(name, x))
+	case []float64: fields = append(fields, particles.NewFloat64(name, x))
+	case [][3]float32:
+		for dim := 0; dim < 3; dim++ {
+			xi := make([]float32, len(x))
+			for i := range x { xi[i] = x[i][dim] }
+			fields = append(fields, particles.NewFloat32(
+				fmt.Sprintf("%s{%d}", name, dim), xi))
+		}
+	case [][3]float64:
+		for dim := 0; dim < 3; dim++ {
+			xi := make([]float64, len(x))
+			for i := range x { xi[i] = x[i][dim] }
+			fields = append(fields, particles.NewFloat64(
+				fmt.Sprintf("%s{%d}", name, dim), xi))
+		}
+	}
+
+	for _, field := range fields {
+		method := compress.NewLagrangianDelta(span, accuracy, period)
+		if err := wr.AddField(field, method); err != nil { return err }
+	}
+	return nil
+}
+
+// CheckIDs checks that particles read from a pipe are in the Lagrangian order
+// used by guppy files, which lets IDs be stored implicitly.
+func CheckIDs(hd *lib.PipeHeader, buf interface{}) error {
+	id, ok := buf.([]uint64)
+	if !ok { return fmt.Errorf("IDs must have type u64.") }
+
+	sx, sy := hd.Span[0], hd.Span[1]
+	ts, o := hd.TotalSpan, hd.Origin
+	for i := range id {
+		i64 := int64(i)
+		ix := i64 % sx + o[0]
+		iy := (i64 / sx) % sy + o[1]
+		iz := i64 / (sx*sy) + o[2]
+		exp := uint64(1 + iz + iy*ts[2] + ix*ts[2]*ts[1])
+		if id[i] != exp {
+			return fmt.Errorf("Particle %d has ID %d, but the particle at " +
+				"that position in the Lagrangian grid has ID %d. Particles " +
+				"must be sent in the same order as in .gup files.", i,
+				id[i], exp)
+		}
 	}
+	return nil
+}
+
+// PipeSnapioHeader converts a PipeHeader into a snapio.Header so that it can
+// be used to create .gup files.
+type PipeSnapioHeader struct {
+	hd *lib.PipeHeader
+	order binary.ByteOrder
+}
+
+func (hd *PipeSnapioHeader) ToBytes() []byte {
+	b := &bytes.Buffer{ }
+	lib.WritePipeHeader(b, hd.order, hd.hd)
+	return b.Bytes()
 }
+
+func (hd *PipeSnapioHeader) ByteOrder() binary.ByteOrder { return hd.order }
+func (hd *PipeSnapioHeader) Names() []string { return []string{ } }
+func (hd *PipeSnapioHeader) Types() []string { return []string{ } }
+func (hd *PipeSnapioHeader) NTot() int64 { return hd.hd.NTot }
+func (hd *PipeSnapioHeader) Z() float64 { return hd.hd.Z }
+func (hd *PipeSnapioHeader) OmegaM() float64 { return hd.hd.OmegaM }
+func (hd *PipeSnapioHeader) OmegaL() float64 { return hd.hd.OmegaL }
+func (hd *PipeSnapioHeader) H100() float64 { return hd.hd.H100 }
+func (hd *PipeSnapioHeader) L() float64 { return hd.hd.L }
+func (hd *PipeSnapioHeader) Mass() float64 { return hd.hd.Mass }
@@ -0,0 +1,145 @@
+package main
+
+/* The scripts directory contains several programs, so these tests need to be
+run with the server's source file:
+
+    go test -vet=off scripts/guppy_server.go scripts/guppy_server_test.go
+*/
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/phil-mansfield/guppy/lib"
+	"github.com/phil-mansfield/guppy/lib/compress"
+	"github.com/phil-mansfield/guppy/lib/logging"
+)
+
+// writeServerTestFile writes a .gup file containing width^3 particles with
+// random positions.
+func writeServerTestFile(fname string, width int64) error {
+	n := width*width*width
+	hd := &lib.PipeHeader{
+		Version: lib.Version, Format: lib.ArraysFormatCode, N: n, NTot: n,
+		Span: [3]int64{ width, width, width },
+		TotalSpan: [3]int64{ width, width, width },
+		OmegaM: 0.27, OmegaL: 0.73, H100: 0.7, L: 100, Mass: 1e10,
+	}
+	x := make([][3]float32, n)
+	for i := range x {
+		for dim := 0; dim < 3; dim++ { x[i][dim] = 100*rand.Float32() }
+	}
+
+	order := lib.SystemByteOrder()
+	wr := compress.NewWriter(fname, &PipeSnapioHeader{ hd, order },
+		hd.Span, hd.Origin, hd.TotalSpan, compress.NewBuffer(0), []byte{ },
+		order)
+	if err := AddFields(wr, hd, "x", 0.01, x); err != nil { return err }
+	_, err := wr.Flush()
+	return err
+}
+
+// serverTestConfig returns a config which sends x through a single pipe in
+// dir using the "arrays" format. prefix is the prefix of the .gup files.
+func serverTestConfig(dir, prefix, logFormat string) *Config {
+	return &Config{
+		Format: "arrays", PipeDirectory: dir, Snapshots: "0",
+		GuppyFiles: filepath.Join(dir, prefix + "_{%d,snapshot}.{%d,block}.gup"),
+		Blocks: 1, Threads: 1, LogFormat: logFormat,
+		Vars: []string{ "x" }, Types: []string{ "v32" },
+		Accuracies: []float64{ 0.01 },
+	}
+}
+
+func fileSize(t *testing.T, fname string) int64 {
+	info, err := os.Stat(fname)
+	if err != nil { t.Fatalf(err.Error()) }
+	return info.Size()
+}
+
+func TestServerLogging(t *testing.T) {
+	dir := t.TempDir()
+	readConf := serverTestConfig(dir, "in", "json")
+	writeConf := serverTestConfig(dir, "out", "text")
+
+	in, out := GuppyFileName(readConf, 0, 0), GuppyFileName(writeConf, 0, 0)
+	pipe := PipeName(readConf, 0)
+	if err := writeServerTestFile(in, 8); err != nil { t.Fatalf(err.Error()) }
+	// A regular file stands in for the pipe, so the read and write modes
+	// can run one after the other.
+	if err := os.WriteFile(pipe, []byte{ }, 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	readLog := &bytes.Buffer{ }
+	log, interval := GetLogger(readConf, readLog, "server_read")
+	Read(readConf, log, interval, 0, 0)
+
+	recs, err := logging.ParseJSON(readLog.String())
+	if err != nil { t.Fatalf(err.Error()) }
+	if len(recs) != 3 {
+		t.Fatalf("Expected 3 records in the read log, got:\n%s",
+			readLog.String())
+	}
+	exp := []map[string]interface{}{
+		{ "mode": "server_read", "event": "open_pipe", "pipe": pipe,
+			"snapshot": 0.0, "block": 0.0, "worker": 0.0 },
+		{ "mode": "server_read", "event": "file", "file": in,
+			"bytes_in": float64(fileSize(t, in)),
+			"bytes_out": float64(fileSize(t, pipe)),
+			"ratio": float64(fileSize(t, pipe)) / float64(fileSize(t, in)),
+			"snapshot": 0.0, "block": 0.0, "worker": 0.0 },
+		{ "mode": "server_read", "event": "finish", "done": 1.0,
+			"jobs": 1.0, "percent": 100.0, "files": 1.0 },
+	}
+	for i := range exp {
+		for key, val := range exp[i] {
+			if recs[i][key] != val {
+				t.Errorf("Expected read log record %d to have %s = %v, " +
+					"got %v.", i, key, val, recs[i][key])
+			}
+		}
+	}
+	if _, ok := recs[1]["read_time"]; !ok {
+		t.Errorf("Expected the read log's file record to have a read_time.")
+	}
+
+	writeLog := &bytes.Buffer{ }
+	log, interval = GetLogger(writeConf, writeLog, "server_write")
+	Write(writeConf, log, interval, 0, 0)
+
+	textRecs, err := logging.ParseText(writeLog.String())
+	if err != nil { t.Fatalf(err.Error()) }
+	if len(textRecs) != 3 {
+		t.Fatalf("Expected 3 records in the write log, got:\n%s",
+			writeLog.String())
+	}
+	textExp := []map[string]string{
+		{ "mode": "server_write", "event": "open_pipe", "pipe": pipe,
+			"snapshot": "0", "block": "0", "worker": "0" },
+		{ "mode": "server_write", "event": "file", "file": out,
+			"bytes_in": strconv.FormatInt(fileSize(t, pipe), 10),
+			"bytes_out": strconv.FormatInt(fileSize(t, out), 10),
+			"snapshot": "0", "block": "0", "worker": "0" },
+		{ "mode": "server_write", "event": "finish", "done": "1",
+			"jobs": "1", "percent": "100", "files": "1" },
+	}
+	for i := range textExp {
+		for key, val := range textExp[i] {
+			if textRecs[i][key] != val {
+				t.Errorf("Expected write log record %d to have %s = %s, " +
+					"got %s.", i, key, val, textRecs[i][key])
+			}
+		}
+	}
+	for _, key := range []string{ "read_time", "compress_time", "ratio" } {
+		if _, ok := textRecs[1][key]; !ok {
+			t.Errorf("Expected the write log's file record to have a %s.",
+				key)
+		}
+	}
+}